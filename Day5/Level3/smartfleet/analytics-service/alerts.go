@@ -0,0 +1,178 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"smartfleet/common/logging"
+	"smartfleet/common/registry"
+	"smartfleet/common/tracing"
+)
+
+// Alert is the message published to notification-service.
+type Alert struct {
+	TenantID  string    `json:"tenant_id"`
+	VehicleID string    `json:"vehicle_id"`
+	Level     string    `json:"level"`   // INFO / WARN / CRITICAL
+	Message   string    `json:"message"` // English text, for consumers that do not render Code
+	Ts        time.Time `json:"ts"`
+	Source    string    `json:"source,omitempty"`
+	RequestID string    `json:"request_id,omitempty"` // ingest request of the event that raised it
+
+	// W3C trace context of the publish span, so notification-service
+	// continues the trace of the event that raised the alert
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+
+	Rule       string  `json:"rule,omitempty"`       // detector that fired
+	Confidence float64 `json:"confidence,omitempty"` // 0..1, for statistical detections
+	GroupID    *uint   `json:"group_id,omitempty"`   // registry vehicle group, for subscription filters
+
+	// Code and Params let notification-service render Message in the
+	// recipient's language, e.g. OVERSPEED {"speed":145,"limit":140}
+	Code   string `json:"code,omitempty"`
+	Params Params `json:"params,omitempty"`
+}
+
+// Params are the values an alert's message template refers to.
+type Params map[string]interface{}
+
+// Alert codes. Each has a template per locale in notification-service; the
+// params listed are the ones the templates use.
+const (
+	CodeOverspeed           = "OVERSPEED"            // speed, limit (km/h)
+	CodeChargingSlow        = "CHARGING_SLOW"        // power_kw
+	CodeChargingInterrupted = "CHARGING_INTERRUPTED" // soc (%), reason
+	CodeTimestampSkew       = "TIMESTAMP_SKEW"       // skew_s
+	CodeGPSJump             = "GPS_JUMP"             // distance_km, implied_kmph
+	CodeOutOfOrder          = "OUT_OF_ORDER"         // behind_ms
+	CodeSensorFreeze        = "SENSOR_FREEZE"        // metric, value, count
+	CodeAnomaly             = "ANOMALY"              // metric, value, baseline, z
+)
+
+// Alert transports understood by notification-service.
+const (
+	TransportStream = "stream" // Redis Stream: durable, consumed through a group
+	TransportPubSub = "pubsub" // legacy channel, lost while no subscriber listens
+)
+
+// AlertSink says where live alerts are sent.
+type AlertSink struct {
+	Transport string `yaml:"transport" env:"ALERT_TRANSPORT" default:"stream" oneof:"stream pubsub"`
+	Stream    string `yaml:"stream" env:"REDIS_ALERT_STREAM" default:"alerts.stream"`  // stream key (TransportStream)
+	MaxLen    int64  `yaml:"stream_maxlen" env:"ALERT_STREAM_MAXLEN" default:"100000"` // approximate stream length cap
+	Channel   string `yaml:"channel" env:"REDIS_ALERT_CHANNEL" default:"alerts"`       // channel name (TransportPubSub)
+}
+
+// streamAlertField is the stream entry field holding the alert JSON.
+const streamAlertField = "alert"
+
+// AlertBus carries live alerts to notification-service.
+type AlertBus interface {
+	Publish(ctx context.Context, a Alert) error
+}
+
+// RedisAlertBus publishes alerts to the Redis Stream or channel of its sink.
+type RedisAlertBus struct {
+	rdb  *redis.Client
+	sink AlertSink
+}
+
+// NewRedisAlertBus constructs a RedisAlertBus.
+func NewRedisAlertBus(rdb *redis.Client, sink AlertSink) *RedisAlertBus {
+	return &RedisAlertBus{rdb: rdb, sink: sink}
+}
+
+func (b *RedisAlertBus) Publish(ctx context.Context, a Alert) error {
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(semconv.MessagingSystemKey.String("redis"), attribute.String("smartfleet.alert.transport", b.sink.Transport))
+	if b.sink.Transport == TransportPubSub {
+		span.SetAttributes(semconv.MessagingDestinationName(b.sink.Channel))
+		return b.rdb.Publish(ctx, b.sink.Channel, payload).Err()
+	}
+	span.SetAttributes(semconv.MessagingDestinationName(b.sink.Stream))
+	return b.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: b.sink.Stream,
+		MaxLen: b.sink.MaxLen,
+		Approx: true,
+		Values: map[string]interface{}{streamAlertField: string(payload)},
+	}).Err()
+}
+
+// AlertPublisher records alerts in the alert history and publishes them to
+// notification-service.
+type AlertPublisher struct {
+	bus      AlertBus         // nil disables live publishing (replay)
+	history  Store            // nil disables alert history
+	registry *registry.Client // optional: vehicle group lookup
+	logger   *zap.Logger
+}
+
+// NewAlertPublisher constructs an AlertPublisher.
+func NewAlertPublisher(bus AlertBus, history Store, registry *registry.Client, logger *zap.Logger) *AlertPublisher {
+	return &AlertPublisher{bus: bus, history: history, registry: registry, logger: logger}
+}
+
+// Alert publishes a simple alert about ev, stamped with the event time. msg
+// is the English rendering of code with params.
+func (p *AlertPublisher) Alert(ctx context.Context, ev TelemetryEvent, level, code string, params Params, msg string) {
+	p.Publish(ctx, Alert{
+		TenantID:  ev.TenantID,
+		VehicleID: ev.VehicleID,
+		Level:     level,
+		Message:   msg,
+		Code:      code,
+		Params:    params,
+		Ts:        time.UnixMilli(ev.Ts).UTC(),
+		Source:    "analytics",
+		RequestID: ev.RequestID,
+	})
+}
+
+// Publish sends a fully populated alert; failures are logged, not returned,
+// so alerting never blocks telemetry processing.
+func (p *AlertPublisher) Publish(ctx context.Context, a Alert) {
+	if a.Ts.IsZero() {
+		a.Ts = time.Now().UTC()
+	}
+	if a.RequestID == "" {
+		a.RequestID = logging.RequestID(ctx)
+	}
+	log := p.logger.With(zap.String("request_id", a.RequestID), zap.String("tenant", a.TenantID),
+		zap.String("vehicle_id", a.VehicleID), zap.String("code", a.Code))
+	if a.GroupID == nil && p.registry != nil {
+		if v, err := p.registry.Lookup(ctx, a.TenantID, a.VehicleID); err == nil && v != nil {
+			a.GroupID = v.GroupID
+		}
+	}
+	if p.history != nil {
+		if err := p.history.ForTenant(a.TenantID).SaveAlert(ctx, a); err != nil {
+			log.Warn("alert history failed", zap.Error(err))
+		}
+	}
+	if p.bus == nil {
+		return
+	}
+	pctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	pctx, span := tracer.Start(pctx, "alerts publish", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(semconv.MessagingOperationTypePublish, attribute.String("smartfleet.alert.code", a.Code)))
+	a.TraceContext = tracing.Inject(pctx)
+	err := p.bus.Publish(pctx, a)
+	tracing.End(span, err)
+	if err != nil {
+		log.Error("alert publish failed", zap.Error(err))
+		return
+	}
+	log.Info("alert published", zap.String("level", a.Level))
+}
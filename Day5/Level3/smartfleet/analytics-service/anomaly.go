@@ -0,0 +1,259 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Anomaly metrics tracked per vehicle
+const (
+	MetricSpeed      = "speed"
+	MetricFuelBurn   = "fuel_burn" // fuel pct consumed per km driven
+	MetricEngineTemp = "engine_temp"
+)
+
+// AnomalyConfig tunes the streaming detector.
+type AnomalyConfig struct {
+	Alpha            float64       `yaml:"ewma_alpha" env:"ANOMALY_EWMA_ALPHA" default:"0.05"`                // EWMA weight of the newest sample
+	ZThreshold       float64       `yaml:"z_threshold" env:"ANOMALY_Z_THRESHOLD" default:"4"`                 // |z| above this is an outlier
+	Warmup           int           `yaml:"warmup_events" env:"ANOMALY_WARMUP_EVENTS" default:"30"`            // samples before z-scores are trusted
+	FreezeCount      int           `yaml:"freeze_events" env:"ANOMALY_FREEZE_EVENTS" default:"20"`            // identical consecutive values that count as a frozen sensor
+	MaxPlausibleKmph float64       `yaml:"max_plausible_kmph" env:"ANOMALY_MAX_PLAUSIBLE_KMPH" default:"300"` // implied speed between GPS fixes above this is a jump
+	MaxSkew          time.Duration `yaml:"max_skew" env:"ANOMALY_MAX_SKEW_SECONDS" default:"5m" unit:"s"`     // |received - event time| above this is clock skew; 0 disables
+	Seasonal         bool          `yaml:"seasonal" env:"ANOMALY_SEASONAL"`                                   // keep separate baselines per hour of day
+}
+
+// ewma keeps an exponentially weighted mean and variance.
+type ewma struct {
+	mean, variance float64
+	n              int
+}
+
+func (e *ewma) update(x, alpha float64) {
+	if e.n == 0 {
+		e.mean = x
+		e.n = 1
+		return
+	}
+	diff := x - e.mean
+	incr := alpha * diff
+	e.mean += incr
+	e.variance = (1 - alpha) * (e.variance + diff*incr)
+	e.n++
+}
+
+// zscore returns how many standard deviations x is from the mean.
+func (e *ewma) zscore(x float64) float64 {
+	sd := math.Sqrt(e.variance)
+	if sd < 1e-9 {
+		return 0
+	}
+	return (x - e.mean) / sd
+}
+
+// freezeState counts consecutive identical readings of one metric.
+type freezeState struct {
+	last  float64
+	count int
+}
+
+func (f *freezeState) observe(x float64) int {
+	if f.count > 0 && x == f.last {
+		f.count++
+	} else {
+		f.last, f.count = x, 1
+	}
+	return f.count
+}
+
+// anomalyState is the per-vehicle detector state.
+type anomalyState struct {
+	stats    map[string]*[24]ewma // metric -> baselines (index 0 only when not seasonal)
+	freeze   map[string]*freezeState
+	lastLat  float64
+	lastLon  float64
+	lastTs   int64
+	lastFuel float64
+	mutex    sync.Mutex
+}
+
+// Detection is one anomaly found in the stream.
+type Detection struct {
+	Rule       string // zscore_<metric>, sensor_freeze_<metric>, gps_jump, timestamp_skew
+	Level      string
+	Message    string
+	Confidence float64 // 0..1
+	Code       string  // message template, see alerts.go
+	Params     Params
+}
+
+// AnomalyDetector keeps rolling statistics per vehicle and flags outliers.
+type AnomalyDetector struct {
+	cfg    AnomalyConfig
+	states map[string]*anomalyState
+	l      sync.Mutex
+	alerts *AlertPublisher
+}
+
+// NewAnomalyDetector constructs an AnomalyDetector.
+func NewAnomalyDetector(cfg AnomalyConfig, alerts *AlertPublisher) *AnomalyDetector {
+	return &AnomalyDetector{cfg: cfg, states: make(map[string]*anomalyState), alerts: alerts}
+}
+
+func (d *AnomalyDetector) state(tenant, vehicleID string) *anomalyState {
+	k := tripStateKey(tenant, vehicleID)
+	d.l.Lock()
+	defer d.l.Unlock()
+	if s, ok := d.states[k]; ok {
+		return s
+	}
+	s := &anomalyState{stats: make(map[string]*[24]ewma), freeze: make(map[string]*freezeState)}
+	d.states[k] = s
+	return s
+}
+
+// Process runs all detectors for one event and publishes detections as alerts.
+func (d *AnomalyDetector) Process(ctx context.Context, ev TelemetryEvent) []Detection {
+	dets := d.Detect(ev)
+	for _, det := range dets {
+		d.alerts.Publish(ctx, Alert{
+			TenantID:   ev.TenantID,
+			VehicleID:  ev.VehicleID,
+			Level:      det.Level,
+			Message:    det.Message,
+			Rule:       det.Rule,
+			Confidence: det.Confidence,
+			Code:       det.Code,
+			Params:     det.Params,
+			Source:     "anomaly",
+			Ts:         time.UnixMilli(ev.Ts).UTC(),
+		})
+	}
+	return dets
+}
+
+// Detect updates the vehicle's baselines with ev and returns its anomalies.
+func (d *AnomalyDetector) Detect(ev TelemetryEvent) []Detection {
+	st := d.state(ev.TenantID, ev.VehicleID)
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	var out []Detection
+	hour := 0
+	if d.cfg.Seasonal {
+		hour = time.UnixMilli(ev.Ts).UTC().Hour()
+	}
+
+	// timestamp skew against the ingest clock
+	if ev.ReceivedAt > 0 && d.cfg.MaxSkew > 0 {
+		skew := time.Duration(ev.ReceivedAt-ev.Ts) * time.Millisecond
+		if math.Abs(float64(skew)) > float64(d.cfg.MaxSkew) {
+			out = append(out, Detection{
+				Rule:       "timestamp_skew",
+				Level:      "WARN",
+				Message:    fmt.Sprintf("Timestamp skew %s versus ingest time", skew.Round(time.Second)),
+				Confidence: 1 - float64(d.cfg.MaxSkew)/math.Abs(float64(skew)),
+				Code:       CodeTimestampSkew,
+				Params:     Params{"skew_s": skew.Round(time.Second).Seconds()},
+			})
+		}
+	}
+
+	hasPrev := st.lastTs > 0
+	var distKm float64
+	if hasPrev {
+		distKm = haversineKm(st.lastLat, st.lastLon, ev.Lat, ev.Lon)
+		// GPS jump: distance since last fix implies an impossible speed
+		if dt := float64(ev.Ts-st.lastTs) / 3.6e6; dt > 0 {
+			if implied := distKm / dt; implied > d.cfg.MaxPlausibleKmph {
+				out = append(out, Detection{
+					Rule:       "gps_jump",
+					Level:      "WARN",
+					Message:    fmt.Sprintf("GPS jump of %.2f km implies %.0f km/h", distKm, implied),
+					Confidence: 1 - d.cfg.MaxPlausibleKmph/implied,
+					Code:       CodeGPSJump,
+					Params:     Params{"distance_km": distKm, "implied_kmph": implied},
+				})
+			}
+		} else if ev.Ts < st.lastTs {
+			out = append(out, Detection{
+				Rule:       "timestamp_skew",
+				Level:      "INFO",
+				Message:    fmt.Sprintf("Out-of-order event %d ms behind previous", st.lastTs-ev.Ts),
+				Confidence: 1,
+				Code:       CodeOutOfOrder,
+				Params:     Params{"behind_ms": st.lastTs - ev.Ts},
+			})
+			// a late event is only reported: as the last position or fuel
+			// level it would skew the next gps_jump and fuel burn
+			return out
+		}
+	}
+
+	moving := ev.Speed >= movingSpeedThreshold
+	metrics := map[string]float64{MetricSpeed: ev.Speed}
+	if ev.EngineTemp != nil {
+		metrics[MetricEngineTemp] = *ev.EngineTemp
+	}
+	// fuel burn only over real distance, and never across refuels
+	if hasPrev && distKm > 0.05 && ev.FuelLevel >= 0 && st.lastFuel >= ev.FuelLevel {
+		metrics[MetricFuelBurn] = (st.lastFuel - ev.FuelLevel) / distKm
+	}
+
+	for _, name := range []string{MetricSpeed, MetricFuelBurn, MetricEngineTemp} {
+		x, ok := metrics[name]
+		if !ok {
+			continue
+		}
+		// sensor freeze: a live sensor jitters, so N identical readings while
+		// driving (or any N identical engine temperatures) means a stuck value
+		if name != MetricFuelBurn && (moving || name == MetricEngineTemp) {
+			fz := st.freeze[name]
+			if fz == nil {
+				fz = &freezeState{}
+				st.freeze[name] = fz
+			}
+			if n := fz.observe(x); d.cfg.FreezeCount > 0 && n == d.cfg.FreezeCount {
+				out = append(out, Detection{
+					Rule:       "sensor_freeze_" + name,
+					Level:      "WARN",
+					Message:    fmt.Sprintf("Sensor freeze: %s stuck at %.2f for %d events", name, x, n),
+					Confidence: 1 - 1/float64(n),
+					Code:       CodeSensorFreeze,
+					Params:     Params{"metric": name, "value": x, "count": n},
+				})
+			}
+		}
+
+		b := st.stats[name]
+		if b == nil {
+			b = &[24]ewma{}
+			st.stats[name] = b
+		}
+		e := &b[hour]
+		if e.n >= d.cfg.Warmup {
+			if z := e.zscore(x); math.Abs(z) > d.cfg.ZThreshold {
+				level := "WARN"
+				if math.Abs(z) > 2*d.cfg.ZThreshold {
+					level = "CRITICAL"
+				}
+				out = append(out, Detection{
+					Rule:       "zscore_" + name,
+					Level:      level,
+					Message:    fmt.Sprintf("Anomalous %s %.2f (baseline %.2f, z=%.1f)", name, x, e.mean, z),
+					Confidence: 1 - 1/(z*z), // Chebyshev bound
+					Code:       CodeAnomaly,
+					Params:     Params{"metric": name, "value": x, "baseline": e.mean, "z": z},
+				})
+			}
+		}
+		e.update(x, d.cfg.Alpha)
+	}
+
+	st.lastLat, st.lastLon, st.lastTs = ev.Lat, ev.Lon, ev.Ts
+	st.lastFuel = ev.FuelLevel
+	return out
+}
@@ -0,0 +1,115 @@
+package analytics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var anomalyBase = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+func testAnomalyConfig() AnomalyConfig {
+	return AnomalyConfig{Alpha: 0.1, ZThreshold: 4, Warmup: 10, FreezeCount: 5, MaxPlausibleKmph: 300, MaxSkew: 5 * time.Minute}
+}
+
+// anomalyEvent is a sample of vehicle v1 at offset at.
+func anomalyEvent(at time.Duration, speed, lat float64) TelemetryEvent {
+	return TelemetryEvent{TenantID: "t1", VehicleID: "v1", Speed: speed, Lat: lat, FuelLevel: 50, Ts: anomalyBase.Add(at).UnixMilli()}
+}
+
+// codes returns the codes of dets, in order.
+func codes(dets []Detection) []string {
+	var out []string
+	for _, d := range dets {
+		out = append(out, d.Code)
+	}
+	return out
+}
+
+func TestAnomalyZScoreAfterWarmup(t *testing.T) {
+	cfg := testAnomalyConfig()
+	for _, n := range []int{cfg.Warmup - 1, cfg.Warmup} {
+		d := NewAnomalyDetector(cfg, nil)
+		// a jittering speed, one sample a second at the same position
+		for i := 0; i < n; i++ {
+			if dets := d.Detect(anomalyEvent(time.Duration(i)*time.Second, 50+float64(i%2)*2, 0)); len(dets) != 0 {
+				t.Fatalf("sample %d: %+v", i, dets)
+			}
+		}
+		dets := d.Detect(anomalyEvent(time.Duration(n)*time.Second, 200, 0))
+		if n < cfg.Warmup {
+			if len(dets) != 0 {
+				t.Errorf("outlier after %d samples, during warmup: %+v", n, dets)
+			}
+			continue
+		}
+		if len(dets) != 1 || dets[0].Rule != "zscore_speed" || dets[0].Code != CodeAnomaly || dets[0].Level != "CRITICAL" {
+			t.Errorf("outlier after %d samples: %+v, want a CRITICAL zscore_speed", n, dets)
+		}
+	}
+}
+
+func TestAnomalySensorFreeze(t *testing.T) {
+	cfg := testAnomalyConfig()
+	d := NewAnomalyDetector(cfg, nil)
+	for i := 1; i <= 2*cfg.FreezeCount; i++ {
+		dets := d.Detect(anomalyEvent(time.Duration(i)*time.Second, 60, 0))
+		want := []string(nil)
+		if i == cfg.FreezeCount {
+			want = []string{CodeSensorFreeze}
+		}
+		if got := codes(dets); !reflect.DeepEqual(got, want) {
+			t.Fatalf("identical sample %d: %v, want %v", i, got, want)
+		}
+		if i == cfg.FreezeCount && (dets[0].Rule != "sensor_freeze_speed" || dets[0].Params["count"] != cfg.FreezeCount) {
+			t.Errorf("freeze detection = %+v", dets[0])
+		}
+	}
+}
+
+func TestAnomalyGPSJump(t *testing.T) {
+	d := NewAnomalyDetector(testAnomalyConfig(), nil)
+	d.Detect(anomalyEvent(0, 60, 0))
+	// 0.001 degrees (110 m) in a minute is plausible
+	if dets := d.Detect(anomalyEvent(time.Minute, 60, 0.001)); len(dets) != 0 {
+		t.Errorf("plausible move: %+v", dets)
+	}
+	// 0.1 degrees (11 km) in a minute implies about 670 km/h
+	dets := d.Detect(anomalyEvent(2*time.Minute, 60, 0.101))
+	if len(dets) != 1 || dets[0].Rule != "gps_jump" || dets[0].Code != CodeGPSJump {
+		t.Fatalf("jump: %+v, want gps_jump", dets)
+	}
+	if implied := dets[0].Params["implied_kmph"].(float64); implied < 600 || implied > 700 {
+		t.Errorf("implied speed %.0f km/h, want about 670", implied)
+	}
+}
+
+func TestAnomalyTimestampSkew(t *testing.T) {
+	d := NewAnomalyDetector(testAnomalyConfig(), nil)
+	ev := anomalyEvent(0, 60, 0)
+	ev.ReceivedAt = ev.Ts + time.Minute.Milliseconds()
+	if dets := d.Detect(ev); len(dets) != 0 {
+		t.Errorf("one minute of skew: %+v", dets)
+	}
+	ev = anomalyEvent(time.Second, 61, 0)
+	ev.ReceivedAt = ev.Ts + (10 * time.Minute).Milliseconds()
+	dets := d.Detect(ev)
+	if len(dets) != 1 || dets[0].Code != CodeTimestampSkew || dets[0].Params["skew_s"] != 600.0 {
+		t.Errorf("ten minutes of skew: %+v, want TIMESTAMP_SKEW of 600 s", dets)
+	}
+}
+
+func TestAnomalyOutOfOrder(t *testing.T) {
+	d := NewAnomalyDetector(testAnomalyConfig(), nil)
+	d.Detect(anomalyEvent(0, 60, 0))
+	d.Detect(anomalyEvent(2*time.Minute, 60, 0.002))
+	// a late event, far away from the vehicle's current position
+	dets := d.Detect(anomalyEvent(time.Minute, 61, 5))
+	if len(dets) != 1 || dets[0].Code != CodeOutOfOrder || dets[0].Params["behind_ms"] != time.Minute.Milliseconds() {
+		t.Fatalf("late event: %+v, want OUT_OF_ORDER one minute behind", dets)
+	}
+	// the next fix is measured from the last in-order position
+	if dets := d.Detect(anomalyEvent(3*time.Minute, 62, 0.004)); len(dets) != 0 {
+		t.Errorf("fix after the late event: %+v", dets)
+	}
+}
@@ -0,0 +1,180 @@
+package analytics
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"smartfleet/common/apikey"
+	"smartfleet/common/lifecycle"
+)
+
+// VehicleState is the vehicle state API response.
+type VehicleState struct {
+	VehicleID     string           `json:"vehicle_id"`
+	LastSeen      time.Time        `json:"last_seen"`
+	BatteryPct    float64          `json:"battery_pct"`
+	Charging      bool             `json:"charging"`
+	ActiveSession *ChargingSession `json:"active_session,omitempty"`
+	KmPerPct      float64          `json:"km_per_pct,omitempty"`
+	RangeKm       *float64         `json:"range_km,omitempty"` // nil until consumption is learned
+}
+
+// API serves tenant-scoped vehicle state and analytics over HTTP.
+type API struct {
+	store  Store
+	evs    *EVTracker
+	auth   *apikey.Auth
+	probes map[string]lifecycle.Probe
+}
+
+// NewAPI constructs an API.
+func NewAPI(store Store, evs *EVTracker, auth *apikey.Auth) *API {
+	return &API{store: store, evs: evs, auth: auth}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// handleVehicle routes /vehicles/{id}/state and /vehicles/{id}/charging-sessions.
+func (a *API) handleVehicle(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant, err := a.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	vehicleID, sub, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/vehicles/"), "/")
+	if !ok || vehicleID == "" {
+		http.NotFound(w, r)
+		return
+	}
+	switch sub {
+	case "state":
+		a.vehicleState(w, tenant, vehicleID)
+	case "charging-sessions":
+		limit := 20
+		if s := r.URL.Query().Get("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 || n > 500 {
+				http.Error(w, "invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		list, err := a.store.ForTenant(tenant).ListChargingSessions(r.Context(), vehicleID, limit)
+		if err != nil {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (a *API) vehicleState(w http.ResponseWriter, tenant, vehicleID string) {
+	st := a.evs.State(tenant, vehicleID)
+	if st == nil {
+		http.Error(w, "no battery data for vehicle", http.StatusNotFound)
+		return
+	}
+	st.mutex.Lock()
+	out := VehicleState{
+		VehicleID:  vehicleID,
+		LastSeen:   st.LastSeen,
+		BatteryPct: st.LastSoC,
+		Charging:   st.Charging,
+		KmPerPct:   st.KmPerPct,
+	}
+	if st.Session != nil {
+		cs := *st.Session
+		out.ActiveSession = &cs
+	}
+	if st.KmPerPct > 0 {
+		rng := st.RangeKm()
+		out.RangeKm = &rng
+	}
+	st.mutex.Unlock()
+	writeJSON(w, http.StatusOK, out)
+}
+
+// TripSummary is the GET /trips/summary response.
+type TripSummary struct {
+	From       time.Time      `json:"from"`
+	To         time.Time      `json:"to"`
+	Trips      int64          `json:"trips"`
+	DistanceKm float64        `json:"distance_km"`
+	Vehicles   []VehicleTrips `json:"vehicles"`
+}
+
+// handleTripSummary serves GET /trips/summary?from=&to= (RFC 3339, default
+// the last 24 hours): trip counts and distance per vehicle for trips that
+// ended in the window.
+func (a *API) handleTripSummary(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant, err := a.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	to := time.Now().UTC()
+	if s := r.URL.Query().Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid to (want RFC 3339)", http.StatusBadRequest)
+			return
+		}
+	}
+	from := to.Add(-24 * time.Hour)
+	if s := r.URL.Query().Get("from"); s != "" {
+		if from, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "invalid from (want RFC 3339)", http.StatusBadRequest)
+			return
+		}
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	vehicles, err := a.store.ForTenant(tenant).TripTotals(r.Context(), from, to)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	out := TripSummary{From: from.UTC(), To: to.UTC(), Vehicles: vehicles}
+	if out.Vehicles == nil {
+		out.Vehicles = []VehicleTrips{}
+	}
+	for _, v := range vehicles {
+		out.Trips += v.Trips
+		out.DistanceKm += v.DistanceKm
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// SetProbes sets the dependencies /health reports on.
+func (a *API) SetProbes(probes map[string]lifecycle.Probe) { a.probes = probes }
+
+// Routes registers the API endpoints on mux.
+func (a *API) Routes(mux *http.ServeMux) {
+	mux.HandleFunc("/vehicles/", a.handleVehicle)
+	mux.HandleFunc("/trips/summary", a.handleTripSummary)
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		s := map[string]interface{}{"status": "ok"}
+		for name, ok := range lifecycle.Check(r.Context(), 200*time.Millisecond, a.probes) {
+			s[name] = ok
+		}
+		writeJSON(w, http.StatusOK, s)
+	})
+}
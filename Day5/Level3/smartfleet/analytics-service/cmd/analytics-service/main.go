@@ -0,0 +1,10 @@
+// Command analytics-service turns the telemetry on Kafka into trips,
+// aggregates and alerts. The service lives in package analytics, where the
+// pipeline harness wires it up in process.
+package main
+
+import analytics "smartfleet/analytics-service"
+
+func main() {
+	analytics.Main()
+}
@@ -1,27 +1,52 @@
-package analyticsservice
-
-package main
+package analytics
 
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
 	kafka "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+
+	commonkafka "smartfleet/common/kafka"
+	"smartfleet/common/logging"
+	"smartfleet/common/tracing"
+)
+
+// Kafka headers set by telemetry-service, with logging.RequestIDKafkaHeader.
+const (
+	tenantHeader     = "tenant_id"
+	receivedAtHeader = "received_at"
 )
 
 // TelemetryEvent matches producer payload
 type TelemetryEvent struct {
+	TenantID  string  `json:"-"` // from the Kafka tenant_id header
 	VehicleID string  `json:"vehicle_id"`
 	Speed     float64 `json:"speed"`
 	FuelLevel float64 `json:"fuel_level"`
 	Lat       float64 `json:"latitude"`
 	Lon       float64 `json:"longitude"`
 	Ts        int64   `json:"ts"`
+
+	BatteryPct *float64 `json:"battery_pct,omitempty"` // EV state of charge 0-100
+	Charging   *bool    `json:"charging,omitempty"`    // explicit charger signal, if reported
+	EngineTemp *float64 `json:"engine_temp,omitempty"` // celsius
+
+	ReceivedAt int64  `json:"-"` // ingest time (unix millis) from the received_at header
+	RequestID  string `json:"-"` // ingest request, from the request_id header; carried into alerts
 }
 
+// trip detection thresholds
+const (
+	movingSpeedThreshold = 5.0 // km/h
+	tripEndIdleSeconds   = 120 // if idle for 120s -> end trip
+	overspeedKmph        = 140 // CRITICAL overspeed alert above this
+)
+
 // TripState holds transient state for trip detection per vehicle
 type TripState struct {
 	LastLat     float64
@@ -35,7 +60,7 @@ type TripState struct {
 	mutex       sync.Mutex
 }
 
-// TripStateMap stores per-vehicle states
+// TripStateMap stores per-vehicle states, keyed by tenant and vehicle
 type TripStateMap struct {
 	m map[string]*TripState
 	l sync.RWMutex
@@ -45,26 +70,101 @@ func NewTripStateMap() *TripStateMap {
 	return &TripStateMap{m: make(map[string]*TripState)}
 }
 
-func (tsm *TripStateMap) GetOrCreate(v string) *TripState {
+func tripStateKey(tenant, vehicleID string) string {
+	return tenant + "/" + vehicleID
+}
+
+func (tsm *TripStateMap) GetOrCreate(tenant, v string) *TripState {
+	k := tripStateKey(tenant, v)
 	tsm.l.Lock()
 	defer tsm.l.Unlock()
-	if s, ok := tsm.m[v]; ok {
+	if s, ok := tsm.m[k]; ok {
 		return s
 	}
 	s := &TripState{}
-	tsm.m[v] = s
+	tsm.m[k] = s
 	return s
 }
 
-func (tsm *TripStateMap) Delete(v string) {
+func (tsm *TripStateMap) Delete(tenant, v string) {
 	tsm.l.Lock()
 	defer tsm.l.Unlock()
-	delete(tsm.m, v)
+	delete(tsm.m, tripStateKey(tenant, v))
+}
+
+// tenantFromMessage reads the tenant header, falling back to the default tenant
+// for messages produced before tenancy was introduced.
+func tenantFromMessage(m kafka.Message) string {
+	for _, h := range m.Headers {
+		if h.Key == tenantHeader && len(h.Value) > 0 {
+			return string(h.Value)
+		}
+	}
+	return conf.DefaultTenant
+}
+
+// requestIDFromMessage reads the ingest request ID header ("" if absent).
+func requestIDFromMessage(m kafka.Message) string {
+	for _, h := range m.Headers {
+		if h.Key == logging.RequestIDKafkaHeader {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// receivedAtFromMessage reads the ingest timestamp header (0 if absent).
+func receivedAtFromMessage(m kafka.Message) int64 {
+	for _, h := range m.Headers {
+		if h.Key == receivedAtHeader {
+			if n, err := strconv.ParseInt(string(h.Value), 10, 64); err == nil {
+				return n
+			}
+		}
+	}
+	return 0
+}
+
+// Pipeline bundles the state and sinks processTelemetryEvent works against.
+// The live consumer and the replay command each build their own.
+type Pipeline struct {
+	store     Store
+	trips     *TripStateMap
+	alerts    *AlertPublisher
+	evs       *EVTracker
+	anomalies *AnomalyDetector
+	logger    *zap.Logger
+	skipRaw   bool   // replaying from TelemetryRaw: raw rows already exist
+	group     string // Kafka consumer group, recorded on consumer spans
+}
+
+// NewPipeline constructs a Pipeline with fresh trip state.
+func NewPipeline(store Store, alerts *AlertPublisher, evs *EVTracker, anomalies *AnomalyDetector, logger *zap.Logger) *Pipeline {
+	return &Pipeline{
+		store:     store,
+		trips:     NewTripStateMap(),
+		alerts:    alerts,
+		evs:       evs,
+		anomalies: anomalies,
+		logger:    logger,
+	}
+}
+
+// eventFromMessage decodes a telemetry Kafka message including its headers.
+func eventFromMessage(m kafka.Message) (TelemetryEvent, error) {
+	var ev TelemetryEvent
+	if err := json.Unmarshal(m.Value, &ev); err != nil {
+		return ev, err
+	}
+	ev.TenantID = tenantFromMessage(m)
+	ev.ReceivedAt = receivedAtFromMessage(m)
+	ev.RequestID = requestIDFromMessage(m)
+	return ev, nil
 }
 
 // consumer loop
-func runConsumerLoop(ctx context.Context, reader *kafka.Reader, store *Store, logger *log.Logger) error {
-	tripStates := NewTripStateMap()
+func runConsumerLoop(ctx context.Context, reader *kafka.Reader, p *Pipeline) error {
+	p.group = reader.Config().GroupID
 	for {
 		m, err := reader.ReadMessage(ctx)
 		if err != nil {
@@ -74,33 +174,56 @@ func runConsumerLoop(ctx context.Context, reader *kafka.Reader, store *Store, lo
 			}
 			return err
 		}
-		var ev TelemetryEvent
-		if err := json.Unmarshal(m.Value, &ev); err != nil {
-			logger.Printf("invalid message: %v", err)
-			continue
-		}
 		// process synchronously (for simplicity); for performance use worker pool
-		if err := processTelemetryEvent(ctx, store, tripStates, ev, logger); err != nil {
-			logger.Printf("processTelemetryEvent err: %v", err)
+		if err := p.HandleMessage(ctx, m); err != nil {
+			p.logger.Error("message failed", zap.Int("partition", m.Partition), zap.Int64("offset", m.Offset),
+				zap.String("request_id", requestIDFromMessage(m)), zap.Error(err))
 		}
 	}
 }
 
-// processTelemetryEvent persists telemetry, updates aggregate, manages trip state
-func processTelemetryEvent(ctx context.Context, store *Store, tsm *TripStateMap, ev TelemetryEvent, logger *log.Logger) error {
+// HandleMessage processes one telemetry message as the consumer loop does,
+// in a consumer span that continues the trace of the ingest request.
+func (p *Pipeline) HandleMessage(ctx context.Context, m kafka.Message) (err error) {
+	ctx, span := commonkafka.StartConsume(ctx, m, p.group)
+	defer func() { tracing.End(span, err) }()
+	ev, err := eventFromMessage(m)
+	if err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+	// logs and alerts about the event name the ingest request
+	ctx = logging.WithRequestID(ctx, ev.RequestID)
+	if err := processTelemetryEvent(ctx, p, ev); err != nil {
+		return fmt.Errorf("processTelemetryEvent err: %w", err)
+	}
+	return nil
+}
+
+// processTelemetryEvent persists telemetry, updates aggregate, manages trip state.
+// All time-dependent decisions use the event timestamp so replays are deterministic.
+func processTelemetryEvent(ctx context.Context, p *Pipeline, ev TelemetryEvent) error {
+	// errors only: most events log nothing
+	logger := func() *zap.Logger {
+		return logging.Ctx(ctx, p.logger).With(zap.String("tenant", ev.TenantID), zap.String("vehicle_id", ev.VehicleID))
+	}
+	// all DB access for this event is restricted to its tenant
+	store := p.store.ForTenant(ev.TenantID)
+
 	// 1. persist raw telemetry
-	if err := store.InsertTelemetry(ctx, ev); err != nil {
-		logger.Printf("Insert telemetry err: %v", err)
-		// continue to process aggregates/trips — don't return fatal
+	if !p.skipRaw {
+		if err := store.InsertTelemetry(ctx, ev); err != nil {
+			logger().Warn("insert telemetry failed", zap.Error(err))
+			// continue to process aggregates/trips — don't return fatal
+		}
 	}
 
 	// 2. update per-minute aggregate
 	if err := store.UpsertAggregate(ctx, ev); err != nil {
-		logger.Printf("Upsert aggregate err: %v", err)
+		logger().Warn("upsert aggregate failed", zap.Error(err))
 	}
 
 	// 3. handle trip FSM
-	ts := tsm.GetOrCreate(ev.VehicleID)
+	ts := p.trips.GetOrCreate(ev.TenantID, ev.VehicleID)
 	ts.mutex.Lock()
 	defer ts.mutex.Unlock()
 
@@ -114,10 +237,6 @@ func processTelemetryEvent(ctx context.Context, store *Store, tsm *TripStateMap,
 	ts.AccumSpeed += ev.Speed
 	ts.EventCount++
 
-	// trip detection thresholds
-	const movingSpeedThreshold = 5.0       // km/h
-	const tripEndIdleSeconds = 120         // if idle for 120s -> end trip
-	now := time.UnixMilli(ev.Ts)
 	isMoving := ev.Speed >= movingSpeedThreshold
 
 	if !ts.Moving && isMoving {
@@ -132,18 +251,18 @@ func processTelemetryEvent(ctx context.Context, store *Store, tsm *TripStateMap,
 			EventCount: 0,
 		}
 		if err := store.SaveOrUpdateTrip(ctx, trip); err != nil {
-			logger.Printf("create trip err: %v", err)
+			logger().Warn("create trip failed", zap.Error(err))
 		}
 	} else if ts.Moving && !isMoving {
 		// possible trip end - check idle duration since last moving
 		// if last event timestamp exists and gap exceeds threshold -> end
 		if ts.LastTs > 0 {
-			idleSeconds := (now - ts.LastTs) / 1000
+			idleSeconds := (ev.Ts - ts.LastTs) / 1000
 			if idleSeconds >= tripEndIdleSeconds {
 				// finish trip: fetch active trip, update stats and close
 				active, err := store.GetActiveTrip(ctx, ev.VehicleID)
 				if err != nil {
-					logger.Printf("GetActiveTrip err: %v", err)
+					logger().Warn("get active trip failed", zap.Error(err))
 				} else if active != nil {
 					active.DistanceKm = ts.AccumDistKm
 					if ts.EventCount > 0 {
@@ -153,7 +272,7 @@ func processTelemetryEvent(ctx context.Context, store *Store, tsm *TripStateMap,
 					nowT := time.UnixMilli(ev.Ts).UTC()
 					active.EndedAt = &nowT
 					if err := store.SaveOrUpdateTrip(ctx, active); err != nil {
-						logger.Printf("close trip err: %v", err)
+						logger().Warn("close trip failed", zap.Error(err))
 					}
 				}
 				// reset trip state
@@ -170,9 +289,16 @@ func processTelemetryEvent(ctx context.Context, store *Store, tsm *TripStateMap,
 	ts.LastLon = ev.Lon
 	ts.LastTs = ev.Ts
 
-	// 4. Quick alerts example (speed)
-	if ev.Speed > 140 {
-		store.Alert(ev.VehicleID, "CRITICAL", "Overspeed > 140 km/h")
+	// 4. EV charging sessions and consumption (events with battery data only)
+	p.evs.Process(ctx, store, ev, p.logger)
+
+	// 5. streaming anomaly detection (z-scores, sensor freeze, GPS jumps, clock skew)
+	p.anomalies.Process(ctx, ev)
+
+	// 6. Quick alerts example (speed)
+	if ev.Speed > overspeedKmph {
+		p.alerts.Alert(ctx, ev, "CRITICAL", CodeOverspeed, Params{"speed": ev.Speed, "limit": overspeedKmph},
+			fmt.Sprintf("Overspeed > %d km/h", overspeedKmph))
 	}
 
 	return nil
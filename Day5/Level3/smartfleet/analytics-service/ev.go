@@ -0,0 +1,237 @@
+package analytics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"smartfleet/common/logging"
+	"smartfleet/common/registry"
+)
+
+// EV charging detection thresholds
+const (
+	socRiseThreshold  = 0.5              // pct rise between samples that counts as charging
+	socNoise          = 0.2              // pct drop tolerated while still charging
+	chargeGapTimeout  = 10 * time.Minute // no samples for this long ends a session
+	minConsumptionPct = 1.0              // SoC drop needed before updating km-per-pct
+	consumptionAlpha  = 0.3              // EWMA weight of the newest consumption segment
+)
+
+// Charging session end reasons
+const (
+	EndUnplugged = "unplugged" // explicit charging=false
+	EndMoved     = "moved"
+	EndSoCDrop   = "soc_drop"
+	EndDataGap   = "data_gap"
+)
+
+// EVState holds transient battery state per vehicle.
+type EVState struct {
+	LastSoC   float64
+	LastTs    int64
+	LastLat   float64
+	LastLon   float64
+	LastSeen  time.Time
+	Charging  bool
+	Session   *ChargingSession // active session, nil when not charging
+	KmPerPct  float64          // EWMA consumption; 0 until learned
+	segKm     float64          // distance driven since segment start
+	segSoC    float64          // SoC at segment start
+	hasSample bool
+	mutex     sync.Mutex
+}
+
+// RangeKm estimates remaining range from recent consumption.
+func (s *EVState) RangeKm() float64 {
+	return s.LastSoC * s.KmPerPct
+}
+
+// EVTracker detects charging sessions and learns consumption per vehicle.
+type EVTracker struct {
+	states          map[string]*EVState
+	l               sync.RWMutex
+	registry        *registry.Client // optional: battery capacity lookup
+	alerts          *AlertPublisher
+	defaultCapacity float64 // kWh used when the registry has no capacity
+	slowKW          float64 // average power below this flags a slow charge
+	targetSoC       float64 // sessions ending below this are interrupted
+}
+
+// NewEVTracker constructs an EVTracker.
+func NewEVTracker(registry *registry.Client, alerts *AlertPublisher, defaultCapacity, slowKW, targetSoC float64) *EVTracker {
+	return &EVTracker{
+		states:          make(map[string]*EVState),
+		registry:        registry,
+		alerts:          alerts,
+		defaultCapacity: defaultCapacity,
+		slowKW:          slowKW,
+		targetSoC:       targetSoC,
+	}
+}
+
+// State returns the vehicle's EV state, or nil if no battery data was seen.
+func (t *EVTracker) State(tenant, vehicleID string) *EVState {
+	t.l.RLock()
+	defer t.l.RUnlock()
+	return t.states[tripStateKey(tenant, vehicleID)]
+}
+
+func (t *EVTracker) getOrCreate(tenant, vehicleID string) *EVState {
+	k := tripStateKey(tenant, vehicleID)
+	t.l.Lock()
+	defer t.l.Unlock()
+	if s, ok := t.states[k]; ok {
+		return s
+	}
+	s := &EVState{}
+	t.states[k] = s
+	return s
+}
+
+// capacityKWh resolves battery capacity from the registry, falling back to the default.
+func (t *EVTracker) capacityKWh(ctx context.Context, tenant, vehicleID string, logger *zap.Logger) float64 {
+	if t.registry == nil {
+		return t.defaultCapacity
+	}
+	v, err := t.registry.Lookup(ctx, tenant, vehicleID)
+	if err != nil {
+		logging.Ctx(ctx, logger).Warn("registry lookup failed", zap.String("vehicle_id", vehicleID), zap.Error(err))
+		return t.defaultCapacity
+	}
+	if v == nil || v.BatteryCapacityKWh <= 0 {
+		return t.defaultCapacity
+	}
+	return v.BatteryCapacityKWh
+}
+
+// Process updates EV state for one event carrying battery data.
+func (t *EVTracker) Process(ctx context.Context, store Store, ev TelemetryEvent, logger *zap.Logger) {
+	if ev.BatteryPct == nil {
+		return
+	}
+	soc := *ev.BatteryPct
+	st := t.getOrCreate(ev.TenantID, ev.VehicleID)
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if !st.hasSample {
+		st.hasSample = true
+		st.segSoC = soc
+		st.record(ev, soc)
+		if ev.Charging != nil && *ev.Charging {
+			t.startSession(st, ev, soc)
+		}
+		return
+	}
+
+	gap := time.Duration(ev.Ts-st.LastTs) * time.Millisecond
+	stationary := ev.Speed < movingSpeedThreshold
+	rising := soc-st.LastSoC >= socRiseThreshold
+
+	if st.Session != nil {
+		reason := ""
+		switch {
+		case gap > chargeGapTimeout:
+			reason = EndDataGap
+		case ev.Charging != nil && !*ev.Charging:
+			reason = EndUnplugged
+		case !stationary:
+			reason = EndMoved
+		case ev.Charging == nil && soc < st.LastSoC-socNoise:
+			reason = EndSoCDrop
+		}
+		if reason != "" {
+			t.endSession(ctx, store, st, ev, reason, logger)
+		}
+	} else {
+		charging := stationary && rising && gap <= chargeGapTimeout
+		if ev.Charging != nil {
+			charging = *ev.Charging
+		}
+		if charging {
+			// the session started at the previous (pre-rise) sample
+			t.startSession(st, ev, st.LastSoC)
+			st.Session.StartedAt = time.UnixMilli(st.LastTs).UTC()
+		}
+	}
+
+	// learn consumption while driving on battery
+	if st.Session == nil && !stationary {
+		st.segKm += haversineKm(st.LastLat, st.LastLon, ev.Lat, ev.Lon)
+		if drop := st.segSoC - soc; drop >= minConsumptionPct {
+			kmPerPct := st.segKm / drop
+			if st.KmPerPct == 0 {
+				st.KmPerPct = kmPerPct
+			} else {
+				st.KmPerPct = consumptionAlpha*kmPerPct + (1-consumptionAlpha)*st.KmPerPct
+			}
+			st.segKm, st.segSoC = 0, soc
+		}
+	} else if st.Session != nil {
+		// charging resets the consumption segment
+		st.segKm, st.segSoC = 0, soc
+	}
+
+	st.record(ev, soc)
+	if st.Session != nil {
+		st.Session.EndSoC = soc
+	}
+}
+
+func (st *EVState) record(ev TelemetryEvent, soc float64) {
+	st.LastSoC = soc
+	st.LastTs = ev.Ts
+	st.LastLat = ev.Lat
+	st.LastLon = ev.Lon
+	st.LastSeen = time.UnixMilli(ev.Ts).UTC()
+}
+
+func (t *EVTracker) startSession(st *EVState, ev TelemetryEvent, startSoC float64) {
+	st.Charging = true
+	st.Session = &ChargingSession{
+		TenantID:  ev.TenantID,
+		VehicleID: ev.VehicleID,
+		StartedAt: time.UnixMilli(ev.Ts).UTC(),
+		StartSoC:  startSoC,
+		EndSoC:    startSoC,
+		Latitude:  ev.Lat,
+		Longitude: ev.Lon,
+	}
+}
+
+// endSession closes the active session at the last charging sample, persists it and raises alerts.
+func (t *EVTracker) endSession(ctx context.Context, store Store, st *EVState, ev TelemetryEvent, reason string, logger *zap.Logger) {
+	cs := st.Session
+	st.Session = nil
+	st.Charging = false
+
+	ended := time.UnixMilli(st.LastTs).UTC()
+	cs.EndedAt = &ended
+	cs.EndReason = reason
+	cs.DurationSec = int64(ended.Sub(cs.StartedAt).Seconds())
+	capacity := t.capacityKWh(ctx, ev.TenantID, ev.VehicleID, logger)
+	if gained := cs.EndSoC - cs.StartSoC; gained > 0 {
+		cs.EnergyKWh = gained / 100 * capacity
+	}
+	if cs.DurationSec > 0 {
+		cs.AvgPowerKW = cs.EnergyKWh / (float64(cs.DurationSec) / 3600)
+	}
+	cs.Slow = cs.DurationSec > 0 && cs.AvgPowerKW < t.slowKW
+	cs.Interrupted = cs.EndSoC < t.targetSoC
+
+	if err := store.SaveChargingSession(ctx, cs); err != nil {
+		logging.Ctx(ctx, logger).Warn("save charging session failed", zap.String("vehicle_id", ev.VehicleID), zap.Error(err))
+	}
+	if cs.Slow {
+		t.alerts.Alert(ctx, ev, "WARN", CodeChargingSlow, Params{"power_kw": cs.AvgPowerKW},
+			fmt.Sprintf("Slow charging: %.1f kW average", cs.AvgPowerKW))
+	}
+	if cs.Interrupted {
+		t.alerts.Alert(ctx, ev, "WARN", CodeChargingInterrupted, Params{"soc": cs.EndSoC, "reason": reason},
+			fmt.Sprintf("Charging interrupted at %.1f%% (%s)", cs.EndSoC, reason))
+	}
+}
@@ -0,0 +1,199 @@
+package analytics
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"smartfleet/common/registry"
+)
+
+// evStep is one battery sample, at an offset from the start of the test.
+type evStep struct {
+	at       time.Duration
+	soc      float64
+	speed    float64
+	lat      float64
+	charging *bool
+}
+
+// charge returns n stationary samples 5 minutes apart from start, with the
+// state of charge rising by step from soc.
+func charge(start time.Duration, n int, soc, step float64) []evStep {
+	steps := make([]evStep, n)
+	for i := range steps {
+		steps[i] = evStep{at: start + time.Duration(i)*5*time.Minute, soc: soc + float64(i)*step}
+	}
+	return steps
+}
+
+func boolPtr(b bool) *bool { return &b }
+
+func near(a, b float64) bool { return math.Abs(a-b) < 1e-6 }
+
+// newEVTracker returns a tracker whose registry knows EV1 with a 60 kWh
+// battery; other vehicles fall back to 50 kWh. Charging below 7 kW is slow
+// and sessions ending below 80% are interrupted.
+func newEVTracker(t *testing.T) (*EVTracker, *MemoryAlertBus) {
+	t.Helper()
+	reg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/vehicles/EV1" || r.Header.Get("X-Tenant-ID") != "t1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"vin":"EV1","fuel_type":"EV","battery_capacity_kwh":60}`))
+	}))
+	t.Cleanup(reg.Close)
+	bus := &MemoryAlertBus{}
+	alerts := NewAlertPublisher(bus, nil, nil, zap.NewNop())
+	return NewEVTracker(registry.NewClient(reg.URL, time.Hour, time.Hour, ""), alerts, 50, 7, 80), bus
+}
+
+// feed processes the steps for vehicle and returns its charging sessions,
+// newest first.
+func feed(t *testing.T, tr *EVTracker, store Store, vehicle string, steps []evStep) []ChargingSession {
+	t.Helper()
+	ctx := context.Background()
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	for _, s := range steps {
+		soc := s.soc
+		tr.Process(ctx, store, TelemetryEvent{
+			TenantID: "t1", VehicleID: vehicle, Speed: s.speed, Lat: s.lat, Lon: 0,
+			Ts: base.Add(s.at).UnixMilli(), BatteryPct: &soc, Charging: s.charging,
+		}, zap.NewNop())
+	}
+	sessions, err := store.ListChargingSessions(ctx, vehicle, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sessions
+}
+
+func TestEVChargingSessions(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		vehicle     string
+		steps       []evStep
+		reason      string
+		duration    time.Duration
+		startSoC    float64
+		endSoC      float64
+		energyKWh   float64
+		slow        bool
+		interrupted bool
+	}{
+		{
+			name:    "soc rise, unplugged",
+			vehicle: "EV1",
+			steps:   append(charge(0, 13, 40, 4), evStep{at: 65 * time.Minute, soc: 88, charging: boolPtr(false)}),
+			reason:  EndUnplugged, duration: time.Hour, startSoC: 40, endSoC: 88, energyKWh: 28.8,
+		},
+		{
+			name:    "moved",
+			vehicle: "EV1",
+			steps:   append(charge(0, 4, 40, 4), evStep{at: 20 * time.Minute, soc: 52, speed: 30}),
+			reason:  EndMoved, duration: 15 * time.Minute, startSoC: 40, endSoC: 52, energyKWh: 7.2, interrupted: true,
+		},
+		{
+			name:    "soc drop",
+			vehicle: "EV1",
+			steps:   append(charge(0, 4, 40, 4), evStep{at: 20 * time.Minute, soc: 50}),
+			reason:  EndSoCDrop, duration: 15 * time.Minute, startSoC: 40, endSoC: 52, energyKWh: 7.2, interrupted: true,
+		},
+		{
+			name:    "data gap",
+			vehicle: "EV1",
+			steps:   append(charge(0, 4, 40, 4), evStep{at: 40 * time.Minute, soc: 60}),
+			reason:  EndDataGap, duration: 15 * time.Minute, startSoC: 40, endSoC: 52, energyKWh: 7.2, interrupted: true,
+		},
+		{
+			name:    "default capacity",
+			vehicle: "EV2",
+			steps:   append(charge(0, 13, 40, 4), evStep{at: 65 * time.Minute, soc: 88, charging: boolPtr(false)}),
+			reason:  EndUnplugged, duration: time.Hour, startSoC: 40, endSoC: 88, energyKWh: 24,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr, bus := newEVTracker(t)
+			sessions := feed(t, tr, NewMemoryStore().ForTenant("t1"), tc.vehicle, tc.steps)
+			if len(sessions) != 1 {
+				t.Fatalf("sessions = %+v, want one", sessions)
+			}
+			cs := sessions[0]
+			if cs.EndReason != tc.reason || cs.EndedAt == nil || cs.EndedAt.Sub(cs.StartedAt) != tc.duration {
+				t.Errorf("session ended %v (%s) after %v, want %s after %v", cs.EndedAt, cs.EndReason, time.Duration(cs.DurationSec)*time.Second, tc.reason, tc.duration)
+			}
+			if cs.StartSoC != tc.startSoC || cs.EndSoC != tc.endSoC || !near(cs.EnergyKWh, tc.energyKWh) {
+				t.Errorf("session charged %.1f%% -> %.1f%%, %.2f kWh; want %.1f%% -> %.1f%%, %.2f kWh",
+					cs.StartSoC, cs.EndSoC, cs.EnergyKWh, tc.startSoC, tc.endSoC, tc.energyKWh)
+			}
+			if cs.Slow != tc.slow || cs.Interrupted != tc.interrupted {
+				t.Errorf("slow, interrupted = %v, %v; want %v, %v", cs.Slow, cs.Interrupted, tc.slow, tc.interrupted)
+			}
+			var codes []string
+			for _, a := range bus.Alerts() {
+				codes = append(codes, a.Code)
+			}
+			if tc.interrupted != (len(codes) == 1 && codes[0] == CodeChargingInterrupted) {
+				t.Errorf("alerts = %v, interrupted %v", codes, tc.interrupted)
+			}
+			if st := tr.State("t1", tc.vehicle); st.Charging || st.Session != nil {
+				t.Errorf("vehicle still charging after %s", tc.reason)
+			}
+		})
+	}
+}
+
+func TestEVChargingFlag(t *testing.T) {
+	tr, bus := newEVTracker(t)
+	// plugged in at the first sample and charging at 3.6 kW, too slowly to
+	// see a SoC rise between samples
+	var steps []evStep
+	for i := 0; i <= 12; i++ {
+		steps = append(steps, evStep{at: time.Duration(i) * 5 * time.Minute, soc: 40 + float64(i)*0.5, charging: boolPtr(true)})
+	}
+	steps = append(steps, evStep{at: 65 * time.Minute, soc: 46, charging: boolPtr(false)})
+	sessions := feed(t, tr, NewMemoryStore().ForTenant("t1"), "EV1", steps)
+	if len(sessions) != 1 {
+		t.Fatalf("sessions = %+v, want one", sessions)
+	}
+	cs := sessions[0]
+	if cs.EndReason != EndUnplugged || cs.DurationSec != 3600 || cs.StartSoC != 40 || cs.EndSoC != 46 {
+		t.Errorf("session = %+v", cs)
+	}
+	if !near(cs.EnergyKWh, 3.6) || !near(cs.AvgPowerKW, 3.6) || !cs.Slow || !cs.Interrupted {
+		t.Errorf("energy %.2f kWh at %.2f kW, slow %v, interrupted %v; want 3.6 kWh at 3.6 kW, slow and interrupted",
+			cs.EnergyKWh, cs.AvgPowerKW, cs.Slow, cs.Interrupted)
+	}
+	alerts := bus.Alerts()
+	if len(alerts) != 2 || alerts[0].Code != CodeChargingSlow || alerts[1].Code != CodeChargingInterrupted ||
+		alerts[1].Params["reason"] != EndUnplugged {
+		t.Errorf("alerts = %+v, want CHARGING_SLOW then CHARGING_INTERRUPTED", alerts)
+	}
+}
+
+func TestEVRange(t *testing.T) {
+	tr, _ := newEVTracker(t)
+	store := NewMemoryStore().ForTenant("t1")
+	feed(t, tr, store, "EV1", []evStep{{soc: 80, speed: 60}})
+	if st := tr.State("t1", "EV1"); st.KmPerPct != 0 || st.RangeKm() != 0 {
+		t.Fatalf("range %.1f km before any consumption was seen", st.RangeKm())
+	}
+
+	// each 0.09 degrees driven north uses 1% of the battery
+	kmPerPct := haversineKm(0, 0, 0.09, 0)
+	feed(t, tr, store, "EV1", []evStep{
+		{at: time.Minute, soc: 79.5, speed: 60, lat: 0.045},
+		{at: 2 * time.Minute, soc: 79, speed: 60, lat: 0.09},
+		{at: 3 * time.Minute, soc: 78, speed: 60, lat: 0.18},
+	})
+	st := tr.State("t1", "EV1")
+	if !near(st.KmPerPct, kmPerPct) || !near(st.RangeKm(), 78*kmPerPct) {
+		t.Errorf("consumption %.3f km/%%, range %.1f km; want %.3f km/%%, %.1f km", st.KmPerPct, st.RangeKm(), kmPerPct, 78*kmPerPct)
+	}
+}
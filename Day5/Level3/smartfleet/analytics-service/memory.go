@@ -0,0 +1,404 @@
+package analytics
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is a Store in memory, for tests. It follows the Postgres
+// store's tenant scoping and upsert arithmetic. Transactions roll back on
+// error but are not isolated from concurrent writers.
+type MemoryStore struct {
+	data   *memoryData
+	tenant string
+}
+
+type memoryData struct {
+	mu       sync.Mutex
+	nextID   uint
+	raw      []TelemetryRaw
+	aggs     []Aggregate
+	trips    []Trip
+	sessions []ChargingSession
+	alerts   []AlertRecord
+}
+
+// NewMemoryStore constructs an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: &memoryData{}}
+}
+
+func (s *MemoryStore) ForTenant(tenant string) Store {
+	return &MemoryStore{data: s.data, tenant: tenant}
+}
+
+// lock locks the data of a tenant-scoped store.
+func (s *MemoryStore) lock() (*memoryData, error) {
+	if s.tenant == "" {
+		return nil, ErrNoTenant
+	}
+	s.data.mu.Lock()
+	return s.data, nil
+}
+
+func (d *memoryData) id() uint {
+	d.nextID++
+	return d.nextID
+}
+
+func (s *MemoryStore) Transaction(ctx context.Context, fn func(tx Store) error) error {
+	d := s.data
+	d.mu.Lock()
+	saved := memoryData{
+		nextID:   d.nextID,
+		raw:      append([]TelemetryRaw(nil), d.raw...),
+		aggs:     append([]Aggregate(nil), d.aggs...),
+		trips:    append([]Trip(nil), d.trips...),
+		sessions: append([]ChargingSession(nil), d.sessions...),
+		alerts:   append([]AlertRecord(nil), d.alerts...),
+	}
+	d.mu.Unlock()
+
+	if err := fn(s); err != nil {
+		d.mu.Lock()
+		d.nextID, d.raw, d.aggs, d.trips, d.sessions, d.alerts =
+			saved.nextID, saved.raw, saved.aggs, saved.trips, saved.sessions, saved.alerts
+		d.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (s *MemoryStore) InsertTelemetry(ctx context.Context, ev TelemetryEvent) error {
+	d, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer d.mu.Unlock()
+	raw := telemetryRow(s.tenant, ev)
+	raw.ID, raw.CreatedAt = d.id(), time.Now()
+	d.raw = append(d.raw, raw)
+	return nil
+}
+
+func (s *MemoryStore) UpsertAggregate(ctx context.Context, ev TelemetryEvent) error {
+	d, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer d.mu.Unlock()
+	bucket := bucketMinute(time.UnixMilli(ev.Ts).UTC())
+	now := time.Now()
+	for i := range d.aggs {
+		a := &d.aggs[i]
+		if a.TenantID == s.tenant && a.VehicleID == ev.VehicleID && a.Bucket.Equal(bucket) {
+			a.AvgSpeed = (a.AvgSpeed*float64(a.EventCount) + ev.Speed) / float64(a.EventCount+1)
+			a.MinFuel = math.Min(a.MinFuel, ev.FuelLevel)
+			a.MaxSpeed = math.Max(a.MaxSpeed, ev.Speed)
+			a.EventCount++
+			a.UpdatedAt = now
+			return nil
+		}
+	}
+	d.aggs = append(d.aggs, Aggregate{
+		ID:         d.id(),
+		TenantID:   s.tenant,
+		VehicleID:  ev.VehicleID,
+		Bucket:     bucket,
+		AvgSpeed:   ev.Speed,
+		MinFuel:    ev.FuelLevel,
+		MaxSpeed:   ev.Speed,
+		EventCount: 1,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	})
+	return nil
+}
+
+func (s *MemoryStore) SaveOrUpdateTrip(ctx context.Context, trip *Trip) error {
+	d, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer d.mu.Unlock()
+	now := time.Now()
+	if trip.ID == 0 {
+		trip.ID, trip.TenantID, trip.CreatedAt = d.id(), s.tenant, now
+	} else if trip.TenantID != s.tenant {
+		return ErrNoTenant
+	}
+	trip.UpdatedAt = now
+	for i := range d.trips {
+		if d.trips[i].ID == trip.ID {
+			d.trips[i] = *trip
+			return nil
+		}
+	}
+	d.trips = append(d.trips, *trip)
+	return nil
+}
+
+func (s *MemoryStore) GetActiveTrip(ctx context.Context, vehicleID string) (*Trip, error) {
+	d, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+	var active *Trip
+	for i := range d.trips {
+		t := &d.trips[i]
+		if t.TenantID == s.tenant && t.VehicleID == vehicleID && t.EndedAt == nil &&
+			(active == nil || t.StartedAt.After(active.StartedAt)) {
+			active = t
+		}
+	}
+	if active == nil {
+		return nil, nil
+	}
+	t := *active
+	return &t, nil
+}
+
+func (s *MemoryStore) SaveChargingSession(ctx context.Context, cs *ChargingSession) error {
+	d, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer d.mu.Unlock()
+	cs.ID, cs.TenantID, cs.CreatedAt = d.id(), s.tenant, time.Now()
+	d.sessions = append(d.sessions, *cs)
+	return nil
+}
+
+func (s *MemoryStore) ListChargingSessions(ctx context.Context, vehicleID string, limit int) ([]ChargingSession, error) {
+	d, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+	var out []ChargingSession
+	for _, cs := range d.sessions {
+		if cs.TenantID == s.tenant && cs.VehicleID == vehicleID {
+			out = append(out, cs)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].StartedAt.After(out[j].StartedAt) })
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out, nil
+}
+
+func (s *MemoryStore) TripTotals(ctx context.Context, from, to time.Time) ([]VehicleTrips, error) {
+	d, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+	totals := make(map[string]*VehicleTrips)
+	var out []VehicleTrips
+	for _, t := range d.trips {
+		if t.TenantID != s.tenant || t.EndedAt == nil || t.EndedAt.Before(from) || !t.EndedAt.Before(to) {
+			continue
+		}
+		vt := totals[t.VehicleID]
+		if vt == nil {
+			vt = &VehicleTrips{VehicleID: t.VehicleID}
+			totals[t.VehicleID] = vt
+		}
+		vt.Trips++
+		vt.DistanceKm += t.DistanceKm
+	}
+	for _, vt := range totals {
+		out = append(out, *vt)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].DistanceKm != out[j].DistanceKm {
+			return out[i].DistanceKm > out[j].DistanceKm
+		}
+		return out[i].VehicleID < out[j].VehicleID
+	})
+	return out, nil
+}
+
+func (s *MemoryStore) SaveAlert(ctx context.Context, a Alert) error {
+	d, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer d.mu.Unlock()
+	rec, err := alertRow(s.tenant, a)
+	if err != nil {
+		return err
+	}
+	rec.ID, rec.CreatedAt = d.id(), time.Now()
+	d.alerts = append(d.alerts, rec)
+	return nil
+}
+
+func (s *MemoryStore) DumpAggregates(ctx context.Context, vehicleID string) ([]Aggregate, error) {
+	d, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+	var out []Aggregate
+	for _, a := range d.aggs {
+		if a.TenantID == s.tenant && a.VehicleID == vehicleID {
+			out = append(out, a)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Bucket.After(out[j].Bucket) })
+	return out, nil
+}
+
+// contains reports whether a row of vehicleID at t is in rr.
+func (rr ReplayRange) contains(vehicleID string, t time.Time) bool {
+	if t.Before(rr.From) || !t.Before(rr.To) {
+		return false
+	}
+	if len(rr.Vehicles) == 0 {
+		return true
+	}
+	for _, v := range rr.Vehicles {
+		if v == vehicleID {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *MemoryStore) ListRaw(ctx context.Context, rr ReplayRange) ([]TelemetryRaw, error) {
+	d, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+	var out []TelemetryRaw
+	for _, r := range d.raw {
+		if r.TenantID == s.tenant && rr.contains(r.VehicleID, r.Timestamp) {
+			out = append(out, r)
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if !out[i].Timestamp.Equal(out[j].Timestamp) {
+			return out[i].Timestamp.Before(out[j].Timestamp)
+		}
+		return out[i].ID < out[j].ID
+	})
+	return out, nil
+}
+
+func (s *MemoryStore) LoadDerived(ctx context.Context, rr ReplayRange) (*DerivedData, error) {
+	d, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+	var out DerivedData
+	for _, a := range d.aggs {
+		if a.TenantID == s.tenant && rr.contains(a.VehicleID, a.Bucket) {
+			out.Aggregates = append(out.Aggregates, a)
+		}
+	}
+	for _, t := range d.trips {
+		if t.TenantID == s.tenant && rr.contains(t.VehicleID, t.StartedAt) {
+			out.Trips = append(out.Trips, t)
+		}
+	}
+	for _, cs := range d.sessions {
+		if cs.TenantID == s.tenant && rr.contains(cs.VehicleID, cs.StartedAt) {
+			out.Sessions = append(out.Sessions, cs)
+		}
+	}
+	for _, a := range d.alerts {
+		if a.TenantID == s.tenant && rr.contains(a.VehicleID, a.Ts) {
+			out.Alerts = append(out.Alerts, a)
+		}
+	}
+	byVehicle := func(v1, v2 string, t1, t2 time.Time, id1, id2 uint) bool {
+		if v1 != v2 {
+			return v1 < v2
+		}
+		if !t1.Equal(t2) {
+			return t1.Before(t2)
+		}
+		return id1 < id2
+	}
+	sort.Slice(out.Aggregates, func(i, j int) bool {
+		a, b := out.Aggregates[i], out.Aggregates[j]
+		return byVehicle(a.VehicleID, b.VehicleID, a.Bucket, b.Bucket, a.ID, b.ID)
+	})
+	sort.Slice(out.Trips, func(i, j int) bool {
+		a, b := out.Trips[i], out.Trips[j]
+		return byVehicle(a.VehicleID, b.VehicleID, a.StartedAt, b.StartedAt, a.ID, b.ID)
+	})
+	sort.Slice(out.Sessions, func(i, j int) bool {
+		a, b := out.Sessions[i], out.Sessions[j]
+		return byVehicle(a.VehicleID, b.VehicleID, a.StartedAt, b.StartedAt, a.ID, b.ID)
+	})
+	sort.Slice(out.Alerts, func(i, j int) bool {
+		a, b := out.Alerts[i], out.Alerts[j]
+		return byVehicle(a.VehicleID, b.VehicleID, a.Ts, b.Ts, a.ID, b.ID)
+	})
+	return &out, nil
+}
+
+func (s *MemoryStore) ResetDerived(ctx context.Context, rr ReplayRange, includeRaw bool) (map[string]int64, error) {
+	d, err := s.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer d.mu.Unlock()
+	deleted := make(map[string]int64)
+	in := func(tenant, vehicleID string, t time.Time) bool {
+		return tenant == s.tenant && rr.contains(vehicleID, t)
+	}
+	d.aggs = deleteWhere(d.aggs, func(a Aggregate) bool { return in(a.TenantID, a.VehicleID, a.Bucket) }, deleted, "aggregates")
+	d.trips = deleteWhere(d.trips, func(t Trip) bool { return in(t.TenantID, t.VehicleID, t.StartedAt) }, deleted, "trips")
+	d.sessions = deleteWhere(d.sessions, func(cs ChargingSession) bool { return in(cs.TenantID, cs.VehicleID, cs.StartedAt) }, deleted, "charging_sessions")
+	d.alerts = deleteWhere(d.alerts, func(a AlertRecord) bool { return in(a.TenantID, a.VehicleID, a.Ts) }, deleted, "alerts")
+	if includeRaw {
+		d.raw = deleteWhere(d.raw, func(r TelemetryRaw) bool { return in(r.TenantID, r.VehicleID, r.Timestamp) }, deleted, "telemetry")
+	}
+	return deleted, nil
+}
+
+// deleteWhere drops the rows matching del and records how many in
+// deleted[name], as the SQL store reports rows affected per table.
+func deleteWhere[T any](rows []T, del func(T) bool, deleted map[string]int64, name string) []T {
+	var n int64
+	kept := rows[:0]
+	for _, r := range rows {
+		if del(r) {
+			n++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	deleted[name] = n
+	return kept
+}
+
+// MemoryAlertBus is an AlertBus that keeps what it is given, for tests.
+type MemoryAlertBus struct {
+	mu     sync.Mutex
+	alerts []Alert
+}
+
+func (b *MemoryAlertBus) Publish(ctx context.Context, a Alert) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.alerts = append(b.alerts, a)
+	return nil
+}
+
+// Alerts returns the alerts published so far.
+func (b *MemoryAlertBus) Alerts() []Alert {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Alert(nil), b.alerts...)
+}
@@ -0,0 +1,62 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	base := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	mem := NewMemoryStore()
+	if err := mem.InsertTelemetry(ctx, TelemetryEvent{VehicleID: "v1"}); !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("unscoped insert: %v", err)
+	}
+	a, b := mem.ForTenant("a"), mem.ForTenant("b")
+
+	for i, speed := range []float64{40, 80} {
+		ev := TelemetryEvent{VehicleID: "v1", Speed: speed, FuelLevel: 50 - float64(i), Ts: base.Add(time.Duration(i) * time.Second).UnixMilli()}
+		if err := a.UpsertAggregate(ctx, ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aggs, _ := a.DumpAggregates(ctx, "v1")
+	if len(aggs) != 1 || aggs[0].AvgSpeed != 60 || aggs[0].MaxSpeed != 80 || aggs[0].MinFuel != 49 || aggs[0].EventCount != 2 {
+		t.Fatalf("aggregates = %+v", aggs)
+	}
+	if aggs, _ := b.DumpAggregates(ctx, "v1"); len(aggs) != 0 {
+		t.Fatalf("tenant b sees %d aggregates of tenant a", len(aggs))
+	}
+
+	trip := &Trip{VehicleID: "v1", StartedAt: base}
+	if err := a.SaveOrUpdateTrip(ctx, trip); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.SaveOrUpdateTrip(ctx, trip); !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("tenant b saved tenant a's trip: %v", err)
+	}
+	boom := errors.New("boom")
+	err := a.Transaction(ctx, func(tx Store) error {
+		end := base.Add(time.Hour)
+		trip.EndedAt, trip.DistanceKm = &end, 12
+		if err := tx.SaveOrUpdateTrip(ctx, trip); err != nil {
+			return err
+		}
+		return boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("transaction: %v", err)
+	}
+	if active, _ := a.GetActiveTrip(ctx, "v1"); active == nil || active.EndedAt != nil {
+		t.Fatalf("rolled back trip = %+v", active)
+	}
+	if err := a.SaveOrUpdateTrip(ctx, trip); err != nil {
+		t.Fatal(err)
+	}
+	totals, _ := a.TripTotals(ctx, base, base.Add(2*time.Hour))
+	if len(totals) != 1 || totals[0].Trips != 1 || totals[0].DistanceKm != 12 {
+		t.Fatalf("trip totals = %+v", totals)
+	}
+}
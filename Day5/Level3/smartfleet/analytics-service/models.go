@@ -1,6 +1,7 @@
-package analyticsservice
+package analytics
 
 import (
+	"fmt"
 	"time"
 
 	"gorm.io/gorm"
@@ -8,21 +9,27 @@ import (
 
 // TelemetryRaw stores incoming telemetry events (persisted)
 type TelemetryRaw struct {
-	ID        uint      `gorm:"primaryKey"`
-	VehicleID string    `gorm:"index:idx_vehicle_ts,priority:1;index"`
-	Timestamp time.Time `gorm:"index:idx_vehicle_ts,priority:2"`
-	Speed     float64
-	Fuel      float64
-	Latitude  float64
-	Longitude float64
-	CreatedAt time.Time
+	ID         uint      `gorm:"primaryKey"`
+	TenantID   string    `gorm:"size:64;not null;index:idx_raw_tenant_vehicle_ts,priority:1"`
+	VehicleID  string    `gorm:"index:idx_raw_tenant_vehicle_ts,priority:2;index"`
+	Timestamp  time.Time `gorm:"index:idx_raw_tenant_vehicle_ts,priority:3"`
+	Speed      float64
+	Fuel       float64
+	Latitude   float64
+	Longitude  float64
+	Battery    *float64 // EV state of charge, nil for ICE vehicles
+	Charging   *bool
+	EngineTemp *float64
+	ReceivedAt *time.Time // ingest time, used by replays for skew detection
+	CreatedAt  time.Time
 }
 
 // Aggregate represents per-minute aggregate metrics per vehicle
 type Aggregate struct {
 	ID         uint      `gorm:"primaryKey"`
-	VehicleID  string    `gorm:"index:idx_agg_vehicle_bucket,priority:1"`
-	Bucket     time.Time `gorm:"index:idx_agg_vehicle_bucket,priority:2"` // bucket start (UTC minute)
+	TenantID   string    `gorm:"size:64;not null;uniqueIndex:idx_agg_tenant_vehicle_bucket,priority:1"`
+	VehicleID  string    `gorm:"uniqueIndex:idx_agg_tenant_vehicle_bucket,priority:2"`
+	Bucket     time.Time `gorm:"uniqueIndex:idx_agg_tenant_vehicle_bucket,priority:3"` // bucket start (UTC minute)
 	AvgSpeed   float64
 	MinFuel    float64
 	MaxSpeed   float64
@@ -34,7 +41,8 @@ type Aggregate struct {
 // Trip summary for detected trips
 type Trip struct {
 	ID           uint      `gorm:"primaryKey"`
-	VehicleID    string    `gorm:"index"`
+	TenantID     string    `gorm:"size:64;not null;index:idx_trip_tenant_vehicle,priority:1"`
+	VehicleID    string    `gorm:"index;index:idx_trip_tenant_vehicle,priority:2"`
 	StartedAt    time.Time `gorm:"index"`
 	EndedAt      *time.Time
 	DistanceKm   float64
@@ -44,7 +52,86 @@ type Trip struct {
 	UpdatedAt    time.Time
 }
 
-// MigrateSchemas runs AutoMigrate
+// ChargingSession is one detected EV charging session
+type ChargingSession struct {
+	ID          uint       `gorm:"primaryKey" json:"id"`
+	TenantID    string     `gorm:"size:64;not null;index:idx_charge_tenant_vehicle,priority:1" json:"-"`
+	VehicleID   string     `gorm:"index:idx_charge_tenant_vehicle,priority:2" json:"vehicle_id"`
+	StartedAt   time.Time  `gorm:"index" json:"started_at"`
+	EndedAt     *time.Time `json:"ended_at,omitempty"`
+	StartSoC    float64    `json:"start_soc"`
+	EndSoC      float64    `json:"end_soc"`
+	DurationSec int64      `json:"duration_sec"`
+	EnergyKWh   float64    `json:"energy_kwh"`
+	AvgPowerKW  float64    `json:"avg_power_kw"`
+	Latitude    float64    `json:"latitude"`
+	Longitude   float64    `json:"longitude"`
+	Slow        bool       `json:"slow"`
+	Interrupted bool       `json:"interrupted"`
+	EndReason   string     `json:"end_reason,omitempty"`
+	CreatedAt   time.Time  `json:"-"`
+}
+
+// AlertRecord is the alert history written alongside every published alert
+type AlertRecord struct {
+	ID         uint      `gorm:"primaryKey"`
+	TenantID   string    `gorm:"size:64;not null;index:idx_alert_tenant_vehicle_ts,priority:1"`
+	VehicleID  string    `gorm:"index:idx_alert_tenant_vehicle_ts,priority:2"`
+	Ts         time.Time `gorm:"index:idx_alert_tenant_vehicle_ts,priority:3"` // event time
+	Level      string
+	Message    string
+	Rule       string
+	Confidence float64
+	Source     string
+	Code       string `gorm:"size:64"`
+	Params     string // JSON object
+	CreatedAt  time.Time
+}
+
+// Event rebuilds the telemetry event a raw row was stored from.
+func (r TelemetryRaw) Event() TelemetryEvent {
+	ev := TelemetryEvent{
+		TenantID:   r.TenantID,
+		VehicleID:  r.VehicleID,
+		Speed:      r.Speed,
+		FuelLevel:  r.Fuel,
+		Lat:        r.Latitude,
+		Lon:        r.Longitude,
+		Ts:         r.Timestamp.UnixMilli(),
+		BatteryPct: r.Battery,
+		Charging:   r.Charging,
+		EngineTemp: r.EngineTemp,
+	}
+	if r.ReceivedAt != nil {
+		ev.ReceivedAt = r.ReceivedAt.UnixMilli()
+	}
+	return ev
+}
+
+// supersededIndexes were replaced by tenant-scoped indexes under new names.
+// AutoMigrate keeps an index whose name already exists, so the scoped ones
+// are named anew and these are dropped from databases that still have them.
+var supersededIndexes = []struct {
+	model interface{}
+	name  string
+}{
+	{&TelemetryRaw{}, "idx_vehicle_ts"},
+	{&Aggregate{}, "idx_agg_vehicle_bucket"},
+}
+
+// MigrateSchemas runs AutoMigrate and drops superseded indexes
 func MigrateSchemas(db *gorm.DB) error {
-	return db.AutoMigrate(&TelemetryRaw{}, &Aggregate{}, &Trip{})
+	if err := db.AutoMigrate(&TelemetryRaw{}, &Aggregate{}, &Trip{}, &ChargingSession{}, &AlertRecord{}); err != nil {
+		return err
+	}
+	m := db.Migrator()
+	for _, idx := range supersededIndexes {
+		if !m.HasIndex(idx.model, idx.name) {
+			continue
+		}
+		if err := m.DropIndex(idx.model, idx.name); err != nil {
+			return fmt.Errorf("drop index %s: %w", idx.name, err)
+		}
+	}
+	return nil
 }
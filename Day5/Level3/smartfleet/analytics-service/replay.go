@@ -0,0 +1,436 @@
+package analytics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+
+	"smartfleet/common/config"
+	commonkafka "smartfleet/common/kafka"
+	"smartfleet/common/logging"
+	commonpostgres "smartfleet/common/postgres"
+)
+
+// Replay sources
+const (
+	SourceRaw   = "raw"   // re-derive from TelemetryRaw rows
+	SourceKafka = "kafka" // re-ingest a Kafka offset range, replacing raw rows too
+)
+
+// ReplayOptions configures one replay run.
+type ReplayOptions struct {
+	Tenant string
+	Range  ReplayRange
+	Source string
+	DryRun bool
+}
+
+// DiffStat compares one kind of derived data before and after a replay.
+type DiffStat struct {
+	Before    int      `json:"before"`
+	After     int      `json:"after"`
+	Added     int      `json:"added"`
+	Removed   int      `json:"removed"`
+	Changed   int      `json:"changed"`
+	Unchanged int      `json:"unchanged"`
+	Samples   []string `json:"samples,omitempty"` // first few differences
+}
+
+// ReplayReport summarizes a replay run.
+type ReplayReport struct {
+	Tenant   string               `json:"tenant"`
+	Vehicles []string             `json:"vehicles,omitempty"`
+	From     time.Time            `json:"from"`
+	To       time.Time            `json:"to"`
+	Source   string               `json:"source"`
+	DryRun   bool                 `json:"dry_run"`
+	Events   int                  `json:"events"`
+	Deleted  map[string]int64     `json:"deleted"`
+	Diff     map[string]*DiffStat `json:"diff"`
+}
+
+const maxDiffSamples = 5
+
+var errDryRunRollback = errors.New("dry run: rolling back")
+
+// Replay resets derived state in opts.Range and re-runs processTelemetryEvent
+// over events with fresh in-memory state, all inside one transaction.
+// newPipeline builds the pipeline against the transaction's store.
+//
+// Processing is keyed on event time only, so replaying the same events gives
+// the same result. A trip or charging session in progress at Range.From is
+// re-detected as starting at its first in-range event; start ranges while the
+// vehicles are parked to avoid that.
+func Replay(ctx context.Context, store Store, opts ReplayOptions, events []TelemetryEvent, newPipeline func(tx Store) *Pipeline) (*ReplayReport, error) {
+	report := &ReplayReport{
+		Tenant:   opts.Tenant,
+		Vehicles: opts.Range.Vehicles,
+		From:     opts.Range.From,
+		To:       opts.Range.To,
+		Source:   opts.Source,
+		DryRun:   opts.DryRun,
+		Events:   len(events),
+	}
+	err := store.ForTenant(opts.Tenant).Transaction(ctx, func(tx Store) error {
+		before, err := tx.LoadDerived(ctx, opts.Range)
+		if err != nil {
+			return fmt.Errorf("load derived data: %w", err)
+		}
+		report.Deleted, err = tx.ResetDerived(ctx, opts.Range, opts.Source == SourceKafka)
+		if err != nil {
+			return fmt.Errorf("reset derived data: %w", err)
+		}
+
+		p := newPipeline(tx)
+		p.skipRaw = opts.Source == SourceRaw
+		for _, ev := range events {
+			if err := processTelemetryEvent(ctx, p, ev); err != nil {
+				return fmt.Errorf("process event %s@%d: %w", ev.VehicleID, ev.Ts, err)
+			}
+		}
+
+		after, err := tx.LoadDerived(ctx, opts.Range)
+		if err != nil {
+			return fmt.Errorf("load replayed data: %w", err)
+		}
+		report.Diff = diffDerived(before, after)
+		if opts.DryRun {
+			return errDryRunRollback
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRunRollback) {
+		return nil, err
+	}
+	return report, nil
+}
+
+// eventsFromRaw loads replay input from TelemetryRaw.
+func eventsFromRaw(ctx context.Context, store Store, opts ReplayOptions) ([]TelemetryEvent, error) {
+	rows, err := store.ForTenant(opts.Tenant).ListRaw(ctx, opts.Range)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]TelemetryEvent, 0, len(rows))
+	for _, r := range rows {
+		events = append(events, r.Event())
+	}
+	return events, nil
+}
+
+// eventsFromKafka reads offsets [start, end) of one partition and keeps the
+// tenant's events in opts.Range, sorted by event time. end < 0 reads to the
+// partition's current last offset.
+func eventsFromKafka(ctx context.Context, cfg config.Kafka, partition int, start, end int64, opts ReplayOptions, logger *log.Logger) ([]TelemetryEvent, error) {
+	rc, err := commonkafka.ReaderConfig(cfg, cfg.Topic, logger)
+	if err != nil {
+		return nil, err
+	}
+	if end < 0 {
+		conn, err := rc.Dialer.DialLeader(ctx, "tcp", cfg.Brokers[0], cfg.Topic, partition)
+		if err != nil {
+			return nil, fmt.Errorf("dial partition leader: %w", err)
+		}
+		end, err = conn.ReadLastOffset()
+		conn.Close()
+		if err != nil {
+			return nil, fmt.Errorf("read last offset: %w", err)
+		}
+	}
+	if start >= end {
+		return nil, nil
+	}
+
+	rc.Partition, rc.MinBytes = partition, 1
+	reader := kafka.NewReader(rc)
+	defer reader.Close()
+	if err := reader.SetOffset(start); err != nil {
+		return nil, fmt.Errorf("set offset: %w", err)
+	}
+
+	vehicles := make(map[string]bool, len(opts.Range.Vehicles))
+	for _, v := range opts.Range.Vehicles {
+		vehicles[v] = true
+	}
+	var events []TelemetryEvent
+	for {
+		m, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("read offset %d: %w", start, err)
+		}
+		if m.Offset >= end {
+			break
+		}
+		ev, err := eventFromMessage(m)
+		if err != nil {
+			logger.Printf("skipping invalid message at offset %d: %v", m.Offset, err)
+		} else if ev.TenantID == opts.Tenant && (len(vehicles) == 0 || vehicles[ev.VehicleID]) {
+			if t := time.UnixMilli(ev.Ts); !t.Before(opts.Range.From) && t.Before(opts.Range.To) {
+				events = append(events, ev)
+			}
+		}
+		if m.Offset+1 >= end {
+			break
+		}
+	}
+	// Kafka holds arrival order; replay in event-time order
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Ts < events[j].Ts })
+	return events, nil
+}
+
+// diffDerived compares derived data by natural key: aggregates by minute
+// bucket, trips and charging sessions by start time, alerts by time and rule.
+func diffDerived(before, after *DerivedData) map[string]*DiffStat {
+	return map[string]*DiffStat{
+		"aggregates":        diffKeyed(aggregateKeys(before.Aggregates), aggregateKeys(after.Aggregates)),
+		"trips":             diffKeyed(tripKeys(before.Trips), tripKeys(after.Trips)),
+		"charging_sessions": diffKeyed(sessionKeys(before.Sessions), sessionKeys(after.Sessions)),
+		"alerts":            diffKeyed(alertKeys(before.Alerts), alertKeys(after.Alerts)),
+	}
+}
+
+// diffKeyed compares key -> fingerprint maps.
+func diffKeyed(before, after map[string]string) *DiffStat {
+	d := &DiffStat{Before: len(before), After: len(after)}
+	keys := make([]string, 0, len(before)+len(after))
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	sample := func(s string) {
+		if len(d.Samples) < maxDiffSamples {
+			d.Samples = append(d.Samples, s)
+		}
+	}
+	for _, k := range keys {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		switch {
+		case !inBefore:
+			d.Added++
+			sample("+ " + k + " " + a)
+		case !inAfter:
+			d.Removed++
+			sample("- " + k + " " + b)
+		case a != b:
+			d.Changed++
+			sample("~ " + k + " " + b + " -> " + a)
+		default:
+			d.Unchanged++
+		}
+	}
+	return d
+}
+
+func timeKey(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func optTimeKey(t *time.Time) string {
+	if t == nil {
+		return "open"
+	}
+	return timeKey(*t)
+}
+
+func aggregateKeys(rows []Aggregate) map[string]string {
+	out := make(map[string]string, len(rows))
+	for _, a := range rows {
+		out[a.VehicleID+"@"+timeKey(a.Bucket)] = fmt.Sprintf("avg=%.3f max=%.3f min_fuel=%.3f n=%d",
+			a.AvgSpeed, a.MaxSpeed, a.MinFuel, a.EventCount)
+	}
+	return out
+}
+
+func tripKeys(rows []Trip) map[string]string {
+	out := make(map[string]string, len(rows))
+	for _, t := range rows {
+		out[t.VehicleID+"@"+timeKey(t.StartedAt)] = fmt.Sprintf("end=%s km=%.3f avg=%.3f n=%d",
+			optTimeKey(t.EndedAt), t.DistanceKm, t.AvgSpeedKmph, t.EventCount)
+	}
+	return out
+}
+
+func sessionKeys(rows []ChargingSession) map[string]string {
+	out := make(map[string]string, len(rows))
+	for _, s := range rows {
+		out[s.VehicleID+"@"+timeKey(s.StartedAt)] = fmt.Sprintf("end=%s soc=%.1f->%.1f kwh=%.3f reason=%s",
+			optTimeKey(s.EndedAt), s.StartSoC, s.EndSoC, s.EnergyKWh, s.EndReason)
+	}
+	return out
+}
+
+// alertKeys numbers repeated alerts so duplicates are counted, not merged.
+func alertKeys(rows []AlertRecord) map[string]string {
+	out := make(map[string]string, len(rows))
+	for _, a := range rows {
+		base := a.VehicleID + "@" + timeKey(a.Ts) + " " + a.Level + " " + a.Rule + " " + a.Message
+		k := base
+		for n := 2; ; n++ {
+			if _, dup := out[k]; !dup {
+				break
+			}
+			k = fmt.Sprintf("%s #%d", base, n)
+		}
+		out[k] = fmt.Sprintf("confidence=%.3f", a.Confidence)
+	}
+	return out
+}
+
+// writeReplayReport prints the report as indented JSON or a short text summary.
+func writeReplayReport(w io.Writer, r *ReplayReport, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	mode := "applied"
+	if r.DryRun {
+		mode = "dry run, rolled back"
+	}
+	vehicles := "all vehicles"
+	if len(r.Vehicles) > 0 {
+		vehicles = strings.Join(r.Vehicles, ",")
+	}
+	fmt.Fprintf(w, "replay [%s, %s) tenant=%s vehicles=%s source=%s: %d events (%s)\n",
+		timeKey(r.From), timeKey(r.To), r.Tenant, vehicles, r.Source, r.Events, mode)
+	for _, kind := range []string{"aggregates", "trips", "charging_sessions", "alerts"} {
+		d := r.Diff[kind]
+		fmt.Fprintf(w, "  %-17s before=%d after=%d added=%d removed=%d changed=%d unchanged=%d\n",
+			kind, d.Before, d.After, d.Added, d.Removed, d.Changed, d.Unchanged)
+		for _, s := range d.Samples {
+			fmt.Fprintf(w, "      %s\n", s)
+		}
+	}
+	return nil
+}
+
+// runReplay implements the "replay" subcommand and returns the exit code.
+func runReplay(args []string) int {
+	// on stderr, which LOG_FORMAT=console makes easier to read
+	logs, err := logging.New("analytics-replay", conf.Log, os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer logs.Sync()
+	logger := logs.Std("replay")
+
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	tenant := fs.String("tenant", conf.DefaultTenant, "tenant to replay")
+	vehicleList := fs.String("vehicles", "", "comma-separated vehicle IDs (default: all; required for -source kafka)")
+	fromStr := fs.String("from", "", "range start, RFC3339 (inclusive, rounded down to the minute)")
+	toStr := fs.String("to", "", "range end, RFC3339 (exclusive, rounded up to the minute)")
+	source := fs.String("source", SourceRaw, "event source: raw or kafka")
+	partition := fs.Int("partition", 0, "kafka partition (-source kafka)")
+	startOffset := fs.Int64("start-offset", 0, "first kafka offset (-source kafka)")
+	endOffset := fs.Int64("end-offset", -1, "kafka offset to stop before; -1 for the current end (-source kafka)")
+	dryRun := fs.Bool("dry-run", false, "compute the diff and roll back")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	from, err := time.Parse(time.RFC3339, *fromStr)
+	if err != nil {
+		logger.Printf("-from: %v", err)
+		return 2
+	}
+	to, err := time.Parse(time.RFC3339, *toStr)
+	if err != nil {
+		logger.Printf("-to: %v", err)
+		return 2
+	}
+	// whole minutes, so aggregate buckets are either fully replayed or untouched
+	from = bucketMinute(from.UTC())
+	if to = to.UTC(); !bucketMinute(to).Equal(to) {
+		to = bucketMinute(to).Add(time.Minute)
+	}
+	if !from.Before(to) {
+		logger.Printf("-from must be before -to")
+		return 2
+	}
+	var vehicles []string
+	for _, v := range strings.Split(*vehicleList, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			vehicles = append(vehicles, v)
+		}
+	}
+	switch *source {
+	case SourceRaw:
+	case SourceKafka:
+		// raw rows are replaced, so the vehicle set must match what the partition holds
+		if len(vehicles) == 0 {
+			logger.Printf("-source kafka requires -vehicles")
+			return 2
+		}
+	default:
+		logger.Printf("unknown -source %q (want raw or kafka)", *source)
+		return 2
+	}
+	opts := ReplayOptions{
+		Tenant: *tenant,
+		Range:  ReplayRange{Vehicles: vehicles, From: from, To: to},
+		Source: *source,
+		DryRun: *dryRun,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	db, err := commonpostgres.NewPostgres(ctx, conf.Postgres, logs.Std("postgres"))
+	if err != nil {
+		logger.Printf("%v", err)
+		return 1
+	}
+	defer commonpostgres.Close(db)
+	if err := MigrateSchemas(db); err != nil {
+		logger.Printf("migrate schemas: %v", err)
+		return 1
+	}
+	store := NewStore(db, logs.Std("store"))
+
+	var events []TelemetryEvent
+	if opts.Source == SourceKafka {
+		events, err = eventsFromKafka(ctx, conf.Kafka, *partition, *startOffset, *endOffset, opts, logger)
+	} else {
+		events, err = eventsFromRaw(ctx, store, opts)
+	}
+	if err != nil {
+		logger.Printf("load events: %v", err)
+		return 1
+	}
+
+	registry := newRegistry()
+	report, err := Replay(ctx, store, opts, events, func(tx Store) *Pipeline {
+		// alerts go to history only: replays never re-notify
+		alerts := NewAlertPublisher(nil, tx, registry, logs.Logger("alerts"))
+		evs := NewEVTracker(registry, alerts, conf.DefaultBatteryKWh, conf.SlowChargeKW, conf.ChargeTargetPct)
+		return NewPipeline(tx, alerts, evs, NewAnomalyDetector(conf.Anomaly, alerts), logs.Logger("pipeline"))
+	})
+	if err != nil {
+		logger.Printf("replay failed, nothing changed: %v", err)
+		return 1
+	}
+	if err := writeReplayReport(os.Stdout, report, *asJSON); err != nil {
+		logger.Printf("write report: %v", err)
+		return 1
+	}
+	return 0
+}
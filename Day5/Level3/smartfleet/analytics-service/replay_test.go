@@ -0,0 +1,59 @@
+package analytics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiffDerived(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	end := t0.Add(10 * time.Minute)
+	before := &DerivedData{
+		Aggregates: []Aggregate{
+			{VehicleID: "v1", Bucket: t0, AvgSpeed: 40, EventCount: 6},
+			{VehicleID: "v1", Bucket: t0.Add(time.Minute), AvgSpeed: 50, EventCount: 6},
+		},
+		Trips: []Trip{{VehicleID: "v1", StartedAt: t0, DistanceKm: 3}},
+		Alerts: []AlertRecord{
+			{VehicleID: "v1", Ts: t0, Level: "CRITICAL", Message: "Overspeed > 140 km/h"},
+		},
+	}
+	after := &DerivedData{
+		Aggregates: []Aggregate{
+			{VehicleID: "v1", Bucket: t0, AvgSpeed: 40, EventCount: 6},
+			{VehicleID: "v1", Bucket: t0.Add(2 * time.Minute), AvgSpeed: 30, EventCount: 1},
+		},
+		Trips: []Trip{{VehicleID: "v1", StartedAt: t0, EndedAt: &end, DistanceKm: 3}},
+		Alerts: []AlertRecord{
+			{VehicleID: "v1", Ts: t0, Level: "CRITICAL", Message: "Overspeed > 140 km/h"},
+			{VehicleID: "v1", Ts: t0, Level: "CRITICAL", Message: "Overspeed > 140 km/h"},
+		},
+	}
+
+	diff := diffDerived(before, after)
+	cases := []struct {
+		kind                               string
+		added, removed, changed, unchanged int
+	}{
+		{"aggregates", 1, 1, 0, 1},
+		{"trips", 0, 0, 1, 0},
+		{"charging_sessions", 0, 0, 0, 0},
+		{"alerts", 1, 0, 0, 1}, // duplicate alerts are counted, not merged
+	}
+	for _, c := range cases {
+		d := diff[c.kind]
+		if d.Added != c.added || d.Removed != c.removed || d.Changed != c.changed || d.Unchanged != c.unchanged {
+			t.Errorf("%s: got +%d -%d ~%d =%d, want +%d -%d ~%d =%d", c.kind,
+				d.Added, d.Removed, d.Changed, d.Unchanged, c.added, c.removed, c.changed, c.unchanged)
+		}
+	}
+}
+
+func TestDiffDerivedIdenticalIsClean(t *testing.T) {
+	t0 := time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)
+	d := &DerivedData{Aggregates: []Aggregate{{VehicleID: "v1", Bucket: t0, AvgSpeed: 40.0000001, EventCount: 6}}}
+	same := &DerivedData{Aggregates: []Aggregate{{VehicleID: "v1", Bucket: t0, AvgSpeed: 40, EventCount: 6}}}
+	if s := diffDerived(d, same)["aggregates"]; s.Changed != 0 || len(s.Samples) != 0 {
+		t.Errorf("float noise reported as change: %+v", s)
+	}
+}
@@ -1,9 +1,9 @@
-package analyticsservice
-
+package analytics
 
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"time"
 
@@ -11,27 +11,66 @@ import (
 	"gorm.io/gorm/clause"
 )
 
-// Store is the DB wrapper.
-type Store struct {
+// ErrNoTenant is returned when an unscoped Store is used for data access.
+var ErrNoTenant = errors.New("store not scoped to a tenant")
+
+// Store persists telemetry and everything derived from it. Data access
+// requires a tenant-scoped copy from ForTenant; an unscoped Store returns
+// ErrNoTenant. NewStore is the Postgres one, NewMemoryStore keeps it in
+// memory for tests.
+type Store interface {
+	// ForTenant returns a Store whose reads and writes are restricted to tenant.
+	ForTenant(tenant string) Store
+	// Transaction runs fn with a Store whose writes are kept only if fn
+	// returns nil.
+	Transaction(ctx context.Context, fn func(tx Store) error) error
+
+	InsertTelemetry(ctx context.Context, ev TelemetryEvent) error
+	UpsertAggregate(ctx context.Context, ev TelemetryEvent) error
+	SaveOrUpdateTrip(ctx context.Context, trip *Trip) error
+	GetActiveTrip(ctx context.Context, vehicleID string) (*Trip, error)
+	SaveChargingSession(ctx context.Context, cs *ChargingSession) error
+	ListChargingSessions(ctx context.Context, vehicleID string, limit int) ([]ChargingSession, error)
+	TripTotals(ctx context.Context, from, to time.Time) ([]VehicleTrips, error)
+	SaveAlert(ctx context.Context, a Alert) error
+	DumpAggregates(ctx context.Context, vehicleID string) ([]Aggregate, error)
+
+	// replay
+	ListRaw(ctx context.Context, rr ReplayRange) ([]TelemetryRaw, error)
+	LoadDerived(ctx context.Context, rr ReplayRange) (*DerivedData, error)
+	ResetDerived(ctx context.Context, rr ReplayRange, includeRaw bool) (map[string]int64, error)
+}
+
+// sqlStore is the Store in Postgres, through GORM.
+type sqlStore struct {
 	db     *gorm.DB
 	logger *log.Logger
+	tenant string
 }
 
-// NewStore constructs a Store.
-func NewStore(db *gorm.DB, logger *log.Logger) *Store {
-	return &Store{db: db, logger: logger}
+// NewStore constructs a Store on db.
+func NewStore(db *gorm.DB, logger *log.Logger) Store {
+	return &sqlStore{db: db, logger: logger}
+}
+
+func (s *sqlStore) ForTenant(tenant string) Store {
+	return &sqlStore{db: s.db, logger: s.logger, tenant: tenant}
+}
+
+// scoped returns a query builder filtered to the store's tenant.
+func (s *sqlStore) scoped(ctx context.Context) (*gorm.DB, error) {
+	if s.tenant == "" {
+		return nil, ErrNoTenant
+	}
+	return s.db.WithContext(ctx).Where("tenant_id = ?", s.tenant), nil
 }
 
 // InsertTelemetry persists raw telemetry.
-func (s *Store) InsertTelemetry(ctx context.Context, ev TelemetryEvent) error {
-	raw := TelemetryRaw{
-		VehicleID: ev.VehicleID,
-		Timestamp: time.UnixMilli(ev.Ts).UTC(),
-		Speed:     ev.Speed,
-		Fuel:      ev.FuelLevel,
-		Latitude:  ev.Lat,
-		Longitude: ev.Lon,
+func (s *sqlStore) InsertTelemetry(ctx context.Context, ev TelemetryEvent) error {
+	if s.tenant == "" {
+		return ErrNoTenant
 	}
+	raw := telemetryRow(s.tenant, ev)
 	if err := s.db.WithContext(ctx).Create(&raw).Error; err != nil {
 		s.logger.Printf("InsertTelemetry err: %v", err)
 		return err
@@ -40,12 +79,16 @@ func (s *Store) InsertTelemetry(ctx context.Context, ev TelemetryEvent) error {
 }
 
 // UpsertAggregate updates per-minute aggregates using DB upsert.
-func (s *Store) UpsertAggregate(ctx context.Context, ev TelemetryEvent) error {
+func (s *sqlStore) UpsertAggregate(ctx context.Context, ev TelemetryEvent) error {
+	if s.tenant == "" {
+		return ErrNoTenant
+	}
 	ts := time.UnixMilli(ev.Ts).UTC()
 	bucket := bucketMinute(ts)
 
 	// For incoming single event: we upsert with ON CONFLICT combining counts and computing simple aggregates
 	agg := Aggregate{
+		TenantID:   s.tenant,
 		VehicleID:  ev.VehicleID,
 		Bucket:     bucket,
 		AvgSpeed:   ev.Speed,
@@ -58,30 +101,41 @@ func (s *Store) UpsertAggregate(ctx context.Context, ev TelemetryEvent) error {
 	// new_avg = (avg*count + ev.Speed) / (count+1)
 	// min_fuel = least(min_fuel, ev.FuelLevel), max_speed = greatest(max_speed, ev.Speed), event_count = event_count+1
 	return s.db.WithContext(ctx).Clauses(clause.OnConflict{
-		Columns:   []clause.Column{{Name: "vehicle_id"}, {Name: "bucket"}},
+		Columns: []clause.Column{{Name: "tenant_id"}, {Name: "vehicle_id"}, {Name: "bucket"}},
 		DoUpdates: clause.Assignments(map[string]interface{}{
-			"avg_speed":   clause.Expr("((coalesce(avg_speed,0) * coalesce(event_count,0) + ?) / (coalesce(event_count,0) + 1))", ev.Speed),
-			"min_fuel":    clause.Expr("LEAST(coalesce(min_fuel,9999), ?)", ev.FuelLevel),
-			"max_speed":   clause.Expr("GREATEST(coalesce(max_speed,0), ?)", ev.Speed),
-			"event_count": clause.Expr("coalesce(event_count,0) + 1"),
+			"avg_speed":   gorm.Expr("((coalesce(avg_speed,0) * coalesce(event_count,0) + ?) / (coalesce(event_count,0) + 1))", ev.Speed),
+			"min_fuel":    gorm.Expr("LEAST(coalesce(min_fuel,9999), ?)", ev.FuelLevel),
+			"max_speed":   gorm.Expr("GREATEST(coalesce(max_speed,0), ?)", ev.Speed),
+			"event_count": gorm.Expr("coalesce(event_count,0) + 1"),
 			"updated_at":  time.Now(),
 		}),
 	}).Create(&agg).Error
 }
 
 // SaveOrUpdateTrip persists trip start/end and updates distance/avg speed.
-func (s *Store) SaveOrUpdateTrip(ctx context.Context, trip *Trip) error {
+func (s *sqlStore) SaveOrUpdateTrip(ctx context.Context, trip *Trip) error {
+	if s.tenant == "" {
+		return ErrNoTenant
+	}
 	// If trip has ID (existing), update; else create.
 	if trip.ID == 0 {
+		trip.TenantID = s.tenant
 		return s.db.WithContext(ctx).Create(trip).Error
 	}
+	if trip.TenantID != s.tenant {
+		return ErrNoTenant
+	}
 	return s.db.WithContext(ctx).Save(trip).Error
 }
 
 // GetActiveTrip fetches an active (no EndedAt) trip for vehicle
-func (s *Store) GetActiveTrip(ctx context.Context, vehicleID string) (*Trip, error) {
+func (s *sqlStore) GetActiveTrip(ctx context.Context, vehicleID string) (*Trip, error) {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var t Trip
-	err := s.db.WithContext(ctx).Where("vehicle_id = ? AND ended_at IS NULL", vehicleID).Order("started_at DESC").First(&t).Error
+	err = q.Where("vehicle_id = ? AND ended_at IS NULL", vehicleID).Order("started_at DESC").First(&t).Error
 	if err == gorm.ErrRecordNotFound {
 		return nil, nil
 	}
@@ -91,15 +145,226 @@ func (s *Store) GetActiveTrip(ctx context.Context, vehicleID string) (*Trip, err
 	return &t, nil
 }
 
+// SaveChargingSession persists a finished charging session.
+func (s *sqlStore) SaveChargingSession(ctx context.Context, cs *ChargingSession) error {
+	if s.tenant == "" {
+		return ErrNoTenant
+	}
+	cs.TenantID = s.tenant
+	return s.db.WithContext(ctx).Create(cs).Error
+}
+
+// ListChargingSessions returns the most recent charging sessions for a vehicle.
+func (s *sqlStore) ListChargingSessions(ctx context.Context, vehicleID string, limit int) ([]ChargingSession, error) {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []ChargingSession
+	if err := q.Where("vehicle_id = ?", vehicleID).Order("started_at DESC").Limit(limit).Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// VehicleTrips totals a vehicle's completed trips.
+type VehicleTrips struct {
+	VehicleID  string  `json:"vehicle_id"`
+	Trips      int64   `json:"trips"`
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// TripTotals returns per-vehicle totals of the trips that ended in
+// [from, to), longest distance first. Trips still in progress are counted
+// in the period they end in, once their distance is known.
+func (s *sqlStore) TripTotals(ctx context.Context, from, to time.Time) ([]VehicleTrips, error) {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []VehicleTrips
+	err = q.Model(&Trip{}).
+		Select("vehicle_id, COUNT(*) AS trips, COALESCE(SUM(distance_km), 0) AS distance_km").
+		Where("ended_at >= ? AND ended_at < ?", from, to).
+		Group("vehicle_id").
+		Order("distance_km DESC").
+		Find(&out).Error
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SaveAlert appends an alert to the alert history.
+func (s *sqlStore) SaveAlert(ctx context.Context, a Alert) error {
+	if s.tenant == "" {
+		return ErrNoTenant
+	}
+	rec, err := alertRow(s.tenant, a)
+	if err != nil {
+		return err
+	}
+	return s.db.WithContext(ctx).Create(&rec).Error
+}
+
+// Transaction runs fn with a Store bound to a single DB transaction.
+// Returning an error from fn rolls the transaction back.
+func (s *sqlStore) Transaction(ctx context.Context, fn func(tx Store) error) error {
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return fn(&sqlStore{db: tx, logger: s.logger, tenant: s.tenant})
+	})
+}
+
+// ReplayRange selects the vehicles and event-time window of a replay.
+// An empty vehicle list means every vehicle of the tenant.
+type ReplayRange struct {
+	Vehicles []string
+	From     time.Time // inclusive
+	To       time.Time // exclusive
+}
+
+// inRange applies rr to a query on a table whose event time lives in col.
+func (rr ReplayRange) inRange(q *gorm.DB, col string) *gorm.DB {
+	q = q.Where(col+" >= ? AND "+col+" < ?", rr.From, rr.To)
+	if len(rr.Vehicles) > 0 {
+		q = q.Where("vehicle_id IN ?", rr.Vehicles)
+	}
+	return q
+}
+
+// ListRaw returns raw telemetry in rr ordered by event time.
+func (s *sqlStore) ListRaw(ctx context.Context, rr ReplayRange) ([]TelemetryRaw, error) {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []TelemetryRaw
+	if err := rr.inRange(q, "timestamp").Order("timestamp ASC, id ASC").Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DerivedData is everything the pipeline derives from raw telemetry.
+type DerivedData struct {
+	Aggregates []Aggregate
+	Trips      []Trip
+	Sessions   []ChargingSession
+	Alerts     []AlertRecord
+}
+
+// LoadDerived reads derived data in rr. Trips and charging sessions belong
+// to the range they started in.
+func (s *sqlStore) LoadDerived(ctx context.Context, rr ReplayRange) (*DerivedData, error) {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var d DerivedData
+	if err := rr.inRange(q.Session(&gorm.Session{}), "bucket").Order("vehicle_id, bucket").Find(&d.Aggregates).Error; err != nil {
+		return nil, err
+	}
+	if err := rr.inRange(q.Session(&gorm.Session{}), "started_at").Order("vehicle_id, started_at").Find(&d.Trips).Error; err != nil {
+		return nil, err
+	}
+	if err := rr.inRange(q.Session(&gorm.Session{}), "started_at").Order("vehicle_id, started_at").Find(&d.Sessions).Error; err != nil {
+		return nil, err
+	}
+	if err := rr.inRange(q.Session(&gorm.Session{}), "ts").Order("vehicle_id, ts, id").Find(&d.Alerts).Error; err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// ResetDerived deletes derived data in rr, and raw telemetry too when
+// includeRaw is set. It returns the number of rows deleted per table.
+func (s *sqlStore) ResetDerived(ctx context.Context, rr ReplayRange, includeRaw bool) (map[string]int64, error) {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	type target struct {
+		name  string
+		model interface{}
+		col   string
+	}
+	targets := []target{
+		{"aggregates", &Aggregate{}, "bucket"},
+		{"trips", &Trip{}, "started_at"},
+		{"charging_sessions", &ChargingSession{}, "started_at"},
+		{"alerts", &AlertRecord{}, "ts"},
+	}
+	if includeRaw {
+		targets = append(targets, target{"telemetry", &TelemetryRaw{}, "timestamp"})
+	}
+	deleted := make(map[string]int64)
+	for _, t := range targets {
+		res := rr.inRange(q.Session(&gorm.Session{}), t.col).Delete(t.model)
+		if res.Error != nil {
+			return nil, res.Error
+		}
+		deleted[t.name] = res.RowsAffected
+	}
+	return deleted, nil
+}
+
 // For debug: dump aggregates for vehicle
-func (s *Store) DumpAggregates(ctx context.Context, vehicleID string) ([]Aggregate, error) {
+func (s *sqlStore) DumpAggregates(ctx context.Context, vehicleID string) ([]Aggregate, error) {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
 	var out []Aggregate
-	if err := s.db.WithContext(ctx).Where("vehicle_id = ?", vehicleID).Order("bucket DESC").Find(&out).Error; err != nil {
+	if err := q.Where("vehicle_id = ?", vehicleID).Order("bucket DESC").Find(&out).Error; err != nil {
 		return nil, err
 	}
 	return out, nil
 }
 
+// telemetryRow is the raw row ev is stored as.
+func telemetryRow(tenant string, ev TelemetryEvent) TelemetryRaw {
+	raw := TelemetryRaw{
+		TenantID:   tenant,
+		VehicleID:  ev.VehicleID,
+		Timestamp:  time.UnixMilli(ev.Ts).UTC(),
+		Speed:      ev.Speed,
+		Fuel:       ev.FuelLevel,
+		Latitude:   ev.Lat,
+		Longitude:  ev.Lon,
+		Battery:    ev.BatteryPct,
+		Charging:   ev.Charging,
+		EngineTemp: ev.EngineTemp,
+	}
+	if ev.ReceivedAt > 0 {
+		rt := time.UnixMilli(ev.ReceivedAt).UTC()
+		raw.ReceivedAt = &rt
+	}
+	return raw
+}
+
+// alertRow is the alert history row a is stored as.
+func alertRow(tenant string, a Alert) (AlertRecord, error) {
+	rec := AlertRecord{
+		TenantID:   tenant,
+		VehicleID:  a.VehicleID,
+		Ts:         a.Ts,
+		Level:      a.Level,
+		Message:    a.Message,
+		Rule:       a.Rule,
+		Confidence: a.Confidence,
+		Source:     a.Source,
+		Code:       a.Code,
+	}
+	if len(a.Params) > 0 {
+		b, err := json.Marshal(a.Params)
+		if err != nil {
+			return rec, err
+		}
+		rec.Params = string(b)
+	}
+	return rec, nil
+}
+
 // helper to log JSON structure (for debugging)
 func toJSON(v interface{}) string {
 	b, _ := json.Marshal(v)
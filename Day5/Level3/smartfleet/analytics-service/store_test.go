@@ -0,0 +1,107 @@
+package analytics
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+)
+
+// dryRunStore returns a Store whose statements are built but never executed,
+// plus a pointer to the last generated SQL.
+func dryRunStore(t *testing.T) (Store, *string) {
+	t.Helper()
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost user=test dbname=test sslmode=disable"}),
+		&gorm.Config{DryRun: true, DisableAutomaticPing: true, SkipDefaultTransaction: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var last string
+	capture := func(tx *gorm.DB) { last = tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...) }
+	_ = db.Callback().Query().After("gorm:query").Register("test:capture", capture)
+	_ = db.Callback().Create().After("gorm:create").Register("test:capture", capture)
+	_ = db.Callback().Update().After("gorm:update").Register("test:capture", capture)
+	return NewStore(db, log.New(io.Discard, "", 0)), &last
+}
+
+func TestStoreQueriesFilterByTenant(t *testing.T) {
+	store, last := dryRunStore(t)
+	ctx := context.Background()
+	a := store.ForTenant("tenant-a")
+
+	if _, err := a.GetActiveTrip(ctx, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(*last, "tenant_id = 'tenant-a'") {
+		t.Fatalf("GetActiveTrip not tenant scoped: %s", *last)
+	}
+
+	if _, err := a.DumpAggregates(ctx, "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(*last, "tenant_id = 'tenant-a'") {
+		t.Fatalf("DumpAggregates not tenant scoped: %s", *last)
+	}
+
+	if _, err := a.TripTotals(ctx, time.Unix(0, 0), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(*last, "tenant_id = 'tenant-a'") || !strings.Contains(*last, "GROUP BY") {
+		t.Fatalf("TripTotals not tenant scoped: %s", *last)
+	}
+}
+
+func TestStoreWritesStampTenant(t *testing.T) {
+	store, last := dryRunStore(t)
+	ctx := context.Background()
+	ev := TelemetryEvent{VehicleID: "v1", Speed: 50, FuelLevel: 40, Ts: 1700000000000}
+
+	if err := store.ForTenant("tenant-b").InsertTelemetry(ctx, ev); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(*last, "'tenant-b'") {
+		t.Fatalf("InsertTelemetry did not stamp tenant: %s", *last)
+	}
+
+	if err := store.ForTenant("tenant-b").UpsertAggregate(ctx, ev); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(*last, `ON CONFLICT ("tenant_id","vehicle_id","bucket")`) {
+		t.Fatalf("aggregate upsert conflict target not tenant scoped: %s", *last)
+	}
+}
+
+func TestStoreRejectsCrossTenantAccess(t *testing.T) {
+	store, _ := dryRunStore(t)
+	ctx := context.Background()
+
+	if _, err := store.GetActiveTrip(ctx, "v1"); !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("unscoped read err = %v, want ErrNoTenant", err)
+	}
+	if err := store.InsertTelemetry(ctx, TelemetryEvent{VehicleID: "v1"}); !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("unscoped write err = %v, want ErrNoTenant", err)
+	}
+	// a trip loaded for tenant-a cannot be saved through tenant-b's store
+	trip := &Trip{ID: 7, TenantID: "tenant-a", VehicleID: "v1"}
+	if err := store.ForTenant("tenant-b").SaveOrUpdateTrip(ctx, trip); !errors.Is(err, ErrNoTenant) {
+		t.Fatalf("cross-tenant save err = %v, want ErrNoTenant", err)
+	}
+}
+
+func TestTripStateIsolatedPerTenant(t *testing.T) {
+	tsm := NewTripStateMap()
+	a := tsm.GetOrCreate("tenant-a", "v1")
+	b := tsm.GetOrCreate("tenant-b", "v1")
+	if a == b {
+		t.Fatal("same vehicle ID in two tenants shares trip state")
+	}
+	if tsm.GetOrCreate("tenant-a", "v1") != a {
+		t.Fatal("trip state not reused within a tenant")
+	}
+}
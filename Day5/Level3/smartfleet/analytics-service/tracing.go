@@ -0,0 +1,120 @@
+package analytics
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"smartfleet/common/tracing"
+)
+
+var tracer = otel.Tracer("smartfleet/analytics-service")
+
+// TracedStore returns s with a client span around every call, named after
+// the method, e.g. "store InsertTelemetry". system is the db.system of s:
+// "postgresql", or "memory" for a MemoryStore.
+func TracedStore(s Store, system string) Store {
+	return &tracedStore{next: s, system: system}
+}
+
+type tracedStore struct {
+	next   Store
+	system string
+	tenant string
+}
+
+func (s *tracedStore) start(ctx context.Context, op string) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{semconv.DBSystemKey.String(s.system), semconv.DBOperationName(op)}
+	if s.tenant != "" {
+		attrs = append(attrs, attribute.String("smartfleet.tenant", s.tenant))
+	}
+	return tracer.Start(ctx, "store "+op, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (s *tracedStore) ForTenant(tenant string) Store {
+	return &tracedStore{next: s.next.ForTenant(tenant), system: s.system, tenant: tenant}
+}
+
+func (s *tracedStore) Transaction(ctx context.Context, fn func(tx Store) error) (err error) {
+	ctx, span := s.start(ctx, "Transaction")
+	defer func() { tracing.End(span, err) }()
+	return s.next.Transaction(ctx, func(tx Store) error {
+		return fn(&tracedStore{next: tx, system: s.system, tenant: s.tenant})
+	})
+}
+
+func (s *tracedStore) InsertTelemetry(ctx context.Context, ev TelemetryEvent) (err error) {
+	ctx, span := s.start(ctx, "InsertTelemetry")
+	defer func() { tracing.End(span, err) }()
+	return s.next.InsertTelemetry(ctx, ev)
+}
+
+func (s *tracedStore) UpsertAggregate(ctx context.Context, ev TelemetryEvent) (err error) {
+	ctx, span := s.start(ctx, "UpsertAggregate")
+	defer func() { tracing.End(span, err) }()
+	return s.next.UpsertAggregate(ctx, ev)
+}
+
+func (s *tracedStore) SaveOrUpdateTrip(ctx context.Context, trip *Trip) (err error) {
+	ctx, span := s.start(ctx, "SaveOrUpdateTrip")
+	defer func() { tracing.End(span, err) }()
+	return s.next.SaveOrUpdateTrip(ctx, trip)
+}
+
+func (s *tracedStore) GetActiveTrip(ctx context.Context, vehicleID string) (_ *Trip, err error) {
+	ctx, span := s.start(ctx, "GetActiveTrip")
+	defer func() { tracing.End(span, err) }()
+	return s.next.GetActiveTrip(ctx, vehicleID)
+}
+
+func (s *tracedStore) SaveChargingSession(ctx context.Context, cs *ChargingSession) (err error) {
+	ctx, span := s.start(ctx, "SaveChargingSession")
+	defer func() { tracing.End(span, err) }()
+	return s.next.SaveChargingSession(ctx, cs)
+}
+
+func (s *tracedStore) ListChargingSessions(ctx context.Context, vehicleID string, limit int) (_ []ChargingSession, err error) {
+	ctx, span := s.start(ctx, "ListChargingSessions")
+	defer func() { tracing.End(span, err) }()
+	return s.next.ListChargingSessions(ctx, vehicleID, limit)
+}
+
+func (s *tracedStore) TripTotals(ctx context.Context, from, to time.Time) (_ []VehicleTrips, err error) {
+	ctx, span := s.start(ctx, "TripTotals")
+	defer func() { tracing.End(span, err) }()
+	return s.next.TripTotals(ctx, from, to)
+}
+
+func (s *tracedStore) SaveAlert(ctx context.Context, a Alert) (err error) {
+	ctx, span := s.start(ctx, "SaveAlert")
+	defer func() { tracing.End(span, err) }()
+	return s.next.SaveAlert(ctx, a)
+}
+
+func (s *tracedStore) DumpAggregates(ctx context.Context, vehicleID string) (_ []Aggregate, err error) {
+	ctx, span := s.start(ctx, "DumpAggregates")
+	defer func() { tracing.End(span, err) }()
+	return s.next.DumpAggregates(ctx, vehicleID)
+}
+
+func (s *tracedStore) ListRaw(ctx context.Context, rr ReplayRange) (_ []TelemetryRaw, err error) {
+	ctx, span := s.start(ctx, "ListRaw")
+	defer func() { tracing.End(span, err) }()
+	return s.next.ListRaw(ctx, rr)
+}
+
+func (s *tracedStore) LoadDerived(ctx context.Context, rr ReplayRange) (_ *DerivedData, err error) {
+	ctx, span := s.start(ctx, "LoadDerived")
+	defer func() { tracing.End(span, err) }()
+	return s.next.LoadDerived(ctx, rr)
+}
+
+func (s *tracedStore) ResetDerived(ctx context.Context, rr ReplayRange, includeRaw bool) (_ map[string]int64, err error) {
+	ctx, span := s.start(ctx, "ResetDerived")
+	defer func() { tracing.End(span, err) }()
+	return s.next.ResetDerived(ctx, rr, includeRaw)
+}
@@ -1,4 +1,4 @@
-package analyticsservice
+package analytics
 
 import (
 	"math"
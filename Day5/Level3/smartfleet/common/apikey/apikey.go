@@ -0,0 +1,83 @@
+// Package apikey authenticates the HTTP callers of the smartfleet services
+// and tells which tenant they act for. Each API key belongs to one tenant;
+// a service token lets internal callers act for the tenant they name.
+package apikey
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// ErrUnauthenticated is returned for a request without a known credential.
+var ErrUnauthenticated = errors.New("missing or invalid api key")
+
+// Auth maps API keys to tenant IDs. A separate service token lets internal
+// callers (e.g. telemetry-service lookups, notification-service digests)
+// act for any tenant via X-Tenant-ID. With no keys and no service token
+// configured, every request is rejected unless dev mode is on; then
+// X-Tenant-ID is trusted and falls back to the default tenant.
+type Auth struct {
+	keys          map[string]string
+	serviceToken  string
+	defaultTenant string
+	devMode       bool
+}
+
+// New parses a "key1=tenantA,key2=tenantB" spec. An empty serviceToken
+// accepts API keys only. devMode only matters when spec and serviceToken
+// are both empty.
+func New(spec, serviceToken, defaultTenant string, devMode bool) (*Auth, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		k, t, ok := strings.Cut(pair, "=")
+		k, t = strings.TrimSpace(k), strings.TrimSpace(t)
+		if !ok || k == "" || t == "" {
+			return nil, errors.New("invalid api key entry (want key=tenant)")
+		}
+		keys[k] = t
+	}
+	return &Auth{keys: keys, serviceToken: serviceToken, defaultTenant: defaultTenant, devMode: devMode}, nil
+}
+
+// Enabled reports whether credentials are enforced.
+func (a *Auth) Enabled() bool { return len(a.keys) > 0 || a.serviceToken != "" }
+
+// DevMode reports whether X-Tenant-ID is trusted without credentials.
+func (a *Auth) DevMode() bool { return a.devMode && !a.Enabled() }
+
+// TenantFromRequest authenticates the request credential and returns its tenant.
+// The key is read from "Authorization: Bearer <key>" or "X-API-Key", never
+// from the URL, where it would end up in access logs.
+func (a *Auth) TenantFromRequest(r *http.Request) (string, error) {
+	if !a.Enabled() {
+		if !a.devMode {
+			return "", ErrUnauthenticated
+		}
+		if t := r.Header.Get("X-Tenant-ID"); t != "" {
+			return t, nil
+		}
+		return a.defaultTenant, nil
+	}
+	key := r.Header.Get("X-API-Key")
+	if h := r.Header.Get("Authorization"); key == "" && strings.HasPrefix(h, "Bearer ") {
+		key = strings.TrimPrefix(h, "Bearer ")
+	}
+	if key == "" {
+		return "", ErrUnauthenticated
+	}
+	if a.serviceToken != "" && key == a.serviceToken {
+		if t := r.Header.Get("X-Tenant-ID"); t != "" {
+			return t, nil
+		}
+		return "", errors.New("X-Tenant-ID required for service token")
+	}
+	if t, ok := a.keys[key]; ok {
+		return t, nil
+	}
+	return "", ErrUnauthenticated
+}
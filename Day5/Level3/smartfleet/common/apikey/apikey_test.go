@@ -0,0 +1,98 @@
+package apikey
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTenantFromRequest(t *testing.T) {
+	auth, err := New("key-a=tenant-a, key-b=tenant-b", "svc", "default", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		header  []string // name, value pairs
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{"bearer a", []string{"Authorization", "Bearer key-a"}, "", "tenant-a", false},
+		{"api key b", []string{"X-API-Key", "key-b"}, "", "tenant-b", false},
+		{"missing", nil, "", "", true},
+		{"unknown", []string{"X-API-Key", "key-c"}, "", "", true},
+		{"tenant name is not a key", []string{"X-API-Key", "tenant-a"}, "", "", true},
+		{"key in url", nil, "?token=key-a", "", true},
+		{"X-Tenant-ID does not change a key's tenant", []string{"X-API-Key", "key-a", "X-Tenant-ID", "tenant-b"}, "", "tenant-a", false},
+		{"service token", []string{"Authorization", "Bearer svc", "X-Tenant-ID", "tenant-b"}, "", "tenant-b", false},
+		{"service token without tenant", []string{"Authorization", "Bearer svc"}, "", "", true},
+		{"X-Tenant-ID alone", []string{"X-Tenant-ID", "tenant-a"}, "", "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/"+tc.query, nil)
+			for i := 0; i+1 < len(tc.header); i += 2 {
+				req.Header.Set(tc.header[i], tc.header[i+1])
+			}
+			got, err := auth.TenantFromRequest(req)
+			if (err != nil) != tc.wantErr || got != tc.want {
+				t.Fatalf("TenantFromRequest = %q, %v; want %q (err=%v)", got, err, tc.want, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestWithoutServiceToken(t *testing.T) {
+	auth, _ := New("key-a=tenant-a", "", "default", false)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer ")
+	req.Header.Set("X-Tenant-ID", "tenant-a")
+	if got, err := auth.TenantFromRequest(req); err == nil {
+		t.Fatalf("empty bearer token accepted as service token for %q", got)
+	}
+}
+
+func TestDevModeUsesDefault(t *testing.T) {
+	auth, _ := New("", "", "default", true)
+	if auth.Enabled() || !auth.DevMode() {
+		t.Fatalf("Enabled %v, DevMode %v; want dev mode", auth.Enabled(), auth.DevMode())
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if got, err := auth.TenantFromRequest(req); err != nil || got != "default" {
+		t.Fatalf("TenantFromRequest = %q, %v", got, err)
+	}
+	req.Header.Set("X-Tenant-ID", "tenant-a")
+	if got, err := auth.TenantFromRequest(req); err != nil || got != "tenant-a" {
+		t.Fatalf("TenantFromRequest with X-Tenant-ID = %q, %v", got, err)
+	}
+}
+
+func TestNoCredentialsRejectsWithoutDevMode(t *testing.T) {
+	auth, _ := New("", "", "default", false)
+	if auth.Enabled() || auth.DevMode() {
+		t.Fatalf("Enabled %v, DevMode %v without credentials or dev mode", auth.Enabled(), auth.DevMode())
+	}
+	for _, tenant := range []string{"", "tenant-a"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if tenant != "" {
+			req.Header.Set("X-Tenant-ID", tenant)
+		}
+		if got, err := auth.TenantFromRequest(req); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("X-Tenant-ID %q: TenantFromRequest = %q, %v; want ErrUnauthenticated", tenant, got, err)
+		}
+	}
+	// dev mode does not loosen configured keys
+	if auth, _ := New("key-a=tenant-a", "", "default", true); auth.DevMode() {
+		t.Error("DevMode with API keys configured")
+	}
+}
+
+func TestNewRejectsBadSpec(t *testing.T) {
+	for _, spec := range []string{"key-a", "=tenant-a", "key-a=", "key-a=tenant-a,oops"} {
+		if _, err := New(spec, "", "default", false); err == nil {
+			t.Errorf("New(%q) accepted", spec)
+		}
+	}
+}
@@ -0,0 +1,515 @@
+// Package config loads a service's typed configuration from, in rising
+// order of precedence, defaults, an optional YAML file, the environment and
+// command-line flags.
+//
+// A configuration is a struct whose fields carry tags:
+//
+//	env:"HTTP_ADDR"        environment variable
+//	yaml:"http_addr"       key in the YAML file; also names the flag, -http-addr
+//	default:":8081"        value when no source sets one
+//	unit:"s"               unit of bare numbers for a time.Duration: ms, s, m or h
+//	secret:"true"          redacted when the configuration is printed
+//	required:"true"        must not be empty
+//	oneof:"stream pubsub"  the allowed values, or empty unless required
+//	help:"..."             flag usage
+//
+// Struct fields nest: their keys are a YAML mapping, and their flags are
+// prefixed with the key, e.g. -kafka-brokers. A nested struct tagged
+// envprefix:"KAFKA_" prefixes the variables of its fields, so one type such
+// as TLS serves several clients. Fields may be strings, bools,
+// ints, int64s, float64s, time.Durations, Sizes and []strings, which are
+// comma-separated in the environment and on the command line. A
+// configuration with a Validate method has it called last.
+//
+// Every service accepts -config (or CONFIG_FILE) naming the YAML file, and
+// -print-config, which prints the effective configuration with secrets
+// redacted and exits.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrPrinted is returned by Load after -print-config printed the configuration.
+var ErrPrinted = errors.New("configuration printed")
+
+// Sources are where Load reads configuration from besides defaults.
+type Sources struct {
+	Args   []string                          // command-line arguments, without the program name
+	Lookup func(key string) (string, bool)   // environment; nil uses os.LookupEnv
+	Output io.Writer                         // -print-config and flag usage; nil uses os.Stdout
+	Open   func(name string) ([]byte, error) // reads the YAML file; nil uses os.ReadFile
+}
+
+// field is one leaf setting of a configuration.
+type field struct {
+	v     reflect.Value
+	path  []string // YAML keys from the root
+	env   string
+	def   string
+	unit  time.Duration
+	help  string
+	oneof []string
+
+	secret, required bool
+}
+
+func (f *field) key() string  { return strings.Join(f.path, ".") }
+func (f *field) flag() string { return strings.ReplaceAll(strings.Join(f.path, "-"), "_", "-") }
+
+// name is how errors refer to the field.
+func (f *field) name() string {
+	if f.env != "" {
+		return f.env
+	}
+	return f.key()
+}
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	sizeType     = reflect.TypeOf(Size(0))
+)
+
+// fields lists the settings of the struct cfg points to.
+func fields(cfg interface{}) ([]*field, error) {
+	rv := reflect.ValueOf(cfg)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("config: want a pointer to a struct, got %T", cfg)
+	}
+	var out []*field
+	err := collect(rv.Elem(), nil, "", &out)
+	return out, err
+}
+
+func collect(rv reflect.Value, path []string, envPrefix string, out *[]*field) error {
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if !sf.IsExported() {
+			continue
+		}
+		key, _, _ := strings.Cut(sf.Tag.Get("yaml"), ",")
+		if key == "-" {
+			continue
+		}
+		if key == "" {
+			key = strings.ToLower(sf.Name)
+		}
+		p := append(append([]string(nil), path...), key)
+		if sf.Type.Kind() == reflect.Struct {
+			if err := collect(rv.Field(i), p, envPrefix+sf.Tag.Get("envprefix"), out); err != nil {
+				return err
+			}
+			continue
+		}
+		f := &field{
+			v:        rv.Field(i),
+			path:     p,
+			env:      sf.Tag.Get("env"),
+			def:      sf.Tag.Get("default"),
+			help:     sf.Tag.Get("help"),
+			secret:   sf.Tag.Get("secret") == "true",
+			required: sf.Tag.Get("required") == "true",
+		}
+		if f.env != "" {
+			f.env = envPrefix + f.env
+		}
+		if s := sf.Tag.Get("oneof"); s != "" {
+			f.oneof = strings.Fields(s)
+		}
+		if u := sf.Tag.Get("unit"); u != "" {
+			d, err := time.ParseDuration("1" + u)
+			if err != nil {
+				return fmt.Errorf("config: %s: bad unit %q", f.key(), u)
+			}
+			f.unit = d
+		}
+		switch sf.Type.Kind() {
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		case reflect.Slice:
+			if sf.Type.Elem().Kind() != reflect.String {
+				return fmt.Errorf("config: %s: unsupported type %s", f.key(), sf.Type)
+			}
+		default:
+			return fmt.Errorf("config: %s: unsupported type %s", f.key(), sf.Type)
+		}
+		*out = append(*out, f)
+	}
+	return nil
+}
+
+// set parses s into the field.
+func (f *field) set(s string) error {
+	s = strings.TrimSpace(s)
+	v := f.v
+	switch {
+	case v.Type() == durationType:
+		d, err := ParseDuration(s, f.unit)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Type() == sizeType:
+		n, err := ParseSize(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid bool %q", s)
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int, v.Kind() == reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case v.Kind() == reflect.Float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetFloat(x)
+	case v.Kind() == reflect.Slice:
+		var list []string
+		for _, item := range strings.Split(s, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	}
+	return nil
+}
+
+// String formats the field as set parses it.
+func (f *field) String() string {
+	v := f.v
+	switch {
+	case v.Type() == durationType:
+		return time.Duration(v.Int()).String()
+	case v.Type() == sizeType:
+		return Size(v.Int()).String()
+	case v.Kind() == reflect.Slice:
+		return strings.Join(v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func (f *field) empty() bool { return f.v.IsZero() }
+
+// Default returns a T with the defaults of its tags. Defaults are part of
+// the program, so a bad one panics.
+func Default[T any]() T {
+	var cfg T
+	fs, err := fields(&cfg)
+	if err == nil {
+		err = applyDefaults(fs)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return cfg
+}
+
+func applyDefaults(fs []*field) error {
+	for _, f := range fs {
+		if f.def == "" {
+			continue
+		}
+		if err := f.set(f.def); err != nil {
+			return fmt.Errorf("config: default of %s: %w", f.name(), err)
+		}
+	}
+	return nil
+}
+
+// flagValue records a flag for applying after the file and the environment.
+type flagValue struct {
+	f   *field
+	set *[]func() error
+}
+
+func (fv flagValue) String() string {
+	if fv.f == nil {
+		return ""
+	}
+	return fv.f.redacted() // shown as the default in usage
+}
+
+func (fv flagValue) Set(s string) error {
+	f := fv.f
+	*fv.set = append(*fv.set, func() error { return f.set(s) })
+	return nil
+}
+
+func (fv flagValue) IsBoolFlag() bool { return fv.f != nil && fv.f.v.Kind() == reflect.Bool }
+
+// Load fills the struct cfg points to from its defaults and src. name is
+// the program name for usage and errors. After -print-config it returns
+// ErrPrinted, and after -help flag.ErrHelp.
+func Load(name string, cfg interface{}, src Sources) error {
+	fs, err := fields(cfg)
+	if err != nil {
+		return err
+	}
+	lookup := src.Lookup
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	out := src.Output
+	if out == nil {
+		out = os.Stdout
+	}
+	open := src.Open
+	if open == nil {
+		open = os.ReadFile
+	}
+	getenv := func(k string) string {
+		v, _ := lookup(k)
+		return v // empty counts as unset, as it always has
+	}
+
+	// defaults first, so flag usage shows them
+	if err := applyDefaults(fs); err != nil {
+		return err
+	}
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	var pending []func() error
+	for _, f := range fs {
+		usage := f.help
+		if f.env != "" {
+			usage = strings.TrimSpace(usage + " ($" + f.env + ")")
+		}
+		flags.Var(flagValue{f, &pending}, f.flag(), usage)
+	}
+	file := flags.String("config", getenv("CONFIG_FILE"), "YAML configuration file ($CONFIG_FILE)")
+	printConfig := flags.Bool("print-config", false, "print the effective configuration, secrets redacted, and exit")
+	if err := flags.Parse(src.Args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		return fmt.Errorf("%s: unexpected argument %q", name, flags.Arg(0))
+	}
+
+	if *file != "" {
+		data, err := open(*file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if err := applyYAML(fs, data); err != nil {
+			return fmt.Errorf("%s: %s: %w", name, *file, err)
+		}
+	}
+	var errs []error
+	for _, f := range fs {
+		if v := getenv(f.env); f.env != "" && v != "" {
+			if err := f.set(v); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", f.env, err))
+			}
+		}
+	}
+	for _, apply := range pending {
+		if err := apply(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		errs = validate(fs, cfg)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%s: invalid configuration: %w", name, errors.Join(errs...))
+	}
+	if *printConfig {
+		if err := Print(out, cfg); err != nil {
+			return err
+		}
+		return ErrPrinted
+	}
+	return nil
+}
+
+// MustLoad is Load from the process arguments and environment. It exits
+// after -print-config and -help, and on an invalid configuration.
+func MustLoad(name string, cfg interface{}) {
+	err := Load(name, cfg, Sources{Args: os.Args[1:]})
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrPrinted), errors.Is(err, flag.ErrHelp):
+		os.Exit(0)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+}
+
+func validate(fs []*field, cfg interface{}) []error {
+	var errs []error
+	for _, f := range fs {
+		if f.required && f.empty() {
+			errs = append(errs, fmt.Errorf("%s is required", f.name()))
+			continue
+		}
+		if len(f.oneof) > 0 && !f.empty() {
+			ok := false
+			for _, o := range f.oneof {
+				ok = ok || f.String() == o
+			}
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s is %q, want one of %s", f.name(), f.String(), strings.Join(f.oneof, ", ")))
+			}
+		}
+	}
+	if v, ok := cfg.(interface{ Validate() error }); ok && len(errs) == 0 {
+		if err := v.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+// applyYAML sets the fields the YAML document names. Unknown keys are
+// errors, so a misspelt setting is not silently ignored.
+func applyYAML(fs []*field, data []byte) error {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	byKey := make(map[string]*field, len(fs))
+	for _, f := range fs {
+		byKey[f.key()] = f
+	}
+	var walk func(prefix string, m map[string]interface{}) error
+	walk = func(prefix string, m map[string]interface{}) error {
+		for k, v := range m {
+			key := prefix + k
+			if sub, ok := v.(map[string]interface{}); ok {
+				if err := walk(key+".", sub); err != nil {
+					return err
+				}
+				continue
+			}
+			f, ok := byKey[key]
+			if !ok {
+				return fmt.Errorf("unknown setting %q", key)
+			}
+			if err := f.set(yamlString(v)); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		return nil
+	}
+	return walk("", doc)
+}
+
+// yamlString renders a YAML value the way it would be written in the
+// environment.
+func yamlString(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			items[i] = fmt.Sprint(item)
+		}
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// Print writes the configuration as YAML, each setting annotated with its
+// environment variable. Secrets are redacted, as are passwords in URLs.
+func Print(w io.Writer, cfg interface{}) error {
+	fs, err := fields(cfg)
+	if err != nil {
+		return err
+	}
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	maps := map[string]*yaml.Node{"": root}
+	for _, f := range fs {
+		parent := root
+		for i := range f.path[:len(f.path)-1] {
+			k := strings.Join(f.path[:i+1], ".")
+			m, ok := maps[k]
+			if !ok {
+				m = &yaml.Node{Kind: yaml.MappingNode}
+				parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.path[i]}, m)
+				maps[k] = m
+			}
+			parent = m
+		}
+		val := &yaml.Node{Kind: yaml.ScalarNode, Value: f.redacted(), Tag: "!!str"}
+		switch f.v.Kind() {
+		case reflect.Bool:
+			val.Tag = "!!bool"
+		case reflect.Float64:
+			val.Tag = "!!float"
+		case reflect.Int, reflect.Int64:
+			if f.v.Type() != durationType && f.v.Type() != sizeType {
+				val.Tag = "!!int"
+			}
+		}
+		if f.env != "" {
+			val.LineComment = f.env
+		}
+		parent.Content = append(parent.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: f.path[len(f.path)-1]}, val)
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// redactedValue replaces secret values when printing.
+const redactedValue = "[redacted]"
+
+// redacted returns the field's value as -print-config shows it.
+func (f *field) redacted() string {
+	s := f.String()
+	if f.secret && s != "" {
+		return redactedValue
+	}
+	if u, err := url.Parse(s); err == nil && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+	return s
+}
+
+// ParseDuration parses a Go duration such as "90s" or "1h30m". A bare
+// number is in unit, so settings that were numbers of seconds keep working;
+// without a unit it is an error.
+func ParseDuration(s string, unit time.Duration) (time.Duration, error) {
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		if unit == 0 && n != 0 {
+			return 0, fmt.Errorf("duration %q needs a unit", s)
+		}
+		return time.Duration(n * float64(unit)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
@@ -0,0 +1,146 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	HTTPAddr  string        `yaml:"http_addr" env:"HTTP_ADDR" default:":8080"`
+	TTL       time.Duration `yaml:"ttl" env:"TTL_SECONDS" default:"300" unit:"s"`
+	MaxBytes  Size          `yaml:"max_bytes" env:"MAX_BYTES" default:"1MiB"`
+	Transport string        `yaml:"transport" env:"TRANSPORT" default:"stream" oneof:"stream pubsub"`
+	APIKeys   string        `yaml:"api_keys" env:"API_KEYS" secret:"true"`
+	Verbose   bool          `yaml:"verbose" env:"VERBOSE"`
+	Kafka     Kafka         `yaml:"kafka"`
+	Postgres  Postgres      `yaml:"postgres"`
+	Workers   int           `yaml:"workers" env:"WORKERS" default:"4"`
+}
+
+func (c *testConfig) Validate() error {
+	if c.Workers < 1 {
+		return errors.New("WORKERS must be at least 1")
+	}
+	return nil
+}
+
+func env(m map[string]string) func(string) (string, bool) {
+	return func(k string) (string, bool) { v, ok := m[k]; return v, ok }
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := []byte("http_addr: \":9000\"\nttl: 2m\nkafka:\n  brokers: [a:9092, b:9092]\nworkers: 2\n")
+	var c testConfig
+	err := Load("svc", &c, Sources{
+		Args:   []string{"-config", "svc.yaml", "-workers", "8", "-verbose"},
+		Lookup: env(map[string]string{"TTL_SECONDS": "90", "HTTP_ADDR": "", "MAX_BYTES": "10MB"}),
+		Open:   func(string) ([]byte, error) { return file, nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testConfig{
+		HTTPAddr:  ":9000",          // file; the empty variable counts as unset
+		TTL:       90 * time.Second, // environment over file
+		MaxBytes:  10e6,
+		Transport: "stream",
+		Verbose:   true,
+		Kafka:     Kafka{Brokers: []string{"a:9092", "b:9092"}, Topic: "telemetry.events"},
+		Postgres:  Default[testConfig]().Postgres,
+		Workers:   8, // flag over file
+	}
+	if c.HTTPAddr != want.HTTPAddr || c.TTL != want.TTL || c.MaxBytes != want.MaxBytes || c.Transport != want.Transport ||
+		!c.Verbose || strings.Join(c.Kafka.Brokers, ",") != "a:9092,b:9092" || c.Kafka.Topic != want.Kafka.Topic ||
+		c.Postgres != want.Postgres || c.Workers != want.Workers {
+		t.Errorf("config = %+v\nwant     %+v", c, want)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		env  map[string]string
+		args []string
+		file string
+		want string
+	}{
+		{"bad duration", map[string]string{"TTL_SECONDS": "soon"}, nil, "", "TTL_SECONDS"},
+		{"not one of", map[string]string{"TRANSPORT": "carrier-pigeon"}, nil, "", "want one of stream, pubsub"},
+		{"validate", nil, []string{"-workers", "0"}, "", "at least 1"},
+		{"bad size", map[string]string{"MAX_BYTES": "lots"}, nil, "", "invalid size"},
+		{"unknown key", nil, []string{"-config", "f"}, "kafka:\n  broker: x\n", `unknown setting "kafka.broker"`},
+		{"extra argument", nil, []string{"serve"}, "", "unexpected argument"},
+		{"sasl mechanism", map[string]string{"KAFKA_SASL_MECHANISM": "gssapi"}, nil, "", "want one of plain"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var c testConfig
+			err := Load("svc", &c, Sources{
+				Args:   tc.args,
+				Lookup: env(tc.env),
+				Output: &bytes.Buffer{},
+				Open:   func(string) ([]byte, error) { return []byte(tc.file), nil },
+			})
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("err = %v, want it to mention %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadPrefixedSections(t *testing.T) {
+	var c testConfig
+	err := Load("svc", &c, Sources{
+		Lookup: env(map[string]string{"KAFKA_CONNECT_ATTEMPTS": "3", "KAFKA_TLS": "true", "KAFKA_TLS_CA_FILE": "/etc/ca.pem", "POSTGRES_CONNECT_BACKOFF": "1s"}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Kafka.Retry.Attempts != 3 || !c.Kafka.TLS.Enabled || c.Kafka.TLS.CAFile != "/etc/ca.pem" || c.Kafka.SASL.Mechanism != "" {
+		t.Errorf("kafka = %+v", c.Kafka)
+	}
+	if c.Postgres.Retry.Backoff != time.Second || c.Postgres.Retry.Attempts != 10 {
+		t.Errorf("postgres retry = %+v", c.Postgres.Retry)
+	}
+}
+
+func TestPrintConfigRedacts(t *testing.T) {
+	var out bytes.Buffer
+	var c testConfig
+	err := Load("svc", &c, Sources{
+		Args:   []string{"-print-config"},
+		Lookup: env(map[string]string{"API_KEYS": "k1=tenant-a"}),
+		Output: &out,
+	})
+	if !errors.Is(err, ErrPrinted) {
+		t.Fatalf("err = %v", err)
+	}
+	s := out.String()
+	for _, leak := range []string{"k1=tenant-a", ":password@"} {
+		if strings.Contains(s, leak) {
+			t.Errorf("printed config leaks %q:\n%s", leak, s)
+		}
+	}
+	for _, want := range []string{"api_keys: '[redacted]' # API_KEYS", "ttl: 5m0s", "max_bytes: 1MiB", "brokers: kafka:9092", "fleetadmin:xxxxx@postgres"} {
+		if !strings.Contains(s, want) {
+			t.Errorf("printed config lacks %q:\n%s", want, s)
+		}
+	}
+}
+
+func TestSize(t *testing.T) {
+	for s, want := range map[string]Size{"4096": 4096, "10MB": 10e6, "512KiB": 512 << 10, "1.5GB": 1.5e9, "2 mib": 2 << 20} {
+		if got, err := ParseSize(s); err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", s, got, err, want)
+		}
+	}
+	if s := Size(10 << 20).String(); s != "10MiB" {
+		t.Errorf("String = %s", s)
+	}
+	if _, err := ParseDuration("30", 0); err == nil {
+		t.Error("a bare number without a unit was accepted")
+	}
+}
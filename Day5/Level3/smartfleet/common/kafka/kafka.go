@@ -1,36 +1,141 @@
-
+// Package kafka builds the Kafka producers and consumers of the smartfleet
+// services from a config.Kafka: TLS and SASL, a wait for the brokers at
+// startup, and errors logged with the service's logger.
 package kafka
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
-	"os"
 	"time"
 
 	"github.com/segmentio/kafka-go"
-)
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
 
-// Configurable via env
-var (
-	KafkaBroker = getenv("KAFKA_BROKER", "localhost:9092")
+	"smartfleet/common/config"
+	"smartfleet/common/lifecycle"
 )
 
-func getenv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+func mechanism(cfg config.SASL) (sasl.Mechanism, error) {
+	switch cfg.Mechanism {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: cfg.Username, Password: cfg.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, cfg.Username, cfg.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, cfg.Username, cfg.Password)
+	}
+	return nil, fmt.Errorf("kafka: unknown SASL mechanism %q", cfg.Mechanism)
+}
+
+// Dialer returns a dialer with the TLS and SASL settings of cfg, for
+// readers and direct connections.
+func Dialer(cfg config.Kafka) (*kafka.Dialer, error) {
+	tlsConfig, err := cfg.TLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	m, err := mechanism(cfg.SASL)
+	if err != nil {
+		return nil, err
+	}
+	return &kafka.Dialer{Timeout: 10 * time.Second, DualStack: true, TLS: tlsConfig, SASLMechanism: m}, nil
+}
+
+// Ping checks that a broker of cfg answers with the cluster's metadata.
+func Ping(ctx context.Context, cfg config.Kafka) error {
+	d, err := Dialer(cfg)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, addr := range cfg.Brokers {
+		conn, err := d.DialContext(ctx, "tcp", addr)
+		if err == nil {
+			_, err = conn.Brokers()
+			conn.Close()
+		}
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errors.New("kafka: no brokers configured")
+	}
+	return errors.Join(errs...)
+}
+
+// errorLogger adapts the service logger to kafka-go's error logging.
+func errorLogger(logger *log.Logger) kafka.Logger {
+	if logger == nil {
+		return nil
 	}
-	return def
+	return kafka.LoggerFunc(func(msg string, args ...interface{}) {
+		logger.Printf("kafka: "+msg, args...)
+	})
 }
 
-// NewProducer returns a Kafka writer (producer)
-func NewProducer(topic string) *kafka.Writer {
+// NewProducer returns a synchronous writer for topic, keyed by message key
+// so each vehicle's events stay in order, once a broker answers. Close
+// flushes what is still buffered.
+func NewProducer(ctx context.Context, cfg config.Kafka, topic string, logger *log.Logger) (*kafka.Writer, error) {
+	tlsConfig, err := cfg.TLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("kafka: %w", err)
+	}
+	m, err := mechanism(cfg.SASL)
+	if err != nil {
+		return nil, err
+	}
+	if err := lifecycle.Connect(ctx, "kafka", cfg.Retry, logger, func(ctx context.Context) error { return Ping(ctx, cfg) }); err != nil {
+		return nil, err
+	}
 	return &kafka.Writer{
-		Addr:         kafka.TCP(KafkaBroker),
+		Addr:         kafka.TCP(cfg.Brokers...),
 		Topic:        topic,
-		Balancer:     &kafka.LeastBytes{},
+		Balancer:     &kafka.Hash{},
 		RequiredAcks: kafka.RequireAll,
-		Async:        false,
+		BatchTimeout: 10 * time.Millisecond, // writes are synchronous: do not hold them for a batch
+		Transport:    &kafka.Transport{TLS: tlsConfig, SASL: m},
+		ErrorLogger:  errorLogger(logger),
+	}, nil
+}
+
+// ReaderConfig is the base configuration of a reader of topic; callers set
+// a GroupID or a Partition.
+func ReaderConfig(cfg config.Kafka, topic string, logger *log.Logger) (kafka.ReaderConfig, error) {
+	d, err := Dialer(cfg)
+	if err != nil {
+		return kafka.ReaderConfig{}, err
+	}
+	return kafka.ReaderConfig{
+		Brokers:     cfg.Brokers,
+		Topic:       topic,
+		Dialer:      d,
+		MinBytes:    1e3, // 1KB
+		MaxBytes:    int(cfg.MaxBytes),
+		ErrorLogger: errorLogger(logger),
+	}, nil
+}
+
+// NewConsumer returns a reader of topic in consumer group groupID, once a
+// broker answers. Close leaves the group.
+func NewConsumer(ctx context.Context, cfg config.Kafka, topic, groupID string, logger *log.Logger) (*kafka.Reader, error) {
+	rc, err := ReaderConfig(cfg, topic, logger)
+	if err != nil {
+		return nil, err
+	}
+	rc.GroupID = groupID
+	if err := lifecycle.Connect(ctx, "kafka", cfg.Retry, logger, func(ctx context.Context) error { return Ping(ctx, cfg) }); err != nil {
+		return nil, err
 	}
+	return kafka.NewReader(rc), nil
 }
 
 // ProduceMessage publishes a message to Kafka
@@ -43,21 +148,13 @@ func ProduceMessage(ctx context.Context, writer *kafka.Writer, key []byte, value
 	return writer.WriteMessages(ctx, msg)
 }
 
-// NewConsumer returns a Kafka reader (consumer)
-func NewConsumer(topic, groupID string) *kafka.Reader {
-	return kafka.NewReader(kafka.ReaderConfig{
-		Brokers:  []string{KafkaBroker},
-		GroupID:  groupID,
-		Topic:    topic,
-		MinBytes: 10e3,
-		MaxBytes: 10e6,
-	})
-}
-
-// ConsumeMessages reads messages and invokes handler
+// ConsumeMessages reads messages and invokes handler until ctx ends.
 func ConsumeMessages(ctx context.Context, reader *kafka.Reader, handler func(kafka.Message) error) {
 	for {
 		msg, err := reader.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
 		if err != nil {
 			log.Printf("[kafka] fetch error: %v", err)
 			continue
@@ -70,5 +167,3 @@ func ConsumeMessages(ctx context.Context, reader *kafka.Reader, handler func(kaf
 		}
 	}
 }
-
-
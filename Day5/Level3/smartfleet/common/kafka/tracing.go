@@ -0,0 +1,106 @@
+package kafka
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "smartfleet/common/kafka"
+
+// HeaderCarrier carries W3C trace context (traceparent, tracestate) in the
+// headers of a message.
+type HeaderCarrier struct {
+	Headers *[]kafka.Header
+}
+
+var _ propagation.TextMapCarrier = HeaderCarrier{}
+
+// Get returns the value of the last header named key, or "".
+func (c HeaderCarrier) Get(key string) string {
+	for i := len(*c.Headers) - 1; i >= 0; i-- {
+		if h := (*c.Headers)[i]; h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+// Set replaces the headers named key by one with value.
+func (c HeaderCarrier) Set(key, value string) {
+	kept := (*c.Headers)[:0]
+	for _, h := range *c.Headers {
+		if h.Key != key {
+			kept = append(kept, h)
+		}
+	}
+	*c.Headers = append(kept, kafka.Header{Key: key, Value: []byte(value)})
+}
+
+// Keys returns the header names.
+func (c HeaderCarrier) Keys() []string {
+	keys := make([]string, 0, len(*c.Headers))
+	for _, h := range *c.Headers {
+		keys = append(keys, h.Key)
+	}
+	return keys
+}
+
+// StartProduce starts the producer span of m on topic, a child of ctx,
+// and writes its trace context into the headers of m. Write m with the
+// returned context and end the span with tracing.End.
+func StartProduce(ctx context.Context, topic string, m *kafka.Message) (context.Context, trace.Span) {
+	name := topic + " publish"
+	if topic == "" {
+		name = "publish"
+	}
+	ctx, span := otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingOperationTypePublish,
+			semconv.MessagingDestinationName(topic),
+			semconv.MessagingKafkaMessageKey(string(m.Key)),
+			semconv.MessagingMessageBodySize(len(m.Value)),
+		))
+	otel.GetTextMapPropagator().Inject(ctx, HeaderCarrier{&m.Headers})
+	return ctx, span
+}
+
+// StartConsume starts the consumer span of processing m in group. The
+// span continues the trace of the producer span whose context m carries,
+// as its child and through a link, so one trace follows a vehicle event
+// from ingest to the alerts it raises; without one it is a child of ctx.
+// End the span with tracing.End.
+func StartConsume(ctx context.Context, m kafka.Message, group string) (context.Context, trace.Span) {
+	headers := m.Headers
+	producer := trace.SpanContextFromContext(otel.GetTextMapPropagator().Extract(context.Background(), HeaderCarrier{&headers}))
+	opts := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKafka,
+			semconv.MessagingOperationTypeDeliver,
+			semconv.MessagingDestinationName(m.Topic),
+			semconv.MessagingDestinationPartitionID(strconv.Itoa(m.Partition)),
+			semconv.MessagingKafkaMessageOffset(int(m.Offset)),
+			semconv.MessagingKafkaMessageKey(string(m.Key)),
+		),
+	}
+	if group != "" {
+		opts = append(opts, trace.WithAttributes(semconv.MessagingKafkaConsumerGroup(group)))
+	}
+	if producer.IsValid() {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, producer)
+		opts = append(opts, trace.WithLinks(trace.Link{SpanContext: producer}))
+	}
+	name := m.Topic + " process"
+	if m.Topic == "" {
+		name = "process"
+	}
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
@@ -0,0 +1,36 @@
+package kafka
+
+import (
+	"context"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+
+	"smartfleet/common/tracing"
+)
+
+func TestTraceContextHeaders(t *testing.T) {
+	spans := tracing.InMemory("svc")
+	m := kafka.Message{Key: []byte("v1"), Headers: []kafka.Header{{Key: "tenant_id", Value: []byte("t1")}, {Key: "traceparent", Value: []byte("stale")}}}
+	_, produce := StartProduce(context.Background(), "telemetry.events", &m)
+	tracing.End(produce, nil)
+
+	if len(m.Headers) != 2 || m.Headers[0].Key != "tenant_id" || m.Headers[1].Key != "traceparent" {
+		t.Fatalf("headers = %v", m.Headers)
+	}
+	m.Topic = "telemetry.events"
+	_, consume := StartConsume(context.Background(), m, "analytics")
+	tracing.End(consume, nil)
+
+	got := spans.GetSpans()
+	if len(got) != 2 || got[0].Name != "telemetry.events publish" || got[1].Name != "telemetry.events process" {
+		t.Fatalf("spans = %v", got.Snapshots())
+	}
+	p, c := got[0].SpanContext, got[1]
+	if c.Parent.SpanID() != p.SpanID() || c.SpanContext.TraceID() != p.TraceID() {
+		t.Errorf("consumer span is not a child of the producer span")
+	}
+	if len(c.Links) != 1 || c.Links[0].SpanContext.SpanID() != p.SpanID() {
+		t.Errorf("links = %v", c.Links)
+	}
+}
@@ -0,0 +1,117 @@
+// Package lifecycle is what every smartfleet client does around its
+// connection: wait for the server at startup, answer health probes, and
+// close in order at shutdown.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+
+	"smartfleet/common/config"
+)
+
+// Connect calls dial until it succeeds, ctx ends or the attempts of r run
+// out. Between tries it waits with exponential backoff and jitter, so
+// replicas restarted together do not retry in step.
+func Connect(ctx context.Context, name string, r config.Retry, logger *log.Logger, dial func(context.Context) error) error {
+	wait := r.Backoff
+	if wait <= 0 {
+		wait = 500 * time.Millisecond
+	}
+	for attempt := 1; ; attempt++ {
+		err := dial(ctx)
+		if err == nil {
+			if attempt > 1 && logger != nil {
+				logger.Printf("%s: connected after %d attempts", name, attempt)
+			}
+			return nil
+		}
+		if r.Attempts > 0 && attempt >= r.Attempts {
+			return fmt.Errorf("%s: giving up after %d attempts: %w", name, attempt, err)
+		}
+		d := wait/2 + time.Duration(rand.Int63n(int64(wait)))
+		if logger != nil {
+			logger.Printf("%s: %v; retrying in %s", name, err, d.Round(time.Millisecond))
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s: %w (last error: %v)", name, ctx.Err(), err)
+		case <-time.After(d):
+		}
+		if wait *= 2; r.MaxBackoff > 0 && wait > r.MaxBackoff {
+			wait = r.MaxBackoff
+		}
+	}
+}
+
+// Probe checks that a dependency answers.
+type Probe func(ctx context.Context) error
+
+// Check runs the probes concurrently, each bounded by timeout, and reports
+// which answered.
+func Check(ctx context.Context, timeout time.Duration, probes map[string]Probe) map[string]bool {
+	ok := make(map[string]bool, len(probes))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, probe := range probes {
+		wg.Add(1)
+		go func(name string, probe Probe) {
+			defer wg.Done()
+			pctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			err := probe(pctx)
+			mu.Lock()
+			ok[name] = err == nil
+			mu.Unlock()
+		}(name, probe)
+	}
+	wg.Wait()
+	return ok
+}
+
+// Closer closes a service's clients in the reverse of the order they were
+// added, so a producer flushes before the connection it writes to goes.
+// The zero value is ready to use.
+type Closer struct {
+	mu    sync.Mutex
+	names []string
+	funcs []func() error
+}
+
+// Add registers close under name.
+func (c *Closer) Add(name string, close func() error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.names = append(c.names, name)
+	c.funcs = append(c.funcs, close)
+}
+
+// Close closes everything added so far. A close still running when ctx
+// ends is abandoned, and the rest are skipped.
+func (c *Closer) Close(ctx context.Context) error {
+	c.mu.Lock()
+	names, funcs := c.names, c.funcs
+	c.names, c.funcs = nil, nil
+	c.mu.Unlock()
+
+	var errs []error
+	for i := len(funcs) - 1; i >= 0; i-- {
+		done := make(chan error, 1)
+		go func(close func() error) { done <- close() }(funcs[i])
+		select {
+		case err := <-done:
+			if err != nil {
+				errs = append(errs, fmt.Errorf("close %s: %w", names[i], err))
+			}
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("close %s: %w", names[i], ctx.Err()))
+			return errors.Join(errs...)
+		}
+	}
+	return errors.Join(errs...)
+}
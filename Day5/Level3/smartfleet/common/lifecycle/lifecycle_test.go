@@ -0,0 +1,76 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"smartfleet/common/config"
+)
+
+func TestConnect(t *testing.T) {
+	retry := config.Retry{Attempts: 3, Backoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}
+	down := errors.New("connection refused")
+
+	calls := 0
+	err := Connect(context.Background(), "redis", retry, nil, func(context.Context) error {
+		if calls++; calls < 3 {
+			return down
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Fatalf("err = %v after %d calls", err, calls)
+	}
+
+	calls = 0
+	err = Connect(context.Background(), "redis", retry, nil, func(context.Context) error { calls++; return down })
+	if !errors.Is(err, down) || calls != 3 || !strings.Contains(err.Error(), "3 attempts") {
+		t.Fatalf("err = %v after %d calls", err, calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Connect(ctx, "redis", config.Retry{}, nil, func(context.Context) error { return down })
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled: err = %v", err)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ok := Check(context.Background(), 20*time.Millisecond, map[string]Probe{
+		"up":   func(context.Context) error { return nil },
+		"down": func(context.Context) error { return errors.New("no route") },
+		"hung": func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() },
+	})
+	if !ok["up"] || ok["down"] || ok["hung"] || len(ok) != 3 {
+		t.Fatalf("check = %v", ok)
+	}
+}
+
+func TestCloserOrder(t *testing.T) {
+	var c Closer
+	var order []string
+	for _, name := range []string{"redis", "kafka", "writer"} {
+		name := name
+		c.Add(name, func() error {
+			order = append(order, name)
+			if name == "kafka" {
+				return errors.New("boom")
+			}
+			return nil
+		})
+	}
+	err := c.Close(context.Background())
+	if got := strings.Join(order, ","); got != "writer,kafka,redis" {
+		t.Errorf("closed %s", got)
+	}
+	if err == nil || !strings.Contains(err.Error(), "close kafka: boom") {
+		t.Errorf("err = %v", err)
+	}
+	if err := c.Close(context.Background()); err != nil || len(order) != 3 {
+		t.Errorf("second close: %v, %v", err, order)
+	}
+}
@@ -0,0 +1,192 @@
+// Package logging is the structured logging of the smartfleet services:
+// JSON lines on stdout, one logger per component, each with a level that
+// can be changed while the service runs (see Handler).
+//
+// Packages that take a *log.Logger get one from Std; its lines become the
+// msg of an info entry of the component.
+package logging
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"smartfleet/common/config"
+)
+
+// Logging hands out the component loggers of a service.
+type Logging struct {
+	service    string
+	enc        zapcore.Encoder
+	out        zapcore.WriteSyncer
+	adminToken string
+
+	mu     sync.Mutex
+	def    zapcore.Level
+	levels map[string]zap.AtomicLevel
+	set    map[string]bool // components with a level of their own
+}
+
+// New returns the logging of service as configured by cfg, writing to w
+// (stdout when nil).
+func New(service string, cfg config.Log, w io.Writer) (*Logging, error) {
+	def, err := zapcore.ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL: %w", err)
+	}
+	if w == nil {
+		w = os.Stdout
+	}
+	ec := zap.NewProductionEncoderConfig()
+	ec.TimeKey = "ts"
+	ec.EncodeTime = zapcore.ISO8601TimeEncoder
+	enc := zapcore.NewJSONEncoder(ec)
+	if cfg.Format == "console" {
+		ec.EncodeLevel = zapcore.CapitalLevelEncoder
+		enc = zapcore.NewConsoleEncoder(ec)
+	}
+	l := &Logging{
+		service:    service,
+		enc:        enc,
+		out:        zapcore.Lock(zapcore.AddSync(w)),
+		adminToken: cfg.AdminToken,
+		def:        def,
+		levels:     map[string]zap.AtomicLevel{},
+		set:        map[string]bool{},
+	}
+	for _, kv := range strings.Split(cfg.Levels, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		component, level, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("LOG_LEVELS: %q: want component=level", kv)
+		}
+		if err := l.SetLevel(strings.TrimSpace(component), strings.TrimSpace(level)); err != nil {
+			return nil, fmt.Errorf("LOG_LEVELS: %w", err)
+		}
+	}
+	return l, nil
+}
+
+// level returns the level of component, creating it at the default.
+func (l *Logging) level(component string) zap.AtomicLevel {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lvl, ok := l.levels[component]
+	if !ok {
+		lvl = zap.NewAtomicLevelAt(l.def)
+		l.levels[component] = lvl
+	}
+	return lvl
+}
+
+// Logger returns the logger of component. Loggers of the same component
+// share its level.
+func (l *Logging) Logger(component string) *zap.Logger {
+	core := zapcore.NewCore(l.enc, l.out, l.level(component))
+	return zap.New(core, zap.AddCaller()).With(zap.String("service", l.service), zap.String("component", component))
+}
+
+// Std returns a *log.Logger writing info entries of component, for the
+// packages that log with one.
+func (l *Logging) Std(component string) *log.Logger {
+	return zap.NewStdLog(l.Logger(component))
+}
+
+// SetLevel sets the level of component; the component "*" is the default,
+// and setting it resets every component without a level of its own.
+func (l *Logging) SetLevel(component, level string) error {
+	lvl, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if component == "" {
+		return fmt.Errorf("empty component in %s", level)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if component == "*" {
+		l.def = lvl
+		for name, al := range l.levels {
+			if !l.set[name] {
+				al.SetLevel(lvl)
+			}
+		}
+		return nil
+	}
+	al, ok := l.levels[component]
+	if !ok {
+		al = zap.NewAtomicLevelAt(lvl)
+		l.levels[component] = al
+	}
+	al.SetLevel(lvl)
+	l.set[component] = true
+	return nil
+}
+
+// Levels returns the level of every component in use, and of "*".
+func (l *Logging) Levels() map[string]string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	out := map[string]string{"*": l.def.String()}
+	for name, al := range l.levels {
+		out[name] = al.Level().String()
+	}
+	return out
+}
+
+// Sync flushes buffered entries; call it before exiting.
+func (l *Logging) Sync() {
+	_ = l.out.Sync()
+}
+
+// Handler serves /admin/log-levels. GET returns the levels as a JSON
+// object; PUT takes one, e.g. {"ingest":"debug","*":"warn"}, with the
+// admin token as a bearer token. Without a token the levels are read-only.
+func (l *Logging) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			if l.adminToken == "" {
+				http.Error(w, "log levels are read-only: LOG_ADMIN_TOKEN is not set", http.StatusForbidden)
+				return
+			}
+			token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(token), []byte(l.adminToken)) != 1 {
+				http.Error(w, "invalid admin token", http.StatusUnauthorized)
+				return
+			}
+			var levels map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&levels); err != nil {
+				http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			for name, level := range levels {
+				if _, err := zapcore.ParseLevel(level); err != nil || name == "" {
+					http.Error(w, fmt.Sprintf("invalid level %q for %q", level, name), http.StatusBadRequest)
+					return
+				}
+			}
+			for name, level := range levels {
+				_ = l.SetLevel(name, level)
+			}
+			l.Logger("logging").Info("log levels changed", zap.Any("levels", levels), zap.String("remote", r.RemoteAddr))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(l.Levels())
+	})
+}
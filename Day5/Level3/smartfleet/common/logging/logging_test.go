@@ -0,0 +1,137 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"smartfleet/common/config"
+)
+
+func entries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var out []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var e map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("not JSON: %s", line)
+		}
+		out = append(out, e)
+	}
+	buf.Reset()
+	return out
+}
+
+func TestComponentLevels(t *testing.T) {
+	var buf bytes.Buffer
+	logs, err := New("telemetry-service", config.Log{Level: "info", Levels: "kafka=warn"}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingest, kafka := logs.Logger("ingest"), logs.Std("kafka")
+
+	ingest.Debug("hidden")
+	ingest.Info("accepted", zap.String("vehicle_id", "v1"))
+	kafka.Printf("hidden too")
+	got := entries(t, &buf)
+	if len(got) != 1 || got[0]["msg"] != "accepted" || got[0]["component"] != "ingest" ||
+		got[0]["service"] != "telemetry-service" || got[0]["vehicle_id"] != "v1" || got[0]["level"] != "info" {
+		t.Fatalf("entries = %v", got)
+	}
+
+	// at runtime: the default moves ingest, not kafka, which has its own level
+	if err := logs.SetLevel("*", "debug"); err != nil {
+		t.Fatal(err)
+	}
+	ingest.Debug("shown")
+	kafka.Printf("still hidden")
+	if got := entries(t, &buf); len(got) != 1 || got[0]["msg"] != "shown" {
+		t.Fatalf("after *=debug: %v", got)
+	}
+	if err := logs.SetLevel("kafka", "info"); err != nil {
+		t.Fatal(err)
+	}
+	kafka.Printf("dial %s", "kafka:9092")
+	if got := entries(t, &buf); len(got) != 1 || got[0]["msg"] != "dial kafka:9092" || got[0]["component"] != "kafka" {
+		t.Fatalf("after kafka=info: %v", got)
+	}
+
+	if _, err := New("svc", config.Log{Level: "info", Levels: "kafka"}, &buf); err == nil {
+		t.Error("LOG_LEVELS without a level was accepted")
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	var buf bytes.Buffer
+	logs, err := New("svc", config.Log{Level: "info", AdminToken: "s3cret"}, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs.Logger("ingest")
+	h := logs.Handler()
+
+	do := func(method, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/log-levels", strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := do(http.MethodPut, "wrong", `{"ingest":"debug"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token: %d", rec.Code)
+	}
+	if rec := do(http.MethodPut, "s3cret", `{"ingest":"loud"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("bad level: %d", rec.Code)
+	}
+	rec := do(http.MethodPut, "s3cret", `{"ingest":"debug"}`)
+	var levels map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &levels); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", rec.Code, rec.Body)
+	}
+	if levels["ingest"] != "debug" || levels["*"] != "info" {
+		t.Errorf("levels = %v", levels)
+	}
+	if rec := do(http.MethodGet, "", ""); !strings.Contains(rec.Body.String(), `"ingest":"debug"`) {
+		t.Errorf("GET: %s", rec.Body)
+	}
+
+	readOnly, _ := New("svc", config.Log{Level: "info"}, &buf)
+	rec = httptest.NewRecorder()
+	readOnly.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/admin/log-levels", strings.NewReader(`{"*":"debug"}`)))
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("without LOG_ADMIN_TOKEN: %d", rec.Code)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/telemetry", nil)
+	req.Header.Set(RequestIDHeader, "abc-123")
+	if id := FromRequest(req); id != "abc-123" {
+		t.Errorf("caller's ID replaced: %q", id)
+	}
+	req.Header.Set(RequestIDHeader, "bad id\n")
+	if id := FromRequest(req); len(id) != 32 {
+		t.Errorf("invalid caller ID kept: %q", id)
+	}
+
+	var buf bytes.Buffer
+	logs, _ := New("svc", config.Log{Level: "info"}, &buf)
+	ctx := WithRequestID(context.Background(), "abc-123")
+	Ctx(ctx, logs.Logger("alerts")).Info("published")
+	Ctx(context.Background(), logs.Logger("alerts")).Info("no request")
+	got := entries(t, &buf)
+	if got[0]["request_id"] != "abc-123" || got[1]["request_id"] != nil {
+		t.Errorf("entries = %v", got)
+	}
+}
@@ -0,0 +1,70 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// A request ID names one vehicle event from ingest to the alerts it
+// raises: telemetry-service assigns it, the telemetry Kafka message and
+// every alert carry it, and each service logs it as request_id.
+const (
+	RequestIDHeader      = "X-Request-ID" // HTTP request and response header
+	RequestIDKafkaHeader = "request_id"   // telemetry message header, next to tenant_id
+)
+
+type requestIDKey struct{}
+
+// NewRequestID returns a random 128-bit ID in hex.
+func NewRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// FromRequest returns the caller's X-Request-ID, or a new ID when it is
+// missing or not a plain token of at most 64 characters.
+func FromRequest(r *http.Request) string {
+	if id := r.Header.Get(RequestIDHeader); validRequestID(id) {
+		return id
+	}
+	return NewRequestID()
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// WithRequestID returns ctx carrying id; an empty id leaves ctx as is.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID ctx carries, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Ctx returns l with the request ID of ctx, if any, as request_id.
+func Ctx(ctx context.Context, l *zap.Logger) *zap.Logger {
+	if id := RequestID(ctx); id != "" {
+		return l.With(zap.String("request_id", id))
+	}
+	return l
+}
@@ -1,41 +1,38 @@
-
+// Package postgres opens the GORM connection pool of the smartfleet
+// services from a config.Postgres: one set of pool settings, a wait for
+// the server at startup, and slow queries logged with the service's logger.
 package postgres
 
 import (
-	"fmt"
+	"context"
+	"log"
 	"os"
-	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
 	"gorm.io/gorm/logger"
-)
 
-var (
-	PGHost     = getenv("PG_HOST", "localhost")
-	PGPort     = getenv("PG_PORT", "5432")
-	PGUser     = getenv("PG_USER", "postgres")
-	PGPassword = getenv("PG_PASSWORD", "postgres")
-	PGDB       = getenv("PG_DB", "fleet")
+	"smartfleet/common/config"
+	"smartfleet/common/lifecycle"
 )
 
-func getenv(k, d string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
+// NewPostgres creates a GORM PostgreSQL connection pool once the server
+// accepts a connection. TLS is chosen in the DSN (sslmode, sslrootcert).
+func NewPostgres(ctx context.Context, cfg config.Postgres, l *log.Logger) (*gorm.DB, error) {
+	if l == nil {
+		l = log.New(os.Stdout, "", log.LstdFlags)
 	}
-	return d
-}
-
-// NewPostgres creates a GORM PostgreSQL connection pool
-func NewPostgres() (*gorm.DB, error) {
-	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s dbname=%s password=%s sslmode=disable TimeZone=UTC",
-		PGHost, PGPort, PGUser, PGDB, PGPassword,
-	)
-	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{
-		PrepareStmt:            true,
-		SkipDefaultTransaction: false,
-		Logger:                 logger.Default.LogMode(logger.Warn),
+	var db *gorm.DB
+	err := lifecycle.Connect(ctx, "postgres", cfg.Retry, l, func(ctx context.Context) error {
+		var err error
+		db, err = gorm.Open(postgres.Open(cfg.DSN), &gorm.Config{
+			Logger: logger.New(l, logger.Config{
+				SlowThreshold:             cfg.SlowQuery,
+				LogLevel:                  logger.Warn,
+				IgnoreRecordNotFoundError: true,
+			}),
+		})
+		return err
 	})
 	if err != nil {
 		return nil, err
@@ -44,10 +41,26 @@ func NewPostgres() (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	sqlDB.SetMaxIdleConns(10)
-	sqlDB.SetMaxOpenConns(50)
-	sqlDB.SetConnMaxLifetime(time.Hour)
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
 	return db, nil
 }
 
+// Ping checks that the pool reaches the server.
+func Ping(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
 
+// Close closes the pool; queries still running finish first.
+func Close(db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
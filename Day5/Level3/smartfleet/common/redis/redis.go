@@ -1,38 +1,79 @@
-
+// Package redis builds the Redis client of the smartfleet services from a
+// config.Redis: TLS and ACL credentials, a wait for the server at startup,
+// and failed dials logged with the service's logger.
 package redis
 
 import (
 	"context"
-	"os"
+	"fmt"
+	"log"
+	"net"
+	"sync/atomic"
 	"time"
 
 	"github.com/redis/go-redis/v9"
-)
 
-var RedisAddr = getenv("REDIS_ADDR", "localhost:6379")
+	"smartfleet/common/config"
+	"smartfleet/common/lifecycle"
+)
 
-func getenv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+// NewClient returns a pooled client once the server answers a PING.
+func NewClient(ctx context.Context, cfg config.Redis, logger *log.Logger) (*redis.Client, error) {
+	tlsConfig, err := cfg.TLS.Config()
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
 	}
-	return def
-}
-
-// NewClient creates a Redis client with connection pool
-func NewClient() *redis.Client {
-	return redis.NewClient(&redis.Options{
-		Addr:         RedisAddr,
-		Password:     "", // use env if needed
-		DB:           0,
-		PoolSize:     20,
+	rdb := redis.NewClient(&redis.Options{
+		Addr:         cfg.Addr,
+		Username:     cfg.Username,
+		Password:     cfg.Password,
+		DB:           cfg.DB,
+		TLSConfig:    tlsConfig,
+		PoolSize:     cfg.PoolSize,
 		MinIdleConns: 5,
 		DialTimeout:  5 * time.Second,
 		ReadTimeout:  3 * time.Second,
 		WriteTimeout: 3 * time.Second,
 	})
+	if logger != nil {
+		rdb.AddHook(&dialLogger{logger: logger})
+	}
+	if err := lifecycle.Connect(ctx, "redis", cfg.Retry, logger, func(ctx context.Context) error { return Ping(ctx, rdb) }); err != nil {
+		rdb.Close()
+		return nil, err
+	}
+	return rdb, nil
 }
 
 // Ping tests Redis connectivity
 func Ping(ctx context.Context, rdb *redis.Client) error {
 	return rdb.Ping(ctx).Err()
 }
+
+// dialLogger logs failed dials, at most one every dialLogEvery: while the
+// server is down every command dials.
+type dialLogger struct {
+	logger *log.Logger
+	last   atomic.Int64 // unix nanos of the last line
+}
+
+const dialLogEvery = 10 * time.Second
+
+func (h *dialLogger) DialHook(next redis.DialHook) redis.DialHook {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := next(ctx, network, addr)
+		if err != nil {
+			now, last := time.Now().UnixNano(), h.last.Load()
+			if now-last >= int64(dialLogEvery) && h.last.CompareAndSwap(last, now) {
+				h.logger.Printf("redis: dial %s: %v", addr, err)
+			}
+		}
+		return conn, err
+	}
+}
+
+func (h *dialLogger) ProcessHook(next redis.ProcessHook) redis.ProcessHook { return next }
+
+func (h *dialLogger) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
@@ -0,0 +1,127 @@
+// Package registry looks up vehicles in registry-service for the services
+// that check or enrich telemetry against it.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Vehicle is the subset of a registry vehicle the other services use.
+type Vehicle struct {
+	VIN                string  `json:"vin"`
+	FuelType           string  `json:"fuel_type"`
+	BatteryCapacityKWh float64 `json:"battery_capacity_kwh,omitempty"`
+	GroupID            *uint   `json:"group_id,omitempty"`
+	DepotID            *uint   `json:"depot_id,omitempty"`
+	OrganizationID     *uint   `json:"organization_id,omitempty"`
+}
+
+const maxCacheEntries = 100000
+
+type cacheEntry struct {
+	vehicle *Vehicle // nil means "not registered"
+	expires time.Time
+}
+
+// Client looks up vehicles in registry-service with a TTL cache.
+// Unknown vehicles are cached for a shorter negative TTL so newly registered
+// vehicles are picked up quickly.
+type Client struct {
+	baseURL     string
+	token       string // service token allowing X-Tenant-ID impersonation
+	client      *http.Client
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu         sync.RWMutex
+	cache      map[string]cacheEntry
+	maxEntries int
+}
+
+// NewClient constructs a client for the registry at baseURL.
+func NewClient(baseURL string, ttl, negativeTTL time.Duration, token string) *Client {
+	return &Client{
+		baseURL:     strings.TrimRight(baseURL, "/"),
+		token:       token,
+		client:      &http.Client{Timeout: 2 * time.Second},
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		cache:       make(map[string]cacheEntry),
+		maxEntries:  maxCacheEntries,
+	}
+}
+
+// Lookup returns the tenant's registered vehicle, or nil if the vehicle is unknown.
+// An error means the registry could not be reached.
+func (c *Client) Lookup(ctx context.Context, tenant, vehicleID string) (*Vehicle, error) {
+	now := time.Now()
+	cacheKey := tenant + "/" + vehicleID
+	c.mu.RLock()
+	e, ok := c.cache[cacheKey]
+	c.mu.RUnlock()
+	if ok && now.Before(e.expires) {
+		return e.vehicle, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/vehicles/"+url.PathEscape(vehicleID), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Tenant-ID", tenant)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var v *Vehicle
+	ttl := c.negativeTTL
+	switch resp.StatusCode {
+	case http.StatusOK:
+		v = &Vehicle{}
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("decode registry response: %w", err)
+		}
+		ttl = c.ttl
+	case http.StatusNotFound, http.StatusBadRequest:
+		// not registered (or not even a valid VIN)
+	default:
+		return nil, fmt.Errorf("registry lookup %s: status %d", vehicleID, resp.StatusCode)
+	}
+
+	c.mu.Lock()
+	if len(c.cache) >= c.maxEntries {
+		c.evict(now)
+	}
+	c.cache[cacheKey] = cacheEntry{vehicle: v, expires: now.Add(ttl)}
+	c.mu.Unlock()
+	return v, nil
+}
+
+// evict makes room in the full cache: it sweeps expired entries and, when
+// they are all still fresh (e.g. a burst of unknown vehicles within the
+// negative TTL), drops arbitrary ones down to 90% of the limit, so the
+// next inserts do not sweep again. c.mu must be held.
+func (c *Client) evict(now time.Time) {
+	for k, old := range c.cache {
+		if now.After(old.expires) {
+			delete(c.cache, k)
+		}
+	}
+	for k := range c.cache {
+		if len(c.cache) < c.maxEntries*9/10 {
+			break
+		}
+		delete(c.cache, k)
+	}
+}
@@ -0,0 +1,33 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCacheBounded(t *testing.T) {
+	// every vehicle is unknown, and no entry expires during the test
+	reg := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer reg.Close()
+	c := NewClient(reg.URL, time.Hour, time.Hour, "")
+	c.maxEntries = 10
+
+	for i := 0; i < 50; i++ {
+		v, err := c.Lookup(context.Background(), "t1", fmt.Sprintf("VIN%014d", i))
+		if err != nil || v != nil {
+			t.Fatalf("lookup %d: %v %v", i, v, err)
+		}
+		c.mu.RLock()
+		n := len(c.cache)
+		c.mu.RUnlock()
+		if n > c.maxEntries {
+			t.Fatalf("after %d lookups the cache holds %d entries, limit %d", i+1, n, c.maxEntries)
+		}
+	}
+}
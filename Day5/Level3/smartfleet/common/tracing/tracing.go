@@ -0,0 +1,151 @@
+// Package tracing is the OpenTelemetry tracing of the smartfleet services.
+// Setup installs the global tracer provider and the W3C trace-context
+// propagator; the services then start spans with otel.Tracer, and trace
+// context crosses Kafka as message headers (see common/kafka) and Redis
+// inside the alert (see Inject and Extract).
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"smartfleet/common/config"
+)
+
+// Setup installs the tracer provider of service as configured by cfg. The
+// returned func flushes the spans still buffered and stops the exporter;
+// add it to the service's lifecycle.Closer first, so it runs last. With
+// exporter "none" spans are not recorded, but the trace context of a
+// caller still passes through.
+func Setup(ctx context.Context, service string, cfg config.Tracing) (func() error, error) {
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("tracing: sample_ratio %v is not in [0, 1]", cfg.SampleRatio)
+	}
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "", "none":
+		install(noop.NewTracerProvider())
+		return func() error { return nil }, nil
+	case "stdout":
+		var err error
+		if exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout)); err != nil {
+			return nil, fmt.Errorf("tracing: %w", err)
+		}
+	case "otlp":
+		if !strings.HasPrefix(cfg.Endpoint, "http://") && !strings.HasPrefix(cfg.Endpoint, "https://") {
+			return nil, fmt.Errorf("tracing: otlp_endpoint %q is not an http(s) URL", cfg.Endpoint)
+		}
+		opts := []otlptracehttp.Option{otlptracehttp.WithEndpointURL(cfg.Endpoint)}
+		tlsConfig, err := cfg.TLS.Config()
+		if err != nil {
+			return nil, fmt.Errorf("tracing: %w", err)
+		}
+		if tlsConfig != nil {
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConfig))
+		}
+		// New does not dial: spans are sent, and failures logged by otel,
+		// once the collector is up.
+		if exporter, err = otlptracehttp.New(ctx, opts...); err != nil {
+			return nil, fmt.Errorf("tracing: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", cfg.Exporter)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(serviceResource(service)),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	)
+	install(tp)
+	return func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return tp.Shutdown(ctx)
+	}, nil
+}
+
+// InMemory installs a tracer provider that records every span of service,
+// as it ends, in the returned exporter; it is for tests, which read the
+// spans with GetSpans. Tracers taken from otel before the first provider
+// is installed stay with that one: call InMemory once per test binary.
+func InMemory(service string) *tracetest.InMemoryExporter {
+	exporter := tracetest.NewInMemoryExporter()
+	install(sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(exporter),
+		sdktrace.WithResource(serviceResource(service)),
+	))
+	return exporter
+}
+
+func serviceResource(service string) *resource.Resource {
+	return resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(service))
+}
+
+func install(tp trace.TracerProvider) {
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+}
+
+// Handler wraps h in a server span per request, named after the method
+// and the ServeMux pattern that served it (e.g. "POST /telemetry"), so
+// paths with IDs share a name. Health checks are not traced.
+func Handler(h http.Handler, operation string) http.Handler {
+	return otelhttp.NewHandler(h, operation,
+		// called again with r.Pattern set once the mux has routed r
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if r.Pattern == "" {
+				return r.Method
+			}
+			if strings.Contains(r.Pattern, " ") {
+				return r.Pattern
+			}
+			return r.Method + " " + r.Pattern
+		}),
+		otelhttp.WithFilter(func(r *http.Request) bool { return r.URL.Path != "/health" }),
+	)
+}
+
+// Inject returns the trace context of ctx as a map, for messages that
+// carry it in their payload, like alerts on Redis; nil when ctx has none.
+func Inject(ctx context.Context) map[string]string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return nil
+	}
+	return carrier
+}
+
+// Extract returns ctx with the remote trace context of carrier, as
+// written by Inject.
+func Extract(ctx context.Context, carrier map[string]string) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(carrier))
+}
+
+// End records err, if any, on span and ends it. Cancellations are not
+// errors: they are how a service stops.
+func End(span trace.Span, err error) {
+	if err != nil && !errors.Is(err, context.Canceled) {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,61 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+
+	"smartfleet/common/config"
+)
+
+func TestSetup(t *testing.T) {
+	for _, cfg := range []config.Tracing{
+		{Exporter: "otlp", Endpoint: "jaeger:4318", SampleRatio: 1},
+		{Exporter: "stdout", SampleRatio: 2},
+		{Exporter: "zipkin", SampleRatio: 1},
+	} {
+		if _, err := Setup(context.Background(), "svc", cfg); err == nil {
+			t.Errorf("%+v accepted", cfg)
+		}
+	}
+	stop, err := Setup(context.Background(), "svc", config.Tracing{Exporter: "otlp", Endpoint: "http://127.0.0.1:1", SampleRatio: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stop(); err != nil {
+		t.Errorf("shutdown without spans: %v", err)
+	}
+}
+
+func TestHandlerAndCarrier(t *testing.T) {
+	spans := InMemory("svc")
+	mux := http.NewServeMux()
+	var alert map[string]string
+	mux.HandleFunc("GET /vehicles/{id}", func(w http.ResponseWriter, r *http.Request) {
+		alert = Inject(r.Context())
+	})
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {})
+	h := Handler(mux, "api")
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/vehicles/v1", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	got := spans.GetSpans()
+	if len(got) != 1 || got[0].Name != "GET /vehicles/{id}" || got[0].SpanKind != trace.SpanKindServer {
+		t.Fatalf("spans = %v", got.Snapshots())
+	}
+	if alert["traceparent"] == "" {
+		t.Fatalf("carrier = %v", alert)
+	}
+	_, span := otel.Tracer("test").Start(Extract(context.Background(), alert), "consume")
+	span.End()
+	if child := spans.GetSpans()[1]; child.Parent.SpanID() != got[0].SpanContext.SpanID() {
+		t.Errorf("consume span parent = %s, want %s", child.Parent.SpanID(), got[0].SpanContext.SpanID())
+	}
+	if Inject(context.Background()) != nil {
+		t.Error("context without a span injected")
+	}
+}
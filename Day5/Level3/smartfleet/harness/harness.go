@@ -0,0 +1,247 @@
+// Package harness runs the smartfleet pipeline in one process for tests:
+// telemetry-service ingests over HTTP, analytics-service processes each
+// accepted message before the ingest request returns, and alerts reach
+// notification-service WebSocket clients through an in-memory bus. Kafka,
+// Redis and Postgres are replaced by the services' in-memory
+// implementations, so a test that posts telemetry can assert on trips,
+// aggregates and alerts without waiting or polling. Spans go to the global
+// tracer provider; tracing.InMemory records them for a test.
+package harness
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	kafka "github.com/segmentio/kafka-go"
+	"go.uber.org/zap"
+
+	analytics "smartfleet/analytics-service"
+	"smartfleet/common/apikey"
+	"smartfleet/common/logging"
+	notification "smartfleet/notification-service"
+	telemetry "smartfleet/telemetry-service"
+)
+
+// Config configures a Pipeline. The zero value is usable.
+type Config struct {
+	// APIKeys maps API keys to tenants, as INGEST_API_KEYS does; the same
+	// keys open notification streams. Empty puts everything in "default".
+	APIKeys map[string]string
+
+	// Anomaly configures analytics anomaly detection; nil uses
+	// DefaultAnomalyConfig.
+	Anomaly *analytics.AnomalyConfig
+
+	// Logs receives the services' logs, under the components the services
+	// use; nil discards them.
+	Logs *logging.Logging
+}
+
+// DefaultAnomalyConfig is the analytics default configuration without clock
+// skew detection, since tests post telemetry recorded at fixed times.
+var DefaultAnomalyConfig = analytics.AnomalyConfig{
+	Alpha:            0.05,
+	ZThreshold:       4,
+	Warmup:           30,
+	FreezeCount:      20,
+	MaxPlausibleKmph: 300,
+}
+
+// Pipeline is the running pipeline. Its fields give tests direct access to
+// each stage.
+type Pipeline struct {
+	Telemetry    *telemetry.Server
+	Cache        *telemetry.MemoryCache
+	Analytics    *analytics.Pipeline
+	Store        *analytics.MemoryStore
+	Bus          *notification.MemoryBus
+	Notification *notification.NotificationService
+
+	ingest *httptest.Server
+	notify *httptest.Server
+}
+
+// Start wires the services together and starts their HTTP servers.
+func Start(cfg Config) (*Pipeline, error) {
+	logger := func(component string) *zap.Logger {
+		if cfg.Logs == nil {
+			return zap.NewNop()
+		}
+		return cfg.Logs.Logger(component)
+	}
+	anomaly := DefaultAnomalyConfig
+	if cfg.Anomaly != nil {
+		anomaly = *cfg.Anomaly
+	}
+	var keys []string
+	for k, t := range cfg.APIKeys {
+		keys = append(keys, k+"="+t)
+	}
+	spec := strings.Join(keys, ",")
+
+	p := &Pipeline{
+		Cache: telemetry.NewMemoryCache(),
+		Store: analytics.NewMemoryStore(),
+		Bus:   notification.NewMemoryBus(),
+	}
+
+	// notification-service consumes the bus
+	nauth, err := apikey.New(spec, "", "default", spec == "")
+	if err != nil {
+		return nil, err
+	}
+	if p.Notification, err = notification.NewNotificationService(nil, nauth, logger("notify")); err != nil {
+		return nil, err
+	}
+	p.Notification.SetAlertBus(p.Bus)
+	if err := p.Notification.StartStream(context.Background()); err != nil {
+		return nil, fmt.Errorf("notification: %w", err)
+	}
+
+	// analytics-service publishes its alerts onto the bus
+	store := analytics.TracedStore(p.Store, "memory")
+	alerts := analytics.NewAlertPublisher(alertBridge{p.Bus}, store, nil, logger("alerts"))
+	p.Analytics = analytics.NewPipeline(store, alerts,
+		analytics.NewEVTracker(nil, alerts, 60, 3, 80),
+		analytics.NewAnomalyDetector(anomaly, alerts), logger("pipeline"))
+
+	// telemetry-service hands accepted messages straight to analytics
+	const topic = "telemetry.events"
+	tauth, err := apikey.New(spec, "", "default", spec == "")
+	if err != nil {
+		p.Close()
+		return nil, err
+	}
+	p.Telemetry = &telemetry.Server{
+		Auth:      tauth,
+		Publisher: &consumer{pipeline: p.Analytics, topic: topic, logger: logger("pipeline")},
+		Cache:     p.Cache,
+		CacheTTL:  time.Hour,
+		Topic:     topic,
+		Logger:    logger("ingest"),
+	}
+
+	p.ingest = httptest.NewServer(p.Telemetry.Handler())
+	p.notify = httptest.NewServer(p.Notification.Handler())
+	return p, nil
+}
+
+// Close stops the servers and the alert consumer.
+func (p *Pipeline) Close() {
+	if p.ingest != nil {
+		p.ingest.Close()
+	}
+	if p.notify != nil {
+		p.notify.Close()
+	}
+	p.Notification.Stop()
+}
+
+// IngestURL is the base URL of telemetry-service.
+func (p *Pipeline) IngestURL() string { return p.ingest.URL }
+
+// NotifyURL is the base URL of notification-service.
+func (p *Pipeline) NotifyURL() string { return p.notify.URL }
+
+// Post sends one telemetry payload with the API key, which may be empty,
+// and returns the response status. By the time it returns, analytics has
+// processed an accepted payload and any alerts are queued for clients.
+func (p *Pipeline) Post(key string, payload interface{}) (int, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.ingest.URL+"/telemetry", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
+
+// Dial opens a notification WebSocket with the API key, which may be
+// empty, and the query string, e.g. "levels=CRITICAL".
+func (p *Pipeline) Dial(key, query string) (*websocket.Conn, error) {
+	url := "ws" + strings.TrimPrefix(p.notify.URL, "http") + "/ws"
+	if query != "" {
+		url += "?" + query
+	}
+	header := http.Header{}
+	if key != "" {
+		header.Set("Authorization", "Bearer "+key)
+	}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	return conn, err
+}
+
+// consumer is the telemetry Publisher that stands in for Kafka and the
+// analytics consumer loop: messages are processed one at a time, in order.
+// As with Kafka, a message analytics cannot process is logged, not
+// reported to the producer.
+type consumer struct {
+	mu       sync.Mutex
+	pipeline *analytics.Pipeline
+	topic    string
+	logger   *zap.Logger
+	offset   int64
+	closed   bool
+}
+
+func (c *consumer) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return io.ErrClosedPipe
+	}
+	for _, m := range msgs {
+		m.Topic, m.Offset = c.topic, c.offset
+		c.offset++
+		if err := c.pipeline.HandleMessage(ctx, m); err != nil {
+			c.logger.Error("message failed", zap.Int64("offset", m.Offset), zap.Error(err))
+		}
+	}
+	return nil
+}
+
+func (c *consumer) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+// alertBridge carries analytics alerts to the notification bus, through
+// JSON as they travel over Redis.
+type alertBridge struct {
+	bus *notification.MemoryBus
+}
+
+func (b alertBridge) Publish(ctx context.Context, a analytics.Alert) error {
+	v, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	var na notification.Alert
+	if err := json.Unmarshal(v, &na); err != nil {
+		return err
+	}
+	return b.bus.Publish(ctx, na)
+}
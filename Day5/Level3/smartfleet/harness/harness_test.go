@@ -0,0 +1,459 @@
+package harness
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	analytics "smartfleet/analytics-service"
+	"smartfleet/common/config"
+	"smartfleet/common/logging"
+	"smartfleet/common/tracing"
+	notification "smartfleet/notification-service"
+)
+
+var base = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+
+// sample is one telemetry post: a vehicle at a speed and latitude, at an
+// offset from base.
+type sample struct {
+	key, vehicle string
+	speed, lat   float64
+	at           time.Duration
+}
+
+func (s sample) payload() map[string]interface{} {
+	return map[string]interface{}{
+		"vehicle_id": s.vehicle,
+		"speed":      s.speed,
+		"fuel_level": 50,
+		"latitude":   s.lat,
+		"longitude":  77.6,
+		"ts":         base.Add(s.at).UnixMilli(),
+	}
+}
+
+// drive is a vehicle of tenant-a moving at 60 km/h for 50s, then standing
+// for over two minutes, which ends its trip.
+func drive(vehicle string) []sample {
+	var out []sample
+	for i := 0; i < 6; i++ {
+		out = append(out, sample{"key-a", vehicle, 60, 12.9 + float64(i)*0.0015, time.Duration(i) * 10 * time.Second})
+	}
+	return append(out, sample{"key-a", vehicle, 0, 12.9075, 3 * time.Minute})
+}
+
+// bucket is an expected per-minute aggregate.
+type bucket struct {
+	minute int
+	events int64
+}
+
+func TestPipeline(t *testing.T) {
+	cases := []struct {
+		name    string
+		samples []sample
+		status  int
+
+		tenant   string  // whose trips and aggregates are checked
+		vehicle  string  // whose aggregates are checked
+		trips    int64   // finished trips of vehicle
+		minKm    float64 // least distance of those trips
+		buckets  []bucket
+		alerts   []string // alert codes tenant-a's WebSocket receives
+		noStored bool     // nothing at all reaches analytics
+	}{
+		{
+			name:    "trip",
+			samples: drive("v1"),
+			status:  http.StatusAccepted,
+			tenant:  "tenant-a", vehicle: "v1",
+			trips: 1, minKm: 0.8,
+			buckets: []bucket{{3, 1}, {0, 6}},
+		},
+		{
+			name: "overspeed",
+			samples: []sample{
+				{"key-a", "v2", 120, 12.9, 0},
+				{"key-a", "v2", 150, 12.905, 10 * time.Second},
+			},
+			status: http.StatusAccepted,
+			tenant: "tenant-a", vehicle: "v2",
+			buckets: []bucket{{0, 2}},
+			alerts:  []string{"OVERSPEED"},
+		},
+		{
+			name:    "other tenant",
+			samples: []sample{{"key-b", "v3", 150, 12.9, 0}},
+			status:  http.StatusAccepted,
+			tenant:  "tenant-b", vehicle: "v3",
+			buckets: []bucket{{0, 1}},
+		},
+		{
+			name:    "unauthenticated",
+			samples: []sample{{"", "v4", 150, 12.9, 0}},
+			status:  http.StatusUnauthorized,
+			tenant:  "tenant-a", vehicle: "v4",
+			noStored: true,
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := Start(Config{APIKeys: map[string]string{"key-a": "tenant-a", "key-b": "tenant-b"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			conn, err := p.Dial("key-a", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			for _, s := range tc.samples {
+				status, err := p.Post(s.key, s.payload())
+				if err != nil || status != tc.status {
+					t.Fatalf("post %+v: status %d, %v; want %d", s, status, err, tc.status)
+				}
+			}
+
+			ctx := context.Background()
+			store := p.Store.ForTenant(tc.tenant)
+			totals, err := store.TripTotals(ctx, base, base.Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var trips int64
+			for _, vt := range totals {
+				if vt.VehicleID == tc.vehicle {
+					trips = vt.Trips
+					if vt.DistanceKm < tc.minKm {
+						t.Errorf("trip distance %.3f km, want at least %.1f", vt.DistanceKm, tc.minKm)
+					}
+				}
+			}
+			if trips != tc.trips {
+				t.Errorf("%d finished trips, want %d", trips, tc.trips)
+			}
+
+			aggs, err := store.DumpAggregates(ctx, tc.vehicle)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(aggs) != len(tc.buckets) {
+				t.Fatalf("%d aggregate buckets, want %d", len(aggs), len(tc.buckets))
+			}
+			for i, b := range tc.buckets {
+				want := base.Add(time.Duration(b.minute) * time.Minute)
+				if !aggs[i].Bucket.Equal(want) || aggs[i].EventCount != b.events {
+					t.Errorf("bucket %d = %s with %d events, want %s with %d",
+						i, aggs[i].Bucket, aggs[i].EventCount, want, b.events)
+				}
+			}
+			if tc.noStored {
+				rows, err := store.ListRaw(ctx, analytics.ReplayRange{From: base, To: base.Add(time.Hour)})
+				if err != nil || len(rows) != 0 {
+					t.Errorf("raw telemetry stored: %d rows, %v", len(rows), err)
+				}
+			}
+
+			if got := receiveAlerts(t, p, conn); !equalCodes(got, tc.alerts) {
+				t.Errorf("WebSocket alerts = %v, want %v", got, tc.alerts)
+			}
+		})
+	}
+}
+
+// TestResume reconnects a client after it missed alerts: GET /alerts and
+// /ws with ?since= return what tenant-a missed from the bus history, and the
+// resumed WebSocket then receives live alerts. Without Redis, replica
+// presence is not available.
+func TestResume(t *testing.T) {
+	p, err := Start(Config{APIKeys: map[string]string{"key-a": "tenant-a", "key-b": "tenant-b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	overspeed := func(key, vehicle string, at time.Duration) {
+		t.Helper()
+		for i, kmph := range []float64{120, 150} {
+			s := sample{key, vehicle, kmph, 12.9 + float64(i)*0.005, at + time.Duration(i)*10*time.Second}
+			if status, err := p.Post(s.key, s.payload()); err != nil || status != http.StatusAccepted {
+				t.Fatalf("post %+v: status %d, %v", s, status, err)
+			}
+		}
+	}
+
+	conn, err := p.Dial("key-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	overspeed("key-a", "v1", 0)
+	seen := readAlerts(t, p, conn)
+	conn.Close()
+	if len(seen) != 2 || seen[0].VehicleID != "v1" {
+		t.Fatalf("before disconnect: %+v", seen)
+	}
+	since := seen[len(seen)-1].ID
+
+	// missed while disconnected
+	overspeed("key-a", "v2", time.Minute)
+	overspeed("key-b", "v3", time.Minute)
+
+	req, _ := http.NewRequest(http.MethodGet, p.NotifyURL()+"/alerts?since="+since, nil)
+	req.Header.Set("Authorization", "Bearer key-a")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var missed []notification.Alert
+	err = json.NewDecoder(resp.Body).Decode(&missed)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /alerts?since: status %d, %v", resp.StatusCode, err)
+	}
+	if len(missed) != 1 || missed[0].VehicleID != "v2" || missed[0].Code != "OVERSPEED" {
+		t.Fatalf("GET /alerts?since = %+v, want tenant-a's v2 overspeed", missed)
+	}
+
+	conn, err = p.Dial("key-a", "since="+since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var reply notification.SubscriptionReply
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "resume" || reply.Since != since {
+		t.Fatalf("resume reply = %+v, %v", reply, err)
+	}
+	overspeed("key-a", "v4", 2*time.Minute)
+	var vehicles []string
+	for _, a := range readAlerts(t, p, conn) {
+		vehicles = append(vehicles, a.VehicleID)
+	}
+	if want := []string{"v2", "v4", "marker"}; !equalCodes(vehicles, want) {
+		t.Errorf("resumed WebSocket received %v, want %v", vehicles, want)
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, p.NotifyURL()+"/cluster", nil)
+	req.Header.Set("Authorization", "Bearer key-a")
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("GET /cluster without Redis: status %d, want 501", resp.StatusCode)
+	}
+}
+
+// TestRequestIDTrace follows one overspeed event by its request ID: from
+// the ingest request, through analytics, to the alert a WebSocket client
+// receives, with each stage logging the ID.
+func TestRequestIDTrace(t *testing.T) {
+	var out syncBuffer
+	logs, err := logging.New("harness", config.Log{Level: "debug"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Start(Config{APIKeys: map[string]string{"key-a": "tenant-a"}, Logs: logs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	conn, err := p.Dial("key-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	body, _ := json.Marshal(sample{"key-a", "v1", 150, 12.9, 0}.payload())
+	req, _ := http.NewRequest(http.MethodPost, p.IngestURL()+"/telemetry", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer key-a")
+	req.Header.Set(logging.RequestIDHeader, "trace-1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted || resp.Header.Get(logging.RequestIDHeader) != "trace-1" {
+		t.Fatalf("status %d, X-Request-ID %q", resp.StatusCode, resp.Header.Get(logging.RequestIDHeader))
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var a notification.Alert
+		if err := conn.ReadJSON(&a); err != nil {
+			t.Fatalf("reading alerts: %v", err)
+		}
+		if a.Code == "OVERSPEED" {
+			if a.RequestID != "trace-1" {
+				t.Errorf("WebSocket alert request_id = %q", a.RequestID)
+			}
+			break
+		}
+	}
+	// the alert is logged after it is queued: wait for the next one
+	receiveAlerts(t, p, conn)
+
+	// the stages that handled the event, by the component that logged it
+	seen := map[string]bool{}
+	sc := bufio.NewScanner(bytes.NewReader(out.Bytes()))
+	for sc.Scan() {
+		var e struct {
+			Component string `json:"component"`
+			Msg       string `json:"msg"`
+			RequestID string `json:"request_id"`
+		}
+		if json.Unmarshal(sc.Bytes(), &e) == nil && e.RequestID == "trace-1" {
+			seen[e.Component+": "+e.Msg] = true
+		}
+	}
+	for _, want := range []string{"ingest: telemetry accepted", "alerts: alert published", "notify: alert delivered"} {
+		if !seen[want] {
+			t.Errorf("no %q entry with the request ID; have %v", want, seen)
+		}
+	}
+}
+
+func TestSpans(t *testing.T) {
+	spans := tracing.InMemory("harness")
+	p, err := Start(Config{APIKeys: map[string]string{"key-a": "tenant-a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	conn, err := p.Dial("key-a", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if status, err := p.Post("key-a", sample{"key-a", "v1", 150, 12.9, 0}.payload()); err != nil || status != http.StatusAccepted {
+		t.Fatalf("post: %d %v", status, err)
+	}
+	// the notification span ends after the alert is queued
+	if got := receiveAlerts(t, p, conn); !equalCodes(got, []string{"OVERSPEED"}) {
+		t.Fatalf("alerts = %v", got)
+	}
+
+	// the first span of each name in the trace of the ingest request
+	var ingest []sdktrace.ReadOnlySpan
+	for _, s := range spans.GetSpans().Snapshots() {
+		if s.Name() == "POST /telemetry" {
+			ingest = append(ingest, s)
+		}
+	}
+	if len(ingest) != 1 {
+		t.Fatalf("%d ingest spans", len(ingest))
+	}
+	byName := map[string]sdktrace.ReadOnlySpan{}
+	for _, s := range spans.GetSpans().Snapshots() {
+		if _, ok := byName[s.Name()]; !ok && s.SpanContext().TraceID() == ingest[0].SpanContext().TraceID() {
+			byName[s.Name()] = s
+		}
+	}
+	for _, hop := range []struct{ child, parent string }{
+		{"telemetry.events publish", "POST /telemetry"},
+		{"telemetry.events process", "telemetry.events publish"},
+		{"store InsertTelemetry", "telemetry.events process"},
+		{"alerts publish", "telemetry.events process"},
+		{"store SaveAlert", "telemetry.events process"},
+		{"alerts process", "alerts publish"},
+	} {
+		child, parent := byName[hop.child], byName[hop.parent]
+		if child == nil || parent == nil {
+			t.Errorf("%s -> %s: missing span; trace has %v", hop.parent, hop.child, names(byName))
+			continue
+		}
+		if child.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("%s: parent is not %s", hop.child, hop.parent)
+		}
+	}
+	if c := byName["telemetry.events process"]; c != nil && (len(c.Links()) != 1 || c.Links()[0].SpanContext.SpanID() != byName["telemetry.events publish"].SpanContext().SpanID()) {
+		t.Errorf("consumer span links = %v", c.Links())
+	}
+}
+
+func names(spans map[string]sdktrace.ReadOnlySpan) []string {
+	var out []string
+	for name := range spans {
+		out = append(out, name)
+	}
+	return out
+}
+
+// syncBuffer is a log destination tests read while services write to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf.Bytes()...)
+}
+
+// receiveAlerts returns the codes of the alerts conn has been sent. It
+// publishes a marker for tenant-a and reads up to it: the bus delivers in
+// order, so everything published before has arrived by then.
+func receiveAlerts(t *testing.T, p *Pipeline, conn *websocket.Conn) []string {
+	t.Helper()
+	alerts := readAlerts(t, p, conn)
+	var codes []string
+	for _, a := range alerts[:len(alerts)-1] {
+		codes = append(codes, a.Code)
+	}
+	return codes
+}
+
+// readAlerts returns the alerts conn has been sent, as receiveAlerts does,
+// ending with the marker.
+func readAlerts(t *testing.T, p *Pipeline, conn *websocket.Conn) []notification.Alert {
+	t.Helper()
+	marker := notification.Alert{TenantID: "tenant-a", VehicleID: "marker", Level: "INFO", Message: "marker"}
+	if err := p.Bus.Publish(context.Background(), marker); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var alerts []notification.Alert
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("reading alerts: %v", err)
+		}
+		var a notification.Alert
+		if err := json.Unmarshal(data, &a); err != nil || a.Level == "" {
+			continue // control reply
+		}
+		alerts = append(alerts, a)
+		if a.VehicleID == "marker" {
+			return alerts
+		}
+	}
+}
+
+func equalCodes(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,328 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AlertBus carries alerts from analytics-service to this service.
+// Subscribe calls handle for every alert until ctx ends, and returns a
+// channel closed once it has stopped.
+type AlertBus interface {
+	Publish(ctx context.Context, a Alert) error
+	Subscribe(ctx context.Context, handle func(Alert)) (<-chan struct{}, error)
+}
+
+// AlertHistory is implemented by buses that keep the alerts they carry, so
+// clients can resume after an alert ID.
+type AlertHistory interface {
+	// After returns up to count alerts published after the ID after, oldest
+	// first. next is the ID to continue from, empty at the end of history.
+	After(ctx context.Context, after string, count int) (alerts []Alert, next string, err error)
+	// Trimmed reports whether alerts published after since have been dropped.
+	Trimmed(ctx context.Context, since streamID) (bool, error)
+}
+
+// StreamBus is the AlertBus on the Redis alert stream, consumed through the
+// consumer group so every alert is handled once across replicas.
+type StreamBus struct {
+	rdb    *redis.Client
+	logger *log.Logger
+}
+
+// NewStreamBus constructs a StreamBus.
+func NewStreamBus(rdb *redis.Client, logger *log.Logger) *StreamBus {
+	return &StreamBus{rdb: rdb, logger: logger}
+}
+
+func (b *StreamBus) Publish(ctx context.Context, a Alert) error {
+	a.ID = "" // assigned by the stream
+	v, _ := json.Marshal(a)
+	return b.rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: conf.AlertStream,
+		MaxLen: conf.AlertStreamMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{streamAlertField: string(v)},
+	}).Err()
+}
+
+func (b *StreamBus) Subscribe(ctx context.Context, handle func(Alert)) (<-chan struct{}, error) {
+	if err := b.ensureGroup(ctx); err != nil {
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		b.consumeGroup(ctx, handle)
+	}()
+	return done, nil
+}
+
+func (b *StreamBus) After(ctx context.Context, after string, count int) ([]Alert, string, error) {
+	msgs, err := b.rdb.XRangeN(ctx, conf.AlertStream, "("+after, "+", int64(count)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	alerts := make([]Alert, 0, len(msgs))
+	for _, msg := range msgs {
+		if a, err := alertFromStream(msg); err == nil {
+			alerts = append(alerts, normalizeAlert(a))
+		}
+	}
+	if len(msgs) < count {
+		return alerts, "", nil
+	}
+	return alerts, msgs[len(msgs)-1].ID, nil
+}
+
+func (b *StreamBus) Trimmed(ctx context.Context, since streamID) (bool, error) {
+	// Redis 7+ tracks the newest entry removed by trimming
+	info, err := b.rdb.XInfoStream(ctx, conf.AlertStream).Result()
+	if err != nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return false, nil
+		}
+		return false, err
+	}
+	maxDeleted, err := parseStreamID(info.MaxDeletedEntryID)
+	return err == nil && since.less(maxDeleted), nil
+}
+
+// ensureGroup creates the consumer group (and stream) if missing.
+func (b *StreamBus) ensureGroup(ctx context.Context) error {
+	err := b.rdb.XGroupCreateMkStream(ctx, conf.AlertStream, conf.AlertGroup, "$").Err()
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return err
+	}
+	return nil
+}
+
+// consumeGroup reads the stream through the consumer group until ctx ends.
+// Entries left pending by a previous run of this consumer are handled first,
+// and entries abandoned by dead consumers are claimed periodically.
+func (b *StreamBus) consumeGroup(ctx context.Context, handle func(Alert)) {
+	// "0" re-reads our own pending entries; ">" reads new ones
+	cursor := "0"
+	claimTicker := time.NewTicker(time.Minute)
+	defer claimTicker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			b.logger.Println("[stream] stopping consumer")
+			return
+		case <-claimTicker.C:
+			b.claimAbandoned(ctx, handle)
+		default:
+		}
+		res, err := b.rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    conf.AlertGroup,
+			Consumer: conf.AlertConsumer,
+			Streams:  []string{conf.AlertStream, cursor},
+			Count:    100,
+			Block:    5 * time.Second,
+		}).Result()
+		if errors.Is(err, redis.Nil) {
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				continue
+			}
+			b.logger.Printf("[stream] read err: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		for _, s := range res {
+			if cursor == "0" && len(s.Messages) == 0 {
+				cursor = ">" // pending backlog drained
+			}
+			b.handleStreamMessages(ctx, s.Messages, handle)
+		}
+	}
+}
+
+// handleStreamMessages handles and acknowledges a batch of entries.
+func (b *StreamBus) handleStreamMessages(ctx context.Context, msgs []redis.XMessage, handle func(Alert)) {
+	for _, msg := range msgs {
+		a, err := alertFromStream(msg)
+		if err != nil {
+			b.logger.Printf("[stream] invalid alert payload: %v", err)
+		} else {
+			handle(normalizeAlert(a))
+		}
+		// invalid entries are acknowledged too so they are not redelivered forever
+		if err := b.rdb.XAck(ctx, conf.AlertStream, conf.AlertGroup, msg.ID).Err(); err != nil {
+			b.logger.Printf("[stream] ack %s err: %v", msg.ID, err)
+		}
+	}
+}
+
+// claimAbandoned takes over entries pending for over a minute on other consumers.
+func (b *StreamBus) claimAbandoned(ctx context.Context, handle func(Alert)) {
+	start := "0-0"
+	for {
+		msgs, next, err := b.rdb.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+			Stream:   conf.AlertStream,
+			Group:    conf.AlertGroup,
+			Consumer: conf.AlertConsumer,
+			MinIdle:  time.Minute,
+			Start:    start,
+			Count:    100,
+		}).Result()
+		if err != nil {
+			b.logger.Printf("[stream] autoclaim err: %v", err)
+			return
+		}
+		b.handleStreamMessages(ctx, msgs, handle)
+		if next == "0-0" || next == "" {
+			return
+		}
+		start = next
+	}
+}
+
+// PubSubBus is the legacy fire-and-forget AlertBus on a Redis channel.
+// Its alerts carry no resumable ID.
+type PubSubBus struct {
+	rdb     *redis.Client
+	channel string
+	logger  *log.Logger
+}
+
+// NewPubSubBus constructs a PubSubBus on channel.
+func NewPubSubBus(rdb *redis.Client, channel string, logger *log.Logger) *PubSubBus {
+	return &PubSubBus{rdb: rdb, channel: channel, logger: logger}
+}
+
+func (b *PubSubBus) Publish(ctx context.Context, a Alert) error {
+	a.ID = ""
+	v, _ := json.Marshal(a)
+	return b.rdb.Publish(ctx, b.channel, v).Err()
+}
+
+func (b *PubSubBus) Subscribe(ctx context.Context, handle func(Alert)) (<-chan struct{}, error) {
+	ps := b.rdb.Subscribe(ctx, b.channel)
+	// wait for subscription to be ready
+	if _, err := ps.Receive(ctx); err != nil {
+		_ = ps.Close()
+		return nil, err
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ch := ps.Channel()
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					b.logger.Println("[sub] channel closed")
+					return
+				}
+				var a Alert
+				if err := json.Unmarshal([]byte(msg.Payload), &a); err != nil {
+					b.logger.Printf("[sub] invalid alert payload: %v\n", err)
+					continue
+				}
+				a.ID = "" // pub/sub alerts carry no resumable ID
+				handle(a)
+			case <-ctx.Done():
+				b.logger.Println("[sub] stopping subscription")
+				_ = ps.Close()
+				return
+			}
+		}
+	}()
+	return done, nil
+}
+
+// MemoryBus is an AlertBus in process, for tests. Publish hands the alert
+// to every subscriber before it returns, with a stream-style ID, so alerts
+// arrive in publish order; handlers must not publish themselves. Like the
+// stream, it keeps the latest memoryBusHistory alerts for resuming.
+type MemoryBus struct {
+	mu       sync.Mutex
+	last     streamID
+	nextSub  int
+	handlers map[int]func(Alert)
+	history  []Alert
+	trimmed  streamID // newest alert dropped from history
+}
+
+const memoryBusHistory = 10000
+
+// NewMemoryBus constructs a MemoryBus without subscribers.
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{handlers: make(map[int]func(Alert))}
+}
+
+func (b *MemoryBus) Publish(ctx context.Context, a Alert) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := streamID{ms: uint64(time.Now().UnixMilli())}
+	if !b.last.less(id) {
+		id = streamID{b.last.ms, b.last.seq + 1}
+	}
+	b.last = id
+	a.ID = fmt.Sprintf("%d-%d", id.ms, id.seq)
+	a = normalizeAlert(a)
+	if len(b.history) == memoryBusHistory {
+		b.trimmed, _ = parseStreamID(b.history[0].ID)
+		b.history = append(b.history[:0], b.history[1:]...)
+	}
+	b.history = append(b.history, a)
+	for _, h := range b.handlers {
+		h(a)
+	}
+	return nil
+}
+
+func (b *MemoryBus) After(ctx context.Context, after string, count int) ([]Alert, string, error) {
+	afterID, err := parseStreamID(after)
+	if err != nil {
+		return nil, "", err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make([]Alert, 0)
+	for _, a := range b.history {
+		if id, _ := parseStreamID(a.ID); !afterID.less(id) {
+			continue
+		}
+		if len(out) == count {
+			return out, out[len(out)-1].ID, nil
+		}
+		out = append(out, a)
+	}
+	return out, "", nil
+}
+
+func (b *MemoryBus) Trimmed(ctx context.Context, since streamID) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return since.less(b.trimmed), nil
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context, handle func(Alert)) (<-chan struct{}, error) {
+	b.mu.Lock()
+	sub := b.nextSub
+	b.nextSub++
+	b.handlers[sub] = handle
+	b.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.handlers, sub)
+		b.mu.Unlock()
+	}()
+	return done, nil
+}
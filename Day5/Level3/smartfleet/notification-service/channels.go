@@ -0,0 +1,307 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Channel delivers an alert to one recipient. The recipient format depends on
+// the channel: an email address, a webhook URL or a phone number.
+type Channel interface {
+	Name() string
+	Send(ctx context.Context, to string, a Alert) error
+}
+
+// DigestSender is implemented by channels that can deliver digests (see
+// digest.go).
+type DigestSender interface {
+	SendDigest(ctx context.Context, to string, d *Digest) error
+}
+
+// permanentError marks a failure that retrying will not fix (bad address,
+// rejected payload), so the dispatcher gives up immediately.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so it is not retried.
+func Permanent(err error) error { return permanentError{err} }
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// alertSubject is the one-line summary used by email and SMS.
+func alertSubject(a Alert) string {
+	s := fmt.Sprintf("[%s] %s: %s", a.Level, a.VehicleID, a.Message)
+	// no header injection through alert text
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
+
+// httpStatusError classifies a non-2xx response: 4xx other than 408/429 is
+// permanent, everything else is retried.
+func httpStatusError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err := fmt.Errorf("http %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 &&
+		resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+		return Permanent(err)
+	}
+	return err
+}
+
+// EmailChannel sends alerts through an SMTP relay, upgrading to STARTTLS when
+// the server offers it.
+type EmailChannel struct {
+	Addr     string // host:port
+	From     string
+	Username string // optional PLAIN auth
+	Password string
+	Timeout  time.Duration
+}
+
+func (e *EmailChannel) Name() string { return "email" }
+
+func (e *EmailChannel) Send(ctx context.Context, to string, a Alert) error {
+	return e.send(ctx, to, e.message(to, a))
+}
+
+// SendDigest mails the digest as text with an HTML alternative.
+func (e *EmailChannel) SendDigest(ctx context.Context, to string, d *Digest) error {
+	return e.send(ctx, to, e.digestMessage(to, d))
+}
+
+// send delivers one message through the relay.
+func (e *EmailChannel) send(ctx context.Context, to string, msg []byte) error {
+	host, _, err := net.SplitHostPort(e.Addr)
+	if err != nil {
+		return Permanent(fmt.Errorf("smtp addr: %w", err))
+	}
+	timeout := e.Timeout
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	d := net.Dialer{Timeout: timeout}
+	conn, err := d.DialContext(ctx, "tcp", e.Addr)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(timeout))
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if e.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", e.Username, e.Password, host)); err != nil {
+			return smtpError(err)
+		}
+	}
+	if err := c.Mail(e.From); err != nil {
+		return smtpError(err)
+	}
+	if err := c.Rcpt(to); err != nil {
+		return smtpError(err)
+	}
+	w, err := c.Data()
+	if err != nil {
+		return smtpError(err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return smtpError(err)
+	}
+	return c.Quit()
+}
+
+func (e *EmailChannel) header(b *bytes.Buffer, to, subject string) {
+	fmt.Fprintf(b, "From: %s\r\n", e.From)
+	fmt.Fprintf(b, "To: %s\r\n", to)
+	fmt.Fprintf(b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+}
+
+func (e *EmailChannel) message(to string, a Alert) []byte {
+	var b bytes.Buffer
+	e.header(&b, to, alertSubject(a))
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	fmt.Fprintf(&b, "%s\r\n\r\n", a.Message)
+	fmt.Fprintf(&b, "Vehicle: %s\r\nLevel: %s\r\nTime: %s\r\n", a.VehicleID, a.Level, a.Ts.UTC().Format(time.RFC3339))
+	if a.Rule != "" {
+		fmt.Fprintf(&b, "Rule: %s\r\n", a.Rule)
+	}
+	if a.ID != "" {
+		fmt.Fprintf(&b, "Alert ID: %s\r\n", a.ID)
+	}
+	return b.Bytes()
+}
+
+// digestMessage is a multipart/alternative message: plain text first, so
+// clients without HTML show it, then the HTML version.
+func (e *EmailChannel) digestMessage(to string, d *Digest) []byte {
+	var b bytes.Buffer
+	e.header(&b, to, strings.NewReplacer("\r", " ", "\n", " ").Replace(d.Subject))
+	mw := multipart.NewWriter(&b)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	for _, part := range []struct{ typ, body string }{
+		{"text/plain; charset=UTF-8", d.Text},
+		{"text/html; charset=UTF-8", d.HTML},
+	} {
+		pw, _ := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.typ},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		qw := quotedprintable.NewWriter(pw)
+		_, _ = qw.Write([]byte(part.body))
+		_ = qw.Close()
+	}
+	_ = mw.Close()
+	return b.Bytes()
+}
+
+// smtpError makes 5xx replies (unknown mailbox, rejected sender) permanent.
+func smtpError(err error) error {
+	var tp *textproto.Error
+	if errors.As(err, &tp) && tp.Code >= 500 {
+		return Permanent(err)
+	}
+	return err
+}
+
+// Webhook signature headers. The signature is hex HMAC-SHA256 over
+// "<timestamp>.<body>" so receivers can reject replays of old deliveries.
+const (
+	webhookSignatureHeader = "X-Smartfleet-Signature"
+	webhookTimestampHeader = "X-Smartfleet-Timestamp"
+)
+
+// WebhookChannel POSTs the alert JSON to the recipient URL.
+type WebhookChannel struct {
+	Secret string
+	Client *http.Client
+}
+
+func (wh *WebhookChannel) Name() string { return "webhook" }
+
+// SignWebhook computes the signature header value for a webhook body.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *WebhookChannel) Send(ctx context.Context, to string, a Alert) error {
+	body, _ := json.Marshal(a)
+	return wh.post(ctx, to, body)
+}
+
+// SendDigest posts {"type":"digest","digest":{...},"subject","text","html"}.
+func (wh *WebhookChannel) SendDigest(ctx context.Context, to string, d *Digest) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"type": "digest", "digest": d, "subject": d.Subject, "text": d.Text, "html": d.HTML,
+	})
+	return wh.post(ctx, to, body)
+}
+
+func (wh *WebhookChannel) post(ctx context.Context, to string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, to, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookTimestampHeader, ts)
+	if wh.Secret != "" {
+		req.Header.Set(webhookSignatureHeader, SignWebhook(wh.Secret, ts, body))
+	}
+	resp, err := wh.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpStatusError(resp)
+	}
+	return nil
+}
+
+// SMSChannel adapts a generic HTTP SMS gateway: it POSTs
+// {"to","from","text"} with a bearer token, which most providers accept
+// directly or through a thin proxy.
+type SMSChannel struct {
+	GatewayURL string
+	Token      string
+	From       string
+	Client     *http.Client
+}
+
+// maxSMSLength keeps messages to one concatenated SMS.
+const maxSMSLength = 306
+
+func (s *SMSChannel) Name() string { return "sms" }
+
+func (s *SMSChannel) Send(ctx context.Context, to string, a Alert) error {
+	return s.send(ctx, to, alertSubject(a))
+}
+
+// SendDigest texts the digest's subject line; the full digest needs email
+// or a webhook.
+func (s *SMSChannel) SendDigest(ctx context.Context, to string, d *Digest) error {
+	return s.send(ctx, to, d.Subject)
+}
+
+func (s *SMSChannel) send(ctx context.Context, to, text string) error {
+	if r := []rune(text); len(r) > maxSMSLength {
+		text = string(r[:maxSMSLength-1]) + "…"
+	}
+	body, _ := json.Marshal(map[string]string{"to": to, "from": s.From, "text": text})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.GatewayURL, bytes.NewReader(body))
+	if err != nil {
+		return Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return httpStatusError(resp)
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testAlert = Alert{
+	ID:        "1700000000000-0",
+	TenantID:  "tenant-a",
+	VehicleID: "v1",
+	Level:     "CRITICAL",
+	Message:   "engine overheating",
+	Rule:      "engine_temp",
+	Ts:        time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC),
+}
+
+// fakeSMTP is a minimal SMTP server: no TLS, no auth, one message per
+// connection. Recipients starting with "bad" are rejected with 550.
+type fakeSMTP struct {
+	ln   net.Listener
+	mu   sync.Mutex
+	rcpt []string
+	data []string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{ln: ln}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost fake smtp")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			tp.PrintfLine("250 localhost")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			tp.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			addr := strings.Trim(line[len("RCPT TO:"):], "<> ")
+			if strings.HasPrefix(addr, "bad") {
+				tp.PrintfLine("550 no such user")
+				continue
+			}
+			s.mu.Lock()
+			s.rcpt = append(s.rcpt, addr)
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case cmd == "DATA":
+			tp.PrintfLine("354 go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.data = append(s.data, string(b))
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case cmd == "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestEmailChannelSendsThroughSMTP(t *testing.T) {
+	srv := newFakeSMTP(t)
+	ch := &EmailChannel{Addr: srv.ln.Addr().String(), From: "alerts@smartfleet.test", Timeout: 5 * time.Second}
+
+	if err := ch.Send(context.Background(), "ops@example.com", testAlert); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.rcpt) != 1 || srv.rcpt[0] != "ops@example.com" {
+		t.Fatalf("recipients = %v", srv.rcpt)
+	}
+	if len(srv.data) != 1 {
+		t.Fatalf("got %d messages", len(srv.data))
+	}
+	msg := srv.data[0]
+	for _, want := range []string{"Subject: [CRITICAL] v1: engine overheating", "To: ops@example.com", "Alert ID: 1700000000000-0"} {
+		if !strings.Contains(msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg)
+		}
+	}
+}
+
+func TestEmailChannelRejectedRecipientIsPermanent(t *testing.T) {
+	srv := newFakeSMTP(t)
+	ch := &EmailChannel{Addr: srv.ln.Addr().String(), From: "alerts@smartfleet.test", Timeout: 5 * time.Second}
+
+	err := ch.Send(context.Background(), "bad@example.com", testAlert)
+	if err == nil || !isPermanent(err) {
+		t.Fatalf("Send to rejected recipient = %v, want permanent error", err)
+	}
+}
+
+func TestAlertSubjectStripsNewlines(t *testing.T) {
+	a := testAlert
+	a.Message = "x\r\nBcc: evil@example.com"
+	if s := alertSubject(a); strings.ContainsAny(s, "\r\n") {
+		t.Fatalf("subject contains line breaks: %q", s)
+	}
+}
+
+func TestWebhookChannelSignsBody(t *testing.T) {
+	const secret = "s3cret"
+	var got Alert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		ts := r.Header.Get(webhookTimestampHeader)
+		if r.Header.Get(webhookSignatureHeader) != SignWebhook(secret, ts, body) {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		_ = json.Unmarshal(body, &got)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	ch := &WebhookChannel{Secret: secret, Client: srv.Client()}
+	if err := ch.Send(context.Background(), srv.URL, testAlert); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got.ID != testAlert.ID || got.VehicleID != "v1" {
+		t.Fatalf("receiver got %+v", got)
+	}
+
+	// a receiver with another secret rejects the delivery, and 401 is not retried
+	ch.Secret = "other"
+	if err := ch.Send(context.Background(), srv.URL, testAlert); err == nil || !isPermanent(err) {
+		t.Fatalf("Send with wrong secret = %v, want permanent error", err)
+	}
+}
+
+func TestWebhookChannelServerErrorIsRetryable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "boom", http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	err := (&WebhookChannel{Client: srv.Client()}).Send(context.Background(), srv.URL, testAlert)
+	if err == nil || isPermanent(err) {
+		t.Fatalf("Send = %v, want retryable error", err)
+	}
+}
+
+func TestSMSChannelPostsToGateway(t *testing.T) {
+	var req map[string]string
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	a := testAlert
+	a.Message = strings.Repeat("x", 400)
+	ch := &SMSChannel{GatewayURL: srv.URL, Token: "tok", From: "SmartFleet", Client: srv.Client()}
+	if err := ch.Send(context.Background(), "+15550100", a); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if auth != "Bearer tok" {
+		t.Errorf("Authorization = %q", auth)
+	}
+	if req["to"] != "+15550100" || req["from"] != "SmartFleet" {
+		t.Errorf("gateway request = %v", req)
+	}
+	if n := len([]rune(req["text"])); n != maxSMSLength {
+		t.Errorf("text length = %d, want %d", n, maxSMSLength)
+	}
+}
+
+func TestRoutingRules(t *testing.T) {
+	channels := map[string]Channel{"webhook": &WebhookChannel{}}
+	rules, err := ParseRoutingRules([]byte(`[
+		{"name":"critical","tenant":"tenant-a","levels":["CRITICAL"],"channel":"webhook","to":["http://x"]},
+		{"name":"night","tenant":"tenant-a","groups":[7],"hours":"22:00-06:00","days":["fri"],"timezone":"Europe/Berlin","channel":"webhook","to":["http://y"]}
+	]`), channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	critical, night := rules[0], rules[1]
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	fri23 := time.Date(2024, 3, 1, 23, 0, 0, 0, berlin) // Friday
+	sat05 := time.Date(2024, 3, 2, 5, 0, 0, 0, berlin)  // still Friday night
+	sat23 := time.Date(2024, 3, 2, 23, 0, 0, 0, berlin)
+	fri12 := time.Date(2024, 3, 1, 12, 0, 0, 0, berlin)
+
+	grouped := testAlert
+	grouped.Level = "WARNING"
+	grouped.GroupID = uintPtr(7)
+	otherTenant := testAlert
+	otherTenant.TenantID = "tenant-b"
+
+	cases := []struct {
+		name string
+		rule *RoutingRule
+		a    Alert
+		at   time.Time
+		want bool
+	}{
+		{"level match", critical, testAlert, fri12, true},
+		{"level mismatch", critical, grouped, fri12, false},
+		{"other tenant", critical, otherTenant, fri12, false},
+		{"night window on friday", night, grouped, fri23, true},
+		{"wrapped window after midnight", night, grouped, sat05, true},
+		{"saturday night", night, grouped, sat23, false},
+		{"outside hours", night, grouped, fri12, false},
+		{"group mismatch", night, testAlert, fri23, false},
+	}
+	for _, tc := range cases {
+		if got := tc.rule.Matches(tc.a, tc.at); got != tc.want {
+			t.Errorf("%s: Matches = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	for _, bad := range []string{
+		`[{"name":"x","channel":"email","to":["a@b"]}]`,
+		`[{"name":"x","channel":"webhook"}]`,
+		`[{"name":"x","channel":"webhook","to":["u"],"hours":"9-17"}]`,
+		`[{"name":"x","channel":"webhook","to":["u"],"days":["someday"]}]`,
+	} {
+		if _, err := ParseRoutingRules([]byte(bad), channels); err == nil {
+			t.Errorf("ParseRoutingRules(%s) accepted invalid rule", bad)
+		}
+	}
+}
+
+// memDeliveryLog is an in-memory DeliveryLog for tests.
+type memDeliveryLog struct {
+	mu   sync.Mutex
+	recs []DeliveryRecord
+}
+
+func (l *memDeliveryLog) Record(_ context.Context, rec DeliveryRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.recs = append(l.recs, rec)
+	return nil
+}
+
+func (l *memDeliveryLog) List(_ context.Context, tenant string, limit int) ([]DeliveryRecord, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []DeliveryRecord
+	for i := len(l.recs) - 1; i >= 0 && len(out) < limit; i-- {
+		if l.recs[i].TenantID == tenant {
+			out = append(out, l.recs[i])
+		}
+	}
+	return out, nil
+}
+
+func dispatchOnce(t *testing.T, handler http.HandlerFunc) DeliveryRecord {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+	channels := map[string]Channel{"webhook": &WebhookChannel{Client: srv.Client()}}
+	rules, err := ParseRoutingRules([]byte(`[{"name":"all","tenant":"tenant-a","channel":"webhook","to":["`+srv.URL+`"]}]`), channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dlog := &memDeliveryLog{}
+	retry := RetryPolicy{MaxAttempts: 4, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+	d := NewDispatcher(channels, rules, dlog, retry, 2, nil, log.New(io.Discard, "", 0))
+	d.Dispatch(testAlert)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		recs, _ := dlog.List(context.Background(), "tenant-a", 10)
+		if len(recs) > 0 {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			d.Close(ctx)
+			cancel()
+			if len(recs) != 1 {
+				t.Fatalf("got %d delivery records", len(recs))
+			}
+			return recs[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("delivery did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWebhookRequiresSecret(t *testing.T) {
+	saved := conf
+	t.Cleanup(func() { conf = saved })
+	for _, tc := range []struct{ name, routes, escalations, digests string }{
+		{"routing rule", `[{"name":"all","channel":"webhook","to":["https://hooks.example.com"]}]`, "", ""},
+		{"escalation tier", "", `[{"name":"p","levels":["CRITICAL"],"tiers":[{"after":"5m","channel":"webhook","to":["https://hooks.example.com"]}]}]`, ""},
+		{"digest", "", "", `[{"name":"d","period":"daily","channel":"webhook","to":["https://hooks.example.com"]}]`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conf = saved
+			conf.Routes, conf.Escalations, conf.Digests = tc.routes, tc.escalations, tc.digests
+			conf.WebhookSecret = ""
+			n, err := NewNotificationService(nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n.transport = TransportStream
+			err = n.configureDelivery()
+			if err == nil || !strings.Contains(err.Error(), `channel "webhook" is not configured`) {
+				t.Fatalf("configureDelivery without WEBHOOK_SECRET: err = %v", err)
+			}
+		})
+	}
+
+	conf = saved
+	conf.Routes = `[{"name":"all","channel":"webhook","to":["https://hooks.example.com"]}]`
+	conf.WebhookSecret = "s3cret"
+	n, err := NewNotificationService(nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.configureDelivery(); err != nil {
+		t.Fatal(err)
+	}
+	n.dispatcher.Close(context.Background())
+}
+
+func TestDispatcherRetriesWithBackoff(t *testing.T) {
+	var calls atomic.Int32
+	rec := dispatchOnce(t, func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 2 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	if rec.Status != DeliverySent || rec.Attempts != 3 || rec.LastError != "" {
+		t.Fatalf("record = %+v, want sent after 3 attempts", rec)
+	}
+	if rec.AlertID != testAlert.ID || rec.Rule != "all" || rec.Channel != "webhook" {
+		t.Fatalf("record = %+v", rec)
+	}
+}
+
+func TestDispatcherDoesNotRetryPermanentFailure(t *testing.T) {
+	var calls atomic.Int32
+	rec := dispatchOnce(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "gone", http.StatusGone)
+	})
+	if rec.Status != DeliveryFailed || rec.Attempts != 1 || calls.Load() != 1 {
+		t.Fatalf("record = %+v after %d calls, want one failed attempt", rec, calls.Load())
+	}
+}
+
+func TestDispatcherGivesUpAfterMaxAttempts(t *testing.T) {
+	rec := dispatchOnce(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	})
+	if rec.Status != DeliveryFailed || rec.Attempts != 4 {
+		t.Fatalf("record = %+v, want failed after 4 attempts", rec)
+	}
+	if !strings.Contains(rec.LastError, "500") {
+		t.Fatalf("last error = %q", rec.LastError)
+	}
+}
+
+func TestDispatcherCloseFailsScheduledRetries(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+	channels := map[string]Channel{"webhook": &WebhookChannel{Client: srv.Client()}}
+	rules, _ := ParseRoutingRules([]byte(`[{"name":"all","tenant":"tenant-a","channel":"webhook","to":["`+srv.URL+`"]}]`), channels)
+	dlog := &memDeliveryLog{}
+	retry := RetryPolicy{MaxAttempts: 5, BaseDelay: time.Hour, MaxDelay: time.Hour}
+	d := NewDispatcher(channels, rules, dlog, retry, 1, nil, log.New(io.Discard, "", 0))
+	d.Dispatch(testAlert)
+
+	// wait for the first attempt to schedule its retry
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		d.mu.Lock()
+		n := len(d.waiting)
+		d.mu.Unlock()
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("retry was not scheduled")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	d.Close(ctx)
+	if ctx.Err() != nil {
+		t.Fatal("Close waited for the retry timer")
+	}
+	recs, _ := dlog.List(context.Background(), "tenant-a", 10)
+	if len(recs) != 1 || recs[0].Status != DeliveryFailed || recs[0].Attempts != 1 {
+		t.Fatalf("records = %+v", recs)
+	}
+}
@@ -0,0 +1,280 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// Clustering: with CLUSTER_MODE=true every replica reads the whole alert
+// stream (plain XREAD, no consumer group) and fans out to its own clients,
+// so a client sees every alert of its tenant whichever replica it lands on.
+// A client that reconnects elsewhere resumes with ?since=<last id>.
+// Incident tracking and outbound deliveries must happen once per alert, so
+// they still go through the shared consumer group.
+//
+// Each replica also publishes its presence (connection count, draining flag)
+// under presenceKeyPrefix+<replica id> with a TTL, indexed in presenceIndex.
+
+const (
+	presenceKeyPrefix = "notify:replica:"
+	presenceIndex     = "notify:replicas" // zset: replica id -> last heartbeat (unix ms)
+)
+
+// closeServiceRestart is sent to clients when a replica drains.
+const closeServiceRestart = 1012
+
+// ReplicaPresence is one replica's heartbeat record.
+type ReplicaPresence struct {
+	ID          string    `json:"id"`
+	Connections int       `json:"connections"`
+	Draining    bool      `json:"draining"`
+	StartedAt   time.Time `json:"started_at"`
+	HeartbeatAt time.Time `json:"heartbeat_at"`
+}
+
+// Count returns the number of connected clients.
+func (h *Hub) Count() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.clients)
+}
+
+// Drain asks every client to reconnect elsewhere. Each client gets a
+// "reconnect" message with a random retry delay below jitter, so clients do
+// not all land on the remaining replicas at once, followed by a close frame.
+func (h *Hub) Drain(jitter time.Duration) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		var wait time.Duration
+		if jitter > 0 {
+			wait = time.Duration(rand.Int63n(int64(jitter)))
+		}
+		ctl := wsControl{
+			reply:       &SubscriptionReply{Type: "reconnect", RetryAfterMs: wait.Milliseconds()},
+			closeCode:   closeServiceRestart,
+			closeReason: "draining",
+		}
+		select {
+		case c.control <- ctl:
+		default:
+			// control queue full: the client is dropped at shutdown instead
+		}
+	}
+}
+
+// StartFanout consumes the full alert stream on this replica (cluster mode).
+func (n *NotificationService) StartFanout(ctx context.Context) error {
+	ctxSub, cancel := context.WithCancel(ctx)
+	n.cancelSub = cancel
+
+	// continue right after the warmed tail so nothing falls between the two
+	last := n.warmRecent(ctxSub)
+	if last == "" {
+		last = "$"
+	}
+
+	go func() {
+		defer close(n.subRunning)
+		for ctxSub.Err() == nil {
+			res, err := n.rdb.XRead(ctxSub, &redis.XReadArgs{
+				Streams: []string{conf.AlertStream, last},
+				Count:   100,
+				Block:   5 * time.Second,
+			}).Result()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				if ctxSub.Err() == nil {
+					n.logger.Printf("[fanout] read err: %v", err)
+					time.Sleep(time.Second)
+				}
+				continue
+			}
+			for _, s := range res {
+				for _, msg := range s.Messages {
+					last = msg.ID
+					a, err := alertFromStream(msg)
+					if err != nil {
+						n.logger.Printf("[fanout] invalid alert payload: %v", err)
+						continue
+					}
+					a, span := startAlertSpan(a, "alerts fan-out")
+					if n.admit(a, true) {
+						n.deliver(a)
+					}
+					span.End()
+				}
+			}
+		}
+		n.logger.Println("[fanout] stopping stream reader")
+	}()
+
+	// the consumer group still hands each alert to one replica for the
+	// once-only work; fan-out above reads the stream itself, so this is Redis
+	done, err := NewStreamBus(n.rdb, n.logger).Subscribe(ctxSub, func(a Alert) {
+		a, span := startAlertSpan(a, "alerts process")
+		defer span.End()
+		if n.admit(a, false) {
+			n.handleOnce(a)
+		}
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+	n.workers.Add(1)
+	go func() {
+		defer n.workers.Done()
+		<-done
+	}()
+
+	go n.hub.Run(ctxSub)
+	return nil
+}
+
+// heartbeat writes this replica's presence record.
+func (n *NotificationService) heartbeat(ctx context.Context) error {
+	now := time.Now().UTC()
+	p := ReplicaPresence{
+		ID:          conf.ReplicaID,
+		Connections: n.hub.Count(),
+		Draining:    n.draining.Load(),
+		StartedAt:   n.startedAt,
+		HeartbeatAt: now,
+	}
+	b, _ := json.Marshal(p)
+	pipe := n.rdb.TxPipeline()
+	pipe.Set(ctx, presenceKeyPrefix+conf.ReplicaID, b, conf.PresenceTTL)
+	pipe.ZAdd(ctx, presenceIndex, redis.Z{Score: float64(now.UnixMilli()), Member: conf.ReplicaID})
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RunPresence refreshes this replica's presence until ctx ends, then removes it.
+func (n *NotificationService) RunPresence(ctx context.Context) {
+	ticker := time.NewTicker(conf.PresenceTTL / 3)
+	defer ticker.Stop()
+	for {
+		if err := n.heartbeat(ctx); err != nil && ctx.Err() == nil {
+			n.logger.Printf("[presence] heartbeat err: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			rctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			n.rdb.Del(rctx, presenceKeyPrefix+conf.ReplicaID)
+			n.rdb.ZRem(rctx, presenceIndex, conf.ReplicaID)
+			return
+		}
+	}
+}
+
+// errNoPresence is returned by Replicas when there is no Redis to track
+// replicas in.
+var errNoPresence = errors.New("replica presence unavailable without Redis")
+
+// Replicas lists live replicas and prunes ones whose heartbeat expired.
+func (n *NotificationService) Replicas(ctx context.Context) ([]ReplicaPresence, error) {
+	if n.rdb == nil {
+		return nil, errNoPresence
+	}
+	cutoff := time.Now().Add(-conf.PresenceTTL).UnixMilli()
+	if err := n.rdb.ZRemRangeByScore(ctx, presenceIndex, "-inf", "("+strconv.FormatInt(cutoff, 10)).Err(); err != nil {
+		return nil, err
+	}
+	ids, err := n.rdb.ZRange(ctx, presenceIndex, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]ReplicaPresence, 0, len(ids))
+	if len(ids) == 0 {
+		return out, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = presenceKeyPrefix + id
+	}
+	vals, err := n.rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range vals {
+		s, ok := v.(string)
+		if !ok {
+			continue // expired between ZRANGE and MGET
+		}
+		var p ReplicaPresence
+		if err := json.Unmarshal([]byte(s), &p); err == nil {
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// handleCluster reports the replicas and their connection counts.
+func (n *NotificationService) handleCluster(w http.ResponseWriter, r *http.Request) {
+	if _, err := n.auth.TenantFromRequest(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	replicas, err := n.Replicas(ctx)
+	if errors.Is(err, errNoPresence) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		n.logger.Printf("[cluster] list replicas: %v", err)
+		http.Error(w, "presence unavailable", http.StatusInternalServerError)
+		return
+	}
+	total := 0
+	for _, p := range replicas {
+		total += p.Connections
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"replica":           conf.ReplicaID,
+		"cluster_mode":      conf.ClusterMode,
+		"replicas":          replicas,
+		"total_connections": total,
+	})
+}
+
+// Drain stops accepting WebSocket clients, asks connected ones to reconnect
+// elsewhere and waits up to timeout for them to leave.
+func (n *NotificationService) Drain(ctx context.Context, timeout time.Duration) {
+	n.draining.Store(true)
+	if n.rdb != nil {
+		if err := n.heartbeat(ctx); err != nil {
+			n.logger.Printf("[drain] presence update err: %v", err)
+		}
+	}
+	n.hub.Drain(conf.ReconnectJitter)
+
+	deadline := time.Now().Add(timeout)
+	for n.hub.Count() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if left := n.hub.Count(); left > 0 {
+		n.logger.Printf("[drain] %d clients still connected after %s", left, timeout)
+	}
+}
+
+// writeClose sends a close frame; the reader then sees the close and unregisters.
+func writeClose(c *Client, code int, reason string) error {
+	msg := websocket.FormatCloseMessage(code, reason)
+	return c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+}
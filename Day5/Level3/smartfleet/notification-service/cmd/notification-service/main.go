@@ -0,0 +1,10 @@
+// Command notification-service pushes alerts to WebSocket and SSE clients
+// and outbound channels. The service lives in package notification, where
+// the pipeline harness wires it up in process.
+package main
+
+import notification "smartfleet/notification-service"
+
+func main() {
+	notification.Main()
+}
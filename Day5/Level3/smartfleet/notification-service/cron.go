@@ -0,0 +1,157 @@
+package notification
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron is a five-field cron schedule ("minute hour day-of-month month
+// day-of-week") evaluated in a time zone. Fields take *, numbers, ranges
+// (1-5), steps (*/15, 8-18/2) and comma lists; day-of-week also takes
+// sun..sat, with 0 and 7 both Sunday. As in classic cron, when both day
+// fields are restricted a day matches if either does.
+type Cron struct {
+	spec                          string
+	minute, hour, dom, month, dow uint64 // bit i set: value i matches
+	domAny, dowAny                bool   // the field starts with *
+	loc                           *time.Location
+}
+
+var cronDays = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// ParseCron parses spec for the given zone (nil means UTC).
+func ParseCron(spec string, loc *time.Location) (*Cron, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron %q: want 5 fields (minute hour day month weekday)", spec)
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	c := &Cron{spec: spec, loc: loc}
+	var err error
+	if c.minute, err = cronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron %q minute: %w", spec, err)
+	}
+	if c.hour, err = cronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron %q hour: %w", spec, err)
+	}
+	if c.dom, err = cronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron %q day of month: %w", spec, err)
+	}
+	if c.month, err = cronField(fields[3], 1, 12, nil); err != nil {
+		return nil, fmt.Errorf("cron %q month: %w", spec, err)
+	}
+	if c.dow, err = cronField(fields[4], 0, 7, cronDays); err != nil {
+		return nil, fmt.Errorf("cron %q day of week: %w", spec, err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1 // 7 is Sunday too
+	}
+	c.domAny, c.dowAny = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// cronField parses one field into a bit set of the values in [lo, hi].
+func cronField(s string, lo, hi int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("bad step %q", stepStr)
+			}
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = cronValue(a, lo, hi, names); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = cronValue(b, lo, hi, names); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				to = hi // "5/15" means 5-hi/15
+			}
+			if to < from {
+				return 0, fmt.Errorf("bad range %q", rng)
+			}
+		}
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func cronValue(s string, lo, hi int, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < lo || v > hi {
+		return 0, fmt.Errorf("bad value %q (want %d-%d)", s, lo, hi)
+	}
+	return v, nil
+}
+
+func (c *Cron) String() string { return c.spec }
+
+func (c *Cron) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if !c.domAny && !c.dowAny {
+		return dom || dow
+	}
+	return dom && dow
+}
+
+// Next returns the first matching minute after t, or the zero time if
+// there is none within five years (e.g. "0 0 30 2 *"). Wall-clock times
+// skipped by a daylight saving change do not fire, and times repeated by one
+// fire only the first time.
+func (c *Cron) Next(t time.Time) time.Time {
+	t = c.step(t.In(c.loc))
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		y, m, d := t.Date()
+		switch {
+		case c.month&(1<<uint(m)) == 0:
+			t = time.Date(y, m+1, 1, 0, 0, 0, 0, c.loc)
+		case !c.dayMatches(t):
+			t = time.Date(y, m, d+1, 0, 0, 0, 0, c.loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			next := time.Date(y, m, d, t.Hour()+1, 0, 0, 0, c.loc)
+			if !next.After(t) {
+				next = c.step(t)
+			}
+			t = next
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = c.step(t)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// step advances t to the next minute, skipping wall-clock minutes repeated
+// when the clock goes back.
+func (c *Cron) step(t time.Time) time.Time {
+	next := t.Truncate(time.Minute).Add(time.Minute)
+	y, m, d := t.Date()
+	if ny, nm, nd := next.Date(); ny == y && nm == m && nd == d &&
+		next.Hour()*60+next.Minute() <= t.Hour()*60+t.Minute() {
+		return time.Date(y, m, d, t.Hour()+1, 0, 0, 0, c.loc)
+	}
+	return next
+}
@@ -0,0 +1,62 @@
+package notification
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(loc *time.Location, s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	cases := []struct {
+		spec  string
+		loc   *time.Location
+		after string
+		want  string
+	}{
+		{"0 7 * * *", time.UTC, "2024-03-01 06:59", "2024-03-01 07:00"},
+		{"0 7 * * *", time.UTC, "2024-03-01 07:00", "2024-03-02 07:00"},
+		{"30 6 * * mon-fri", time.UTC, "2024-03-01 07:00", "2024-03-04 06:30"}, // Friday -> Monday
+		{"*/15 8-9 * * *", time.UTC, "2024-03-01 09:50", "2024-03-02 08:00"},
+		{"0 7 1 * mon", time.UTC, "2024-03-01 08:00", "2024-03-04 07:00"}, // day of month OR weekday
+		{"0 0 29 2 *", time.UTC, "2024-03-01 00:00", "2028-02-29 00:00"},
+		{"0 7 * * 7", time.UTC, "2024-03-01 00:00", "2024-03-03 07:00"}, // 7 is Sunday
+		{"0 7 * * *", berlin, "2024-03-30 08:00", "2024-03-31 07:00"},
+		{"30 2 * * *", berlin, "2024-03-30 03:00", "2024-04-01 02:30"}, // 02:30 does not exist on the 31st
+	}
+	for _, tc := range cases {
+		c, err := ParseCron(tc.spec, tc.loc)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.spec, err)
+		}
+		got := c.Next(at(tc.loc, tc.after))
+		if want := at(tc.loc, tc.want); !got.Equal(want) {
+			t.Errorf("%s after %s = %s, want %s", tc.spec, tc.after, got, want)
+		}
+	}
+
+	// the clock goes back from 03:00 to 02:00 on 27 Oct: 02:30 fires once
+	c, _ := ParseCron("30 2 * * *", berlin)
+	first := c.Next(at(berlin, "2024-10-27 00:00"))
+	if second := c.Next(first); second.Sub(first) < 24*time.Hour {
+		t.Errorf("repeated hour fired twice: %s and %s", first, second)
+	}
+
+	if c, _ := ParseCron("0 0 30 2 *", time.UTC); !c.Next(time.Now()).IsZero() {
+		t.Error("impossible schedule has a next time")
+	}
+	for _, bad := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *", "* * * * 8", "5-1 * * * *", "*/0 * * * *", "* * * * funday"} {
+		if _, err := ParseCron(bad, nil); err == nil {
+			t.Errorf("ParseCron(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,627 @@
+package notification
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Digests summarise a tenant's alerts for people who do not want them in
+// real time. Each schedule fires on a cron expression in its time zone and
+// covers the day or week before: alert counts by level and vehicle, the top
+// offenders, unresolved incidents and, with ANALYTICS_URL set, trip totals.
+// Every replica runs the scheduler; a Redis key per schedule and firing
+// makes sure only one of them sends it.
+
+// Digest periods
+const (
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// defaultDigestTop is how many vehicles and incidents a digest lists.
+const defaultDigestTop = 5
+
+// DigestSchedule sends one tenant's digest to recipients on a channel:
+//
+//	{"name":"ops-morning","tenant":"acme","period":"daily","cron":"0 7 * * 1-5",
+//	 "timezone":"Europe/Berlin","channel":"email","to":["ops@example.com"]}
+type DigestSchedule struct {
+	Name     string   `json:"name"`
+	Tenant   string   `json:"tenant,omitempty"` // defaults to DEFAULT_TENANT
+	Period   string   `json:"period"`           // daily or weekly
+	Cron     string   `json:"cron,omitempty"`   // default 07:00 daily, Mondays 07:00 weekly
+	Timezone string   `json:"timezone,omitempty"`
+	Channel  string   `json:"channel"`
+	To       []string `json:"to"`
+	Locale   string   `json:"locale,omitempty"` // for alert and incident messages
+	Top      int      `json:"top,omitempty"`    // vehicles and incidents listed, default 5
+
+	cron *Cron
+	loc  *time.Location
+}
+
+// ParseDigestSchedules parses and validates the NOTIFY_DIGESTS JSON array.
+// The channel of each schedule must be able to send digests.
+func ParseDigestSchedules(data []byte, channels map[string]Channel) ([]*DigestSchedule, error) {
+	var schedules []*DigestSchedule
+	if err := json.Unmarshal(data, &schedules); err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool, len(schedules))
+	for i, s := range schedules {
+		if s.Name == "" {
+			return nil, fmt.Errorf("digest #%d: name is required", i)
+		}
+		if names[s.Name] {
+			return nil, fmt.Errorf("digest %s: duplicate name", s.Name)
+		}
+		names[s.Name] = true
+		if err := s.compile(channels); err != nil {
+			return nil, fmt.Errorf("digest %s: %w", s.Name, err)
+		}
+	}
+	return schedules, nil
+}
+
+func (s *DigestSchedule) compile(channels map[string]Channel) error {
+	if s.Tenant == "" {
+		s.Tenant = conf.DefaultTenant
+	}
+	ch, ok := channels[s.Channel]
+	if !ok {
+		return fmt.Errorf("channel %q is not configured", s.Channel)
+	}
+	if _, ok := ch.(DigestSender); !ok {
+		return fmt.Errorf("channel %q cannot send digests", s.Channel)
+	}
+	if len(s.To) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	switch s.Period {
+	case DigestDaily:
+		if s.Cron == "" {
+			s.Cron = "0 7 * * *"
+		}
+	case DigestWeekly:
+		if s.Cron == "" {
+			s.Cron = "0 7 * * mon"
+		}
+	default:
+		return fmt.Errorf("period %q: want daily or weekly", s.Period)
+	}
+	if s.Top <= 0 {
+		s.Top = defaultDigestTop
+	}
+	s.loc = time.UTC
+	if s.Timezone != "" {
+		var err error
+		if s.loc, err = time.LoadLocation(s.Timezone); err != nil {
+			return err
+		}
+	}
+	var err error
+	s.cron, err = ParseCron(s.Cron, s.loc)
+	return err
+}
+
+// window returns the period a digest sent at t covers. Days are calendar
+// days in the schedule's zone, so a daily digest spans 23 or 25 hours when
+// the clocks change.
+func (s *DigestSchedule) window(t time.Time) (from, to time.Time) {
+	days := -1
+	if s.Period == DigestWeekly {
+		days = -7
+	}
+	to = t.In(s.loc)
+	return to.AddDate(0, 0, days), to
+}
+
+// Digest is one rendered summary.
+type Digest struct {
+	Schedule      string           `json:"schedule"`
+	TenantID      string           `json:"tenant_id"`
+	Period        string           `json:"period"`
+	From          time.Time        `json:"from"`
+	To            time.Time        `json:"to"`
+	Timezone      string           `json:"timezone"`
+	Alerts        int              `json:"alerts"`
+	ByLevel       map[string]int   `json:"by_level"`
+	Vehicles      int              `json:"vehicles"`     // vehicles with alerts
+	TopVehicles   []DigestVehicle  `json:"top_vehicles"` // most alerts first
+	OpenIncidents int              `json:"open_incidents"`
+	Incidents     []DigestIncident `json:"incidents"` // most severe, then oldest
+	Trips         *TripTotals      `json:"trips,omitempty"`
+	Partial       []string         `json:"partial,omitempty"` // why figures may be incomplete
+
+	Subject string `json:"-"`
+	Text    string `json:"-"`
+	HTML    string `json:"-"`
+}
+
+// DigestVehicle is one of a digest's top offenders.
+type DigestVehicle struct {
+	VehicleID  string         `json:"vehicle_id"`
+	Alerts     int            `json:"alerts"`
+	ByLevel    map[string]int `json:"by_level"`
+	DistanceKm *float64       `json:"distance_km,omitempty"`
+}
+
+// DigestIncident is an unresolved incident listed in a digest.
+type DigestIncident struct {
+	ID         string    `json:"id"`
+	VehicleID  string    `json:"vehicle_id"`
+	Level      string    `json:"level"`
+	State      string    `json:"state"`
+	Message    string    `json:"message"`
+	AlertCount int       `json:"alert_count"`
+	OpenedAt   time.Time `json:"opened_at"`
+}
+
+// TripTotals is analytics-service's GET /trips/summary response.
+type TripTotals struct {
+	Trips      int64          `json:"trips"`
+	DistanceKm float64        `json:"distance_km"`
+	Vehicles   []VehicleTrips `json:"vehicles"`
+}
+
+// VehicleTrips totals one vehicle's trips.
+type VehicleTrips struct {
+	VehicleID  string  `json:"vehicle_id"`
+	Trips      int64   `json:"trips"`
+	DistanceKm float64 `json:"distance_km"`
+}
+
+// digestInput is what a digest is built from.
+type digestInput struct {
+	alerts    []Alert     // of the tenant, in the window
+	incidents []*Incident // of the tenant, any state
+	trips     *TripTotals // nil when unavailable
+	partial   []string
+}
+
+// buildDigest summarises in for the window [from, to).
+func buildDigest(s *DigestSchedule, from, to time.Time, in digestInput, catalog *Catalog) *Digest {
+	d := &Digest{
+		Schedule: s.Name,
+		TenantID: s.Tenant,
+		Period:   s.Period,
+		From:     from,
+		To:       to,
+		Timezone: s.loc.String(),
+		ByLevel:  make(map[string]int),
+		Trips:    in.trips,
+		Partial:  in.partial,
+	}
+	vehicles := make(map[string]*DigestVehicle)
+	for _, a := range in.alerts {
+		n := a.Occurrences
+		if n == 0 {
+			n = 1
+		}
+		level := strings.ToUpper(a.Level)
+		d.Alerts += n
+		d.ByLevel[level] += n
+		v := vehicles[a.VehicleID]
+		if v == nil {
+			v = &DigestVehicle{VehicleID: a.VehicleID, ByLevel: make(map[string]int)}
+			vehicles[a.VehicleID] = v
+		}
+		v.Alerts += n
+		v.ByLevel[level] += n
+	}
+	d.Vehicles = len(vehicles)
+	ranked := make([]*DigestVehicle, 0, len(vehicles))
+	for _, v := range vehicles {
+		ranked = append(ranked, v)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		a, b := ranked[i], ranked[j]
+		if a.Alerts != b.Alerts {
+			return a.Alerts > b.Alerts
+		}
+		if a.ByLevel["CRITICAL"] != b.ByLevel["CRITICAL"] {
+			return a.ByLevel["CRITICAL"] > b.ByLevel["CRITICAL"]
+		}
+		return a.VehicleID < b.VehicleID
+	})
+	if len(ranked) > s.Top {
+		ranked = ranked[:s.Top]
+	}
+	d.TopVehicles = make([]DigestVehicle, len(ranked))
+	for i, v := range ranked {
+		if in.trips != nil {
+			for _, t := range in.trips.Vehicles {
+				if t.VehicleID == v.VehicleID {
+					km := t.DistanceKm
+					v.DistanceKm = &km
+				}
+			}
+		}
+		d.TopVehicles[i] = *v
+	}
+
+	var open []*Incident
+	for _, inc := range in.incidents {
+		if inc.active() {
+			open = append(open, inc)
+		}
+	}
+	sort.Slice(open, func(i, j int) bool {
+		a, b := open[i], open[j]
+		if levelRank[a.Level] != levelRank[b.Level] {
+			return levelRank[a.Level] > levelRank[b.Level]
+		}
+		return a.OpenedAt.Before(b.OpenedAt)
+	})
+	d.OpenIncidents = len(open)
+	if len(open) > s.Top {
+		open = open[:s.Top]
+	}
+	d.Incidents = make([]DigestIncident, len(open))
+	for i, inc := range open {
+		d.Incidents[i] = DigestIncident{
+			ID:         inc.ID,
+			VehicleID:  inc.VehicleID,
+			Level:      inc.Level,
+			State:      inc.State,
+			Message:    catalog.Localize(inc.alert(), []string{s.Locale}).Message,
+			AlertCount: inc.AlertCount,
+			OpenedAt:   inc.OpenedAt,
+		}
+	}
+	d.render(s.loc)
+	return d
+}
+
+// levelOrder lists the known levels first, most severe first.
+var levelOrder = []string{"CRITICAL", "WARN", "INFO"}
+
+// formatLevels renders counts as "CRITICAL 2, WARN 5".
+func formatLevels(counts map[string]int) string {
+	var parts []string
+	for _, l := range levelOrder {
+		if counts[l] > 0 {
+			parts = append(parts, fmt.Sprintf("%s %d", l, counts[l]))
+		}
+	}
+	var other []string
+	for l, n := range counts {
+		if levelRank[l] == 0 && n > 0 {
+			other = append(other, fmt.Sprintf("%s %d", l, n))
+		}
+	}
+	sort.Strings(other)
+	return strings.Join(append(parts, other...), ", ")
+}
+
+func digestFuncs(loc *time.Location) map[string]interface{} {
+	return map[string]interface{}{
+		"levels": formatLevels,
+		"when":   func(t time.Time) string { return t.In(loc).Format("Mon 2 Jan 2006 15:04") },
+		"km":     func(f float64) string { return strconv.FormatFloat(f, 'f', 1, 64) },
+	}
+}
+
+var digestText = template.Must(template.New("text").Funcs(digestFuncs(time.UTC)).Parse(
+	`SmartFleet {{.Period}} digest for {{.TenantID}}
+{{when .From}} - {{when .To}} ({{.Timezone}})
+
+Alerts: {{.Alerts}}{{if .Alerts}} ({{levels .ByLevel}}) from {{.Vehicles}} vehicles{{end}}
+{{- with .Trips}}
+Trips: {{.Trips}}, {{km .DistanceKm}} km{{end}}
+Unresolved incidents: {{.OpenIncidents}}
+{{- if .TopVehicles}}
+
+Top vehicles
+{{- range .TopVehicles}}
+  {{.VehicleID}}: {{.Alerts}} alerts ({{levels .ByLevel}}){{with .DistanceKm}}, {{km .}} km{{end}}
+{{- end}}{{end}}
+{{- if .Incidents}}
+
+Unresolved incidents
+{{- range .Incidents}}
+  {{.ID}} {{.Level}} {{.VehicleID}}, {{.State}} since {{when .OpenedAt}}, {{.AlertCount}} alerts: {{.Message}}
+{{- end}}{{end}}
+{{- range .Partial}}
+
+Note: {{.}}{{end}}
+`))
+
+var digestHTML = htmltemplate.Must(htmltemplate.New("html").Funcs(digestFuncs(time.UTC)).Parse(
+	`<!DOCTYPE html>
+<html><body style="font-family:sans-serif">
+<h2>SmartFleet {{.Period}} digest for {{.TenantID}}</h2>
+<p>{{when .From}} &ndash; {{when .To}} ({{.Timezone}})</p>
+<ul>
+<li>Alerts: <b>{{.Alerts}}</b>{{if .Alerts}} ({{levels .ByLevel}}) from {{.Vehicles}} vehicles{{end}}</li>
+{{- with .Trips}}
+<li>Trips: <b>{{.Trips}}</b>, {{km .DistanceKm}} km</li>{{end}}
+<li>Unresolved incidents: <b>{{.OpenIncidents}}</b></li>
+</ul>
+{{- if .TopVehicles}}
+<h3>Top vehicles</h3>
+<table cellpadding="4">
+<tr><th align="left">Vehicle</th><th align="right">Alerts</th><th align="left">Levels</th><th align="right">Distance</th></tr>
+{{- range .TopVehicles}}
+<tr><td>{{.VehicleID}}</td><td align="right">{{.Alerts}}</td><td>{{levels .ByLevel}}</td><td align="right">{{with .DistanceKm}}{{km .}} km{{end}}</td></tr>
+{{- end}}
+</table>{{end}}
+{{- if .Incidents}}
+<h3>Unresolved incidents</h3>
+<table cellpadding="4">
+<tr><th align="left">Incident</th><th align="left">Level</th><th align="left">Vehicle</th><th align="left">Since</th><th align="right">Alerts</th><th align="left">Latest</th></tr>
+{{- range .Incidents}}
+<tr><td>{{.ID}}</td><td>{{.Level}}</td><td>{{.VehicleID}}</td><td>{{when .OpenedAt}}</td><td align="right">{{.AlertCount}}</td><td>{{.Message}}</td></tr>
+{{- end}}
+</table>{{end}}
+{{- range .Partial}}
+<p><i>Note: {{.}}</i></p>{{end}}
+</body></html>
+`))
+
+// render fills in the subject, text and HTML, with times in loc.
+func (d *Digest) render(loc *time.Location) {
+	d.Subject = fmt.Sprintf("SmartFleet %s digest for %s: %d alerts, %d unresolved incidents",
+		d.Period, d.TenantID, d.Alerts, d.OpenIncidents)
+	var b bytes.Buffer
+	t := template.Must(digestText.Clone()).Funcs(digestFuncs(loc))
+	if err := t.Execute(&b, d); err != nil {
+		b.WriteString(err.Error()) // the templates are fixed, so a bug
+	}
+	d.Text = b.String()
+	b.Reset()
+	h := htmltemplate.Must(digestHTML.Clone()).Funcs(digestFuncs(loc))
+	if err := h.Execute(&b, d); err != nil {
+		b.WriteString(htmltemplate.HTMLEscapeString(err.Error()))
+	}
+	d.HTML = b.String()
+}
+
+// AnalyticsClient fetches trip totals from analytics-service, acting for a
+// tenant with the service token.
+type AnalyticsClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+func NewAnalyticsClient(baseURL, token string) *AnalyticsClient {
+	return &AnalyticsClient{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// TripTotals returns the tenant's trips that ended in [from, to).
+func (c *AnalyticsClient) TripTotals(ctx context.Context, tenant string, from, to time.Time) (*TripTotals, error) {
+	q := url.Values{"from": {from.UTC().Format(time.RFC3339)}, "to": {to.UTC().Format(time.RFC3339)}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/trips/summary?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Tenant-ID", tenant)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, httpStatusError(resp)
+	}
+	var out TripTotals
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// digestClaimKey marks one firing of a schedule as taken by a replica.
+func digestClaimKey(name string, at time.Time) string {
+	return "notify:digest:" + name + ":" + strconv.FormatInt(at.Unix(), 10)
+}
+
+// StartDigests runs the digest scheduler until ctx ends.
+func (n *NotificationService) StartDigests(ctx context.Context) {
+	if len(n.digests) == 0 {
+		return
+	}
+	n.workers.Add(1)
+	go func() {
+		defer n.workers.Done()
+		n.RunDigests(ctx, conf.DigestInterval)
+	}()
+}
+
+// RunDigests sends digests as their schedules come due until ctx ends.
+// Firings missed while no replica was running are not made up.
+func (n *NotificationService) RunDigests(ctx context.Context, every time.Duration) {
+	next := make(map[*DigestSchedule]time.Time, len(n.digests))
+	now := time.Now()
+	for _, s := range n.digests {
+		next[s] = s.cron.Next(now)
+	}
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		now := time.Now()
+		for _, s := range n.digests {
+			at := next[s]
+			if at.IsZero() || now.Before(at) {
+				continue
+			}
+			next[s] = s.cron.Next(now)
+			ok, err := n.rdb.SetNX(ctx, digestClaimKey(s.Name, at), conf.ReplicaID, 8*24*time.Hour).Result()
+			if err != nil {
+				n.logger.Printf("[digest] %s: claim: %v", s.Name, err)
+				continue
+			}
+			if !ok {
+				continue // another replica sends this one
+			}
+			d, err := n.buildDigestAt(ctx, s, at)
+			if err != nil {
+				n.logger.Printf("[digest] %s: %v", s.Name, err)
+				continue
+			}
+			n.logger.Printf("[digest] %s: %d alerts, %d incidents to %d recipients", s.Name, d.Alerts, d.OpenIncidents, len(s.To))
+			n.dispatcher.DispatchDigest(d, "digest:"+s.Name, s.Channel, s.To)
+		}
+	}
+}
+
+// buildDigestAt gathers the data for the window ending at and builds the
+// digest. Missing trip totals or trimmed alert history make it partial
+// rather than failing it.
+func (n *NotificationService) buildDigestAt(ctx context.Context, s *DigestSchedule, at time.Time) (*Digest, error) {
+	from, to := s.window(at)
+	var in digestInput
+	var err error
+	var trimmed bool
+	if in.alerts, trimmed, err = n.alertsBetween(ctx, s.Tenant, from, to); err != nil {
+		return nil, fmt.Errorf("alerts: %w", err)
+	}
+	if trimmed {
+		in.partial = append(in.partial, "the oldest alerts of the period were trimmed from the stream")
+	}
+	if n.incidents != nil {
+		if in.incidents, err = n.incidents.List(ctx, s.Tenant, "", maxHistoryLimit); err != nil {
+			return nil, fmt.Errorf("incidents: %w", err)
+		}
+	}
+	if n.analytics != nil {
+		if in.trips, err = n.analytics.TripTotals(ctx, s.Tenant, from, to); err != nil {
+			n.logger.Printf("[digest] %s: trip totals: %v", s.Name, err)
+			in.partial = append(in.partial, "trip totals are unavailable")
+		}
+	}
+	return buildDigest(s, from, to, in, n.catalog), nil
+}
+
+// alertsBetween reads the tenant's alerts published in [from, to) from the
+// stream. trimmed reports that part of the window is no longer retained.
+func (n *NotificationService) alertsBetween(ctx context.Context, tenant string, from, to time.Time) (alerts []Alert, trimmed bool, err error) {
+	if n.transport != TransportStream || n.rdb == nil {
+		return nil, false, errors.New("digests require ALERT_TRANSPORT=stream")
+	}
+	info, err := n.rdb.XInfoStream(ctx, conf.AlertStream).Result()
+	if err != nil && !strings.Contains(err.Error(), "no such key") {
+		return nil, false, err
+	}
+	if info != nil {
+		if id, err := parseStreamID(info.MaxDeletedEntryID); err == nil && id.ms >= uint64(from.UnixMilli()) {
+			trimmed = true
+		}
+	}
+	start, end := strconv.FormatInt(from.UnixMilli(), 10), strconv.FormatInt(to.UnixMilli()-1, 10)
+	for {
+		msgs, err := n.rdb.XRangeN(ctx, conf.AlertStream, start, end, historyScanBatch).Result()
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, false, err
+		}
+		for _, msg := range msgs {
+			if a, err := alertFromStream(msg); err == nil {
+				if a = normalizeAlert(a); a.TenantID == tenant {
+					alerts = append(alerts, a)
+				}
+			}
+		}
+		if len(msgs) < historyScanBatch {
+			return alerts, trimmed, nil
+		}
+		start = "(" + msgs[len(msgs)-1].ID
+	}
+}
+
+// DigestStatus describes a schedule for GET /digests.
+type DigestStatus struct {
+	Name     string    `json:"name"`
+	Period   string    `json:"period"`
+	Cron     string    `json:"cron"`
+	Timezone string    `json:"timezone"`
+	Channel  string    `json:"channel"`
+	To       []string  `json:"to"`
+	NextAt   time.Time `json:"next_at"`
+}
+
+// handleDigests serves GET /digests, the caller's schedules, and
+// GET /digests/{name}/preview?format=text|html|json, the digest the
+// schedule would send now.
+func (n *NotificationService) handleDigests(w http.ResponseWriter, r *http.Request) {
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/digests"), "/")
+	if rest == "" {
+		out := make([]DigestStatus, 0)
+		now := time.Now()
+		for _, s := range n.digests {
+			if s.Tenant == tenant {
+				out = append(out, DigestStatus{
+					Name: s.Name, Period: s.Period, Cron: s.Cron, Timezone: s.loc.String(),
+					Channel: s.Channel, To: s.To, NextAt: s.cron.Next(now),
+				})
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+		return
+	}
+	name, action, _ := strings.Cut(rest, "/")
+	var s *DigestSchedule
+	for _, cand := range n.digests {
+		if cand.Name == name && cand.Tenant == tenant {
+			s = cand
+		}
+	}
+	if s == nil || action != "preview" {
+		http.NotFound(w, r)
+		return
+	}
+	d, err := n.buildDigestAt(r.Context(), s, time.Now())
+	if err != nil {
+		n.logger.Printf("[digest] preview %s: %v", s.Name, err)
+		http.Error(w, "digest unavailable", http.StatusInternalServerError)
+		return
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = w.Write([]byte(d.Text))
+	case "html":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(d.HTML))
+	case "json":
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(d)
+	default:
+		http.Error(w, "format must be text, html or json", http.StatusBadRequest)
+	}
+}
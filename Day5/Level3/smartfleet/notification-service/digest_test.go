@@ -0,0 +1,255 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+
+	"smartfleet/common/apikey"
+)
+
+// digestChannel records the digests it is asked to send.
+type digestChannel struct{ sent chan *Digest }
+
+func (c digestChannel) Name() string { return "digest" }
+
+func (c digestChannel) Send(context.Context, string, Alert) error { return nil }
+
+func (c digestChannel) SendDigest(_ context.Context, _ string, d *Digest) error {
+	c.sent <- d
+	return nil
+}
+
+func testDigestSchedule(t *testing.T, spec string) *DigestSchedule {
+	t.Helper()
+	channels := map[string]Channel{"digest": digestChannel{}}
+	list, err := ParseDigestSchedules([]byte(spec), channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return list[0]
+}
+
+func TestParseDigestSchedules(t *testing.T) {
+	s := testDigestSchedule(t, `[{"name":"weekly","tenant":"t","period":"weekly","timezone":"Europe/Berlin","channel":"digest","to":["ops@example.com"]}]`)
+	if s.Cron != "0 7 * * mon" || s.Top != defaultDigestTop {
+		t.Fatalf("defaults not applied: %+v", s)
+	}
+	from, to := s.window(time.Date(2024, 4, 1, 5, 0, 0, 0, time.UTC)) // Monday 07:00 in Berlin
+	if to.Sub(from) != 7*24*time.Hour-time.Hour {
+		t.Fatalf("window across the DST change = %s", to.Sub(from))
+	}
+
+	channels := map[string]Channel{"digest": digestChannel{}, "plain": captureChannel{}}
+	for _, bad := range []string{
+		`[{"period":"daily","channel":"digest","to":["a"]}]`,
+		`[{"name":"a","period":"hourly","channel":"digest","to":["a"]}]`,
+		`[{"name":"a","period":"daily","channel":"digest"}]`,
+		`[{"name":"a","period":"daily","channel":"plain","to":["a"]}]`,
+		`[{"name":"a","period":"daily","channel":"digest","to":["a"],"cron":"0 7 * *"}]`,
+		`[{"name":"a","period":"daily","channel":"digest","to":["a"],"timezone":"Mars/Olympus"}]`,
+		`[{"name":"a","period":"daily","channel":"digest","to":["a"]},{"name":"a","period":"weekly","channel":"digest","to":["b"]}]`,
+	} {
+		if _, err := ParseDigestSchedules([]byte(bad), channels); err == nil {
+			t.Errorf("accepted %s", bad)
+		}
+	}
+}
+
+func TestBuildDigest(t *testing.T) {
+	s := testDigestSchedule(t, `[{"name":"morning","tenant":"t","period":"daily","channel":"digest","to":["ops@example.com"],"locale":"de","top":2}]`)
+	to := time.Date(2024, 3, 2, 7, 0, 0, 0, time.UTC)
+	from, _ := s.window(to)
+	alert := func(vehicle, level string) Alert {
+		return Alert{TenantID: "t", VehicleID: vehicle, Level: level, Message: "m"}
+	}
+	opened := func(id, vehicle, level, state string, at time.Time) *Incident {
+		inc := &Incident{ID: id}
+		inc.observe(Alert{TenantID: "t", VehicleID: vehicle, Level: level, Message: overspeed.Message, Code: overspeed.Code, Params: overspeed.Params}, at)
+		inc.State = state
+		return inc
+	}
+	in := digestInput{
+		alerts: []Alert{
+			alert("v1", "WARN"), alert("v1", "WARN"), alert("v2", "CRITICAL"), alert("v2", "warn"),
+			alert("v3", "INFO"), alert("<script>", "INFO"),
+		},
+		incidents: []*Incident{
+			opened("inc-1", "v1", "WARN", IncidentOpen, from),
+			opened("inc-2", "v2", "CRITICAL", IncidentAcknowledged, from.Add(time.Hour)),
+			opened("inc-3", "v3", "CRITICAL", IncidentResolved, from),
+			opened("inc-4", "v3", "WARN", IncidentOpen, from.Add(-time.Hour)),
+		},
+		trips: &TripTotals{Trips: 12, DistanceKm: 340.25, Vehicles: []VehicleTrips{{VehicleID: "v2", Trips: 3, DistanceKm: 120.5}}},
+	}
+	d := buildDigest(s, from, to, in, mustCatalog(t))
+
+	if d.Alerts != 6 || d.ByLevel["WARN"] != 3 || d.ByLevel["CRITICAL"] != 1 || d.Vehicles != 4 {
+		t.Fatalf("counts = %d %v from %d vehicles", d.Alerts, d.ByLevel, d.Vehicles)
+	}
+	// v1 and v2 both have two alerts; v2's is critical
+	if len(d.TopVehicles) != 2 || d.TopVehicles[0].VehicleID != "v2" || d.TopVehicles[1].VehicleID != "v1" {
+		t.Fatalf("top vehicles = %+v", d.TopVehicles)
+	}
+	if km := d.TopVehicles[0].DistanceKm; km == nil || *km != 120.5 || d.TopVehicles[1].DistanceKm != nil {
+		t.Fatalf("distances = %v %v", d.TopVehicles[0].DistanceKm, d.TopVehicles[1].DistanceKm)
+	}
+	if d.OpenIncidents != 3 || len(d.Incidents) != 2 || d.Incidents[0].ID != "inc-2" || d.Incidents[1].ID != "inc-4" {
+		t.Fatalf("incidents = %d %+v", d.OpenIncidents, d.Incidents)
+	}
+	if !strings.HasPrefix(d.Incidents[0].Message, "Geschwindigkeitsüberschreitung") {
+		t.Fatalf("incident message not in the schedule's locale: %q", d.Incidents[0].Message)
+	}
+
+	for _, want := range []string{
+		"SmartFleet daily digest for t",
+		"Fri 1 Mar 2024 07:00 - Sat 2 Mar 2024 07:00 (UTC)",
+		"Alerts: 6 (CRITICAL 1, WARN 3, INFO 2) from 4 vehicles",
+		"Trips: 12, 340.2 km",
+		"Unresolved incidents: 3",
+		"  v2: 2 alerts (CRITICAL 1, WARN 1), 120.5 km",
+		"  inc-2 CRITICAL v2, acknowledged since Fri 1 Mar 2024 08:00, 1 alerts: Geschwindigkeitsüberschreitung",
+	} {
+		if !strings.Contains(d.Text, want) {
+			t.Errorf("text lacks %q:\n%s", want, d.Text)
+		}
+	}
+	if !strings.Contains(d.HTML, "<td>v2</td>") || strings.Contains(d.HTML, "<script>") {
+		t.Errorf("html:\n%s", d.HTML)
+	}
+	if d.Subject != "SmartFleet daily digest for t: 6 alerts, 3 unresolved incidents" {
+		t.Errorf("subject = %q", d.Subject)
+	}
+
+	empty := buildDigest(s, from, to, digestInput{partial: []string{"trip totals are unavailable"}}, mustCatalog(t))
+	if !strings.Contains(empty.Text, "Alerts: 0\n") || strings.Contains(empty.Text, "Trips:") ||
+		!strings.Contains(empty.Text, "Note: trip totals are unavailable") {
+		t.Errorf("empty digest:\n%s", empty.Text)
+	}
+}
+
+func mustCatalog(t *testing.T) *Catalog {
+	t.Helper()
+	c, err := NewCatalog("en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestEmailDigestIsMultipart(t *testing.T) {
+	s := testDigestSchedule(t, `[{"name":"m","period":"daily","channel":"digest","to":["a"]}]`)
+	d := buildDigest(s, time.Unix(0, 0), time.Unix(86400, 0), digestInput{alerts: []Alert{{VehicleID: "v1", Level: "WARN"}}}, nil)
+	e := &EmailChannel{From: "fleet@example.com"}
+	msg, err := mail.ReadMessage(strings.NewReader(string(e.digestMessage("ops@example.com", d))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.Header.Get("Subject"); got != d.Subject {
+		t.Fatalf("subject = %q", got)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("content type %q: %v", mediaType, err)
+	}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	var types []string
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(p) // quoted-printable is decoded by NextPart
+		types = append(types, p.Header.Get("Content-Type"))
+		if !strings.Contains(string(body), "Alerts: 1") && !strings.Contains(string(body), "<b>1</b>") {
+			t.Errorf("%s part:\n%s", p.Header.Get("Content-Type"), body)
+		}
+	}
+	if strings.Join(types, ",") != "text/plain; charset=UTF-8,text/html; charset=UTF-8" {
+		t.Fatalf("parts = %v", types)
+	}
+}
+
+func TestDispatchDigest(t *testing.T) {
+	ch := digestChannel{sent: make(chan *Digest, 2)}
+	dlog := &memDeliveryLog{}
+	d := NewDispatcher(map[string]Channel{"digest": ch}, nil, dlog, RetryPolicy{MaxAttempts: 1}, 1, nil, log.New(io.Discard, "", 0))
+	dg := &Digest{Schedule: "m", TenantID: "t"}
+	d.DispatchDigest(dg, "digest:m", "digest", []string{"a@example.com", "b@example.com"})
+	d.Close(context.Background())
+	if len(ch.sent) != 2 || <-ch.sent != dg {
+		t.Fatalf("sent %d digests", len(ch.sent))
+	}
+	recs, _ := dlog.List(context.Background(), "t", 10)
+	if len(recs) != 2 || recs[0].Status != DeliverySent || recs[0].Rule != "digest:m" || recs[0].Level != "DIGEST" {
+		t.Fatalf("delivery log = %+v", recs)
+	}
+}
+
+func TestAnalyticsTripTotals(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/trips/summary" || r.Header.Get("X-Tenant-ID") != "acme" || r.Header.Get("Authorization") != "Bearer svc" {
+			http.Error(w, "bad request "+r.URL.String(), http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Query().Get("from") != "2024-03-01T07:00:00Z" {
+			http.Error(w, "bad from "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"trips":3,"distance_km":42.5,"vehicles":[{"vehicle_id":"v1","trips":3,"distance_km":42.5}]}`))
+	}))
+	defer srv.Close()
+	c := NewAnalyticsClient(srv.URL+"/", "svc")
+	from := time.Date(2024, 3, 1, 8, 0, 0, 0, time.FixedZone("CET", 3600))
+	got, err := c.TripTotals(context.Background(), "acme", from, from.Add(24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Trips != 3 || got.DistanceKm != 42.5 || len(got.Vehicles) != 1 {
+		t.Fatalf("totals = %+v", got)
+	}
+}
+
+func TestDigestsEndpoint(t *testing.T) {
+	auth, _ := apikey.New("key-a=tenant-a,key-b=tenant-b", "", "default", false)
+	ns, err := NewNotificationService(nil, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.digests = []*DigestSchedule{
+		testDigestSchedule(t, `[{"name":"a","tenant":"tenant-a","period":"daily","channel":"digest","to":["x"]}]`),
+		testDigestSchedule(t, `[{"name":"b","tenant":"tenant-b","period":"daily","channel":"digest","to":["y"]}]`),
+	}
+	req := httptest.NewRequest(http.MethodGet, "/digests", nil)
+	req.Header.Set("X-API-Key", "key-a")
+	rec := httptest.NewRecorder()
+	ns.handleDigests(rec, req)
+	var list []DigestStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if len(list) != 1 || list[0].Name != "a" || list[0].NextAt.IsZero() {
+		t.Fatalf("digests = %+v", list)
+	}
+
+	// another tenant's schedule is not found
+	req = httptest.NewRequest(http.MethodGet, "/digests/b/preview", nil)
+	req.Header.Set("X-API-Key", "key-a")
+	rec = httptest.NewRecorder()
+	ns.handleDigests(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("foreign preview status = %d", rec.Code)
+	}
+}
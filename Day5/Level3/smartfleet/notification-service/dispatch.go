@@ -0,0 +1,334 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Delivery statuses
+const (
+	DeliverySent   = "sent"
+	DeliveryFailed = "failed"
+)
+
+// DeliveryRecord is one delivery log entry, written when a delivery finishes.
+type DeliveryRecord struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id"`
+	AlertID   string    `json:"alert_id,omitempty"`
+	VehicleID string    `json:"vehicle_id"`
+	Level     string    `json:"level"`
+	Rule      string    `json:"rule"`
+	Channel   string    `json:"channel"`
+	To        string    `json:"to"`
+	Status    string    `json:"status"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DeliveryLog stores delivery records per tenant.
+type DeliveryLog interface {
+	Record(ctx context.Context, rec DeliveryRecord) error
+	List(ctx context.Context, tenant string, limit int) ([]DeliveryRecord, error)
+}
+
+// RedisDeliveryLog keeps the newest records of each tenant in a capped list.
+type RedisDeliveryLog struct {
+	rdb    *redis.Client
+	maxLen int64
+}
+
+func NewRedisDeliveryLog(rdb *redis.Client, maxLen int64) *RedisDeliveryLog {
+	return &RedisDeliveryLog{rdb: rdb, maxLen: maxLen}
+}
+
+func deliveryLogKey(tenant string) string {
+	return "notify:deliveries:" + tenant
+}
+
+func (l *RedisDeliveryLog) Record(ctx context.Context, rec DeliveryRecord) error {
+	b, _ := json.Marshal(rec)
+	pipe := l.rdb.TxPipeline()
+	pipe.LPush(ctx, deliveryLogKey(rec.TenantID), b)
+	pipe.LTrim(ctx, deliveryLogKey(rec.TenantID), 0, l.maxLen-1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// List returns the tenant's newest records first.
+func (l *RedisDeliveryLog) List(ctx context.Context, tenant string, limit int) ([]DeliveryRecord, error) {
+	vals, err := l.rdb.LRange(ctx, deliveryLogKey(tenant), 0, int64(limit)-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]DeliveryRecord, 0, len(vals))
+	for _, v := range vals {
+		var rec DeliveryRecord
+		if err := json.Unmarshal([]byte(v), &rec); err == nil {
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+// RetryPolicy is exponential backoff with full jitter.
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// delay returns the wait before the given retry (attempt counts from 1).
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	d := p.BaseDelay << uint(attempt-1)
+	if d > p.MaxDelay || d <= 0 {
+		d = p.MaxDelay
+	}
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
+
+// deliveryJob is one alert, or one digest, to one recipient.
+type deliveryJob struct {
+	rec    DeliveryRecord
+	alert  Alert
+	digest *Digest
+}
+
+// Dispatcher routes alerts to channels and retries failed deliveries.
+// Retries wait on timers rather than in workers, so a slow or failing
+// recipient does not hold up others. Retries still waiting at shutdown are
+// recorded as failed.
+type Dispatcher struct {
+	channels map[string]Channel
+	rules    []*RoutingRule
+	log      DeliveryLog
+	retry    RetryPolicy
+	logger   *log.Logger
+	timeout  time.Duration // per attempt
+	catalog  *Catalog      // renders alerts per rule locale; nil sends them as received
+
+	jobs    chan deliveryJob
+	wg      sync.WaitGroup // workers
+	pending sync.WaitGroup // jobs queued or being attempted
+	mu      sync.Mutex     // guards closed, waiting and pending.Add
+	closed  bool
+	waiting map[*time.Timer]deliveryJob // scheduled retries
+	seq     atomic.Uint64
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewDispatcher starts workers delivering for the given rules.
+func NewDispatcher(channels map[string]Channel, rules []*RoutingRule, dlog DeliveryLog, retry RetryPolicy, workers int, catalog *Catalog, logger *log.Logger) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{
+		channels: channels,
+		rules:    rules,
+		log:      dlog,
+		retry:    retry,
+		logger:   logger,
+		timeout:  30 * time.Second,
+		catalog:  catalog,
+		jobs:     make(chan deliveryJob, 1024),
+		waiting:  make(map[*time.Timer]deliveryJob),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	for i := 0; i < workers; i++ {
+		d.wg.Add(1)
+		go d.worker()
+	}
+	return d
+}
+
+// Dispatch queues deliveries for every rule matching the alert.
+func (d *Dispatcher) Dispatch(a Alert) {
+	now := time.Now().UTC()
+	var jobs []deliveryJob
+	for _, r := range d.rules {
+		if r.Matches(a, now) {
+			jobs = d.appendJobs(jobs, a, r.Name, r.Channel, r.Locale, r.To, now)
+		}
+	}
+	d.enqueue(jobs)
+}
+
+// DispatchTo queues deliveries of an alert to explicit recipients, bypassing
+// the routing rules; rule names the reason in the delivery log.
+func (d *Dispatcher) DispatchTo(a Alert, rule, channel, locale string, to []string) {
+	d.enqueue(d.appendJobs(nil, a, rule, channel, locale, to, time.Now().UTC()))
+}
+
+// DispatchDigest queues deliveries of a digest; rule names the schedule in
+// the delivery log.
+func (d *Dispatcher) DispatchDigest(dg *Digest, rule, channel string, to []string) {
+	now := time.Now().UTC()
+	jobs := make([]deliveryJob, 0, len(to))
+	for _, r := range to {
+		jobs = append(jobs, deliveryJob{digest: dg, rec: DeliveryRecord{
+			ID:        d.recordID(now),
+			TenantID:  dg.TenantID,
+			Level:     "DIGEST",
+			Rule:      rule,
+			Channel:   channel,
+			To:        r,
+			CreatedAt: now,
+		}})
+	}
+	d.enqueue(jobs)
+}
+
+func (d *Dispatcher) recordID(now time.Time) string {
+	return strconv.FormatInt(now.UnixNano(), 36) + "-" + strconv.FormatUint(d.seq.Add(1), 36)
+}
+
+func (d *Dispatcher) appendJobs(jobs []deliveryJob, a Alert, rule, channel, locale string, recipients []string, now time.Time) []deliveryJob {
+	a = d.catalog.Localize(a, []string{locale})
+	for _, to := range recipients {
+		jobs = append(jobs, deliveryJob{alert: a, rec: DeliveryRecord{
+			ID:        d.recordID(now),
+			TenantID:  a.TenantID,
+			AlertID:   a.ID,
+			VehicleID: a.VehicleID,
+			Level:     a.Level,
+			Rule:      rule,
+			Channel:   channel,
+			To:        to,
+			CreatedAt: now,
+		}})
+	}
+	return jobs
+}
+
+func (d *Dispatcher) enqueue(jobs []deliveryJob) {
+	if len(jobs) == 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	for _, j := range jobs {
+		d.pending.Add(1)
+		select {
+		case d.jobs <- j:
+		default:
+			d.pending.Done()
+			j.rec.LastError = "delivery queue full"
+			go d.finish(j, DeliveryFailed)
+		}
+	}
+}
+
+func (d *Dispatcher) worker() {
+	defer d.wg.Done()
+	for j := range d.jobs {
+		d.attempt(j)
+		d.pending.Done()
+	}
+}
+
+// attempt makes one delivery attempt and schedules a retry on failure.
+func (d *Dispatcher) attempt(j deliveryJob) {
+	j.rec.Attempts++
+	ctx, cancel := context.WithTimeout(d.ctx, d.timeout)
+	err := d.send(ctx, j)
+	cancel()
+	if err == nil {
+		j.rec.LastError = ""
+		d.finish(j, DeliverySent)
+		return
+	}
+	j.rec.LastError = err.Error()
+	if isPermanent(err) || j.rec.Attempts >= d.retry.MaxAttempts {
+		d.logger.Printf("[deliver] %s to %s failed after %d attempts: %v", j.rec.Channel, j.rec.To, j.rec.Attempts, err)
+		d.finish(j, DeliveryFailed)
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		d.finish(j, DeliveryFailed)
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d.retry.delay(j.rec.Attempts), func() {
+		d.mu.Lock()
+		if _, ok := d.waiting[t]; !ok {
+			d.mu.Unlock() // cancelled by Close
+			return
+		}
+		delete(d.waiting, t)
+		d.pending.Add(1)
+		d.mu.Unlock()
+		d.jobs <- j
+	})
+	d.waiting[t] = j
+}
+
+func (d *Dispatcher) send(ctx context.Context, j deliveryJob) error {
+	ch := d.channels[j.rec.Channel]
+	if j.digest == nil {
+		return ch.Send(ctx, j.rec.To, j.alert)
+	}
+	ds, ok := ch.(DigestSender)
+	if !ok {
+		return Permanent(fmt.Errorf("channel %s cannot send digests", j.rec.Channel))
+	}
+	return ds.SendDigest(ctx, j.rec.To, j.digest)
+}
+
+func (d *Dispatcher) finish(j deliveryJob, status string) {
+	j.rec.Status = status
+	j.rec.UpdatedAt = time.Now().UTC()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := d.log.Record(ctx, j.rec); err != nil {
+		d.logger.Printf("[deliver] delivery log err: %v", err)
+	}
+}
+
+// Close stops accepting alerts, records scheduled retries as failed and waits
+// for queued attempts; when ctx expires, in-flight sends are cancelled.
+func (d *Dispatcher) Close(ctx context.Context) {
+	d.mu.Lock()
+	d.closed = true
+	var dropped []deliveryJob
+	for t, j := range d.waiting {
+		t.Stop()
+		dropped = append(dropped, j)
+	}
+	d.waiting = map[*time.Timer]deliveryJob{}
+	d.mu.Unlock()
+	for _, j := range dropped {
+		d.finish(j, DeliveryFailed)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		d.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+	}
+	d.cancel()
+	close(d.jobs)
+	d.wg.Wait()
+}
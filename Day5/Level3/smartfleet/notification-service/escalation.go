@@ -0,0 +1,212 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// EscalationPolicy notifies further tiers while a matching incident stays
+// open (unacknowledged). Tier delays count from when the policy started to
+// apply, which is when the incident opened or first reached a matching level:
+//
+//	{"name":"critical","levels":["CRITICAL"],"tiers":[
+//	  {"after":"5m","channel":"sms","to":["+15550100"]},
+//	  {"after":"15m","channel":"email","to":["head-of-ops@example.com"]}]}
+type EscalationPolicy struct {
+	Name     string           `json:"name"`
+	Tenant   string           `json:"tenant,omitempty"` // defaults to DEFAULT_TENANT
+	Levels   []string         `json:"levels,omitempty"`
+	Groups   []uint           `json:"groups,omitempty"`
+	Vehicles []string         `json:"vehicles,omitempty"`
+	Tiers    []EscalationTier `json:"tiers"`
+
+	filter *Subscription
+}
+
+// EscalationTier is one step of a policy.
+type EscalationTier struct {
+	After   string   `json:"after"` // Go duration, e.g. "5m"
+	Channel string   `json:"channel"`
+	To      []string `json:"to"`
+	Locale  string   `json:"locale,omitempty"`
+
+	after time.Duration
+}
+
+// Escalations is the set of configured policies; the first matching policy
+// applies. A nil *Escalations has no policies.
+type Escalations struct {
+	policies []*EscalationPolicy
+	byName   map[string]*EscalationPolicy
+}
+
+// ParseEscalations parses and validates the NOTIFY_ESCALATIONS JSON array.
+func ParseEscalations(data []byte, channels map[string]Channel) (*Escalations, error) {
+	var policies []*EscalationPolicy
+	if err := json.Unmarshal(data, &policies); err != nil {
+		return nil, err
+	}
+	e := &Escalations{policies: policies, byName: make(map[string]*EscalationPolicy, len(policies))}
+	for i, p := range policies {
+		if p.Name == "" {
+			return nil, fmt.Errorf("policy #%d: name is required", i)
+		}
+		if _, dup := e.byName[p.Name]; dup {
+			return nil, fmt.Errorf("policy %s: duplicate name", p.Name)
+		}
+		if err := p.compile(channels); err != nil {
+			return nil, fmt.Errorf("policy %s: %w", p.Name, err)
+		}
+		e.byName[p.Name] = p
+	}
+	return e, nil
+}
+
+func (p *EscalationPolicy) compile(channels map[string]Channel) error {
+	if p.Tenant == "" {
+		p.Tenant = conf.DefaultTenant
+	}
+	sub, err := NewSubscription(p.Vehicles, p.Levels, p.Groups)
+	if err != nil {
+		return err
+	}
+	p.filter = sub
+	if len(p.Tiers) == 0 {
+		return fmt.Errorf("no tiers")
+	}
+	var prev time.Duration
+	for i := range p.Tiers {
+		t := &p.Tiers[i]
+		if t.after, err = time.ParseDuration(t.After); err != nil {
+			return fmt.Errorf("tier %d: %w", i+1, err)
+		}
+		if t.after <= prev {
+			return fmt.Errorf("tier %d: after must be positive and increase from tier to tier", i+1)
+		}
+		prev = t.after
+		if _, ok := channels[t.Channel]; !ok {
+			return fmt.Errorf("tier %d: channel %q is not configured", i+1, t.Channel)
+		}
+		if len(t.To) == 0 {
+			return fmt.Errorf("tier %d: no recipients", i+1)
+		}
+	}
+	return nil
+}
+
+func (p *EscalationPolicy) matches(inc *Incident) bool {
+	return inc.TenantID == p.Tenant && p.filter.Matches(inc.alert())
+}
+
+// assign attaches the first matching policy to an open incident that has
+// none yet and schedules its first tier.
+func (e *Escalations) assign(inc *Incident, now time.Time) {
+	if e == nil || inc.Policy != "" || inc.State != IncidentOpen {
+		return
+	}
+	for _, p := range e.policies {
+		if p.matches(inc) {
+			due := now.Add(p.Tiers[0].after)
+			inc.Policy, inc.PolicySince = p.Name, &now
+			inc.Tier, inc.NextEscalationAt = 0, &due
+			return
+		}
+	}
+}
+
+// advance moves an open incident whose escalation is due to its next tier
+// and returns that tier. It returns nil when nothing is due, e.g. because
+// another replica escalated first or the incident was acknowledged.
+func (e *Escalations) advance(inc *Incident, now time.Time) *EscalationTier {
+	if e == nil || inc.State != IncidentOpen || inc.NextEscalationAt == nil || inc.NextEscalationAt.After(now) {
+		return nil
+	}
+	p := e.byName[inc.Policy]
+	if p == nil || inc.Tier >= len(p.Tiers) {
+		inc.NextEscalationAt = nil // policy removed from the configuration
+		return nil
+	}
+	tier := &p.Tiers[inc.Tier]
+	inc.Tier++
+	inc.NextEscalationAt = nil
+	if inc.Tier < len(p.Tiers) {
+		due := inc.PolicySince.Add(p.Tiers[inc.Tier].after)
+		inc.NextEscalationAt = &due
+	}
+	inc.UpdatedAt = now
+	return tier
+}
+
+// escalationAlert is what an escalation tier receives. The incident's own
+// message is rendered in the tier's locale first and embedded as a param.
+func escalationAlert(inc *Incident, now time.Time, catalog *Catalog, locale string) Alert {
+	a := inc.alert()
+	inner := catalog.Localize(a, []string{locale}).Message
+	a.Ts = now
+	a.Source = "escalation"
+	a.Message = fmt.Sprintf("unacknowledged for %s (incident %s, %d alerts): %s",
+		now.Sub(inc.OpenedAt).Round(time.Second), inc.ID, inc.AlertCount, inner)
+	a.Code = "INCIDENT_ESCALATED"
+	a.Params = map[string]interface{}{
+		"minutes":  int(now.Sub(inc.OpenedAt).Minutes()),
+		"incident": inc.ID,
+		"alerts":   inc.AlertCount,
+		"message":  inner,
+	}
+	return a
+}
+
+// RunEscalations notifies due escalation tiers until ctx ends. Every replica
+// runs it; the incident transaction makes sure only one of them sends a tier.
+func (n *NotificationService) RunEscalations(ctx context.Context, every time.Duration) {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.escalateDue(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (n *NotificationService) escalateDue(ctx context.Context) {
+	due, err := n.incidents.DueEscalations(ctx, 100)
+	if err != nil {
+		if ctx.Err() == nil {
+			n.logger.Printf("[escalate] list due: %v", err)
+		}
+		return
+	}
+	for _, d := range due {
+		tenant, id := d[0], d[1]
+		var tier *EscalationTier
+		inc, _, err := n.incidents.Update(ctx, tenant, id, func(inc *Incident, now time.Time) (bool, error) {
+			tier = n.escalations.advance(inc, now)
+			// saving also drops index entries that are no longer due
+			return true, nil
+		})
+		if errors.Is(err, errIncidentNotFound) {
+			n.rdb.ZRem(ctx, escalationIndex, escalationMember(tenant, id))
+			continue
+		}
+		if err != nil {
+			n.logger.Printf("[escalate] incident %s: %v", id, err)
+			continue
+		}
+		if tier == nil {
+			continue
+		}
+		n.logger.Printf("[escalate] incident %s tier %d via %s", inc.ID, inc.Tier, tier.Channel)
+		if n.dispatcher != nil {
+			rule := fmt.Sprintf("escalation:%s#%d", inc.Policy, inc.Tier)
+			a := escalationAlert(inc, time.Now().UTC(), n.catalog, tier.Locale)
+			n.dispatcher.DispatchTo(a, rule, tier.Channel, tier.Locale, tier.To)
+		}
+		n.publishIncident(ctx, EventEscalated, inc)
+	}
+}
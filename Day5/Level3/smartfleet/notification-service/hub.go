@@ -0,0 +1,273 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// The hub fans every alert out to the clients of its tenant. Broadcast never
+// blocks on a client: each client has a bounded send queue, and its slow
+// consumer policy decides what happens when the queue is full.
+
+// SlowConsumerPolicy is what a full send queue does with the next alert.
+type SlowConsumerPolicy string
+
+const (
+	SlowDropOldest SlowConsumerPolicy = "drop-oldest" // discard the oldest queued alert
+	SlowCoalesce   SlowConsumerPolicy = "coalesce"    // keep only the newest queued alert of each vehicle
+	SlowDisconnect SlowConsumerPolicy = "disconnect"  // close the client; it resumes with ?since=
+)
+
+// ParseSlowConsumerPolicy parses a policy name; "" selects the default.
+func ParseSlowConsumerPolicy(s string) (SlowConsumerPolicy, error) {
+	switch p := SlowConsumerPolicy(s); p {
+	case "":
+		return SlowConsumerPolicy(conf.SlowConsumerPolicy), nil
+	case SlowDropOldest, SlowCoalesce, SlowDisconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown slow consumer policy %q (want drop-oldest, coalesce or disconnect)", s)
+}
+
+// sendQueue is a client's bounded queue of outgoing alerts. The hub pushes,
+// the client's writer takes everything queued whenever ready is signalled.
+type sendQueue struct {
+	mu     sync.Mutex
+	policy SlowConsumerPolicy
+	max    int
+	buf    []Alert
+	ready  chan struct{} // capacity 1: "something changed"
+
+	closed      bool
+	closeCode   int
+	closeReason string
+
+	delivered, dropped, coalesced uint64
+}
+
+func newSendQueue(policy SlowConsumerPolicy, max int) *sendQueue {
+	if max < 1 {
+		max = 1
+	}
+	return &sendQueue{policy: policy, max: max, ready: make(chan struct{}, 1)}
+}
+
+func (q *sendQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// push queues a, applying the policy when the queue is full.
+func (q *sendQueue) push(a Alert) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	if len(q.buf) >= q.max {
+		switch q.policy {
+		case SlowDisconnect:
+			q.dropped++
+			q.closeLocked(websocket.ClosePolicyViolation, "slow consumer")
+			return
+		case SlowCoalesce:
+			q.coalesce()
+		}
+		if len(q.buf) >= q.max {
+			q.remove(0)
+			q.dropped++
+		}
+	}
+	q.buf = append(q.buf, a)
+	q.signal()
+}
+
+// coalesce keeps only the newest queued alert of each vehicle, in order.
+func (q *sendQueue) coalesce() {
+	seen := make(map[string]bool, len(q.buf))
+	keep := len(q.buf)
+	for i := len(q.buf) - 1; i >= 0; i-- {
+		if seen[q.buf[i].VehicleID] {
+			continue
+		}
+		seen[q.buf[i].VehicleID] = true
+		keep--
+		q.buf[keep] = q.buf[i]
+	}
+	n := copy(q.buf, q.buf[keep:])
+	for i := n; i < len(q.buf); i++ {
+		q.buf[i] = Alert{}
+	}
+	q.coalesced += uint64(len(q.buf) - n)
+	q.buf = q.buf[:n]
+}
+
+func (q *sendQueue) remove(i int) {
+	copy(q.buf[i:], q.buf[i+1:])
+	q.buf[len(q.buf)-1] = Alert{}
+	q.buf = q.buf[:len(q.buf)-1]
+}
+
+// take appends the queued alerts to dst and empties the queue. closed is
+// true once the queue was closed; the writer then stops without writing dst.
+func (q *sendQueue) take(dst []Alert) (out []Alert, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return dst, true
+	}
+	out = append(dst, q.buf...)
+	q.delivered += uint64(len(q.buf))
+	for i := range q.buf {
+		q.buf[i] = Alert{}
+	}
+	q.buf = q.buf[:0]
+	return out, false
+}
+
+// close stops the writer; the first reason wins.
+func (q *sendQueue) close(code int, reason string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closeLocked(code, reason)
+}
+
+func (q *sendQueue) closeLocked(code int, reason string) {
+	if q.closed {
+		return
+	}
+	q.closed, q.closeCode, q.closeReason = true, code, reason
+	q.buf = nil
+	q.signal()
+}
+
+// closeFrame returns the close code and reason once the queue is closed.
+func (q *sendQueue) closeFrame() (int, string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closeCode, q.closeReason
+}
+
+// ClientStats describes a connected client for GET /clients.
+type ClientStats struct {
+	ID          string             `json:"id"`
+	Transport   string             `json:"transport"`
+	Policy      SlowConsumerPolicy `json:"policy"`
+	ConnectedAt time.Time          `json:"connected_at"`
+	Queued      int                `json:"queued"`
+	Delivered   uint64             `json:"delivered"`
+	Dropped     uint64             `json:"dropped"`
+	Coalesced   uint64             `json:"coalesced"`
+}
+
+func (c *Client) stats() ClientStats {
+	q := c.queue
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return ClientStats{
+		ID: c.id, Transport: c.transport, Policy: q.policy, ConnectedAt: c.connectedAt,
+		Queued: len(q.buf), Delivered: q.delivered, Dropped: q.dropped, Coalesced: q.coalesced,
+	}
+}
+
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[*Client]struct{}
+	closed  bool
+	seq     atomic.Uint64
+}
+
+func NewHub() *Hub {
+	return &Hub{clients: make(map[*Client]struct{})}
+}
+
+// Register adds a client. After the hub has stopped the client's queue is
+// closed straight away, so its writer ends.
+func (h *Hub) Register(c *Client) {
+	c.id = "c-" + strconv.FormatUint(h.seq.Add(1), 10)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		c.queue.close(websocket.CloseGoingAway, "shutting down")
+		return
+	}
+	h.clients[c] = struct{}{}
+}
+
+// Unregister removes a client and stops its writer. It never blocks and may
+// be called more than once.
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+	c.queue.close(websocket.CloseNormalClosure, "")
+}
+
+// Broadcast queues a for every client that wants it and returns how many
+// did. Only the clients' own queues are modified, so the read lock
+// suffices and alerts are never dropped for the hub as a whole.
+func (h *Hub) Broadcast(a Alert) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	n := 0
+	for c := range h.clients {
+		if c.wants(a) {
+			c.queue.push(a)
+			n++
+		}
+	}
+	return n
+}
+
+// Run closes every client when ctx ends.
+func (h *Hub) Run(ctx context.Context) {
+	<-ctx.Done()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for c := range h.clients {
+		c.queue.close(websocket.CloseGoingAway, "shutting down")
+		delete(h.clients, c)
+	}
+}
+
+// Stats returns the tenant's clients on this replica, oldest first.
+func (h *Hub) Stats(tenant string) []ClientStats {
+	h.mu.RLock()
+	out := make([]ClientStats, 0)
+	for c := range h.clients {
+		if c.tenant == tenant {
+			out = append(out, c.stats())
+		}
+	}
+	h.mu.RUnlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].ConnectedAt.Before(out[j].ConnectedAt) })
+	return out
+}
+
+// handleClients serves GET /clients: the tenant's connections on this
+// replica with their queue and drop counters.
+func (n *NotificationService) handleClients(w http.ResponseWriter, r *http.Request) {
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"replica": conf.ReplicaID, "clients": n.hub.Stats(tenant)})
+}
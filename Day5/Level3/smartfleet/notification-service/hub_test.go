@@ -0,0 +1,292 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"smartfleet/common/apikey"
+)
+
+func testClient(tenant string, policy SlowConsumerPolicy, size int) *Client {
+	c := newClient(tenant, "ws", policy)
+	c.queue = newSendQueue(policy, size)
+	return c
+}
+
+func TestSlowConsumerPolicies(t *testing.T) {
+	alert := func(i int, vehicle string) Alert {
+		return Alert{ID: fmt.Sprintf("%d-0", i), TenantID: "t", VehicleID: vehicle}
+	}
+	ids := func(as []Alert) []string {
+		out := make([]string, len(as))
+		for i, a := range as {
+			out[i] = a.ID
+		}
+		return out
+	}
+
+	t.Run("drop-oldest", func(t *testing.T) {
+		c := testClient("t", SlowDropOldest, 3)
+		for i := 1; i <= 5; i++ {
+			c.queue.push(alert(i, "v1"))
+		}
+		got, closed := c.queue.take(nil)
+		if closed || fmt.Sprint(ids(got)) != "[3-0 4-0 5-0]" {
+			t.Fatalf("queue = %v (closed %v)", ids(got), closed)
+		}
+		if s := c.stats(); s.Dropped != 2 || s.Delivered != 3 || s.Queued != 0 {
+			t.Fatalf("stats = %+v", s)
+		}
+	})
+
+	t.Run("coalesce", func(t *testing.T) {
+		c := testClient("t", SlowCoalesce, 3)
+		c.queue.push(alert(1, "v1"))
+		c.queue.push(alert(2, "v2"))
+		c.queue.push(alert(3, "v1"))
+		c.queue.push(alert(4, "v2")) // full: 1-0 is superseded by 3-0
+		c.queue.push(alert(5, "v3")) // full: 2-0 is superseded by 4-0
+		got, _ := c.queue.take(nil)
+		if fmt.Sprint(ids(got)) != "[3-0 4-0 5-0]" {
+			t.Fatalf("queue = %v", ids(got))
+		}
+		if s := c.stats(); s.Coalesced != 2 || s.Dropped != 0 {
+			t.Fatalf("stats = %+v", s)
+		}
+		// more vehicles than slots: the oldest goes
+		for i := 6; i <= 9; i++ {
+			c.queue.push(alert(i, fmt.Sprintf("v%d", i)))
+		}
+		got, _ = c.queue.take(nil)
+		if fmt.Sprint(ids(got)) != "[7-0 8-0 9-0]" {
+			t.Fatalf("queue = %v", ids(got))
+		}
+		if s := c.stats(); s.Dropped != 1 {
+			t.Fatalf("stats = %+v", s)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		c := testClient("t", SlowDisconnect, 2)
+		for i := 1; i <= 3; i++ {
+			c.queue.push(alert(i, "v1"))
+		}
+		if _, closed := c.queue.take(nil); !closed {
+			t.Fatal("overflowing client not closed")
+		}
+		if code, reason := c.queue.closeFrame(); code != 1008 || reason != "slow consumer" {
+			t.Fatalf("close frame = %d %q", code, reason)
+		}
+		c.queue.push(alert(4, "v1")) // no-op once closed
+		if s := c.stats(); s.Dropped != 1 || s.Queued != 0 {
+			t.Fatalf("stats = %+v", s)
+		}
+	})
+
+	if _, err := ParseSlowConsumerPolicy("wait"); err == nil {
+		t.Error("unknown policy accepted")
+	}
+}
+
+func TestHubUnregisterAfterShutdownDoesNotBlock(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	hub := NewHub()
+	done := make(chan struct{})
+	go func() {
+		hub.Run(ctx)
+		close(done)
+	}()
+	c := testClient("t", SlowDisconnect, 4)
+	hub.Register(c)
+	cancel()
+	<-done
+
+	if _, closed := c.queue.take(nil); !closed {
+		t.Fatal("client not closed at shutdown")
+	}
+	unregistered := make(chan struct{})
+	go func() {
+		hub.Unregister(c)
+		hub.Unregister(c)
+		close(unregistered)
+	}()
+	select {
+	case <-unregistered:
+	case <-time.After(time.Second):
+		t.Fatal("Unregister blocked after the hub stopped")
+	}
+	late := testClient("t", SlowDisconnect, 4)
+	hub.Register(late)
+	if _, closed := late.queue.take(nil); !closed || hub.Count() != 0 {
+		t.Fatal("client registered after shutdown left open")
+	}
+}
+
+// TestHubStress broadcasts from several goroutines to thousands of clients
+// while others connect and leave. Run with -race; slow clients must not
+// grow beyond their queue and fast ones must not lose alerts.
+func TestHubStress(t *testing.T) {
+	const (
+		queueSize    = 32
+		vehicles     = 10
+		broadcasters = 4
+		perSender    = 100
+		total        = broadcasters * perSender
+	)
+	clients := 2000
+	if testing.Short() {
+		clients = 200
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	hub := NewHub()
+	hubDone := make(chan struct{})
+	go func() {
+		hub.Run(ctx)
+		close(hubDone)
+	}()
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+
+	policies := []SlowConsumerPolicy{SlowDropOldest, SlowCoalesce, SlowDisconnect}
+	var slow, fast []*Client
+	received := make([]int, clients/4)
+	var readers sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		if i%4 == 3 {
+			// a fast reader with a queue large enough for everything
+			c := testClient("t", SlowDropOldest, total)
+			idx := len(fast)
+			fast = append(fast, c)
+			hub.Register(c)
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				var batch []Alert
+				for range c.queue.ready {
+					var closed bool
+					if batch, closed = c.queue.take(batch[:0]); closed {
+						return
+					}
+					received[idx] += len(batch)
+				}
+			}()
+			continue
+		}
+		c := testClient("t", policies[i%4], queueSize)
+		slow = append(slow, c)
+		hub.Register(c)
+	}
+
+	var churn sync.WaitGroup
+	stopChurn := make(chan struct{})
+	churn.Add(1)
+	go func() {
+		defer churn.Done()
+		for {
+			select {
+			case <-stopChurn:
+				return
+			default:
+			}
+			c := testClient("t", SlowDropOldest, queueSize)
+			hub.Register(c)
+			hub.Publish(Alert{TenantID: "t", VehicleID: "v0"}, &OccurrenceEvent{Type: "occurrence"})
+			_ = hub.Stats("t")
+			hub.Unregister(c)
+		}
+	}()
+
+	var senders sync.WaitGroup
+	for s := 0; s < broadcasters; s++ {
+		senders.Add(1)
+		go func(s int) {
+			defer senders.Done()
+			for i := 0; i < perSender; i++ {
+				hub.Broadcast(Alert{
+					ID:        fmt.Sprintf("%d-%d", i, s),
+					TenantID:  "t",
+					VehicleID: fmt.Sprintf("v%d", i%vehicles),
+					Message:   "stress",
+				})
+			}
+		}(s)
+	}
+	senders.Wait()
+	close(stopChurn)
+	churn.Wait()
+
+	runtime.GC()
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	// queues hold at most queueSize alerts per slow client (total per fast
+	// one); allow four times what that takes
+	bound := uint64(4 * (len(slow)*queueSize + len(fast)*total) * 200)
+	if after.HeapAlloc > before.HeapAlloc && after.HeapAlloc-before.HeapAlloc > bound {
+		t.Errorf("heap grew by %d bytes, bound %d", after.HeapAlloc-before.HeapAlloc, bound)
+	}
+
+	for _, c := range slow {
+		s := c.stats()
+		switch s.Policy {
+		case SlowDropOldest:
+			if s.Queued != queueSize || s.Dropped != total-queueSize {
+				t.Fatalf("drop-oldest client: %+v", s)
+			}
+		case SlowCoalesce:
+			if s.Queued > queueSize || s.Dropped != 0 || s.Coalesced != uint64(total-s.Queued) {
+				t.Fatalf("coalescing client: %+v", s)
+			}
+		case SlowDisconnect:
+			if _, closed := c.queue.take(nil); !closed || s.Dropped != 1 {
+				t.Fatalf("disconnect client: %+v", s)
+			}
+		}
+	}
+
+	cancel()
+	<-hubDone
+	readers.Wait()
+	for i, c := range fast {
+		if s := c.stats(); received[i] != total || s.Dropped != 0 {
+			t.Fatalf("fast client %d received %d of %d: %+v", i, received[i], total, s)
+		}
+	}
+}
+
+func TestClientsEndpoint(t *testing.T) {
+	auth, _ := apikey.New("key-a=tenant-a,key-b=tenant-b", "", "default", false)
+	ns, err := NewNotificationService(nil, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := testClient("tenant-a", SlowDropOldest, 1)
+	ns.hub.Register(a)
+	ns.hub.Register(testClient("tenant-b", SlowDropOldest, 1))
+	ns.hub.Broadcast(Alert{TenantID: "tenant-a", VehicleID: "v1"})
+	ns.hub.Broadcast(Alert{TenantID: "tenant-a", VehicleID: "v1"})
+
+	req := httptest.NewRequest(http.MethodGet, "/clients", nil)
+	req.Header.Set("X-API-Key", "key-a")
+	rec := httptest.NewRecorder()
+	ns.handleClients(rec, req)
+	var body struct {
+		Clients []ClientStats `json:"clients"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %v", rec.Code, err)
+	}
+	if len(body.Clients) != 1 || body.Clients[0].ID != a.id || body.Clients[0].Dropped != 1 || body.Clients[0].Queued != 1 {
+		t.Fatalf("clients = %+v", body.Clients)
+	}
+}
@@ -0,0 +1,619 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Incidents group related alerts: every alert of the same tenant, vehicle and
+// rule lands in one incident until it is resolved. An incident moves
+// open -> acknowledged -> resolved (or straight from open to resolved); the
+// next alert after resolution opens a new incident.
+
+// Incident states
+const (
+	IncidentOpen         = "open"
+	IncidentAcknowledged = "acknowledged"
+	IncidentResolved     = "resolved"
+)
+
+// Incident events sent to WebSocket clients
+const (
+	EventOpened       = "opened"
+	EventUpdated      = "updated"
+	EventAcknowledged = "acknowledged"
+	EventResolved     = "resolved"
+	EventEscalated    = "escalated"
+)
+
+// incidentIDPrefix tells incident IDs from alert (stream entry) IDs.
+const incidentIDPrefix = "inc-"
+
+var (
+	errIncidentNotFound = errors.New("incident not found")
+	errIncidentResolved = errors.New("incident already resolved")
+)
+
+// levelRank orders alert levels; an incident keeps its highest level.
+var levelRank = map[string]int{"INFO": 1, "WARN": 2, "CRITICAL": 3}
+
+// Incident is the lifecycle record of a group of related alerts.
+type Incident struct {
+	ID           string    `json:"id"`
+	TenantID     string    `json:"tenant_id"`
+	VehicleID    string    `json:"vehicle_id"`
+	Rule         string    `json:"rule,omitempty"` // grouping key, see Alert.ruleKey
+	GroupID      *uint     `json:"group_id,omitempty"`
+	Level        string    `json:"level"`   // highest level seen
+	Message      string    `json:"message"` // of the latest alert
+	State        string    `json:"state"`
+	AlertCount   int       `json:"alert_count"`
+	FirstAlertID string    `json:"first_alert_id,omitempty"`
+	LastAlertID  string    `json:"last_alert_id,omitempty"`
+	OpenedAt     time.Time `json:"opened_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+
+	AckedAt    *time.Time `json:"acked_at,omitempty"`
+	AckedBy    string     `json:"acked_by,omitempty"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+	ResolvedBy string     `json:"resolved_by,omitempty"`
+
+	// escalation (see escalation.go)
+	Policy           string     `json:"policy,omitempty"`
+	PolicySince      *time.Time `json:"policy_since,omitempty"`
+	Tier             int        `json:"tier"` // escalation tiers notified so far
+	NextEscalationAt *time.Time `json:"next_escalation_at,omitempty"`
+
+	// structured message of the latest alert (see templates.go)
+	Code   string                 `json:"code,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+}
+
+// IncidentEvent is a state change pushed to WebSocket clients as
+// {"type":"incident","event":...,"incident":{...}}.
+type IncidentEvent struct {
+	Type     string    `json:"type"` // always "incident"
+	Event    string    `json:"event"`
+	Incident *Incident `json:"incident"`
+}
+
+// alert returns an alert describing the incident, for filters and channels.
+func (inc *Incident) alert() Alert {
+	return Alert{
+		ID:        inc.LastAlertID,
+		TenantID:  inc.TenantID,
+		VehicleID: inc.VehicleID,
+		Level:     inc.Level,
+		Message:   inc.Message,
+		Code:      inc.Code,
+		Params:    inc.Params,
+		Ts:        inc.UpdatedAt,
+		Rule:      inc.Rule,
+		GroupID:   inc.GroupID,
+	}
+}
+
+func (inc *Incident) active() bool { return inc.State != IncidentResolved }
+
+// observe adds an alert to the incident.
+func (inc *Incident) observe(a Alert, now time.Time) {
+	if inc.AlertCount == 0 {
+		inc.State = IncidentOpen
+		inc.TenantID, inc.VehicleID, inc.Rule = a.TenantID, a.VehicleID, a.ruleKey()
+		inc.FirstAlertID = a.ID
+		inc.OpenedAt = now
+	}
+	inc.AlertCount++
+	if levelRank[strings.ToUpper(a.Level)] > levelRank[inc.Level] {
+		inc.Level = strings.ToUpper(a.Level)
+	}
+	if a.GroupID != nil {
+		inc.GroupID = a.GroupID
+	}
+	inc.Message, inc.Code, inc.Params = a.Message, a.Code, a.Params
+	if a.ID != "" {
+		inc.LastAlertID = a.ID
+	}
+	inc.UpdatedAt = now
+}
+
+// acknowledge stops escalation; acknowledging twice is a no-op.
+func (inc *Incident) acknowledge(by string, now time.Time) (bool, error) {
+	switch inc.State {
+	case IncidentResolved:
+		return false, errIncidentResolved
+	case IncidentAcknowledged:
+		return false, nil
+	}
+	inc.State = IncidentAcknowledged
+	inc.AckedAt, inc.AckedBy = &now, by
+	inc.NextEscalationAt = nil
+	inc.UpdatedAt = now
+	return true, nil
+}
+
+func (inc *Incident) resolve(by string, now time.Time) error {
+	if inc.State == IncidentResolved {
+		return errIncidentResolved
+	}
+	inc.State = IncidentResolved
+	inc.ResolvedAt, inc.ResolvedBy = &now, by
+	inc.NextEscalationAt = nil
+	inc.UpdatedAt = now
+	return nil
+}
+
+// Redis layout, per tenant:
+//
+//	notify:incident:<tenant>:<id>               incident JSON; expires after resolution
+//	notify:incidents:<tenant>                   zset id -> updated_at (unix ms)
+//	notify:incident-key:<tenant>:<vehicle>:<rule> id of the active incident
+//	notify:alert-incident:<tenant>:<alert id>   id of the alert's incident
+//
+// plus notify:escalations, a zset "<tenant>|<id>" -> next escalation (unix
+// ms), and notify:incident:seq for IDs.
+const (
+	incidentSeqKey        = "notify:incident:seq"
+	escalationIndex       = "notify:escalations"
+	incidentEventsChannel = "notify:incident-events"
+	maxTxRetries          = 10
+)
+
+func incidentKey(tenant, id string) string  { return "notify:incident:" + tenant + ":" + id }
+func incidentIndexKey(tenant string) string { return "notify:incidents:" + tenant }
+func incidentGroupKey(tenant, vehicle, rule string) string {
+	return "notify:incident-key:" + tenant + ":" + vehicle + ":" + rule
+}
+func alertIncidentKey(tenant, alertID string) string {
+	return "notify:alert-incident:" + tenant + ":" + alertID
+}
+func escalationMember(tenant, id string) string { return tenant + "|" + id }
+
+// IncidentStore keeps incidents in Redis. Updates are optimistic
+// transactions (WATCH/MULTI), so replicas can change incidents concurrently.
+type IncidentStore struct {
+	rdb       *redis.Client
+	retention time.Duration // how long resolved incidents are kept
+	now       func() time.Time
+}
+
+func NewIncidentStore(rdb *redis.Client, retention time.Duration) *IncidentStore {
+	return &IncidentStore{rdb: rdb, retention: retention, now: func() time.Time { return time.Now().UTC() }}
+}
+
+func getIncident(ctx context.Context, c redis.Cmdable, tenant, id string) (*Incident, error) {
+	b, err := c.Get(ctx, incidentKey(tenant, id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, errIncidentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var inc Incident
+	if err := json.Unmarshal(b, &inc); err != nil {
+		return nil, err
+	}
+	return &inc, nil
+}
+
+// save queues the incident and the indexes that follow from its state.
+func (s *IncidentStore) save(ctx context.Context, pipe redis.Pipeliner, inc *Incident) {
+	b, _ := json.Marshal(inc)
+	key := incidentKey(inc.TenantID, inc.ID)
+	pipe.Set(ctx, key, b, 0)
+	pipe.ZAdd(ctx, incidentIndexKey(inc.TenantID), redis.Z{Score: float64(inc.UpdatedAt.UnixMilli()), Member: inc.ID})
+	member := escalationMember(inc.TenantID, inc.ID)
+	if inc.State == IncidentOpen && inc.NextEscalationAt != nil {
+		pipe.ZAdd(ctx, escalationIndex, redis.Z{Score: float64(inc.NextEscalationAt.UnixMilli()), Member: member})
+	} else {
+		pipe.ZRem(ctx, escalationIndex, member)
+	}
+	if !inc.active() {
+		pipe.Expire(ctx, key, s.retention)
+		pipe.Del(ctx, incidentGroupKey(inc.TenantID, inc.VehicleID, inc.Rule))
+	}
+}
+
+// Observe adds an alert to the active incident of its vehicle and rule, or
+// opens a new one. assign may attach an escalation policy to the incident.
+func (s *IncidentStore) Observe(ctx context.Context, a Alert, assign func(*Incident, time.Time)) (*Incident, string, error) {
+	groupKey := incidentGroupKey(a.TenantID, a.VehicleID, a.ruleKey())
+	for i := 0; i < maxTxRetries; i++ {
+		var inc *Incident
+		event := EventUpdated
+		err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			now := s.now()
+			id, err := tx.Get(ctx, groupKey).Result()
+			switch {
+			case errors.Is(err, redis.Nil):
+				id = ""
+			case err != nil:
+				return err
+			}
+			if id != "" {
+				// an ack or escalation must not be overwritten by this update
+				if err := tx.Watch(ctx, incidentKey(a.TenantID, id)).Err(); err != nil {
+					return err
+				}
+				inc, err = getIncident(ctx, tx, a.TenantID, id)
+				if errors.Is(err, errIncidentNotFound) {
+					id = "" // index outlived the incident
+				} else if err != nil {
+					return err
+				}
+			}
+			if id == "" {
+				seq, err := s.rdb.Incr(ctx, incidentSeqKey).Result()
+				if err != nil {
+					return err
+				}
+				inc = &Incident{ID: incidentIDPrefix + strconv.FormatInt(seq, 10)}
+				event = EventOpened
+			}
+			inc.observe(a, now)
+			if assign != nil {
+				assign(inc, now)
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				s.save(ctx, pipe, inc)
+				pipe.Set(ctx, groupKey, inc.ID, 0)
+				if a.ID != "" {
+					pipe.Set(ctx, alertIncidentKey(a.TenantID, a.ID), inc.ID, s.retention)
+				}
+				return nil
+			})
+			return err
+		}, groupKey)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		return inc, event, nil
+	}
+	return nil, "", redis.TxFailedErr
+}
+
+// Update applies fn to an incident in a transaction. fn returns false when
+// it changed nothing, in which case nothing is written.
+func (s *IncidentStore) Update(ctx context.Context, tenant, id string, fn func(inc *Incident, now time.Time) (bool, error)) (*Incident, bool, error) {
+	key := incidentKey(tenant, id)
+	for i := 0; i < maxTxRetries; i++ {
+		var inc *Incident
+		var changed bool
+		err := s.rdb.Watch(ctx, func(tx *redis.Tx) error {
+			var err error
+			if inc, err = getIncident(ctx, tx, tenant, id); err != nil {
+				return err
+			}
+			if changed, err = fn(inc, s.now()); err != nil || !changed {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				s.save(ctx, pipe, inc)
+				return nil
+			})
+			return err
+		}, key)
+		if errors.Is(err, redis.TxFailedErr) {
+			continue
+		}
+		return inc, changed, err
+	}
+	return nil, false, redis.TxFailedErr
+}
+
+// Resolve finds the incident for an incident ID or for the ID of one of its alerts.
+func (s *IncidentStore) Resolve(ctx context.Context, tenant, id string) (string, error) {
+	if strings.HasPrefix(id, incidentIDPrefix) {
+		return id, nil
+	}
+	incID, err := s.rdb.Get(ctx, alertIncidentKey(tenant, id)).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", errIncidentNotFound
+	}
+	return incID, err
+}
+
+func (s *IncidentStore) Get(ctx context.Context, tenant, id string) (*Incident, error) {
+	return getIncident(ctx, s.rdb, tenant, id)
+}
+
+// List returns the tenant's most recently updated incidents, optionally
+// only those in one state.
+func (s *IncidentStore) List(ctx context.Context, tenant, state string, limit int) ([]*Incident, error) {
+	index := incidentIndexKey(tenant)
+	out := make([]*Incident, 0)
+	const page = 200
+	for start := int64(0); len(out) < limit; start += page {
+		ids, err := s.rdb.ZRevRange(ctx, index, start, start+page-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = incidentKey(tenant, id)
+		}
+		vals, err := s.rdb.MGet(ctx, keys...).Result()
+		if err != nil {
+			return nil, err
+		}
+		var expired []interface{}
+		for i, v := range vals {
+			str, ok := v.(string)
+			if !ok {
+				expired = append(expired, ids[i])
+				continue
+			}
+			var inc Incident
+			if err := json.Unmarshal([]byte(str), &inc); err != nil {
+				continue
+			}
+			if (state == "" || inc.State == state) && len(out) < limit {
+				out = append(out, &inc)
+			}
+		}
+		if len(expired) > 0 {
+			// resolved incidents past retention
+			s.rdb.ZRem(ctx, index, expired...)
+			start -= int64(len(expired))
+		}
+	}
+	return out, nil
+}
+
+// DueEscalations returns up to limit (tenant, id) pairs whose escalation is due.
+func (s *IncidentStore) DueEscalations(ctx context.Context, limit int64) ([][2]string, error) {
+	members, err := s.rdb.ZRangeByScore(ctx, escalationIndex, &redis.ZRangeBy{
+		Min: "-inf", Max: strconv.FormatInt(s.now().UnixMilli(), 10), Count: limit,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make([][2]string, 0, len(members))
+	for _, m := range members {
+		if tenant, id, ok := strings.Cut(m, "|"); ok {
+			out = append(out, [2]string{tenant, id})
+		}
+	}
+	return out, nil
+}
+
+// observeIncident files an alert into its incident and announces the change.
+func (n *NotificationService) observeIncident(a Alert) {
+	if n.incidents == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	inc, event, err := n.incidents.Observe(ctx, a, n.escalations.assign)
+	if err != nil {
+		n.logger.Printf("[incident] observe alert %s: %v", a.ID, err)
+		return
+	}
+	n.publishIncident(ctx, event, inc)
+}
+
+// StartIncidents forwards incident events to local clients and, when
+// policies are configured, runs escalation until ctx ends.
+func (n *NotificationService) StartIncidents(ctx context.Context) {
+	if n.incidents == nil {
+		return
+	}
+	n.workers.Add(1)
+	go func() {
+		defer n.workers.Done()
+		n.RunIncidentEvents(ctx)
+	}()
+	if n.escalations != nil {
+		n.workers.Add(1)
+		go func() {
+			defer n.workers.Done()
+			n.RunEscalations(ctx, conf.EscalationInterval)
+		}()
+	}
+}
+
+// publishIncident sends an incident event to the clients of every replica.
+func (n *NotificationService) publishIncident(ctx context.Context, event string, inc *Incident) {
+	b, _ := json.Marshal(IncidentEvent{Type: "incident", Event: event, Incident: inc})
+	if err := n.rdb.Publish(ctx, incidentEventsChannel, b).Err(); err != nil {
+		n.logger.Printf("[incident] publish %s event: %v", event, err)
+	}
+}
+
+// RunIncidentEvents forwards incident events from Redis to local clients.
+func (n *NotificationService) RunIncidentEvents(ctx context.Context) {
+	ps := n.rdb.Subscribe(ctx, incidentEventsChannel)
+	defer ps.Close()
+	ch := ps.Channel()
+	for {
+		select {
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var ev IncidentEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil || ev.Incident == nil {
+				n.logger.Printf("[incident] invalid event payload: %v", err)
+				continue
+			}
+			n.hub.Publish(ev.Incident.alert(), &ev)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Publish pushes an event about alert a to the clients whose tenant and
+// filter select a. A client whose control queue is full misses the event
+// and can catch up through the HTTP API.
+func (h *Hub) Publish(a Alert, ev interface{}) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	for c := range h.clients {
+		if !c.wants(a) {
+			continue
+		}
+		select {
+		case c.control <- wsControl{event: ev}:
+		default:
+		}
+	}
+}
+
+// http handlers
+
+// incidentFor resolves the path ID (incident or alert ID) to an incident ID.
+func (n *NotificationService) incidentFor(w http.ResponseWriter, r *http.Request, tenant, id string) (string, bool) {
+	incID, err := n.incidents.Resolve(r.Context(), tenant, id)
+	if errors.Is(err, errIncidentNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return "", false
+	}
+	if err != nil {
+		n.logger.Printf("[incident] resolve %s: %v", id, err)
+		http.Error(w, "incidents unavailable", http.StatusInternalServerError)
+		return "", false
+	}
+	return incID, true
+}
+
+// handleAlertAction serves POST /alerts/{id}/ack and /alerts/{id}/resolve.
+// {id} is an incident ID or the ID of any alert in the incident. The
+// optional body {"by":"name"} records who acted.
+func (n *NotificationService) handleAlertAction(w http.ResponseWriter, r *http.Request) {
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	id, action, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/alerts/"), "/")
+	if !ok || id == "" || (action != "ack" && action != "resolve") {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if n.incidents == nil {
+		http.Error(w, "incidents disabled", http.StatusNotFound)
+		return
+	}
+	var body struct {
+		By string `json:"by"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if body.By == "" {
+		body.By = "api"
+	}
+	incID, ok := n.incidentFor(w, r, tenant, id)
+	if !ok {
+		return
+	}
+
+	event := EventAcknowledged
+	inc, changed, err := n.incidents.Update(r.Context(), tenant, incID, func(inc *Incident, now time.Time) (bool, error) {
+		if action == "ack" {
+			return inc.acknowledge(body.By, now)
+		}
+		event = EventResolved
+		return true, inc.resolve(body.By, now)
+	})
+	switch {
+	case errors.Is(err, errIncidentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errIncidentResolved):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		n.logger.Printf("[incident] %s %s: %v", action, incID, err)
+		http.Error(w, "incidents unavailable", http.StatusInternalServerError)
+		return
+	}
+	if changed {
+		n.publishIncident(r.Context(), event, inc)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(inc)
+}
+
+// handleIncidents serves GET /incidents?state=&limit= and GET /incidents/{id}.
+func (n *NotificationService) handleIncidents(w http.ResponseWriter, r *http.Request) {
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if n.incidents == nil {
+		http.Error(w, "incidents disabled", http.StatusNotFound)
+		return
+	}
+	if id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/incidents"), "/"); id != "" {
+		incID, ok := n.incidentFor(w, r, tenant, id)
+		if !ok {
+			return
+		}
+		inc, err := n.incidents.Get(r.Context(), tenant, incID)
+		if errors.Is(err, errIncidentNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			n.logger.Printf("[incident] get %s: %v", incID, err)
+			http.Error(w, "incidents unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(inc)
+		return
+	}
+
+	state := r.URL.Query().Get("state")
+	switch state {
+	case "", IncidentOpen, IncidentAcknowledged, IncidentResolved:
+	default:
+		http.Error(w, fmt.Sprintf("state must be %s, %s or %s", IncidentOpen, IncidentAcknowledged, IncidentResolved), http.StatusBadRequest)
+		return
+	}
+	limit := defaultHistoryLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			http.Error(w, "limit must be 1.."+strconv.Itoa(maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	list, err := n.incidents.List(r.Context(), tenant, state, limit)
+	if err != nil {
+		n.logger.Printf("[incident] list: %v", err)
+		http.Error(w, "incidents unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,253 @@
+package notification
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIncidentLifecycle(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	inc := &Incident{ID: "inc-1"}
+	inc.observe(Alert{ID: "1-0", TenantID: "tenant-a", VehicleID: "v1", Rule: "engine_temp", Level: "WARN", Message: "hot"}, t0)
+	inc.observe(Alert{ID: "2-0", TenantID: "tenant-a", VehicleID: "v1", Rule: "engine_temp", Level: "CRITICAL", Message: "very hot"}, t0.Add(time.Minute))
+	inc.observe(Alert{ID: "3-0", TenantID: "tenant-a", VehicleID: "v1", Rule: "engine_temp", Level: "WARN", Message: "hot again"}, t0.Add(2*time.Minute))
+
+	if inc.State != IncidentOpen || inc.AlertCount != 3 || inc.Level != "CRITICAL" {
+		t.Fatalf("after 3 alerts: %+v", inc)
+	}
+	if inc.FirstAlertID != "1-0" || inc.LastAlertID != "3-0" || inc.Message != "hot again" || !inc.OpenedAt.Equal(t0) {
+		t.Fatalf("alert bookkeeping: %+v", inc)
+	}
+
+	changed, err := inc.acknowledge("alice", t0.Add(3*time.Minute))
+	if err != nil || !changed || inc.State != IncidentAcknowledged || inc.AckedBy != "alice" {
+		t.Fatalf("acknowledge = %v, %v: %+v", changed, err, inc)
+	}
+	if changed, err := inc.acknowledge("bob", t0.Add(4*time.Minute)); err != nil || changed || inc.AckedBy != "alice" {
+		t.Fatalf("second acknowledge = %v, %v; acked by %q", changed, err, inc.AckedBy)
+	}
+	if err := inc.resolve("alice", t0.Add(5*time.Minute)); err != nil || inc.State != IncidentResolved || inc.active() {
+		t.Fatalf("resolve = %v: %+v", err, inc)
+	}
+	if err := inc.resolve("bob", t0.Add(6*time.Minute)); !errors.Is(err, errIncidentResolved) {
+		t.Fatalf("resolving twice = %v, want errIncidentResolved", err)
+	}
+	if _, err := inc.acknowledge("bob", t0.Add(6*time.Minute)); !errors.Is(err, errIncidentResolved) {
+		t.Fatalf("acknowledging resolved = %v, want errIncidentResolved", err)
+	}
+}
+
+func TestIncidentStoreGroupsAlerts(t *testing.T) {
+	_, rdb := testRedis(t)
+	ctx := context.Background()
+	s := NewIncidentStore(rdb, time.Hour)
+	observe := func(id, rule string) (*Incident, string) {
+		t.Helper()
+		inc, event, err := s.Observe(ctx, Alert{ID: id, TenantID: "tenant-a", VehicleID: "v1", Rule: rule, Level: "WARN"}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return inc, event
+	}
+
+	first, event := observe("1-0", "engine_temp")
+	if event != EventOpened || first.AlertCount != 1 {
+		t.Fatalf("first alert: %s %+v", event, first)
+	}
+	inc, event := observe("2-0", "engine_temp")
+	if event != EventUpdated || inc.ID != first.ID || inc.AlertCount != 2 || inc.LastAlertID != "2-0" {
+		t.Fatalf("second alert of the group: %s %+v, want %s updated", event, inc, first.ID)
+	}
+	if other, event := observe("3-0", "overspeed"); event != EventOpened || other.ID == first.ID {
+		t.Fatalf("alert of another rule: %s %+v, want a new incident", event, other)
+	}
+	if id, err := s.Resolve(ctx, "tenant-a", "2-0"); err != nil || id != first.ID {
+		t.Fatalf("incident of alert 2-0 = %q, %v; want %s", id, err, first.ID)
+	}
+
+	resolved, changed, err := s.Update(ctx, "tenant-a", first.ID, func(inc *Incident, now time.Time) (bool, error) {
+		return true, inc.resolve("alice", now)
+	})
+	if err != nil || !changed || resolved.State != IncidentResolved {
+		t.Fatalf("resolve = %v, %v: %+v", changed, err, resolved)
+	}
+	if n, err := rdb.Exists(ctx, incidentGroupKey("tenant-a", "v1", "engine_temp")).Result(); err != nil || n != 0 {
+		t.Fatalf("group key of a resolved incident still set (%d, %v)", n, err)
+	}
+	next, event := observe("4-0", "engine_temp")
+	if event != EventOpened || next.ID == first.ID || next.AlertCount != 1 {
+		t.Fatalf("alert after resolution: %s %+v, want a new incident", event, next)
+	}
+	if got, err := s.Get(ctx, "tenant-a", first.ID); err != nil || got.State != IncidentResolved || got.AlertCount != 2 {
+		t.Fatalf("resolved incident = %+v, %v", got, err)
+	}
+}
+
+func TestIncidentStoreScopedToTenant(t *testing.T) {
+	_, rdb := testRedis(t)
+	ctx := context.Background()
+	s := NewIncidentStore(rdb, time.Hour)
+	inc, _, err := s.Observe(ctx, Alert{ID: "1-0", TenantID: "tenant-a", VehicleID: "v1", Rule: "engine_temp", Level: "WARN"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, err := s.Get(ctx, "tenant-a", inc.ID); err != nil || got.ID != inc.ID {
+		t.Fatalf("tenant-a Get = %+v, %v", got, err)
+	}
+	if got, err := s.Get(ctx, "tenant-b", inc.ID); !errors.Is(err, errIncidentNotFound) {
+		t.Fatalf("tenant-b Get = %+v, %v; want errIncidentNotFound", got, err)
+	}
+	if id, err := s.Resolve(ctx, "tenant-b", "1-0"); !errors.Is(err, errIncidentNotFound) {
+		t.Fatalf("tenant-b Resolve of tenant-a's alert = %q, %v", id, err)
+	}
+	_, changed, err := s.Update(ctx, "tenant-b", inc.ID, func(inc *Incident, now time.Time) (bool, error) {
+		return inc.acknowledge("mallory", now)
+	})
+	if !errors.Is(err, errIncidentNotFound) || changed {
+		t.Fatalf("tenant-b acknowledge = %v, %v; want errIncidentNotFound", changed, err)
+	}
+	if list, err := s.List(ctx, "tenant-b", "", 10); err != nil || len(list) != 0 {
+		t.Fatalf("tenant-b List = %+v, %v", list, err)
+	}
+	if got, _ := s.Get(ctx, "tenant-a", inc.ID); got.State != IncidentOpen {
+		t.Fatalf("tenant-a incident changed: %+v", got)
+	}
+}
+
+func TestRuleLessAlertsGroupByCode(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	overspeed := Alert{ID: "1-0", TenantID: "tenant-a", VehicleID: "v1", Level: "WARN", Code: "OVERSPEED", Message: "132 km/h in a 100 zone"}
+	faster := Alert{ID: "2-0", TenantID: "tenant-a", VehicleID: "v1", Level: "WARN", Code: "OVERSPEED", Message: "140 km/h in a 100 zone"}
+	charging := Alert{ID: "3-0", TenantID: "tenant-a", VehicleID: "v1", Level: "WARN", Code: "CHARGING_SLOW", Message: "charging at 2 kW"}
+	key := func(a Alert) string { return incidentGroupKey(a.TenantID, a.VehicleID, a.ruleKey()) }
+
+	if key(overspeed) == key(charging) {
+		t.Fatalf("different codes share incident key %q", key(overspeed))
+	}
+	if key(overspeed) != key(faster) {
+		t.Fatalf("same code, other message: keys %q and %q", key(overspeed), key(faster))
+	}
+	// dedup and incidents agree on what a repeat is
+	if dedupKey(overspeed.TenantID, overspeed.VehicleID, overspeed.ruleKey()) == dedupKey(charging.TenantID, charging.VehicleID, charging.ruleKey()) {
+		t.Fatal("different codes share a dedup key")
+	}
+
+	// resolving frees the key the incident was opened under
+	inc := &Incident{ID: "inc-1"}
+	inc.observe(overspeed, t0)
+	if got := incidentGroupKey(inc.TenantID, inc.VehicleID, inc.Rule); got != key(overspeed) {
+		t.Fatalf("incident indexed as %q, opened under %q", got, key(overspeed))
+	}
+
+	for _, tc := range []struct {
+		a    Alert
+		want string
+	}{
+		{Alert{Rule: "engine_temp", Code: "ENGINE_HOT", Message: "hot"}, "engine_temp"},
+		{Alert{Code: "ENGINE_HOT", Message: "hot"}, "ENGINE_HOT"},
+		{Alert{Message: "hot"}, "hot"},
+	} {
+		if got := tc.a.ruleKey(); got != tc.want {
+			t.Errorf("ruleKey(%+v) = %q, want %q", tc.a, got, tc.want)
+		}
+	}
+}
+
+func TestEscalationTiers(t *testing.T) {
+	channels := map[string]Channel{"webhook": &WebhookChannel{}, "sms": &SMSChannel{}}
+	esc, err := ParseEscalations([]byte(`[
+		{"name":"critical","tenant":"tenant-a","levels":["CRITICAL"],"tiers":[
+			{"after":"5m","channel":"sms","to":["+15550100"]},
+			{"after":"15m","channel":"webhook","to":["http://oncall"]}]}
+	]`), channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	inc := &Incident{ID: "inc-1"}
+	inc.observe(Alert{TenantID: "tenant-a", VehicleID: "v1", Level: "WARN"}, t0)
+	esc.assign(inc, t0)
+	if inc.Policy != "" {
+		t.Fatalf("WARN incident got policy %q", inc.Policy)
+	}
+
+	// the incident becomes CRITICAL a minute later: tiers count from then
+	t1 := t0.Add(time.Minute)
+	inc.observe(Alert{TenantID: "tenant-a", VehicleID: "v1", Level: "CRITICAL"}, t1)
+	esc.assign(inc, t1)
+	if inc.Policy != "critical" || !inc.NextEscalationAt.Equal(t1.Add(5*time.Minute)) {
+		t.Fatalf("after CRITICAL: policy %q next %v", inc.Policy, inc.NextEscalationAt)
+	}
+
+	if tier := esc.advance(inc, t1.Add(4*time.Minute)); tier != nil {
+		t.Fatalf("escalated early to %+v", tier)
+	}
+	tier := esc.advance(inc, t1.Add(5*time.Minute))
+	if tier == nil || tier.Channel != "sms" || inc.Tier != 1 || !inc.NextEscalationAt.Equal(t1.Add(15*time.Minute)) {
+		t.Fatalf("first tier = %+v, incident tier %d next %v", tier, inc.Tier, inc.NextEscalationAt)
+	}
+	// a second replica seeing the same due entry does nothing
+	if tier := esc.advance(inc, t1.Add(5*time.Minute)); tier != nil {
+		t.Fatalf("escalated twice to %+v", tier)
+	}
+	tier = esc.advance(inc, t1.Add(20*time.Minute))
+	if tier == nil || tier.Channel != "webhook" || inc.Tier != 2 || inc.NextEscalationAt != nil {
+		t.Fatalf("last tier = %+v, incident tier %d next %v", tier, inc.Tier, inc.NextEscalationAt)
+	}
+
+	// acknowledgement stops escalation
+	other := &Incident{ID: "inc-2"}
+	other.observe(Alert{TenantID: "tenant-a", VehicleID: "v2", Level: "CRITICAL"}, t0)
+	esc.assign(other, t0)
+	other.acknowledge("alice", t0.Add(time.Minute))
+	if tier := esc.advance(other, t0.Add(time.Hour)); tier != nil || other.NextEscalationAt != nil {
+		t.Fatalf("acknowledged incident escalated to %+v", tier)
+	}
+
+	for _, bad := range []string{
+		`[{"name":"x","tiers":[]}]`,
+		`[{"tiers":[{"after":"5m","channel":"sms","to":["1"]}]}]`,
+		`[{"name":"x","tiers":[{"after":"soon","channel":"sms","to":["1"]}]}]`,
+		`[{"name":"x","tiers":[{"after":"10m","channel":"sms","to":["1"]},{"after":"5m","channel":"sms","to":["1"]}]}]`,
+		`[{"name":"x","tiers":[{"after":"5m","channel":"email","to":["a@b"]}]}]`,
+		`[{"name":"x","tiers":[{"after":"5m","channel":"sms","to":["1"]}]},{"name":"x","tiers":[{"after":"5m","channel":"sms","to":["1"]}]}]`,
+	} {
+		if _, err := ParseEscalations([]byte(bad), channels); err == nil {
+			t.Errorf("ParseEscalations(%s) accepted invalid policy", bad)
+		}
+	}
+}
+
+func TestHubPublishesIncidentEventsToMatchingClients(t *testing.T) {
+	hub := NewHub()
+	all := &Client{control: make(chan wsControl, 1), tenant: "tenant-a"}
+	other := &Client{control: make(chan wsControl, 1), tenant: "tenant-b"}
+	filtered := &Client{control: make(chan wsControl, 1), tenant: "tenant-a"}
+	sub, _ := NewSubscription([]string{"v9"}, nil, nil)
+	filtered.filter.Store(sub)
+	for _, c := range []*Client{all, other, filtered} {
+		hub.clients[c] = struct{}{}
+	}
+
+	ev := &IncidentEvent{Type: "incident", Event: EventAcknowledged, Incident: &Incident{ID: "inc-1", TenantID: "tenant-a", VehicleID: "v1", Level: "CRITICAL"}}
+	hub.Publish(ev.Incident.alert(), ev)
+
+	select {
+	case ctl := <-all.control:
+		if ctl.event != ev {
+			t.Fatalf("client got %+v", ctl)
+		}
+	default:
+		t.Fatal("tenant client did not receive the incident event")
+	}
+	if len(other.control) != 0 {
+		t.Fatal("other tenant received the incident event")
+	}
+	if len(filtered.control) != 0 {
+		t.Fatal("client filtered to another vehicle received the incident event")
+	}
+}
@@ -1,56 +1,198 @@
-package main
+package notification
 
 import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+
+	"smartfleet/common/apikey"
+	"smartfleet/common/config"
+	"smartfleet/common/logging"
+	commonredis "smartfleet/common/redis"
+	"smartfleet/common/tracing"
 )
 
 // Alert represents an alert message produced by analytics.
 type Alert struct {
+	ID        string    `json:"id,omitempty"` // stream entry ID; resume point for ?since=
+	TenantID  string    `json:"tenant_id"`
 	VehicleID string    `json:"vehicle_id"`
 	Level     string    `json:"level"`   // INFO / WARN / CRITICAL
 	Message   string    `json:"message"` // human message
 	Ts        time.Time `json:"ts"`
 	Source    string    `json:"source,omitempty"`
+	RequestID string    `json:"request_id,omitempty"` // ingest request of the telemetry that raised it
+
+	// W3C trace context of the analytics publish span (see tracing.go);
+	// dropped before alerts reach clients
+	TraceContext map[string]string `json:"trace_context,omitempty"`
+
+	Rule       string  `json:"rule,omitempty"`       // detector that fired (analytics)
+	Confidence float64 `json:"confidence,omitempty"` // 0..1, for statistical detections
+	GroupID    *uint   `json:"group_id,omitempty"`   // registry vehicle group, when known
+
+	Occurrences int `json:"occurrences,omitempty"` // with deduplicated repeats; absent means 1
+
+	// structured alerts (see templates.go): Message is rendered from Code
+	// and Params at delivery time, in Locale
+	Code   string                 `json:"code,omitempty"`
+	Params map[string]interface{} `json:"params,omitempty"`
+	Locale string                 `json:"locale,omitempty"`
+}
+
+// ruleKey names the condition an alert reports, so repeats of it share a
+// dedup key and an incident: the detector's Rule, or the Code of alerts
+// published without one, or else the Message of older publishers.
+func (a Alert) ruleKey() string {
+	switch {
+	case a.Rule != "":
+		return a.Rule
+	case a.Code != "":
+		return a.Code
+	}
+	return a.Message
 }
 
-// Config via environment vars (12-factor)
 var (
-	redisAddr   = getenv("REDIS_ADDR", "redis:6379")
-	redisPubSub = getenv("REDIS_ALERT_CHANNEL", "alerts")
-	httpAddr    = getenv("HTTP_ADDR", ":8083")
-	maxRecent   = getenvInt("MAX_RECENT_ALERTS", 200)
-	pingPeriod  = 30 * time.Second
-	writeWait   = 10 * time.Second
-	readWait    = 60 * time.Second
+	pingPeriod = 30 * time.Second
+	writeWait  = 10 * time.Second
+	readWait   = 60 * time.Second
+	sseRetry   = 3 * time.Second
 )
 
-// helper env functions
-func getenv(k, d string) string {
-	if v := os.Getenv(k); v != "" {
-		return v
+// Config is the service configuration, from the environment, an optional
+// YAML file (-config) and flags; -print-config shows it.
+type Config struct {
+	HTTPAddr  string         `yaml:"http_addr" env:"HTTP_ADDR" default:":8083"`
+	Log       config.Log     `yaml:"log"`
+	Tracing   config.Tracing `yaml:"tracing"`
+	Redis     config.Redis   `yaml:"redis"`
+	MaxRecent int            `yaml:"max_recent_alerts" env:"MAX_RECENT_ALERTS" default:"200"`
+
+	// tenant authentication for API and WebSocket clients: "key1=tenantA,key2=tenantB"
+	APIKeys       string `yaml:"api_keys" env:"NOTIFY_API_KEYS" secret:"true"`
+	DefaultTenant string `yaml:"default_tenant" env:"DEFAULT_TENANT" default:"default"`
+	AuthDevMode   bool   `yaml:"auth_dev_mode" env:"AUTH_DEV_MODE" help:"without API keys, trust X-Tenant-ID; never in production"`
+
+	// alert transport: "stream" (durable, resumable) or "pubsub" (legacy)
+	AlertTransport    string `yaml:"alert_transport" env:"ALERT_TRANSPORT" default:"stream" oneof:"stream pubsub"`
+	AlertStream       string `yaml:"alert_stream" env:"REDIS_ALERT_STREAM" default:"alerts.stream"`
+	AlertStreamMaxLen int64  `yaml:"alert_stream_maxlen" env:"ALERT_STREAM_MAXLEN" default:"100000"`
+	AlertChannel      string `yaml:"alert_channel" env:"REDIS_ALERT_CHANNEL" default:"alerts"`
+	AlertGroup        string `yaml:"alert_consumer_group" env:"ALERT_CONSUMER_GROUP" default:"notification-service"`
+	AlertConsumer     string `yaml:"alert_consumer_name" env:"ALERT_CONSUMER_NAME" help:"defaults to the replica ID"`
+
+	// clustering (see cluster.go): every replica fans out the full stream
+	ClusterMode     bool          `yaml:"cluster_mode" env:"CLUSTER_MODE"`
+	ReplicaID       string        `yaml:"replica_id" env:"REPLICA_ID" help:"defaults to the host name"`
+	PresenceTTL     time.Duration `yaml:"presence_ttl" env:"PRESENCE_TTL_SECONDS" default:"30s" unit:"s"`
+	DrainTimeout    time.Duration `yaml:"drain_timeout" env:"DRAIN_TIMEOUT_SECONDS" default:"10s" unit:"s"`
+	ReconnectJitter time.Duration `yaml:"reconnect_jitter" env:"RECONNECT_JITTER_MS" default:"5s" unit:"ms"`
+
+	// outbound delivery (see routing.go): NOTIFY_ROUTES is a JSON rule array,
+	// or NOTIFY_ROUTES_FILE a path to one
+	Routes            string        `yaml:"routes" env:"NOTIFY_ROUTES"`
+	RoutesFile        string        `yaml:"routes_file" env:"NOTIFY_ROUTES_FILE"`
+	SMTPAddr          string        `yaml:"smtp_addr" env:"SMTP_ADDR"`
+	SMTPFrom          string        `yaml:"smtp_from" env:"SMTP_FROM" default:"alerts@smartfleet.local"`
+	SMTPUsername      string        `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword      string        `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+	WebhookSecret     string        `yaml:"webhook_secret" env:"WEBHOOK_SECRET" secret:"true" help:"signs webhook deliveries; the webhook channel is disabled without it"`
+	SMSGatewayURL     string        `yaml:"sms_gateway_url" env:"SMS_GATEWAY_URL"`
+	SMSGatewayToken   string        `yaml:"sms_gateway_token" env:"SMS_GATEWAY_TOKEN" secret:"true"`
+	SMSFrom           string        `yaml:"sms_from" env:"SMS_FROM" default:"SmartFleet"`
+	DeliveryWorkers   int           `yaml:"delivery_workers" env:"DELIVERY_WORKERS" default:"4"`
+	DeliveryAttempts  int           `yaml:"delivery_max_attempts" env:"DELIVERY_MAX_ATTEMPTS" default:"5"`
+	DeliveryBaseDelay time.Duration `yaml:"delivery_base_delay" env:"DELIVERY_BASE_DELAY_MS" default:"1s" unit:"ms"`
+	DeliveryMaxDelay  time.Duration `yaml:"delivery_max_delay" env:"DELIVERY_MAX_DELAY_SECONDS" default:"1m" unit:"s"`
+	DeliveryLogMax    int64         `yaml:"delivery_log_max" env:"DELIVERY_LOG_MAX" default:"1000"`
+
+	// incidents and escalation (see incidents.go, escalation.go)
+	Escalations        string        `yaml:"escalations" env:"NOTIFY_ESCALATIONS"`
+	EscalationsFile    string        `yaml:"escalations_file" env:"NOTIFY_ESCALATIONS_FILE"`
+	IncidentRetention  time.Duration `yaml:"incident_retention" env:"INCIDENT_RETENTION_HOURS" default:"168h" unit:"h"`
+	EscalationInterval time.Duration `yaml:"escalation_check" env:"ESCALATION_CHECK_SECONDS" default:"5s" unit:"s"`
+
+	// suppression (see suppression.go); a cooldown of 0 disables deduplication
+	SuppressionCooldown  time.Duration `yaml:"suppression_cooldown" env:"SUPPRESSION_COOLDOWN_SECONDS" default:"5m" unit:"s"`
+	SuppressionRetention time.Duration `yaml:"suppression_retention" env:"SUPPRESSION_RETENTION_HOURS" default:"168h" unit:"h"`
+
+	// browser streams (see streamauth.go, sse.go): ALLOWED_ORIGINS is a
+	// comma-separated origin list or "*"; same-origin is always allowed
+	AllowedOrigins    string        `yaml:"allowed_origins" env:"ALLOWED_ORIGINS"`
+	StreamTokenSecret string        `yaml:"stream_token_secret" env:"STREAM_TOKEN_SECRET" secret:"true"`
+	StreamTokenTTL    time.Duration `yaml:"stream_token_ttl" env:"STREAM_TOKEN_TTL_SECONDS" default:"5m" unit:"s"`
+	SSEHeartbeat      time.Duration `yaml:"sse_heartbeat" env:"SSE_HEARTBEAT_SECONDS" default:"15s" unit:"s"`
+
+	// per-client send queue (see hub.go); clients choose a policy with ?slow=
+	ClientSendBuffer   int    `yaml:"client_send_buffer" env:"CLIENT_SEND_BUFFER" default:"128"`
+	SlowConsumerPolicy string `yaml:"slow_consumer_policy" env:"SLOW_CONSUMER_POLICY" default:"disconnect" oneof:"drop-oldest coalesce disconnect"`
+
+	// message templates (see templates.go): NOTIFY_TEMPLATES is a JSON object
+	// of locales adding to or overriding the built-in ones
+	DefaultLocale string `yaml:"default_locale" env:"NOTIFY_DEFAULT_LOCALE" default:"en"`
+	Templates     string `yaml:"templates" env:"NOTIFY_TEMPLATES"`
+	TemplatesFile string `yaml:"templates_file" env:"NOTIFY_TEMPLATES_FILE"`
+
+	// digests (see digest.go): NOTIFY_DIGESTS is a JSON schedule array;
+	// trip totals come from analytics-service when ANALYTICS_URL is set
+	Digests               string        `yaml:"digests" env:"NOTIFY_DIGESTS"`
+	DigestsFile           string        `yaml:"digests_file" env:"NOTIFY_DIGESTS_FILE"`
+	DigestInterval        time.Duration `yaml:"digest_check" env:"DIGEST_CHECK_SECONDS" default:"30s" unit:"s"`
+	AnalyticsURL          string        `yaml:"analytics_url" env:"ANALYTICS_URL"`
+	AnalyticsServiceToken string        `yaml:"analytics_service_token" env:"ANALYTICS_SERVICE_TOKEN" secret:"true"`
+}
+
+// Validate fills in the names derived from the host and rejects
+// combinations the service cannot run with.
+func (c *Config) Validate() error {
+	if c.ReplicaID == "" {
+		c.ReplicaID = hostname()
+	}
+	if c.AlertConsumer == "" {
+		c.AlertConsumer = c.ReplicaID
+	}
+	var errs []error
+	if c.ClusterMode && c.AlertTransport != TransportStream {
+		errs = append(errs, errors.New("CLUSTER_MODE requires ALERT_TRANSPORT=stream"))
 	}
-	return d
+	if c.DeliveryWorkers < 1 {
+		errs = append(errs, errors.New("DELIVERY_WORKERS must be at least 1"))
+	}
+	if c.ClientSendBuffer < 1 {
+		errs = append(errs, errors.New("CLIENT_SEND_BUFFER must be at least 1"))
+	}
+	return errors.Join(errs...)
 }
-func getenvInt(k string, d int) int {
-	if s := os.Getenv(k); s != "" {
-		if n, err := strconv.Atoi(s); err == nil {
-			return n
-		}
+
+// conf is loaded by Main; until then it holds the defaults.
+var conf = func() Config {
+	c := config.Default[Config]()
+	_ = c.Validate()
+	return c
+}()
+
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		return "notification"
 	}
-	return d
+	return h
 }
 
 // RecentAlerts is a simple goroutine-safe ring/circular buffer
@@ -93,128 +235,310 @@ func (r *RecentAlerts) List() []Alert {
 	return out
 }
 
-// WebSocket client management
+// SetOccurrences updates the occurrence count of a buffered alert.
+func (r *RecentAlerts) SetOccurrences(tenant, id string, occurrences int) {
+	if id == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := 0; i < r.len; i++ {
+		a := &r.buf[(r.start+i)%r.cap]
+		if a.ID == id && a.TenantID == tenant {
+			if occurrences > a.Occurrences {
+				a.Occurrences = occurrences
+			}
+			return
+		}
+	}
+}
+
+// ListTenant returns the recent alerts belonging to one tenant.
+func (r *RecentAlerts) ListTenant(tenant string) []Alert {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := make([]Alert, 0)
+	for i := 0; i < r.len; i++ {
+		if a := r.buf[(r.start+i)%r.cap]; a.TenantID == tenant {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// WebSocket and SSE client management (see hub.go)
 type Client struct {
-	conn *websocket.Conn
-	send chan Alert
+	conn    *websocket.Conn // nil for SSE clients
+	queue   *sendQueue
+	control chan wsControl
+	tenant  string                       // only alerts of this tenant are delivered
+	filter  atomic.Pointer[Subscription] // nil delivers every alert of the tenant
+
+	id          string // assigned by Hub.Register
+	transport   string // "ws" or "sse"
+	connectedAt time.Time
+	catalog     *Catalog
+	locales     []string // preferred first
+}
+
+func newClient(tenant, transport string, policy SlowConsumerPolicy) *Client {
+	return &Client{
+		queue:       newSendQueue(policy, conf.ClientSendBuffer),
+		control:     make(chan wsControl, 8),
+		tenant:      tenant,
+		transport:   transport,
+		connectedAt: time.Now().UTC(),
+	}
 }
 
-type Hub struct {
-	clients    map[*Client]struct{}
-	register   chan *Client
-	unregister chan *Client
-	broadcast  chan Alert
-	mu         sync.RWMutex
+// wsControl is written by wsWriter alongside alerts: an optional reply to a
+// client message or an event (incident, occurrence), followed by a batch of
+// alerts to replay.
+type wsControl struct {
+	reply  *SubscriptionReply
+	event  interface{}
+	replay []Alert
+
+	closeCode   int // non-zero: send a close frame afterwards and stop
+	closeReason string
+}
+
+// localize renders an alert in the client's language.
+func (c *Client) localize(a Alert) Alert {
+	return c.catalog.Localize(a, c.locales)
+}
+
+// wants reports whether the alert should be delivered to this client.
+func (c *Client) wants(a Alert) bool {
+	return c.tenant == a.TenantID && c.filter.Load().Matches(a)
 }
 
-func NewHub() *Hub {
-	return &Hub{
-		clients:    make(map[*Client]struct{}),
-		register:   make(chan *Client),
-		unregister: make(chan *Client),
-		broadcast:  make(chan Alert, 256),
+// recentFor returns the recent alerts the client's current filter selects.
+func (c *Client) recentFor(recent *RecentAlerts) []Alert {
+	sub := c.filter.Load()
+	out := make([]Alert, 0)
+	for _, a := range recent.ListTenant(c.tenant) {
+		if sub.Matches(a) {
+			out = append(out, a)
+		}
 	}
+	return out
 }
 
-func (h *Hub) Run(ctx context.Context) {
-	for {
-		select {
-		case c := <-h.register:
-			h.mu.Lock()
-			h.clients[c] = struct{}{}
-			h.mu.Unlock()
-		case c := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.clients[c]; ok {
-				delete(h.clients, c)
-				close(c.send)
-			}
-			h.mu.Unlock()
-		case a := <-h.broadcast:
-			h.mu.RLock()
-			for c := range h.clients {
-				// non-blocking push to client
-				select {
-				case c.send <- a:
-				default:
-					// client send buffer full -> close it
-					delete(h.clients, c)
-					close(c.send)
-				}
-			}
-			h.mu.RUnlock()
-		case <-ctx.Done():
-			// shutdown: close all clients
-			h.mu.Lock()
-			for c := range h.clients {
-				close(c.send)
-			}
-			h.clients = nil
-			h.mu.Unlock()
+// serveWs upgrades a client. With ?since=<id> the client first receives every
+// alert after that ID (stream transport), otherwise the recent alerts.
+func (n *NotificationService) serveWs(w http.ResponseWriter, r *http.Request) {
+	if n.draining.Load() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "replica draining, reconnect", http.StatusServiceUnavailable)
+		return
+	}
+	tenant, err := n.streamTenant(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	// initial filter from the query string, e.g. /ws?levels=CRITICAL&vehicles=v1,v2
+	sub, err := SubscriptionFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	since := r.URL.Query().Get("since")
+	if since != "" {
+		if n.transport != TransportStream {
+			http.Error(w, "since requires ALERT_TRANSPORT=stream", http.StatusBadRequest)
+			return
+		}
+		if _, err := parseStreamID(since); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n.history() == nil {
+			http.Error(w, errNoHistory.Error(), http.StatusNotImplemented)
 			return
 		}
 	}
-}
+	policy, err := ParseSlowConsumerPolicy(r.URL.Query().Get("slow"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// a disallowed Origin gets 403 from the upgrader
+	conn, err := n.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		n.logger.Printf("[ws] upgrade error: %v", err)
+		return
+	}
+	client := newClient(tenant, "ws", policy)
+	client.conn = conn
+	client.catalog, client.locales = n.catalog, localePrefs(r)
+	client.filter.Store(sub)
 
-// upgrader for websocket
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	// allow all origins for demo; in prod restrict origins
-	CheckOrigin: func(r *http.Request) bool { return true },
+	initial, ok := n.attach(r.Context(), client, since)
+	// start writer and reader goroutines
+	go wsWriter(client, initial)
+	if ok {
+		go wsReader(client, n.hub, n.recent)
+	}
 }
 
-func serveWs(hub *Hub, recent *RecentAlerts, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
+// attach registers a WebSocket or SSE client with the hub and returns what
+// it receives first: the recent alerts, or with since the history after it.
+// A resuming client is only registered once its history has been read; if
+// that fails it is not registered at all, and the returned control tells it
+// so and closes the stream.
+func (n *NotificationService) attach(ctx context.Context, c *Client, since string) (wsControl, bool) {
+	if since == "" {
+		// register before reading: anything published in between is queued
+		// for the client and de-duplicated by ID in the writer
+		n.hub.Register(c)
+		return wsControl{replay: c.recentFor(n.recent)}, true
+	}
+	initial, err := n.resumeFrom(ctx, c, since)
 	if err != nil {
-		log.Printf("[ws] upgrade error: %v\n", err)
-		return
+		return initial, false
 	}
-	client := &Client{conn: conn, send: make(chan Alert, 128)}
-	hub.register <- client
-
-	// send recent alerts on connect
-	for _, a := range recent.List() {
-		client.send <- a
+	n.hub.Register(c)
+	if !initial.reply.More {
+		// deliver adds alerts to the recent buffer before broadcasting them,
+		// so what was published while the history was read is there
+		last := since
+		if len(initial.replay) > 0 {
+			last = initial.replay[len(initial.replay)-1].ID
+		}
+		for _, a := range c.recentFor(n.recent) {
+			if a.ID != "" && alertIDAfter(a.ID, last) {
+				initial.replay = append(initial.replay, a)
+			}
+		}
 	}
+	return initial, true
+}
 
-	// start writer and reader goroutines
-	go wsWriter(client)
-	go wsReader(client, hub)
+// resumeFrom builds the history a client reconnecting with ?since= receives.
+// The reply tells the client whether the stream was trimmed past its ID or
+// whether more history remains to be paged through GET /alerts?since=.
+func (n *NotificationService) resumeFrom(ctx context.Context, c *Client, since string) (wsControl, error) {
+	hist, truncated, err := n.AlertsSince(ctx, c.tenant, since, maxHistoryLimit)
+	reply := &SubscriptionReply{Type: "resume", Since: since, Truncated: truncated}
+	if err != nil {
+		n.logger.Printf("[ws] resume from %s: %v", since, err)
+		reply.Type, reply.Error = "error", "history unavailable"
+		return wsControl{reply: reply, closeCode: websocket.CloseTryAgainLater, closeReason: "history unavailable"}, err
+	}
+	reply.More = len(hist) == maxHistoryLimit
+	sub := c.filter.Load()
+	replay := make([]Alert, 0, len(hist))
+	for _, a := range hist {
+		if sub.Matches(a) {
+			replay = append(replay, a)
+		}
+	}
+	return wsControl{reply: reply, replay: replay}, nil
 }
 
-func wsReader(c *Client, hub *Hub) {
+// wsReader handles subscribe/unsubscribe messages until the connection closes.
+func wsReader(c *Client, hub *Hub, recent *RecentAlerts) {
 	defer func() {
-		hub.unregister <- c
+		hub.Unregister(c)
 		c.conn.Close()
 	}()
-	c.conn.SetReadLimit(512)
+	c.conn.SetReadLimit(maxClientMessageBytes)
 	_ = c.conn.SetReadDeadline(time.Now().Add(readWait))
 	c.conn.SetPongHandler(func(string) error { _ = c.conn.SetReadDeadline(time.Now().Add(readWait)); return nil })
 	for {
-		// we only expect pings/pongs or client messages (ignored) — read to detect close
-		if _, _, err := c.conn.ReadMessage(); err != nil {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
 			break
 		}
+		reply, replay := handleClientMessage(c, data)
+		ctl := wsControl{reply: &reply}
+		if replay {
+			ctl.replay = c.recentFor(recent)
+		}
+		select {
+		case c.control <- ctl:
+		default:
+			// client is sending faster than we can acknowledge
+			return
+		}
+	}
+}
+
+// writeControl writes a reply and its replayed alerts.
+func writeControl(c *Client, ctl wsControl) error {
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if ctl.reply != nil {
+		if err := c.conn.WriteJSON(ctl.reply); err != nil {
+			return err
+		}
+	}
+	if ctl.event != nil {
+		if err := c.conn.WriteJSON(ctl.event); err != nil {
+			return err
+		}
+	}
+	for _, a := range ctl.replay {
+		if err := c.conn.WriteJSON(c.localize(a)); err != nil {
+			return err
+		}
+	}
+	if ctl.closeCode != 0 {
+		if err := writeClose(c, ctl.closeCode, ctl.closeReason); err != nil {
+			return err
+		}
+		return errClientClosed
 	}
+	return nil
 }
 
-func wsWriter(c *Client) {
+// errClientClosed ends wsWriter after a deliberate close frame.
+var errClientClosed = errors.New("closed by server")
+
+// wsWriter writes the initial replay, then live alerts and control replies.
+// Live alerts at or before the last replayed ID are skipped, so the handover
+// from history to the live feed has neither gaps nor duplicates.
+func wsWriter(c *Client, initial wsControl) {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
 	}()
+	if err := writeControl(c, initial); err != nil {
+		return
+	}
+	var lastID string
+	for _, a := range initial.replay {
+		if a.ID != "" {
+			lastID = a.ID
+		}
+	}
+	var batch []Alert
 	for {
 		select {
-		case a, ok := <-c.send:
-			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// channel closed
-				_ = c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case <-c.queue.ready:
+			var closed bool
+			if batch, closed = c.queue.take(batch[:0]); closed {
+				// unregistered, too slow or shutting down
+				code, reason := c.queue.closeFrame()
+				_ = writeClose(c, code, reason)
 				return
 			}
-			if err := c.conn.WriteJSON(a); err != nil {
+			_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			for _, a := range batch {
+				if !alertIDAfter(a.ID, lastID) {
+					continue
+				}
+				if a.ID != "" {
+					lastID = a.ID
+				}
+				if err := c.conn.WriteJSON(c.localize(a)); err != nil {
+					return
+				}
+			}
+		case ctl := <-c.control:
+			if err := writeControl(c, ctl); err != nil {
 				return
 			}
 		case <-ticker.C:
@@ -229,77 +553,130 @@ func wsWriter(c *Client) {
 // NotificationService encapsulates Redis subscription and HTTP/WebSocket APIs
 type NotificationService struct {
 	rdb        *redis.Client
+	transport  string
 	recent     *RecentAlerts
 	hub        *Hub
-	logger     *log.Logger
-	pubsub     *redis.PubSub
+	auth       *apikey.Auth
+	log        *zap.Logger  // the alert path, with request IDs
+	logger     *log.Logger  // the same component, for everything else
+	logLevels  http.Handler // /admin/log-levels, nil when not set
+	bus        AlertBus     // nil without Redis until SetAlertBus
 	cancelSub  context.CancelFunc
 	subRunning chan struct{}
+	server     *http.Server
+	startedAt  time.Time
+	draining   atomic.Bool
+	dispatcher *Dispatcher    // nil when no routing rules are configured
+	deliveries DeliveryLog    // nil when no routing rules are configured
+	workers    sync.WaitGroup // background consumers besides the main one
+
+	incidents   *IncidentStore // nil without Redis
+	escalations *Escalations   // nil when no policies are configured
+	suppressor  *Suppressor    // nil without Redis
+	catalog     *Catalog
+	digests     []*DigestSchedule // nil when no digests are configured
+	analytics   *AnalyticsClient  // nil without ANALYTICS_URL
+
+	upgrader websocket.Upgrader
+	origins  *OriginAllowlist // browser origins allowed to open streams
+	tokens   *StreamTokens
 }
 
-func NewNotificationService(rdb *redis.Client, logger *log.Logger) *NotificationService {
-	return &NotificationService{
+// NewNotificationService builds the service on rdb, or on a bus set with
+// SetAlertBus when rdb is nil.
+func NewNotificationService(rdb *redis.Client, auth *apikey.Auth, l *zap.Logger) (*NotificationService, error) {
+	if l == nil {
+		l = zap.NewNop()
+	}
+	logger := zap.NewStdLog(l)
+	n := &NotificationService{
 		rdb:        rdb,
-		recent:     NewRecentAlerts(maxRecent),
+		transport:  conf.AlertTransport,
+		recent:     NewRecentAlerts(conf.MaxRecent),
 		hub:        NewHub(),
+		auth:       auth,
+		log:        l,
 		logger:     logger,
 		subRunning: make(chan struct{}),
+		startedAt:  time.Now().UTC(),
+		origins:    &OriginAllowlist{},
 	}
+	n.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     func(r *http.Request) bool { return n.origins.Allowed(r) },
+	}
+	// random secret: tokens only work on this replica until main configures one
+	var err error
+	if n.tokens, err = NewStreamTokens("", conf.StreamTokenTTL); err != nil {
+		return nil, fmt.Errorf("stream tokens: %w", err)
+	}
+	if n.catalog, err = NewCatalog(conf.DefaultLocale); err != nil {
+		return nil, fmt.Errorf("built-in message templates: %w", err)
+	}
+	if rdb != nil {
+		if n.transport == TransportPubSub {
+			n.bus = NewPubSubBus(rdb, conf.AlertChannel, logger)
+		} else {
+			n.bus = NewStreamBus(rdb, logger)
+		}
+		n.incidents = NewIncidentStore(rdb, conf.IncidentRetention)
+		n.suppressor = NewSuppressor(rdb, conf.SuppressionCooldown, conf.SuppressionRetention)
+	}
+	return n, nil
 }
 
-// start subscription to Redis channel 'alerts'
-func (n *NotificationService) StartSubscription(ctx context.Context, channel string) error {
-	ctxSub, cancel := context.WithCancel(ctx)
-	n.cancelSub = cancel
-	ps := n.rdb.Subscribe(ctxSub, channel)
-	n.pubsub = ps
+// SetAlertBus replaces the bus alerts are published on and consumed from,
+// for running the service without Redis. Call it before starting.
+func (n *NotificationService) SetAlertBus(bus AlertBus) {
+	n.bus = bus
+}
 
-	// wait for subscription to be ready
-	_, err := ps.Receive(ctxSub)
-	if err != nil {
-		return err
+// SetLogLevels serves h at /admin/log-levels (see common/logging).
+func (n *NotificationService) SetLogLevels(h http.Handler) {
+	n.logLevels = h
+}
+
+// normalizeAlert fills fields older publishers leave empty.
+func normalizeAlert(a Alert) Alert {
+	if a.Ts.IsZero() {
+		a.Ts = time.Now().UTC()
 	}
+	if a.TenantID == "" {
+		a.TenantID = conf.DefaultTenant
+	}
+	return a
+}
 
-	go func() {
-		defer close(n.subRunning)
-		ch := ps.Channel()
-		for {
-			select {
-			case msg, ok := <-ch:
-				if !ok {
-					n.logger.Println("[sub] channel closed")
-					return
-				}
-				// parse alert
-				var a Alert
-				if err := json.Unmarshal([]byte(msg.Payload), &a); err != nil {
-					n.logger.Printf("[sub] invalid alert payload: %v\n", err)
-					continue
-				}
-				// ensure timestamp
-				if a.Ts.IsZero() {
-					a.Ts = time.Now().UTC()
-				}
-				// 1) store in recent buffer
-				n.recent.Add(a)
-				// 2) publish to websocket clients
-				select {
-				case n.hub.broadcast <- a:
-				default:
-					// drop if hub busy
-					n.logger.Println("[sub] hub busy, dropped alert broadcast")
-				}
-			case <-ctxSub.Done():
-				n.logger.Println("[sub] stopping subscription")
-				_ = ps.Close()
-				return
-			}
-		}
-	}()
+// handleOnce does the per-alert work that must happen once across all
+// replicas: filing the alert into its incident and outbound delivery.
+func (n *NotificationService) handleOnce(a Alert) {
+	a = normalizeAlert(a)
+	n.observeIncident(a)
+	if n.dispatcher != nil {
+		n.dispatcher.Dispatch(a)
+	}
+}
 
-	// run hub
-	go n.hub.Run(ctxSub)
-	return nil
+// deliver stores an incoming alert and fans it out to WebSocket clients.
+func (n *NotificationService) deliver(a Alert) {
+	a = normalizeAlert(a)
+	// 1) store in recent buffer
+	n.recent.Add(a)
+	// 2) queue for WebSocket and SSE clients; slow clients are handled by
+	// their own policy and never hold up the others
+	clients := n.hub.Broadcast(a)
+	n.log.Debug("alert delivered", zap.String("request_id", a.RequestID), zap.String("alert_id", a.ID),
+		zap.String("tenant", a.TenantID), zap.String("vehicle_id", a.VehicleID), zap.String("code", a.Code), zap.Int("clients", clients))
+}
+
+// StartSubscription consumes alerts from the Redis channel
+// (ALERT_TRANSPORT=pubsub) and both fans out and dispatches each alert.
+func (n *NotificationService) StartSubscription(ctx context.Context, channel string) error {
+	ctxSub, cancel := context.WithCancel(ctx)
+	n.cancelSub = cancel
+	n.bus = NewPubSubBus(n.rdb, channel, n.logger)
+	return n.consume(ctxSub, cancel)
 }
 
 func (n *NotificationService) Stop() {
@@ -307,29 +684,35 @@ func (n *NotificationService) Stop() {
 		n.cancelSub()
 		<-n.subRunning // wait for subscription loop to end
 	}
+	n.workers.Wait()
 }
 
 // http handlers
 
-// push test alert (also publishes to Redis channel so consumers see same)
+// push test alert (published over the alert transport so consumers see same)
 func (n *NotificationService) handlePushAlert(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
 	var a Alert
 	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
 		http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
 		return
 	}
+	// callers can only push alerts into their own tenant
+	a.TenantID = tenant
 	if a.Ts.IsZero() {
 		a.Ts = time.Now().UTC()
 	}
-	// publish to redis channel
-	pb, _ := json.Marshal(a)
 	ctx, cancel := context.WithTimeout(r.Context(), 500*time.Millisecond)
 	defer cancel()
-	if err := n.rdb.Publish(ctx, redisPubSub, pb).Err(); err != nil {
+	if err := n.publishAlert(ctx, a); err != nil {
 		n.logger.Printf("[push] redis publish err: %v", err)
 		http.Error(w, "publish failed", http.StatusInternalServerError)
 		return
@@ -337,62 +720,327 @@ func (n *NotificationService) handlePushAlert(w http.ResponseWriter, r *http.Req
 	w.WriteHeader(http.StatusAccepted)
 }
 
-// list recent alerts
+// list recent alerts, or with ?since=<id>&limit= the alerts after that ID.
+// X-Alerts-Truncated: true means history between since and the first
+// returned alert was trimmed from the stream.
 func (n *NotificationService) handleListAlerts(w http.ResponseWriter, r *http.Request) {
-	list := n.recent.List()
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		list := n.localizeAll(n.recent.ListTenant(tenant), localePrefs(r))
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	limit := defaultHistoryLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			http.Error(w, "limit must be 1.."+strconv.Itoa(maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	if n.transport != TransportStream {
+		http.Error(w, "since requires ALERT_TRANSPORT=stream", http.StatusBadRequest)
+		return
+	}
+	list, truncated, err := n.AlertsSince(r.Context(), tenant, since, limit)
+	if errors.Is(err, errInvalidStreamID) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, errNoHistory) {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		n.logger.Printf("[alerts] history since %s: %v", since, err)
+		http.Error(w, "history unavailable", http.StatusInternalServerError)
+		return
+	}
+	if truncated {
+		w.Header().Set("X-Alerts-Truncated", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(n.localizeAll(list, localePrefs(r)))
+}
+
+// localizeAll renders a list of alerts in place.
+func (n *NotificationService) localizeAll(list []Alert, prefs []string) []Alert {
+	for i := range list {
+		list[i] = n.catalog.Localize(list[i], prefs)
+	}
+	return list
+}
+
+// configureDelivery sets up outbound channels, the dispatcher and escalation
+// policies from the environment. Channels are enabled by their settings;
+// rules and policies may only use enabled channels.
+func (n *NotificationService) configureDelivery() error {
+	routes, err := configJSON(conf.Routes, conf.RoutesFile)
+	if err != nil {
+		return err
+	}
+	escalations, err := configJSON(conf.Escalations, conf.EscalationsFile)
+	if err != nil {
+		return err
+	}
+	digests, err := configJSON(conf.Digests, conf.DigestsFile)
+	if err != nil {
+		return err
+	}
+	if routes == nil && escalations == nil && digests == nil {
+		return nil
+	}
+	httpClient := &http.Client{Timeout: 15 * time.Second}
+	channels := map[string]Channel{}
+	// receivers verify the signature, so an unsigned webhook is not offered
+	if conf.WebhookSecret != "" {
+		channels["webhook"] = &WebhookChannel{Secret: conf.WebhookSecret, Client: httpClient}
+	}
+	if conf.SMTPAddr != "" {
+		channels["email"] = &EmailChannel{Addr: conf.SMTPAddr, From: conf.SMTPFrom, Username: conf.SMTPUsername, Password: conf.SMTPPassword}
+	}
+	if conf.SMSGatewayURL != "" {
+		channels["sms"] = &SMSChannel{GatewayURL: conf.SMSGatewayURL, Token: conf.SMSGatewayToken, From: conf.SMSFrom, Client: httpClient}
+	}
+	var rules []*RoutingRule
+	if routes != nil {
+		if rules, err = ParseRoutingRules(routes, channels); err != nil {
+			return err
+		}
+	}
+	if escalations != nil {
+		if n.escalations, err = ParseEscalations(escalations, channels); err != nil {
+			return fmt.Errorf("escalations: %w", err)
+		}
+		n.logger.Printf("escalation: %d policies", len(n.escalations.policies))
+	}
+	if digests != nil {
+		if n.transport != TransportStream {
+			return fmt.Errorf("digests require ALERT_TRANSPORT=stream")
+		}
+		if n.digests, err = ParseDigestSchedules(digests, channels); err != nil {
+			return err
+		}
+		if conf.AnalyticsURL != "" {
+			n.analytics = NewAnalyticsClient(conf.AnalyticsURL, conf.AnalyticsServiceToken)
+		}
+		n.logger.Printf("digests: %d schedules", len(n.digests))
+	}
+	n.deliveries = NewRedisDeliveryLog(n.rdb, conf.DeliveryLogMax)
+	n.dispatcher = NewDispatcher(channels, rules, n.deliveries, RetryPolicy{
+		MaxAttempts: conf.DeliveryAttempts,
+		BaseDelay:   conf.DeliveryBaseDelay,
+		MaxDelay:    conf.DeliveryMaxDelay,
+	}, conf.DeliveryWorkers, n.catalog, n.logger)
+	n.logger.Printf("outbound delivery: %d routing rules", len(rules))
+	return nil
+}
+
+// configJSON returns inline JSON or the contents of file; nil when neither is set.
+func configJSON(inline, file string) ([]byte, error) {
+	if file != "" {
+		return os.ReadFile(file)
+	}
+	if inline == "" {
+		return nil, nil
+	}
+	return []byte(inline), nil
+}
+
+// list the caller's outbound delivery log, newest first
+func (n *NotificationService) handleListDeliveries(w http.ResponseWriter, r *http.Request) {
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	limit := defaultHistoryLimit
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 || n > maxHistoryLimit {
+			http.Error(w, "limit must be 1.."+strconv.Itoa(maxHistoryLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	list := make([]DeliveryRecord, 0)
+	if n.deliveries != nil {
+		if list, err = n.deliveries.List(r.Context(), tenant, limit); err != nil {
+			n.logger.Printf("[deliveries] list: %v", err)
+			http.Error(w, "delivery log unavailable", http.StatusInternalServerError)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(list)
 }
 
-func (n *NotificationService) ServeHTTP(addr string) error {
+// Handler returns the HTTP and WebSocket routes.
+func (n *NotificationService) Handler() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/alerts", n.handleListAlerts)       // GET -> list
-	mux.HandleFunc("/alert", n.handlePushAlert)         // POST -> push test alert
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) { serveWs(n.hub, n.recent, w, r) }) // WS endpoint
+	mux.HandleFunc("/alerts", n.handleListAlerts)         // GET -> list
+	mux.HandleFunc("/alerts/stream", n.serveSSE)          // GET -> SSE stream
+	mux.HandleFunc("/alerts/", n.handleAlertAction)       // POST /alerts/{id}/ack|resolve
+	mux.HandleFunc("/incidents", n.handleIncidents)       // GET -> list incidents
+	mux.HandleFunc("/incidents/", n.handleIncidents)      // GET -> one incident
+	mux.HandleFunc("/suppressions", n.handleSuppressions) // GET -> suppressed counts
+	mux.HandleFunc("/mutes", n.handleMutes)               // GET, POST
+	mux.HandleFunc("/mutes/", n.handleMutes)              // DELETE
+	mux.HandleFunc("/maintenance", n.handleMaintenance)   // GET, POST
+	mux.HandleFunc("/maintenance/", n.handleMaintenance)  // DELETE
+	mux.HandleFunc("/alert", n.handlePushAlert)           // POST -> push test alert
+	mux.HandleFunc("/ws", n.serveWs)                      // WS endpoint
+	mux.HandleFunc("/stream-token", n.handleStreamToken)  // POST -> short-lived stream token
+	mux.HandleFunc("/cluster", n.handleCluster)           // GET -> replicas and connection counts
+	mux.HandleFunc("/clients", n.handleClients)           // GET -> this replica's clients and drop counters
+	mux.HandleFunc("/deliveries", n.handleListDeliveries) // GET -> outbound delivery log
+	mux.HandleFunc("/digests", n.handleDigests)           // GET -> digest schedules
+	mux.HandleFunc("/digests/", n.handleDigests)          // GET /digests/{name}/preview
+	if n.logLevels != nil {
+		mux.Handle("/admin/log-levels", n.logLevels)
+	}
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
 		defer cancel()
-		s := map[string]interface{}{"status": "ok", "redis": false}
-		if err := n.rdb.Ping(ctx).Err(); err == nil {
+		s := map[string]interface{}{"status": "ok", "redis": false, "replica": conf.ReplicaID, "connections": n.hub.Count()}
+		if n.rdb != nil && commonredis.Ping(ctx, n.rdb) == nil {
 			s["redis"] = true
 		}
 		w.Header().Set("Content-Type", "application/json")
+		if n.draining.Load() {
+			// take this replica out of the load balancer
+			s["status"] = "draining"
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
 		_ = json.NewEncoder(w).Encode(s)
 	})
-	server := &http.Server{
+	return mux
+}
+
+func (n *NotificationService) ServeHTTP(addr string) error {
+	n.server = &http.Server{
 		Addr:    addr,
-		Handler: mux,
+		Handler: n.Handler(),
+	}
+	// graceful shutdown via Shutdown
+	return n.server.ListenAndServe()
+}
+
+// Shutdown stops the HTTP server. WebSocket connections are hijacked and not
+// affected, and Shutdown waits for SSE streams; Drain them first.
+func (n *NotificationService) Shutdown(ctx context.Context) error {
+	if n.server == nil {
+		return nil
 	}
-	// graceful shutdown handled by caller
-	return server.ListenAndServe()
+	return n.server.Shutdown(ctx)
 }
 
-func main() {
-	logger := log.New(os.Stdout, "[notification] ", log.LstdFlags|log.Lmsgprefix)
+// Main runs notification-service until it is signalled to stop.
+func Main() {
+	config.MustLoad("notification-service", &conf)
+	logs, err := logging.New("notification-service", conf.Log, nil)
+	if err != nil {
+		log.Fatalf("[notification] %v", err)
+	}
+	defer logs.Sync()
+	logger := logs.Std("main")
+	stopTracing, err := tracing.Setup(context.Background(), "notification-service", conf.Tracing)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
 
-	// Redis client
-	rdb := redis.NewClient(&redis.Options{Addr: redisAddr})
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := rdb.Ping(ctx).Err(); err != nil {
-		logger.Fatalf("redis ping failed: %v", err)
+	// Redis client: wait for it until it answers or the process is signalled
+	startCtx, started := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	rdb, err := commonredis.NewClient(startCtx, conf.Redis, logs.Std("redis"))
+	started()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	auth, err := apikey.New(conf.APIKeys, "", conf.DefaultTenant, conf.AuthDevMode)
+	if err != nil {
+		logger.Fatalf("NOTIFY_API_KEYS: %v", err)
+	}
+	switch {
+	case auth.DevMode():
+		logger.Printf("AUTH_DEV_MODE: clients belong to X-Tenant-ID, or else tenant %q", conf.DefaultTenant)
+	case !auth.Enabled():
+		logger.Println("NOTIFY_API_KEYS not set: every client is rejected")
 	}
 
 	// build service
-	ns := NewNotificationService(rdb, logger)
+	ns, err := NewNotificationService(rdb, auth, logs.Logger("notify"))
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	ns.SetLogLevels(logs.Handler())
+	templates, err := configJSON(conf.Templates, conf.TemplatesFile)
+	if err != nil {
+		logger.Fatalf("message templates: %v", err)
+	}
+	if templates != nil {
+		if err := ns.catalog.Merge(templates); err != nil {
+			logger.Fatalf("message templates: %v", err)
+		}
+	}
+	if !ns.catalog.HasLocale(conf.DefaultLocale) {
+		logger.Fatalf("NOTIFY_DEFAULT_LOCALE %q has no templates (have %s)", conf.DefaultLocale, strings.Join(ns.catalog.Locales(), ", "))
+	}
+	if err := ns.configureDelivery(); err != nil {
+		logger.Fatalf("outbound delivery: %v", err)
+	}
+	if ns.origins, err = ParseOriginAllowlist(conf.AllowedOrigins); err != nil {
+		logger.Fatalf("ALLOWED_ORIGINS: %v", err)
+	}
+	if ns.tokens, err = NewStreamTokens(conf.StreamTokenSecret, conf.StreamTokenTTL); err != nil {
+		logger.Fatalf("stream tokens: %v", err)
+	}
+	if conf.StreamTokenSecret == "" && conf.ClusterMode {
+		logger.Println("STREAM_TOKEN_SECRET not set: stream tokens are only valid on the replica that issued them")
+	}
 
-	// start subscription
+	// start consuming alerts
 	rootCtx, rootCancel := context.WithCancel(context.Background())
-	if err := ns.StartSubscription(rootCtx, redisPubSub); err != nil {
-		logger.Fatalf("start subscription failed: %v", err)
+	switch {
+	case conf.ClusterMode:
+		if err := ns.StartFanout(rootCtx); err != nil {
+			logger.Fatalf("start stream fan-out failed: %v", err)
+		}
+		logger.Printf("cluster mode: replica %s fanning out stream %s", conf.ReplicaID, conf.AlertStream)
+	case conf.AlertTransport == TransportStream:
+		if err := ns.StartStream(rootCtx); err != nil {
+			logger.Fatalf("start stream consumer failed: %v", err)
+		}
+		logger.Printf("consuming stream %s as %s/%s", conf.AlertStream, conf.AlertGroup, conf.AlertConsumer)
+	case conf.AlertTransport == TransportPubSub:
+		if err := ns.StartSubscription(rootCtx, conf.AlertChannel); err != nil {
+			logger.Fatalf("start subscription failed: %v", err)
+		}
+		logger.Println("subscription started on channel:", conf.AlertChannel)
 	}
-	logger.Println("subscription started on channel:", redisPubSub)
+	ns.StartIncidents(rootCtx)
+	ns.StartDigests(rootCtx)
+
+	presenceCtx, stopPresence := context.WithCancel(context.Background())
+	presenceDone := make(chan struct{})
+	go func() {
+		defer close(presenceDone)
+		ns.RunPresence(presenceCtx)
+	}()
 
 	// HTTP server in goroutine
 	srvErr := make(chan error, 1)
 	go func() {
-		logger.Printf("http service listening on %s\n", httpAddr)
-		srvErr <- ns.ServeHTTP(httpAddr)
+		logger.Printf("http service listening on %s\n", conf.HTTPAddr)
+		srvErr <- ns.ServeHTTP(conf.HTTPAddr)
 	}()
 
 	// graceful shutdown on signals
@@ -407,9 +1055,29 @@ func main() {
 		}
 	}
 
+	// hand clients over to other replicas before going away
+	ns.Drain(context.Background(), conf.DrainTimeout)
+	shutCtx, shutCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutCancel()
+	if err := ns.Shutdown(shutCtx); err != nil {
+		logger.Printf("http shutdown: %v", err)
+	}
+	stopPresence()
+	<-presenceDone
+
 	// stop subscription & hub
 	rootCancel()
 	ns.Stop()
+	if ns.dispatcher != nil {
+		dctx, dcancel := context.WithTimeout(context.Background(), 10*time.Second)
+		ns.dispatcher.Close(dctx)
+		dcancel()
+	}
+	if err := rdb.Close(); err != nil {
+		logger.Printf("redis close: %v", err)
+	}
+	if err := stopTracing(); err != nil {
+		logger.Printf("tracing: %v", err)
+	}
 	logger.Println("notification service stopped")
 }
-
@@ -0,0 +1,333 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"smartfleet/common/apikey"
+)
+
+func TestHubDeliversOnlyToClientTenant(t *testing.T) {
+	hub := NewHub()
+	a := newClient("tenant-a", "ws", SlowDisconnect)
+	b := newClient("tenant-b", "ws", SlowDisconnect)
+	hub.Register(a)
+	hub.Register(b)
+
+	hub.Broadcast(Alert{TenantID: "tenant-a", VehicleID: "v1", Level: "CRITICAL", Message: "for a"})
+
+	got, _ := a.queue.take(nil)
+	if len(got) != 1 || got[0].TenantID != "tenant-a" {
+		t.Fatalf("tenant-a client got %+v", got)
+	}
+	if got, _ := b.queue.take(nil); len(got) != 0 {
+		t.Fatalf("tenant-b client received cross-tenant alert: %+v", got)
+	}
+}
+
+func TestRecentAlertsListTenant(t *testing.T) {
+	r := NewRecentAlerts(10)
+	r.Add(Alert{TenantID: "tenant-a", VehicleID: "v1"})
+	r.Add(Alert{TenantID: "tenant-b", VehicleID: "v2"})
+	r.Add(Alert{TenantID: "tenant-a", VehicleID: "v3"})
+
+	got := r.ListTenant("tenant-b")
+	if len(got) != 1 || got[0].VehicleID != "v2" {
+		t.Fatalf("ListTenant(tenant-b) = %+v", got)
+	}
+	if got := r.ListTenant("tenant-c"); len(got) != 0 {
+		t.Fatalf("unknown tenant saw alerts: %+v", got)
+	}
+}
+
+func TestListAlertsScopedToAPIKeyTenant(t *testing.T) {
+	auth, err := apikey.New("key-a=tenant-a,key-b=tenant-b", "", "default", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns, err := NewNotificationService(nil, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.recent.Add(Alert{TenantID: "tenant-a", VehicleID: "secret-a"})
+	ns.recent.Add(Alert{TenantID: "tenant-b", VehicleID: "secret-b"})
+
+	cases := []struct {
+		name     string
+		key      string
+		status   int
+		vehicles []string
+	}{
+		{"tenant a", "key-a", http.StatusOK, []string{"secret-a"}},
+		{"tenant b", "key-b", http.StatusOK, []string{"secret-b"}},
+		{"no key", "", http.StatusUnauthorized, nil},
+		{"bad key", "nope", http.StatusUnauthorized, nil},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/alerts", nil)
+			if tc.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.key)
+			}
+			rec := httptest.NewRecorder()
+			ns.handleListAlerts(rec, req)
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.status)
+			}
+			if tc.status != http.StatusOK {
+				return
+			}
+			var list []Alert
+			if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+				t.Fatal(err)
+			}
+			if len(list) != len(tc.vehicles) {
+				t.Fatalf("got %d alerts, want %d: %+v", len(list), len(tc.vehicles), list)
+			}
+			for i, a := range list {
+				if a.VehicleID != tc.vehicles[i] {
+					t.Fatalf("alert %d vehicle = %q, want %q", i, a.VehicleID, tc.vehicles[i])
+				}
+			}
+		})
+	}
+}
+
+func TestWebSocketRejectsAPIKeyInURL(t *testing.T) {
+	auth, _ := apikey.New("key-a=tenant-a", "", "default", false)
+	ns, err := NewNotificationService(nil, auth, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(ns.serveWs))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?token=key-a", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("dial with api key in url: resp=%v err=%v", resp, err)
+	}
+	// in a header the key is accepted
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"X-API-Key": {"key-a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func uintPtr(n uint) *uint { return &n }
+
+func TestSubscriptionMatches(t *testing.T) {
+	sub, err := NewSubscription([]string{"v1", "v2"}, []string{"critical"}, []uint{7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name  string
+		alert Alert
+		want  bool
+	}{
+		{"all match", Alert{VehicleID: "v1", Level: "CRITICAL", GroupID: uintPtr(7)}, true},
+		{"other vehicle", Alert{VehicleID: "v3", Level: "CRITICAL", GroupID: uintPtr(7)}, false},
+		{"other level", Alert{VehicleID: "v1", Level: "WARN", GroupID: uintPtr(7)}, false},
+		{"other group", Alert{VehicleID: "v1", Level: "CRITICAL", GroupID: uintPtr(8)}, false},
+		{"unknown group", Alert{VehicleID: "v1", Level: "CRITICAL"}, false},
+	}
+	for _, tc := range cases {
+		if got := sub.Matches(tc.alert); got != tc.want {
+			t.Errorf("%s: Matches = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	var none *Subscription
+	if !none.Matches(Alert{VehicleID: "anything"}) {
+		t.Error("nil subscription should match everything")
+	}
+	if _, err := NewSubscription(nil, []string{"LOUD"}, nil); err == nil {
+		t.Error("unknown level accepted")
+	}
+}
+
+func TestHubRoutesBySubscription(t *testing.T) {
+	hub := NewHub()
+	critical := newClient("t", "ws", SlowDisconnect)
+	sub, _ := NewSubscription(nil, []string{"CRITICAL"}, nil)
+	critical.filter.Store(sub)
+	all := newClient("t", "ws", SlowDisconnect)
+	hub.Register(critical)
+	hub.Register(all)
+
+	hub.Broadcast(Alert{TenantID: "t", VehicleID: "v1", Level: "WARN"})
+	hub.Broadcast(Alert{TenantID: "t", VehicleID: "v1", Level: "CRITICAL"})
+
+	if got, _ := all.queue.take(nil); len(got) != 2 {
+		t.Fatalf("unfiltered client got %d alerts, want 2", len(got))
+	}
+	got, _ := critical.queue.take(nil)
+	if len(got) != 1 || got[0].Level != "CRITICAL" {
+		t.Fatalf("filtered client got %+v", got)
+	}
+}
+
+func TestWebSocketSubscribeProtocol(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	auth, _ := apikey.New("", "", "t", true)
+	ns, err := NewNotificationService(nil, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hub := ns.hub
+	go hub.Run(ctx)
+	ns.recent.Add(Alert{TenantID: "t", VehicleID: "v1", Level: "WARN", Message: "old warn"})
+	ns.recent.Add(Alert{TenantID: "t", VehicleID: "v2", Level: "CRITICAL", Message: "old critical"})
+
+	srv := httptest.NewServer(http.HandlerFunc(ns.serveWs))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?levels=CRITICAL", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// connect replay is filtered by the query-string subscription
+	var a Alert
+	if err := conn.ReadJSON(&a); err != nil || a.Message != "old critical" {
+		t.Fatalf("first replayed alert = %+v, %v", a, err)
+	}
+
+	// change the subscription mid-session and ask for a filtered replay
+	if err := conn.WriteJSON(map[string]interface{}{"op": "subscribe", "id": "s1", "vehicles": []string{"v1"}, "replay": true}); err != nil {
+		t.Fatal(err)
+	}
+	var reply SubscriptionReply
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "ack" || reply.ID != "s1" {
+		t.Fatalf("subscribe reply = %+v, %v", reply, err)
+	}
+	if err := conn.ReadJSON(&a); err != nil || a.Message != "old warn" {
+		t.Fatalf("replay after subscribe = %+v, %v", a, err)
+	}
+
+	hub.Broadcast(Alert{TenantID: "t", VehicleID: "v2", Level: "CRITICAL", Message: "filtered out"})
+	hub.Broadcast(Alert{TenantID: "t", VehicleID: "v1", Level: "INFO", Message: "live v1"})
+	if err := conn.ReadJSON(&a); err != nil || a.Message != "live v1" {
+		t.Fatalf("live alert = %+v, %v", a, err)
+	}
+
+	if err := conn.WriteJSON(map[string]string{"op": "bogus", "id": "x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "error" || reply.ID != "x" {
+		t.Fatalf("bogus op reply = %+v, %v", reply, err)
+	}
+}
+
+func TestAlertIDAfter(t *testing.T) {
+	cases := []struct {
+		a, b string
+		want bool
+	}{
+		{"1700000000001-0", "1700000000000-5", true},
+		{"1700000000000-5", "1700000000000-4", true},
+		{"1700000000000-4", "1700000000000-4", false},
+		{"1700000000000-3", "1700000000000-4", false},
+		{"1700000000000-0", "", true}, // nothing replayed yet
+		{"", "1700000000000-0", true}, // pub/sub alerts carry no ID
+	}
+	for _, c := range cases {
+		if got := alertIDAfter(c.a, c.b); got != c.want {
+			t.Errorf("alertIDAfter(%q, %q) = %v, want %v", c.a, c.b, got, c.want)
+		}
+	}
+	if _, err := parseStreamID("not-an-id"); err == nil {
+		t.Error("parseStreamID accepted a malformed ID")
+	}
+}
+
+func TestListAlertsSinceValidation(t *testing.T) {
+	auth, _ := apikey.New("", "", "t", true)
+	ns, err := NewNotificationService(nil, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name, query, transport string
+		status                 int
+	}{
+		{"bad limit", "?since=1-0&limit=0", TransportStream, http.StatusBadRequest},
+		{"limit too large", "?since=1-0&limit=5000", TransportStream, http.StatusBadRequest},
+		{"bad id", "?since=yesterday", TransportStream, http.StatusBadRequest},
+		{"pubsub mode", "?since=1-0", TransportPubSub, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ns.transport = tc.transport
+			rec := httptest.NewRecorder()
+			ns.handleListAlerts(rec, httptest.NewRequest(http.MethodGet, "/alerts"+tc.query, nil))
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.status)
+			}
+		})
+	}
+}
+
+func TestDrainSendsReconnectHintAndClose(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	auth, _ := apikey.New("", "", "t", true)
+	ns, err := NewNotificationService(nil, auth, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.hub.Run(ctx)
+
+	srv := httptest.NewServer(http.HandlerFunc(ns.serveWs))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for ns.hub.Count() != 1 {
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ns.Drain(ctx, 2*time.Second)
+		close(done)
+	}()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var reply SubscriptionReply
+	if err := conn.ReadJSON(&reply); err != nil || reply.Type != "reconnect" {
+		t.Fatalf("drain message = %+v, %v", reply, err)
+	}
+	_, _, err = conn.ReadMessage()
+	if !websocket.IsCloseError(err, closeServiceRestart) {
+		t.Fatalf("expected close %d, got %v", closeServiceRestart, err)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Drain did not return after the client left")
+	}
+	if n := ns.hub.Count(); n != 0 {
+		t.Fatalf("%d clients still registered after drain", n)
+	}
+
+	// new connections are refused while draining
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("dial while draining: resp=%v err=%v", resp, err)
+	}
+}
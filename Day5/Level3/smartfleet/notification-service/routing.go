@@ -0,0 +1,148 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // rule time zones work on images without zoneinfo
+)
+
+// RoutingRule sends matching alerts of one tenant to recipients on a channel.
+// Empty match lists match everything.
+type RoutingRule struct {
+	Name     string   `json:"name"`
+	Tenant   string   `json:"tenant,omitempty"` // defaults to DEFAULT_TENANT
+	Levels   []string `json:"levels,omitempty"`
+	Groups   []uint   `json:"groups,omitempty"`
+	Vehicles []string `json:"vehicles,omitempty"`
+	Hours    string   `json:"hours,omitempty"`    // "HH:MM-HH:MM", may wrap midnight; empty = all day
+	Days     []string `json:"days,omitempty"`     // "mon".."sun"; empty = every day
+	Timezone string   `json:"timezone,omitempty"` // IANA zone for Hours/Days, default UTC
+	Channel  string   `json:"channel"`
+	To       []string `json:"to"`
+	Locale   string   `json:"locale,omitempty"` // recipients' language, default NOTIFY_DEFAULT_LOCALE
+
+	filter   *Subscription
+	loc      *time.Location
+	from, to int // minutes after midnight
+	days     map[time.Weekday]bool
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// ParseRoutingRules parses and validates the NOTIFY_ROUTES JSON array.
+// channels lists the configured channel names.
+func ParseRoutingRules(data []byte, channels map[string]Channel) ([]*RoutingRule, error) {
+	var rules []*RoutingRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, err
+	}
+	for i, r := range rules {
+		if err := r.compile(channels); err != nil {
+			name := r.Name
+			if name == "" {
+				name = fmt.Sprintf("#%d", i)
+			}
+			return nil, fmt.Errorf("rule %s: %w", name, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *RoutingRule) compile(channels map[string]Channel) error {
+	if r.Tenant == "" {
+		r.Tenant = conf.DefaultTenant
+	}
+	if _, ok := channels[r.Channel]; !ok {
+		return fmt.Errorf("channel %q is not configured", r.Channel)
+	}
+	if len(r.To) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	sub, err := NewSubscription(r.Vehicles, r.Levels, r.Groups)
+	if err != nil {
+		return err
+	}
+	r.filter = sub
+
+	r.loc = time.UTC
+	if r.Timezone != "" {
+		if r.loc, err = time.LoadLocation(r.Timezone); err != nil {
+			return err
+		}
+	}
+	r.from, r.to = 0, 24*60
+	if r.Hours != "" {
+		a, b, ok := strings.Cut(r.Hours, "-")
+		if !ok {
+			return fmt.Errorf("hours %q: want HH:MM-HH:MM", r.Hours)
+		}
+		if r.from, err = parseClock(a); err != nil {
+			return err
+		}
+		if r.to, err = parseClock(b); err != nil {
+			return err
+		}
+	}
+	if len(r.Days) > 0 {
+		r.days = make(map[time.Weekday]bool, len(r.Days))
+		for _, d := range r.Days {
+			key := strings.ToLower(strings.TrimSpace(d))
+			if len(key) > 3 {
+				key = key[:3] // "monday" -> "mon"
+			}
+			wd, ok := weekdays[key]
+			if !ok {
+				return fmt.Errorf("unknown day %q", d)
+			}
+			r.days[wd] = true
+		}
+	}
+	return nil
+}
+
+func parseClock(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q (want HH:MM)", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// activeAt reports whether t falls in the rule's days and hours. A window
+// that wraps midnight (22:00-06:00) belongs to the day it starts on.
+func (r *RoutingRule) activeAt(t time.Time) bool {
+	t = t.In(r.loc)
+	m := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	switch {
+	case r.from == r.to:
+		// empty window never matches; a full day is 00:00-24:00 (the default)
+		return false
+	case r.from < r.to:
+		if m < r.from || m >= r.to {
+			return false
+		}
+	default: // wraps midnight
+		if m < r.from && m >= r.to {
+			return false
+		}
+		if m < r.to {
+			day = (day + 6) % 7 // early-morning part belongs to the previous day
+		}
+	}
+	return r.days == nil || r.days[day]
+}
+
+// Matches reports whether the rule routes alert a raised at time t.
+func (r *RoutingRule) Matches(a Alert, t time.Time) bool {
+	return a.TenantID == r.Tenant && r.filter.Matches(a) && r.activeAt(t)
+}
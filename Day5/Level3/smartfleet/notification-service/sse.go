@@ -0,0 +1,210 @@
+package notification
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// GET /alerts/stream serves alerts as Server-Sent Events for networks that
+// strip WebSocket upgrades. SSE clients join the same Hub as WebSocket
+// clients. Alerts are unnamed events whose id is the alert ID, so a browser
+// EventSource resumes with Last-Event-ID after a reconnect. Replies and
+// incident and occurrence events are named after their "type".
+
+// serveSSE streams alerts until the client goes away or the replica drains.
+func (n *NotificationService) serveSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if n.draining.Load() {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "replica draining, reconnect", http.StatusServiceUnavailable)
+		return
+	}
+	if !n.origins.Allowed(r) {
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+	tenant, err := n.streamTenant(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	sub, err := SubscriptionFromQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// EventSource sends Last-Event-ID on its own reconnects; ?since= covers
+	// the first connection of a client that kept its position elsewhere
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	if since != "" {
+		if n.transport != TransportStream {
+			http.Error(w, "resuming requires ALERT_TRANSPORT=stream", http.StatusBadRequest)
+			return
+		}
+		if _, err := parseStreamID(since); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n.history() == nil {
+			http.Error(w, errNoHistory.Error(), http.StatusNotImplemented)
+			return
+		}
+	}
+
+	policy, err := ParseSlowConsumerPolicy(r.URL.Query().Get("slow"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no") // nginx: do not buffer the stream
+	if origin := r.Header.Get("Origin"); origin != "" {
+		h.Set("Access-Control-Allow-Origin", origin) // already checked against the allowlist
+		h.Set("Vary", "Origin")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	client := newClient(tenant, "sse", policy)
+	client.catalog, client.locales = n.catalog, localePrefs(r)
+	client.filter.Store(sub)
+	initial, _ := n.attach(r.Context(), client, since)
+	defer n.hub.Unregister(client)
+	sseWriter(w, r, client, initial)
+}
+
+// sseWriter mirrors wsWriter: the initial replay, then live alerts, events
+// and heartbeat comments.
+func sseWriter(w http.ResponseWriter, r *http.Request, c *Client, initial wsControl) {
+	rc := http.NewResponseController(w)
+	write := func(f func(io.Writer) error) bool {
+		_ = rc.SetWriteDeadline(time.Now().Add(writeWait))
+		return f(w) == nil && rc.Flush() == nil
+	}
+	ticker := time.NewTicker(conf.SSEHeartbeat)
+	defer ticker.Stop()
+
+	if !write(sseText(fmt.Sprintf("retry: %d\n\n", sseRetry.Milliseconds()))) {
+		return
+	}
+	done, ok := writeSSEControl(write, c, initial)
+	if done || !ok {
+		return
+	}
+	var lastID string
+	for _, a := range initial.replay {
+		if a.ID != "" {
+			lastID = a.ID
+		}
+	}
+	var batch []Alert
+	for {
+		select {
+		case <-c.queue.ready:
+			var closed bool
+			if batch, closed = c.queue.take(batch[:0]); closed {
+				// too slow or shutting down: EventSource reconnects with Last-Event-ID
+				return
+			}
+			for _, a := range batch {
+				if !alertIDAfter(a.ID, lastID) {
+					continue
+				}
+				if a.ID != "" {
+					lastID = a.ID
+				}
+				a := c.localize(a)
+				if !write(func(w io.Writer) error { return writeSSEAlert(w, a) }) {
+					return
+				}
+			}
+		case ctl := <-c.control:
+			if done, ok := writeSSEControl(write, c, ctl); done || !ok {
+				return
+			}
+		case <-ticker.C:
+			if !write(sseText(": ping\n\n")) { // comment line: keeps proxies from timing out
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func sseText(s string) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := io.WriteString(w, s)
+		return err
+	}
+}
+
+func writeSSEAlert(w io.Writer, a Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	if a.ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", a.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", b)
+	return err
+}
+
+func writeSSEEvent(w io.Writer, event string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+	return err
+}
+
+// writeSSEControl writes a reply or event and replayed alerts. done is true
+// when the server ends the stream (drain); the reconnect reply then also
+// sets the client's retry delay.
+func writeSSEControl(write func(func(io.Writer) error) bool, c *Client, ctl wsControl) (done, ok bool) {
+	if ctl.reply != nil {
+		reply := ctl.reply
+		if !write(func(w io.Writer) error {
+			if reply.RetryAfterMs > 0 {
+				if _, err := fmt.Fprintf(w, "retry: %d\n", reply.RetryAfterMs); err != nil {
+					return err
+				}
+			}
+			return writeSSEEvent(w, reply.Type, reply)
+		}) {
+			return false, false
+		}
+	}
+	switch ev := ctl.event.(type) {
+	case *IncidentEvent:
+		if !write(func(w io.Writer) error { return writeSSEEvent(w, ev.Type, ev) }) {
+			return false, false
+		}
+	case *OccurrenceEvent:
+		if !write(func(w io.Writer) error { return writeSSEEvent(w, ev.Type, ev) }) {
+			return false, false
+		}
+	}
+	for _, a := range ctl.replay {
+		a := c.localize(a)
+		if !write(func(w io.Writer) error { return writeSSEAlert(w, a) }) {
+			return false, false
+		}
+	}
+	return ctl.closeCode != 0, true
+}
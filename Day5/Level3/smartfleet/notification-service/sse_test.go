@@ -0,0 +1,242 @@
+package notification
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"smartfleet/common/apikey"
+)
+
+// sseEvent is one parsed Server-Sent Event.
+type sseEvent struct {
+	id, event, data string
+}
+
+// readSSEEvent returns the next event, skipping comments and retry lines.
+func readSSEEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if ev.data != "" {
+				return ev
+			}
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestSSEStreamReplaysFiltersAndDeliversLive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	auth, _ := apikey.New("key-a=tenant-a", "", "default", false)
+	ns, err := NewNotificationService(nil, auth, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.hub.Run(ctx)
+	ns.recent.Add(Alert{ID: "1-0", TenantID: "tenant-a", VehicleID: "v1", Level: "WARN", Message: "old warn"})
+	ns.recent.Add(Alert{ID: "2-0", TenantID: "tenant-a", VehicleID: "v2", Level: "CRITICAL", Message: "old critical"})
+
+	srv := httptest.NewServer(http.HandlerFunc(ns.serveSSE))
+	defer srv.Close()
+
+	token, _ := ns.tokens.Issue("tenant-a", time.Now())
+	resp, err := http.Get(srv.URL + "/alerts/stream?levels=CRITICAL&token=" + token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	body := bufio.NewReader(resp.Body)
+
+	ev := readSSEEvent(t, body)
+	var a Alert
+	if err := json.Unmarshal([]byte(ev.data), &a); err != nil || ev.id != "2-0" || a.Message != "old critical" {
+		t.Fatalf("replayed event = %+v (%v)", ev, err)
+	}
+
+	// the client registered before its replay was written
+	ns.hub.Broadcast(Alert{ID: "3-0", TenantID: "tenant-a", VehicleID: "v1", Level: "WARN", Message: "filtered out"})
+	ns.hub.Broadcast(Alert{ID: "4-0", TenantID: "tenant-b", VehicleID: "v1", Level: "CRITICAL", Message: "other tenant"})
+	ns.hub.Broadcast(Alert{ID: "5-0", TenantID: "tenant-a", VehicleID: "v3", Level: "CRITICAL", Message: "live"})
+	ev = readSSEEvent(t, body)
+	if err := json.Unmarshal([]byte(ev.data), &a); err != nil || ev.id != "5-0" || a.Message != "live" {
+		t.Fatalf("live event = %+v (%v)", ev, err)
+	}
+
+	ns.hub.Publish(a, &IncidentEvent{Type: "incident", Event: EventOpened, Incident: &Incident{ID: "inc-1", TenantID: "tenant-a"}})
+	if ev = readSSEEvent(t, body); ev.event != "incident" || !strings.Contains(ev.data, `"inc-1"`) {
+		t.Fatalf("incident event = %+v", ev)
+	}
+}
+
+func TestSSEStreamRejectsBadRequests(t *testing.T) {
+	auth, _ := apikey.New("key-a=tenant-a", "", "default", false)
+	ns, err := NewNotificationService(nil, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, _ := ns.tokens.Issue("tenant-a", time.Now().Add(-time.Hour))
+
+	cases := []struct {
+		name, query, key, lastEventID, origin, transport string
+		status                                           int
+	}{
+		{"no credentials", "", "", "", "", TransportStream, http.StatusUnauthorized},
+		{"expired stream token", "?token=" + expired, "", "", "", TransportStream, http.StatusUnauthorized},
+		{"api key in url", "?token=key-a", "", "", "", TransportStream, http.StatusUnauthorized},
+		{"foreign origin", "", "key-a", "", "https://evil.example", TransportStream, http.StatusForbidden},
+		{"bad filter", "?levels=LOUD", "key-a", "", "", TransportStream, http.StatusBadRequest},
+		{"bad last event id", "", "key-a", "yesterday", "", TransportStream, http.StatusBadRequest},
+		{"resume in pubsub mode", "", "key-a", "1-0", "", TransportPubSub, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ns.transport = tc.transport
+			req := httptest.NewRequest(http.MethodGet, "/alerts/stream"+tc.query, nil)
+			if tc.key != "" {
+				req.Header.Set("X-API-Key", tc.key)
+			}
+			if tc.lastEventID != "" {
+				req.Header.Set("Last-Event-ID", tc.lastEventID)
+			}
+			if tc.origin != "" {
+				req.Header.Set("Origin", tc.origin)
+			}
+			rec := httptest.NewRecorder()
+			ns.serveSSE(rec, req)
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tc.status)
+			}
+		})
+	}
+}
+
+func TestStreamTokens(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tokens, _ := NewStreamTokens("shared", 5*time.Minute)
+	token, exp := tokens.Issue("tenant-a", now)
+	if !exp.Equal(now.Add(5 * time.Minute)) {
+		t.Fatalf("expiry = %v", exp)
+	}
+	if tenant, err := tokens.Verify(token, now.Add(time.Minute)); err != nil || tenant != "tenant-a" {
+		t.Fatalf("Verify = %q, %v", tenant, err)
+	}
+	if _, err := tokens.Verify(token, exp); err == nil {
+		t.Error("expired token accepted")
+	}
+	// another replica with the same secret accepts it, one with another does not
+	peer, _ := NewStreamTokens("shared", time.Minute)
+	if _, err := peer.Verify(token, now); err != nil {
+		t.Errorf("peer rejected token: %v", err)
+	}
+	stranger, _ := NewStreamTokens("", time.Minute)
+	if _, err := stranger.Verify(token, now); err == nil {
+		t.Error("token accepted with a different secret")
+	}
+	forged, _ := (&StreamTokens{secret: []byte("guess"), ttl: time.Hour}).Issue("tenant-b", now)
+	if _, err := tokens.Verify(forged, now); err == nil {
+		t.Error("forged token accepted")
+	}
+}
+
+func TestStreamTokenEndpoint(t *testing.T) {
+	auth, _ := apikey.New("key-a=tenant-a", "", "default", false)
+	ns, err := NewNotificationService(nil, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	ns.handleStreamToken(rec, httptest.NewRequest(http.MethodPost, "/stream-token?token=key-a", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("api key in url: status = %d, want 400", rec.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/stream-token", nil)
+	req.Header.Set("X-API-Key", "key-a")
+	rec = httptest.NewRecorder()
+	ns.handleStreamToken(rec, req)
+	var got struct {
+		Token string `json:"token"`
+	}
+	if rec.Code != http.StatusOK || json.Unmarshal(rec.Body.Bytes(), &got) != nil {
+		t.Fatalf("status = %d body %s", rec.Code, rec.Body)
+	}
+	wsReq := httptest.NewRequest(http.MethodGet, "/ws?token="+got.Token, nil)
+	if tenant, err := ns.streamTenant(wsReq); err != nil || tenant != "tenant-a" {
+		t.Fatalf("streamTenant = %q, %v", tenant, err)
+	}
+}
+
+func TestOriginAllowlist(t *testing.T) {
+	list, err := ParseOriginAllowlist("https://ops.example.com, http://localhost:3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name, host, origin string
+		want               bool
+	}{
+		{"no origin header", "api.example.com", "", true},
+		{"same origin", "api.example.com", "https://api.example.com", true},
+		{"listed", "api.example.com", "https://ops.example.com", true},
+		{"listed with port", "api.example.com", "http://localhost:3000", true},
+		{"scheme differs", "api.example.com", "http://ops.example.com", false},
+		{"not listed", "api.example.com", "https://evil.example", false},
+	}
+	for _, tc := range cases {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.Host = tc.host
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if got := list.Allowed(req); got != tc.want {
+			t.Errorf("%s: Allowed = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"ops.example.com", "ftp://x", "https://x/path"} {
+		if _, err := ParseOriginAllowlist(bad); err == nil {
+			t.Errorf("ParseOriginAllowlist(%q) accepted", bad)
+		}
+	}
+}
+
+func TestWebSocketRejectsForeignOrigin(t *testing.T) {
+	auth, _ := apikey.New("", "", "t", true)
+	ns, err := NewNotificationService(nil, auth, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(ns.serveWs))
+	defer srv.Close()
+
+	header := http.Header{"Origin": {"https://evil.example"}}
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws", header)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("dial from foreign origin: resp=%v err=%v", resp, err)
+	}
+}
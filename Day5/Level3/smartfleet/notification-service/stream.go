@@ -0,0 +1,198 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Alert transports between analytics and notification-service.
+const (
+	TransportStream = "stream" // Redis Stream + consumer group: durable, resumable
+	TransportPubSub = "pubsub" // legacy fire-and-forget channel
+)
+
+// streamAlertField is the stream entry field holding the alert JSON.
+const streamAlertField = "alert"
+
+// history page limits for ?since= reads
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+	historyScanBatch    = 500
+)
+
+var errInvalidStreamID = errors.New("invalid alert id (want <ms>-<seq>)")
+
+var errNoAlertBus = errors.New("no alert bus configured")
+
+var errNoHistory = errors.New("alert history unavailable without Redis")
+
+// streamID is a parsed Redis Stream entry ID.
+type streamID struct{ ms, seq uint64 }
+
+func parseStreamID(s string) (streamID, error) {
+	msPart, seqPart, ok := strings.Cut(s, "-")
+	if !ok {
+		return streamID{}, errInvalidStreamID
+	}
+	ms, err1 := strconv.ParseUint(msPart, 10, 64)
+	seq, err2 := strconv.ParseUint(seqPart, 10, 64)
+	if err1 != nil || err2 != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	return streamID{ms, seq}, nil
+}
+
+func (a streamID) less(b streamID) bool {
+	return a.ms < b.ms || (a.ms == b.ms && a.seq < b.seq)
+}
+
+// alertIDAfter reports whether alert ID a sorts after b. Alerts without an ID
+// (pub/sub mode) are never considered duplicates.
+func alertIDAfter(a, b string) bool {
+	if a == "" || b == "" {
+		return true
+	}
+	ia, err1 := parseStreamID(a)
+	ib, err2 := parseStreamID(b)
+	if err1 != nil || err2 != nil {
+		return true
+	}
+	return ib.less(ia)
+}
+
+// alertFromStream decodes one stream entry; the entry ID becomes the alert ID.
+func alertFromStream(msg redis.XMessage) (Alert, error) {
+	var a Alert
+	raw, _ := msg.Values[streamAlertField].(string)
+	if err := json.Unmarshal([]byte(raw), &a); err != nil {
+		return a, fmt.Errorf("entry %s: %w", msg.ID, err)
+	}
+	a.ID = msg.ID
+	return a, nil
+}
+
+// publishAlert sends an alert over the alert bus.
+func (n *NotificationService) publishAlert(ctx context.Context, a Alert) error {
+	if n.bus == nil {
+		return errNoAlertBus
+	}
+	a.ID = "" // assigned by the bus
+	return n.bus.Publish(ctx, a)
+}
+
+// StartStream consumes alerts from the alert bus, after warming the recent
+// buffer from the stream, and both fans out and dispatches each alert.
+func (n *NotificationService) StartStream(ctx context.Context) error {
+	ctxSub, cancel := context.WithCancel(ctx)
+	n.cancelSub = cancel
+	n.warmRecent(ctxSub)
+	return n.consume(ctxSub, cancel)
+}
+
+// consume subscribes to the alert bus until ctx ends and runs the hub.
+func (n *NotificationService) consume(ctx context.Context, cancel context.CancelFunc) error {
+	if n.bus == nil {
+		cancel()
+		return errNoAlertBus
+	}
+	done, err := n.bus.Subscribe(ctx, func(a Alert) {
+		a, span := startAlertSpan(a, "alerts process")
+		defer span.End()
+		if n.admit(a, true) {
+			n.deliver(a)
+			n.handleOnce(a)
+		}
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+	go func() {
+		<-done
+		close(n.subRunning)
+	}()
+	go n.hub.Run(ctx)
+	return nil
+}
+
+// warmRecent fills the recent-alert buffer from the stream tail so a restart
+// does not empty GET /alerts. It returns the newest entry ID read, if any.
+func (n *NotificationService) warmRecent(ctx context.Context) string {
+	if n.rdb == nil || n.transport != TransportStream {
+		return ""
+	}
+	msgs, err := n.rdb.XRevRangeN(ctx, conf.AlertStream, "+", "-", int64(conf.MaxRecent)).Result()
+	if err != nil {
+		n.logger.Printf("[stream] warm recent alerts: %v", err)
+		return ""
+	}
+	warm := make([]Alert, 0, len(msgs))
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if a, err := alertFromStream(msgs[i]); err == nil {
+			warm = append(warm, withoutTrace(normalizeAlert(a)))
+		}
+	}
+	for _, a := range n.annotate(ctx, warm) {
+		n.recent.Add(a)
+	}
+	if len(msgs) == 0 {
+		return ""
+	}
+	return msgs[0].ID
+}
+
+// AlertsSince returns up to limit alerts of the tenant published after the
+// given ID, oldest first. truncated reports that the history has been trimmed
+// past since, so some alerts in between can no longer be returned.
+func (n *NotificationService) AlertsSince(ctx context.Context, tenant, since string, limit int) (alerts []Alert, truncated bool, err error) {
+	if n.transport != TransportStream {
+		return nil, false, errors.New("resuming by id requires ALERT_TRANSPORT=stream")
+	}
+	sinceID, err := parseStreamID(since)
+	if err != nil {
+		return nil, false, err
+	}
+	hist := n.history()
+	if hist == nil {
+		return nil, false, errNoHistory
+	}
+	if truncated, err = hist.Trimmed(ctx, sinceID); err != nil {
+		return nil, false, err
+	}
+
+	alerts = make([]Alert, 0)
+	for cursor := since; cursor != "" && len(alerts) < limit; {
+		page, next, err := hist.After(ctx, cursor, historyScanBatch)
+		if err != nil {
+			return nil, false, err
+		}
+		batch := make([]Alert, 0, len(page))
+		for _, a := range page {
+			if a.TenantID == tenant {
+				batch = append(batch, withoutTrace(a))
+			}
+		}
+		for _, a := range n.annotate(ctx, batch) {
+			alerts = append(alerts, a)
+			if len(alerts) == limit {
+				break
+			}
+		}
+		cursor = next
+	}
+	return alerts, truncated, nil
+}
+
+// history returns the alert history of the bus, or nil when it keeps none
+// (no bus yet, or the pub/sub transport).
+func (n *NotificationService) history() AlertHistory {
+	h, _ := n.bus.(AlertHistory)
+	return h
+}
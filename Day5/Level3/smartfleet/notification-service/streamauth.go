@@ -0,0 +1,160 @@
+package notification
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Browsers cannot set headers on WebSocket or EventSource requests, so the
+// credential has to travel in the URL, where it ends up in proxy and access
+// logs. Instead of the API key, clients exchange it (in a header) for a
+// short-lived stream token at POST /stream-token and connect with
+// ?token=<stream token>.
+
+// streamTokenPrefix marks stream tokens. Only they are accepted in the URL:
+// an API key in ?token= is rejected, not looked up.
+const streamTokenPrefix = "st1."
+
+var errInvalidStreamToken = errors.New("invalid or expired stream token")
+
+// StreamTokens issues and verifies HMAC-signed stream tokens. Replicas that
+// share the secret accept each other's tokens.
+type StreamTokens struct {
+	secret []byte
+	ttl    time.Duration
+}
+
+// NewStreamTokens uses secret, or a random one when it is empty; tokens are
+// then only valid on this replica.
+func NewStreamTokens(secret string, ttl time.Duration) (*StreamTokens, error) {
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+	}
+	return &StreamTokens{secret: key, ttl: ttl}, nil
+}
+
+func (s *StreamTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a token for tenant and its expiry.
+func (s *StreamTokens) Issue(tenant string, now time.Time) (string, time.Time) {
+	exp := now.Add(s.ttl).Truncate(time.Second)
+	payload := base64.RawURLEncoding.EncodeToString([]byte(tenant + "|" + strconv.FormatInt(exp.Unix(), 10)))
+	return streamTokenPrefix + payload + "." + s.sign(payload), exp
+}
+
+// Verify returns the tenant of a valid, unexpired token.
+func (s *StreamTokens) Verify(token string, now time.Time) (string, error) {
+	rest, ok := strings.CutPrefix(token, streamTokenPrefix)
+	if !ok {
+		return "", errInvalidStreamToken
+	}
+	payload, sig, ok := strings.Cut(rest, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(s.sign(payload))) {
+		return "", errInvalidStreamToken
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", errInvalidStreamToken
+	}
+	tenant, expStr, ok := strings.Cut(string(raw), "|")
+	exp, err := strconv.ParseInt(expStr, 10, 64)
+	if !ok || err != nil || now.Unix() >= exp {
+		return "", errInvalidStreamToken
+	}
+	return tenant, nil
+}
+
+// streamTenant authenticates a WebSocket or SSE request: a stream token in
+// ?token=, or else an API key in a header.
+func (n *NotificationService) streamTenant(r *http.Request) (string, error) {
+	if tok := r.URL.Query().Get("token"); tok != "" {
+		return n.tokens.Verify(tok, time.Now())
+	}
+	return n.auth.TenantFromRequest(r)
+}
+
+// handleStreamToken serves POST /stream-token: exchange the API key for a
+// short-lived token to put in WebSocket and SSE URLs.
+func (n *NotificationService) handleStreamToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Query().Get("token") != "" {
+		http.Error(w, "send the api key in a header, not the url", http.StatusBadRequest)
+		return
+	}
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	token, exp := n.tokens.Issue(tenant, time.Now())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"token": token, "expires_at": exp.UTC()})
+}
+
+// OriginAllowlist decides which browser origins may open streams. Requests
+// without an Origin header (non-browser clients) and same-origin requests
+// are always allowed; "*" allows every origin.
+type OriginAllowlist struct {
+	any     bool
+	origins map[string]bool
+}
+
+// ParseOriginAllowlist parses a comma-separated list of origins such as
+// "https://ops.example.com,http://localhost:3000".
+func ParseOriginAllowlist(spec string) (*OriginAllowlist, error) {
+	o := &OriginAllowlist{origins: make(map[string]bool)}
+	for _, s := range strings.Split(spec, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if s == "*" {
+			o.any = true
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return nil, fmt.Errorf("invalid origin %q (want scheme://host[:port])", s)
+		}
+		o.origins[strings.ToLower(u.Scheme+"://"+u.Host)] = true
+	}
+	return o, nil
+}
+
+// Allowed reports whether the request's origin may connect.
+func (o *OriginAllowlist) Allowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return o != nil && (o.any || o.origins[strings.ToLower(u.Scheme+"://"+u.Host)])
+}
@@ -0,0 +1,182 @@
+package notification
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Subscribe protocol ops sent by WebSocket clients.
+const (
+	opSubscribe   = "subscribe"
+	opUnsubscribe = "unsubscribe"
+)
+
+// limits on a single subscription
+const (
+	maxSubscriptionVehicles = 1000
+	maxSubscriptionGroups   = 100
+	maxClientMessageBytes   = 64 << 10
+)
+
+var validLevels = map[string]bool{"INFO": true, "WARN": true, "CRITICAL": true}
+
+// Subscription filters the alerts a client receives.
+// Each non-empty list must match; empty lists match everything.
+type Subscription struct {
+	Vehicles []string `json:"vehicles,omitempty"`
+	Levels   []string `json:"levels,omitempty"`
+	Groups   []uint   `json:"groups,omitempty"`
+	Paused   bool     `json:"paused,omitempty"` // set by unsubscribe: nothing matches
+
+	vehicles map[string]bool
+	levels   map[string]bool
+	groups   map[uint]bool
+}
+
+// NewSubscription validates and indexes a filter.
+func NewSubscription(vehicles, levels []string, groups []uint) (*Subscription, error) {
+	if len(vehicles) > maxSubscriptionVehicles {
+		return nil, fmt.Errorf("too many vehicles (max %d)", maxSubscriptionVehicles)
+	}
+	if len(groups) > maxSubscriptionGroups {
+		return nil, fmt.Errorf("too many groups (max %d)", maxSubscriptionGroups)
+	}
+	s := &Subscription{}
+	if len(vehicles) > 0 {
+		s.vehicles = make(map[string]bool, len(vehicles))
+		for _, v := range vehicles {
+			if v = strings.TrimSpace(v); v != "" && !s.vehicles[v] {
+				s.vehicles[v] = true
+				s.Vehicles = append(s.Vehicles, v)
+			}
+		}
+	}
+	if len(levels) > 0 {
+		s.levels = make(map[string]bool, len(levels))
+		for _, l := range levels {
+			l = strings.ToUpper(strings.TrimSpace(l))
+			if !validLevels[l] {
+				return nil, fmt.Errorf("unknown level %q", l)
+			}
+			if !s.levels[l] {
+				s.levels[l] = true
+				s.Levels = append(s.Levels, l)
+			}
+		}
+	}
+	if len(groups) > 0 {
+		s.groups = make(map[uint]bool, len(groups))
+		for _, g := range groups {
+			if !s.groups[g] {
+				s.groups[g] = true
+				s.Groups = append(s.Groups, g)
+			}
+		}
+	}
+	return s, nil
+}
+
+// SubscriptionFromQuery reads the initial filter from ?vehicles=a,b&levels=CRITICAL&groups=1,2.
+func SubscriptionFromQuery(q url.Values) (*Subscription, error) {
+	var groups []uint
+	for _, g := range splitList(q.Get("groups")) {
+		n, err := strconv.ParseUint(g, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid group %q", g)
+		}
+		groups = append(groups, uint(n))
+	}
+	return NewSubscription(splitList(q.Get("vehicles")), splitList(q.Get("levels")), groups)
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Matches reports whether the alert passes the filter. A nil filter matches everything.
+func (s *Subscription) Matches(a Alert) bool {
+	if s == nil {
+		return true
+	}
+	if s.Paused {
+		return false
+	}
+	if s.vehicles != nil && !s.vehicles[a.VehicleID] {
+		return false
+	}
+	if s.levels != nil && !s.levels[strings.ToUpper(a.Level)] {
+		return false
+	}
+	if s.groups != nil && (a.GroupID == nil || !s.groups[*a.GroupID]) {
+		return false
+	}
+	return true
+}
+
+// clientMessage is a control message received from a WebSocket client.
+type clientMessage struct {
+	Op       string   `json:"op"`
+	ID       string   `json:"id,omitempty"` // echoed in the reply for correlation
+	Vehicles []string `json:"vehicles,omitempty"`
+	Levels   []string `json:"levels,omitempty"`
+	Groups   []uint   `json:"groups,omitempty"`
+	Replay   bool     `json:"replay,omitempty"` // resend matching recent alerts after the ack
+}
+
+// SubscriptionReply acknowledges (or rejects) a client message, opens a
+// ?since= resume or announces a drain. Alerts on the socket have no "type" field, which tells the
+// two apart.
+type SubscriptionReply struct {
+	Type         string        `json:"type"` // "ack", "error", "resume" or "reconnect"
+	Op           string        `json:"op,omitempty"`
+	ID           string        `json:"id,omitempty"`
+	Subscription *Subscription `json:"subscription,omitempty"`
+	Error        string        `json:"error,omitempty"`
+
+	// resume only
+	Since     string `json:"since,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"` // stream was trimmed past since
+	More      bool   `json:"more,omitempty"`      // history exceeded the replay limit; page GET /alerts?since=
+
+	// reconnect only: the replica is draining; reconnect (with ?since=) after this delay
+	RetryAfterMs int64 `json:"retry_after_ms,omitempty"`
+}
+
+var errUnknownOp = errors.New("unknown op (want subscribe or unsubscribe)")
+
+// handleClientMessage applies one client message and returns the reply and,
+// for subscribe with replay, whether recent alerts should be resent.
+func handleClientMessage(c *Client, data []byte) (SubscriptionReply, bool) {
+	var msg clientMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return SubscriptionReply{Type: "error", Error: "invalid message: " + err.Error()}, false
+	}
+	reply := SubscriptionReply{Type: "ack", Op: msg.Op, ID: msg.ID}
+	switch msg.Op {
+	case opSubscribe:
+		sub, err := NewSubscription(msg.Vehicles, msg.Levels, msg.Groups)
+		if err != nil {
+			return SubscriptionReply{Type: "error", Op: msg.Op, ID: msg.ID, Error: err.Error()}, false
+		}
+		c.filter.Store(sub)
+		reply.Subscription = sub
+		return reply, msg.Replay
+	case opUnsubscribe:
+		sub := &Subscription{Paused: true}
+		c.filter.Store(sub)
+		reply.Subscription = sub
+		return reply, false
+	default:
+		return SubscriptionReply{Type: "error", Op: msg.Op, ID: msg.ID, Error: errUnknownOp.Error()}, false
+	}
+}
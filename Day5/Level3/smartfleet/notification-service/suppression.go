@@ -0,0 +1,563 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.uber.org/zap"
+)
+
+// Suppression keeps noisy alerts out of dashboards and channels. An alert is
+// suppressed when
+//
+//   - a mute covers its vehicle or group (any level), or
+//   - a maintenance window covers its vehicle or group and it is not CRITICAL, or
+//   - an alert with the same vehicle and rule was delivered less than the
+//     cooldown ago; the duplicate then raises the occurrence count of that
+//     original alert instead.
+//
+// The verdict for an alert is stored in Redis and is the same whichever
+// replica or consumer asks, so fan-out and outbound delivery agree.
+
+// Suppression reasons
+const (
+	SuppressedDuplicate   = "duplicate"
+	SuppressedMuted       = "muted"
+	SuppressedMaintenance = "maintenance"
+)
+
+// Mute silences every alert of a vehicle or a vehicle group until it expires.
+type Mute struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id"`
+	VehicleID string    `json:"vehicle_id,omitempty"`
+	GroupID   *uint     `json:"group_id,omitempty"`
+	Until     time.Time `json:"until"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (m *Mute) covers(a Alert) bool {
+	if !a.Ts.Before(m.Until) {
+		return false
+	}
+	return (m.VehicleID != "" && m.VehicleID == a.VehicleID) ||
+		(m.GroupID != nil && a.GroupID != nil && *m.GroupID == *a.GroupID)
+}
+
+// MaintenanceWindow silences non-critical alerts of some vehicles and groups
+// between Start and End.
+type MaintenanceWindow struct {
+	ID        string    `json:"id"`
+	TenantID  string    `json:"tenant_id"`
+	Vehicles  []string  `json:"vehicles,omitempty"`
+	Groups    []uint    `json:"groups,omitempty"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Reason    string    `json:"reason,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (w *MaintenanceWindow) covers(a Alert) bool {
+	if strings.EqualFold(a.Level, "CRITICAL") || a.Ts.Before(w.Start) || !a.Ts.Before(w.End) {
+		return false
+	}
+	for _, v := range w.Vehicles {
+		if v == a.VehicleID {
+			return true
+		}
+	}
+	if a.GroupID != nil {
+		for _, g := range w.Groups {
+			if g == *a.GroupID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Verdict is the suppression decision for one alert. An empty Reason means
+// deliver.
+type Verdict struct {
+	Reason      string
+	OriginalID  string // duplicates: the alert being counted
+	Occurrences int    // duplicates: occurrences of the original so far
+	MatchedID   string // mutes and maintenance windows: which one
+}
+
+// OccurrenceEvent tells WebSocket clients that an alert they have seen
+// occurred again: {"type":"occurrence","alert_id":...,"occurrences":N}.
+type OccurrenceEvent struct {
+	Type        string    `json:"type"` // always "occurrence"
+	AlertID     string    `json:"alert_id"`
+	VehicleID   string    `json:"vehicle_id"`
+	Rule        string    `json:"rule,omitempty"`
+	Occurrences int       `json:"occurrences"`
+	LastTs      time.Time `json:"last_ts"`
+}
+
+// SuppressionStats counts suppressed alerts of a tenant.
+type SuppressionStats struct {
+	CooldownSeconds int                         `json:"cooldown_seconds"`
+	Totals          map[string]int64            `json:"totals"`
+	ByVehicle       map[string]map[string]int64 `json:"by_vehicle"`
+}
+
+// Redis layout, per tenant:
+//
+//	notify:dedup:<tenant>:<vehicle>:<rule>  hash: id -> original alert, d:<id> per duplicate; expires after the cooldown
+//	notify:occurrences:<tenant>:<alert id>  occurrence count of an original alert
+//	notify:suppressed:<tenant>              zset: suppressed alert id -> unix ms
+//	notify:suppression-stats:<tenant>       hash: <reason> and <reason>|<vehicle> -> count
+//	notify:mutes:<tenant>                   hash: id -> Mute JSON
+//	notify:maintenance:<tenant>             hash: id -> MaintenanceWindow JSON
+const suppressionSeqKey = "notify:suppression:seq"
+
+func dedupKey(tenant, vehicle, rule string) string {
+	return "notify:dedup:" + tenant + ":" + vehicle + ":" + rule
+}
+func occurrencesKey(tenant, id string) string { return "notify:occurrences:" + tenant + ":" + id }
+func suppressedKey(tenant string) string      { return "notify:suppressed:" + tenant }
+func suppressionStatsKey(tenant string) string {
+	return "notify:suppression-stats:" + tenant
+}
+func mutesKey(tenant string) string       { return "notify:mutes:" + tenant }
+func maintenanceKey(tenant string) string { return "notify:maintenance:" + tenant }
+
+// dedupScript records an alert against the cooldown window of its vehicle
+// and rule. It returns {original id, occurrences, kind} where kind is 0 for
+// the original, 1 for a duplicate seen before and 2 for a new duplicate.
+var dedupScript = redis.NewScript(`
+local orig = redis.call('HGET', KEYS[1], 'id')
+if not orig then
+  redis.call('HSET', KEYS[1], 'id', ARGV[1])
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+  return {ARGV[1], 1, 0}
+end
+if orig == ARGV[1] then
+  return {orig, redis.call('HLEN', KEYS[1]), 0}
+end
+local added = redis.call('HSETNX', KEYS[1], 'd:' .. ARGV[1], 1)
+return {orig, redis.call('HLEN', KEYS[1]), 1 + added}
+`)
+
+// Suppressor evaluates and records suppression in Redis.
+type Suppressor struct {
+	rdb       *redis.Client
+	cooldown  time.Duration // 0 disables deduplication
+	retention time.Duration // how long suppressed IDs and occurrence counts are kept
+	seq       atomic.Uint64 // tokens for alerts without an ID
+}
+
+func NewSuppressor(rdb *redis.Client, cooldown, retention time.Duration) *Suppressor {
+	return &Suppressor{rdb: rdb, cooldown: cooldown, retention: retention}
+}
+
+// Check returns the verdict for an alert, recording it on first sight.
+// Asking again for the same alert ID returns the same verdict without
+// counting it twice.
+func (s *Suppressor) Check(ctx context.Context, a Alert) (Verdict, error) {
+	mutes, windows, err := s.active(ctx, a.TenantID)
+	if err != nil {
+		return Verdict{}, err
+	}
+	for _, m := range mutes {
+		if m.covers(a) {
+			return Verdict{Reason: SuppressedMuted, MatchedID: m.ID}, s.record(ctx, a, SuppressedMuted)
+		}
+	}
+	for _, w := range windows {
+		if w.covers(a) {
+			return Verdict{Reason: SuppressedMaintenance, MatchedID: w.ID}, s.record(ctx, a, SuppressedMaintenance)
+		}
+	}
+	if s.cooldown <= 0 {
+		return Verdict{}, nil
+	}
+
+	token := a.ID
+	if token == "" {
+		// pub/sub alerts have no ID; each one is seen exactly once anyway
+		token = "tok-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + strconv.FormatUint(s.seq.Add(1), 36)
+	}
+	res, err := dedupScript.Run(ctx, s.rdb, []string{dedupKey(a.TenantID, a.VehicleID, a.ruleKey())},
+		token, s.cooldown.Milliseconds()).Slice()
+	if err != nil {
+		return Verdict{}, err
+	}
+	if len(res) != 3 {
+		return Verdict{}, fmt.Errorf("dedup: unexpected reply %v", res)
+	}
+	orig, _ := res[0].(string)
+	count, _ := res[1].(int64)
+	kind, _ := res[2].(int64)
+	if kind == 0 {
+		return Verdict{}, nil
+	}
+	v := Verdict{Reason: SuppressedDuplicate, OriginalID: orig, Occurrences: int(count)}
+	if kind == 2 {
+		if err := s.rdb.Set(ctx, occurrencesKey(a.TenantID, orig), count, s.retention).Err(); err != nil {
+			return v, err
+		}
+		return v, s.record(ctx, a, SuppressedDuplicate)
+	}
+	return v, nil
+}
+
+// record marks the alert suppressed and counts it once.
+func (s *Suppressor) record(ctx context.Context, a Alert, reason string) error {
+	if a.ID != "" {
+		now := time.Now()
+		added, err := s.rdb.ZAddNX(ctx, suppressedKey(a.TenantID), redis.Z{Score: float64(now.UnixMilli()), Member: a.ID}).Result()
+		if err != nil || added == 0 {
+			return err // already counted by another consumer
+		}
+		cutoff := strconv.FormatInt(now.Add(-s.retention).UnixMilli(), 10)
+		s.rdb.ZRemRangeByScore(ctx, suppressedKey(a.TenantID), "-inf", "("+cutoff)
+	}
+	pipe := s.rdb.Pipeline()
+	pipe.HIncrBy(ctx, suppressionStatsKey(a.TenantID), reason, 1)
+	pipe.HIncrBy(ctx, suppressionStatsKey(a.TenantID), reason+"|"+a.VehicleID, 1)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// active loads the tenant's mutes and maintenance windows that have not
+// ended yet, dropping expired ones.
+func (s *Suppressor) active(ctx context.Context, tenant string) ([]*Mute, []*MaintenanceWindow, error) {
+	pipe := s.rdb.Pipeline()
+	mc := pipe.HGetAll(ctx, mutesKey(tenant))
+	wc := pipe.HGetAll(ctx, maintenanceKey(tenant))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	var mutes []*Mute
+	var expired []string
+	for id, v := range mc.Val() {
+		var m Mute
+		if err := json.Unmarshal([]byte(v), &m); err != nil || !now.Before(m.Until) {
+			expired = append(expired, id)
+			continue
+		}
+		mutes = append(mutes, &m)
+	}
+	if len(expired) > 0 {
+		s.rdb.HDel(ctx, mutesKey(tenant), expired...)
+	}
+	var windows []*MaintenanceWindow
+	expired = expired[:0]
+	for id, v := range wc.Val() {
+		var w MaintenanceWindow
+		if err := json.Unmarshal([]byte(v), &w); err != nil || !now.Before(w.End) {
+			expired = append(expired, id)
+			continue
+		}
+		windows = append(windows, &w)
+	}
+	if len(expired) > 0 {
+		s.rdb.HDel(ctx, maintenanceKey(tenant), expired...)
+	}
+	return mutes, windows, nil
+}
+
+func (s *Suppressor) nextID(ctx context.Context, prefix string) (string, error) {
+	n, err := s.rdb.Incr(ctx, suppressionSeqKey).Result()
+	if err != nil {
+		return "", err
+	}
+	return prefix + strconv.FormatInt(n, 10), nil
+}
+
+// Annotate drops suppressed alerts from history and sets the occurrence
+// count of deduplicated originals.
+func (s *Suppressor) Annotate(ctx context.Context, alerts []Alert) ([]Alert, error) {
+	if len(alerts) == 0 {
+		return alerts, nil
+	}
+	pipe := s.rdb.Pipeline()
+	scores := make([]*redis.FloatCmd, len(alerts))
+	counts := make([]*redis.StringCmd, len(alerts))
+	for i, a := range alerts {
+		if a.ID == "" {
+			continue
+		}
+		scores[i] = pipe.ZScore(ctx, suppressedKey(a.TenantID), a.ID)
+		counts[i] = pipe.Get(ctx, occurrencesKey(a.TenantID, a.ID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return alerts, err
+	}
+	out := alerts[:0]
+	for i, a := range alerts {
+		if scores[i] != nil {
+			if scores[i].Err() == nil {
+				continue // suppressed
+			}
+			if n, err := counts[i].Int(); err == nil {
+				a.Occurrences = n
+			}
+		}
+		out = append(out, a)
+	}
+	return out, nil
+}
+
+// Stats returns the tenant's suppression counters.
+func (s *Suppressor) Stats(ctx context.Context, tenant string) (SuppressionStats, error) {
+	vals, err := s.rdb.HGetAll(ctx, suppressionStatsKey(tenant)).Result()
+	if err != nil {
+		return SuppressionStats{}, err
+	}
+	st := SuppressionStats{
+		CooldownSeconds: int(s.cooldown / time.Second),
+		Totals:          map[string]int64{SuppressedDuplicate: 0, SuppressedMuted: 0, SuppressedMaintenance: 0},
+		ByVehicle:       map[string]map[string]int64{},
+	}
+	for k, v := range vals {
+		n, _ := strconv.ParseInt(v, 10, 64)
+		reason, vehicle, ok := strings.Cut(k, "|")
+		if !ok {
+			st.Totals[reason] = n
+			continue
+		}
+		if st.ByVehicle[vehicle] == nil {
+			st.ByVehicle[vehicle] = map[string]int64{}
+		}
+		st.ByVehicle[vehicle][reason] = n
+	}
+	return st, nil
+}
+
+// annotate applies Suppressor.Annotate to history; on errors the history is
+// returned as is.
+func (n *NotificationService) annotate(ctx context.Context, alerts []Alert) []Alert {
+	if n.suppressor == nil {
+		return alerts
+	}
+	out, err := n.suppressor.Annotate(ctx, alerts)
+	if err != nil {
+		n.logger.Printf("[suppress] annotate history: %v", err)
+	}
+	return out
+}
+
+// admit runs suppression for an alert and reports whether to deliver it.
+// With local set, a duplicate bumps the occurrence count of its original in
+// the recent buffer and on this replica's WebSocket clients.
+func (n *NotificationService) admit(a Alert, local bool) bool {
+	if n.suppressor == nil {
+		return true
+	}
+	a = normalizeAlert(a)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	v, err := n.suppressor.Check(ctx, a)
+	if err != nil {
+		// fail open: a lost alert is worse than a duplicate
+		n.logger.Printf("[suppress] alert %s: %v", a.ID, err)
+		return v.Reason == ""
+	}
+	if v.Reason != "" {
+		n.log.Debug("alert suppressed", zap.String("request_id", a.RequestID), zap.String("alert_id", a.ID),
+			zap.String("tenant", a.TenantID), zap.String("vehicle_id", a.VehicleID), zap.String("reason", v.Reason))
+	}
+	if v.Reason == SuppressedDuplicate && local {
+		n.recent.SetOccurrences(a.TenantID, v.OriginalID, v.Occurrences)
+		n.hub.Publish(a, &OccurrenceEvent{
+			Type:        "occurrence",
+			AlertID:     v.OriginalID,
+			VehicleID:   a.VehicleID,
+			Rule:        a.Rule,
+			Occurrences: v.Occurrences,
+			LastTs:      a.Ts,
+		})
+	}
+	return v.Reason == ""
+}
+
+// http handlers
+
+// handleSuppressions serves GET /suppressions: the tenant's suppressed counts.
+func (n *NotificationService) handleSuppressions(w http.ResponseWriter, r *http.Request) {
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if n.suppressor == nil {
+		http.Error(w, "suppression disabled", http.StatusNotFound)
+		return
+	}
+	st, err := n.suppressor.Stats(r.Context(), tenant)
+	if err != nil {
+		n.logger.Printf("[suppress] stats: %v", err)
+		http.Error(w, "suppression unavailable", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+// muteRequest is the body of POST /mutes: a vehicle or a group, and either
+// a duration ("2h") or an end time.
+type muteRequest struct {
+	VehicleID string    `json:"vehicle_id"`
+	GroupID   *uint     `json:"group_id"`
+	Duration  string    `json:"duration"`
+	Until     time.Time `json:"until"`
+	Reason    string    `json:"reason"`
+}
+
+func (req muteRequest) mute(tenant string, now time.Time) (*Mute, error) {
+	if (req.VehicleID == "") == (req.GroupID == nil) {
+		return nil, errors.New("set exactly one of vehicle_id and group_id")
+	}
+	m := &Mute{TenantID: tenant, VehicleID: req.VehicleID, GroupID: req.GroupID, Until: req.Until.UTC(), Reason: req.Reason, CreatedAt: now}
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid duration %q", req.Duration)
+		}
+		m.Until = now.Add(d)
+	}
+	if !m.Until.After(now) {
+		return nil, errors.New("set a positive duration or a future until")
+	}
+	return m, nil
+}
+
+func (w *MaintenanceWindow) validate() error {
+	if len(w.Vehicles) == 0 && len(w.Groups) == 0 {
+		return errors.New("set vehicles or groups")
+	}
+	if w.Start.IsZero() || !w.End.After(w.Start) {
+		return errors.New("end must be after start")
+	}
+	return nil
+}
+
+func (m *Mute) setID(id string)              { m.ID = id }
+func (w *MaintenanceWindow) setID(id string) { w.ID = id }
+
+// handleMutes serves GET and POST /mutes and DELETE /mutes/{id}.
+func (n *NotificationService) handleMutes(w http.ResponseWriter, r *http.Request) {
+	n.serveSuppressionObjects(w, r, "/mutes", "mute-", mutesKey, func(tenant string, now time.Time, body []byte) (suppressionObject, error) {
+		var req muteRequest
+		if err := json.Unmarshal(body, &req); err != nil {
+			return nil, err
+		}
+		return req.mute(tenant, now)
+	}, func(ctx context.Context, tenant string) (interface{}, error) {
+		mutes, _, err := n.suppressor.active(ctx, tenant)
+		if mutes == nil {
+			mutes = []*Mute{}
+		}
+		return mutes, err
+	})
+}
+
+// handleMaintenance serves GET and POST /maintenance and DELETE /maintenance/{id}.
+func (n *NotificationService) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	n.serveSuppressionObjects(w, r, "/maintenance", "mw-", maintenanceKey, func(tenant string, now time.Time, body []byte) (suppressionObject, error) {
+		var mw MaintenanceWindow
+		if err := json.Unmarshal(body, &mw); err != nil {
+			return nil, err
+		}
+		if err := mw.validate(); err != nil {
+			return nil, err
+		}
+		mw.TenantID, mw.CreatedAt = tenant, now
+		mw.Start, mw.End = mw.Start.UTC(), mw.End.UTC()
+		return &mw, nil
+	}, func(ctx context.Context, tenant string) (interface{}, error) {
+		_, windows, err := n.suppressor.active(ctx, tenant)
+		if windows == nil {
+			windows = []*MaintenanceWindow{}
+		}
+		return windows, err
+	})
+}
+
+// suppressionObject is a mute or a maintenance window.
+type suppressionObject interface{ setID(id string) }
+
+// serveSuppressionObjects implements list, create and delete for mutes and
+// maintenance windows, which are stored the same way.
+func (n *NotificationService) serveSuppressionObjects(w http.ResponseWriter, r *http.Request, path, idPrefix string, key func(string) string,
+	parse func(tenant string, now time.Time, body []byte) (suppressionObject, error),
+	list func(ctx context.Context, tenant string) (interface{}, error)) {
+	tenant, err := n.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if n.suppressor == nil {
+		http.Error(w, "suppression disabled", http.StatusNotFound)
+		return
+	}
+	id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, path), "/")
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		objs, err := list(r.Context(), tenant)
+		if err != nil {
+			n.logger.Printf("[suppress] list %s: %v", path, err)
+			http.Error(w, "suppression unavailable", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(objs)
+	case id == "" && r.Method == http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, 64<<10))
+		if err != nil {
+			http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj, err := parse(tenant, time.Now().UTC(), body)
+		if err != nil {
+			http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		newID, err := n.suppressor.nextID(r.Context(), idPrefix)
+		if err == nil {
+			obj.setID(newID)
+			b, _ := json.Marshal(obj)
+			if err = n.rdb.HSet(r.Context(), key(tenant), newID, b).Err(); err == nil {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write(b)
+				return
+			}
+		}
+		n.logger.Printf("[suppress] create %s: %v", path, err)
+		http.Error(w, "suppression unavailable", http.StatusInternalServerError)
+	case id != "" && r.Method == http.MethodDelete:
+		removed, err := n.rdb.HDel(r.Context(), key(tenant), id).Result()
+		if err != nil {
+			n.logger.Printf("[suppress] delete %s/%s: %v", path, id, err)
+			http.Error(w, "suppression unavailable", http.StatusInternalServerError)
+			return
+		}
+		if removed == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,163 @@
+package notification
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/redis/go-redis/v9"
+)
+
+// testRedis returns a client of an in-process Redis that lives as long as t.
+func testRedis(t *testing.T) (*miniredis.Miniredis, *redis.Client) {
+	t.Helper()
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(mr.Close)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return mr, rdb
+}
+
+func TestMuteCovers(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	byVehicle := &Mute{VehicleID: "v1", Until: t0.Add(time.Hour)}
+	byGroup := &Mute{GroupID: uintPtr(3), Until: t0.Add(time.Hour)}
+
+	cases := []struct {
+		name string
+		m    *Mute
+		a    Alert
+		want bool
+	}{
+		{"vehicle, critical too", byVehicle, Alert{VehicleID: "v1", Level: "CRITICAL", Ts: t0}, true},
+		{"other vehicle", byVehicle, Alert{VehicleID: "v2", Ts: t0}, false},
+		{"after expiry", byVehicle, Alert{VehicleID: "v1", Ts: t0.Add(time.Hour)}, false},
+		{"group", byGroup, Alert{VehicleID: "v9", GroupID: uintPtr(3), Ts: t0}, true},
+		{"other group", byGroup, Alert{VehicleID: "v9", GroupID: uintPtr(4), Ts: t0}, false},
+		{"no group on alert", byGroup, Alert{VehicleID: "v9", Ts: t0}, false},
+	}
+	for _, tc := range cases {
+		if got := tc.m.covers(tc.a); got != tc.want {
+			t.Errorf("%s: covers = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestMaintenanceWindowSilencesOnlyNonCritical(t *testing.T) {
+	t0 := time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)
+	w := &MaintenanceWindow{Vehicles: []string{"v1"}, Groups: []uint{7}, Start: t0, End: t0.Add(4 * time.Hour)}
+
+	cases := []struct {
+		name string
+		a    Alert
+		want bool
+	}{
+		{"warn in window", Alert{VehicleID: "v1", Level: "WARN", Ts: t0.Add(time.Hour)}, true},
+		{"critical in window", Alert{VehicleID: "v1", Level: "CRITICAL", Ts: t0.Add(time.Hour)}, false},
+		{"group member", Alert{VehicleID: "v5", GroupID: uintPtr(7), Level: "INFO", Ts: t0}, true},
+		{"before start", Alert{VehicleID: "v1", Level: "WARN", Ts: t0.Add(-time.Minute)}, false},
+		{"at end", Alert{VehicleID: "v1", Level: "WARN", Ts: t0.Add(4 * time.Hour)}, false},
+		{"other vehicle", Alert{VehicleID: "v2", Level: "WARN", Ts: t0.Add(time.Hour)}, false},
+	}
+	for _, tc := range cases {
+		if got := w.covers(tc.a); got != tc.want {
+			t.Errorf("%s: covers = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+
+	if err := (&MaintenanceWindow{Start: t0, End: t0.Add(time.Hour)}).validate(); err == nil {
+		t.Error("window without vehicles or groups accepted")
+	}
+	if err := (&MaintenanceWindow{Vehicles: []string{"v1"}, Start: t0, End: t0}).validate(); err == nil {
+		t.Error("empty window accepted")
+	}
+}
+
+func TestMuteRequest(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	m, err := muteRequest{VehicleID: "v1", Duration: "2h", Reason: "towing"}.mute("tenant-a", now)
+	if err != nil || !m.Until.Equal(now.Add(2*time.Hour)) || m.TenantID != "tenant-a" {
+		t.Fatalf("mute = %+v, %v", m, err)
+	}
+	for name, req := range map[string]muteRequest{
+		"neither vehicle nor group": {Duration: "1h"},
+		"both vehicle and group":    {VehicleID: "v1", GroupID: uintPtr(1), Duration: "1h"},
+		"no expiry":                 {VehicleID: "v1"},
+		"past until":                {VehicleID: "v1", Until: now.Add(-time.Minute)},
+		"bad duration":              {VehicleID: "v1", Duration: "-5m"},
+	} {
+		if _, err := req.mute("tenant-a", now); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestRecentAlertsSetOccurrences(t *testing.T) {
+	r := NewRecentAlerts(10)
+	r.Add(Alert{ID: "1-0", TenantID: "tenant-a", VehicleID: "v1"})
+	r.Add(Alert{ID: "1-0", TenantID: "tenant-b", VehicleID: "v1"})
+
+	r.SetOccurrences("tenant-a", "1-0", 4)
+	r.SetOccurrences("tenant-a", "1-0", 3) // late, lower count is ignored
+
+	if got := r.ListTenant("tenant-a"); got[0].Occurrences != 4 {
+		t.Fatalf("tenant-a occurrences = %d, want 4", got[0].Occurrences)
+	}
+	if got := r.ListTenant("tenant-b"); got[0].Occurrences != 0 {
+		t.Fatalf("tenant-b alert changed: %+v", got[0])
+	}
+}
+
+func TestSuppressorDedup(t *testing.T) {
+	mr, rdb := testRedis(t)
+	ctx := context.Background()
+	s := NewSuppressor(rdb, time.Minute, time.Hour)
+	check := func(id, vehicle string) Verdict {
+		t.Helper()
+		v, err := s.Check(ctx, Alert{ID: id, TenantID: "tenant-a", VehicleID: vehicle, Rule: "overspeed", Level: "WARN"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	dup := func(n int) Verdict { return Verdict{Reason: SuppressedDuplicate, OriginalID: "1-0", Occurrences: n} }
+
+	if v := check("1-0", "v1"); v != (Verdict{}) {
+		t.Fatalf("first alert: %+v, want the original", v)
+	}
+	if v := check("2-0", "v1"); v != dup(2) {
+		t.Fatalf("repeat: %+v, want %+v", v, dup(2))
+	}
+	if v := check("3-0", "v1"); v != dup(3) {
+		t.Fatalf("second repeat: %+v, want %+v", v, dup(3))
+	}
+	// another consumer asking again gets the same answers, uncounted
+	if v := check("3-0", "v1"); v != dup(3) {
+		t.Fatalf("second repeat checked again: %+v, want %+v", v, dup(3))
+	}
+	if v := check("1-0", "v1"); v != (Verdict{}) {
+		t.Fatalf("original checked again: %+v", v)
+	}
+	if n, err := rdb.Get(ctx, occurrencesKey("tenant-a", "1-0")).Int(); err != nil || n != 3 {
+		t.Fatalf("occurrences of 1-0 = %d, %v; want 3", n, err)
+	}
+	if st, err := s.Stats(ctx, "tenant-a"); err != nil || st.Totals[SuppressedDuplicate] != 2 || st.ByVehicle["v1"][SuppressedDuplicate] != 2 {
+		t.Fatalf("stats = %+v, %v; want 2 duplicates of v1", st, err)
+	}
+	// the window is per vehicle and rule
+	if v := check("4-0", "v2"); v != (Verdict{}) {
+		t.Fatalf("another vehicle: %+v, want an original", v)
+	}
+
+	mr.FastForward(time.Minute + time.Second)
+	if v := check("5-0", "v1"); v != (Verdict{}) {
+		t.Fatalf("after the cooldown: %+v, want a new original", v)
+	}
+	if v := check("6-0", "v1"); v.OriginalID != "5-0" || v.Occurrences != 2 {
+		t.Fatalf("repeat after the cooldown: %+v, want the 2nd occurrence of 5-0", v)
+	}
+}
@@ -0,0 +1,300 @@
+package notification
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Alerts that carry a code and params are rendered at delivery time in the
+// recipient's language: per client for WebSocket, SSE and GET /alerts, per
+// routing rule or escalation tier for outbound channels. A template refers
+// to params as {name}, or {name:N} for a number with N decimals. The
+// message the publisher sent is kept when no locale has a template for the
+// code or a param is missing.
+
+//go:embed locales/*.json
+var builtinLocales embed.FS
+
+// localeFile is the JSON form of one locale's templates.
+type localeFile struct {
+	Decimal  string            `json:"decimal,omitempty"` // decimal separator, default "."
+	Messages map[string]string `json:"messages"`
+}
+
+type templatePart struct {
+	text  string
+	param string // empty for literal text
+	prec  int    // decimals, -1 for as many as needed
+}
+
+type messageTemplate []templatePart
+
+type locale struct {
+	decimal  string
+	messages map[string]messageTemplate
+}
+
+// Catalog holds message templates per locale and alert code.
+type Catalog struct {
+	fallback string
+	locales  map[string]*locale
+}
+
+// NewCatalog loads the built-in locales; fallback is used when none of a
+// recipient's locales has a template.
+func NewCatalog(fallback string) (*Catalog, error) {
+	c := &Catalog{fallback: normalizeLocale(fallback), locales: make(map[string]*locale)}
+	files, err := builtinLocales.ReadDir("locales")
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := builtinLocales.ReadFile("locales/" + f.Name())
+		if err != nil {
+			return nil, err
+		}
+		var lf localeFile
+		if err := json.Unmarshal(data, &lf); err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+		if err := c.add(strings.TrimSuffix(f.Name(), path.Ext(f.Name())), lf); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Merge adds or overrides templates from a JSON object of locales, e.g.
+// {"de":{"messages":{"OVERSPEED":"Zu schnell: {speed:0} km/h"}}}.
+func (c *Catalog) Merge(data []byte) error {
+	var files map[string]localeFile
+	if err := json.Unmarshal(data, &files); err != nil {
+		return err
+	}
+	for tag, lf := range files {
+		if err := c.add(tag, lf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Catalog) add(tag string, lf localeFile) error {
+	tag = normalizeLocale(tag)
+	if tag == "" {
+		return fmt.Errorf("empty locale")
+	}
+	l := c.locales[tag]
+	if l == nil {
+		l = &locale{decimal: ".", messages: make(map[string]messageTemplate)}
+		c.locales[tag] = l
+	}
+	if lf.Decimal != "" {
+		l.decimal = lf.Decimal
+	}
+	for code, s := range lf.Messages {
+		t, err := parseTemplate(s)
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", tag, code, err)
+		}
+		l.messages[code] = t
+	}
+	return nil
+}
+
+// Locales lists the configured locales.
+func (c *Catalog) Locales() []string {
+	out := make([]string, 0, len(c.locales))
+	for tag := range c.locales {
+		out = append(out, tag)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// HasLocale reports whether tag or its language has templates.
+func (c *Catalog) HasLocale(tag string) bool {
+	for _, t := range candidates(tag) {
+		if c.locales[t] != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Localize renders a's message for the first of prefs that has a template
+// for a's code, falling back to each tag's language and then to the
+// catalog's fallback locale. Locale tells the client which one was used.
+func (c *Catalog) Localize(a Alert, prefs []string) Alert {
+	if c == nil || a.Code == "" {
+		return a
+	}
+	tried := make(map[string]bool)
+	for i := 0; i <= len(prefs); i++ {
+		pref := c.fallback
+		if i < len(prefs) {
+			pref = prefs[i]
+		}
+		for _, tag := range candidates(pref) {
+			if tried[tag] {
+				continue
+			}
+			tried[tag] = true
+			l := c.locales[tag]
+			if l == nil {
+				continue
+			}
+			t, ok := l.messages[a.Code]
+			if !ok {
+				continue
+			}
+			msg, ok := t.render(a.Params, l.decimal)
+			if !ok {
+				return a // params do not fit the template: keep the publisher's text
+			}
+			a.Message, a.Locale = msg, tag
+			return a
+		}
+	}
+	return a
+}
+
+// candidates returns "de-at", "de" for "de-AT".
+func candidates(tag string) []string {
+	tag = normalizeLocale(tag)
+	if tag == "" || tag == "*" {
+		return nil
+	}
+	if lang, _, ok := strings.Cut(tag, "-"); ok {
+		return []string{tag, lang}
+	}
+	return []string{tag}
+}
+
+func normalizeLocale(tag string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(tag), "_", "-"))
+}
+
+func parseTemplate(s string) (messageTemplate, error) {
+	var t messageTemplate
+	for s != "" {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			t = append(t, templatePart{text: s})
+			break
+		}
+		if i > 0 {
+			t = append(t, templatePart{text: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("unclosed { in %q", s)
+		}
+		name, prec, hasPrec := strings.Cut(s[i+1:i+j], ":")
+		if name == "" || strings.ContainsAny(name, "{ ") {
+			return nil, fmt.Errorf("bad placeholder %q", s[i:i+j+1])
+		}
+		p := templatePart{param: name, prec: -1}
+		if hasPrec {
+			n, err := strconv.Atoi(prec)
+			if err != nil || n < 0 || n > 6 {
+				return nil, fmt.Errorf("bad precision in %q (want 0..6)", s[i:i+j+1])
+			}
+			p.prec = n
+		}
+		t = append(t, p)
+		s = s[i+j+1:]
+	}
+	return t, nil
+}
+
+// render fills in params; ok is false when one is missing.
+func (t messageTemplate) render(params map[string]interface{}, decimal string) (string, bool) {
+	var b strings.Builder
+	for _, p := range t {
+		if p.param == "" {
+			b.WriteString(p.text)
+			continue
+		}
+		v, ok := params[p.param]
+		if !ok {
+			return "", false
+		}
+		b.WriteString(formatParam(v, p.prec, decimal))
+	}
+	return b.String(), true
+}
+
+func formatParam(v interface{}, prec int, decimal string) string {
+	var f float64
+	switch x := v.(type) {
+	case float64:
+		f = x
+	case int:
+		f = float64(x)
+	case int64:
+		f = float64(x)
+	case json.Number:
+		var err error
+		if f, err = x.Float64(); err != nil {
+			return x.String()
+		}
+	case string:
+		return x
+	default:
+		return fmt.Sprint(v)
+	}
+	s := strconv.FormatFloat(f, 'f', prec, 64)
+	if decimal != "." {
+		s = strings.Replace(s, ".", decimal, 1)
+	}
+	return s
+}
+
+// ParseAcceptLanguage returns the tags of an Accept-Language header, most
+// preferred first.
+func ParseAcceptLanguage(h string) []string {
+	type weighted struct {
+		tag string
+		q   float64
+	}
+	var tags []weighted
+	for _, part := range strings.Split(h, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			tags = append(tags, weighted{tag, q})
+		}
+	}
+	sort.SliceStable(tags, func(i, j int) bool { return tags[i].q > tags[j].q })
+	out := make([]string, len(tags))
+	for i, t := range tags {
+		out[i] = t.tag
+	}
+	return out
+}
+
+// localePrefs returns a request's locale preferences: ?locale= first, then
+// Accept-Language, which browsers also send on WebSocket and EventSource
+// requests.
+func localePrefs(r *http.Request) []string {
+	prefs := ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	if l := r.URL.Query().Get("locale"); l != "" {
+		prefs = append([]string{l}, prefs...)
+	}
+	return prefs
+}
@@ -0,0 +1,202 @@
+package notification
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"smartfleet/common/apikey"
+)
+
+var overspeed = Alert{
+	TenantID: "t", VehicleID: "v1", Level: "CRITICAL",
+	Message: "Overspeed > 140 km/h",
+	Code:    "OVERSPEED",
+	Params:  map[string]interface{}{"speed": 145.6, "limit": 140.0},
+}
+
+func TestCatalogLocalize(t *testing.T) {
+	c, err := NewCatalog("en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name   string
+		a      Alert
+		prefs  []string
+		locale string
+		want   string
+	}{
+		{"german", overspeed, []string{"de"}, "de", "Geschwindigkeitsüberschreitung: 146 km/h (Grenze 140 km/h)"},
+		{"region falls back to language", overspeed, []string{"de-AT"}, "de", "Geschwindigkeitsüberschreitung: 146 km/h (Grenze 140 km/h)"},
+		{"hindi", overspeed, []string{"hi-IN"}, "hi", "तेज़ रफ़्तार: 146 किमी/घंटा (सीमा 140 किमी/घंटा)"},
+		{"unknown locale falls back to default", overspeed, []string{"fr", "es"}, "en", "Overspeed: 146 km/h (limit 140 km/h)"},
+		{"no preference", overspeed, nil, "en", "Overspeed: 146 km/h (limit 140 km/h)"},
+		{"decimal comma", Alert{Code: "CHARGING_SLOW", Params: map[string]interface{}{"power_kw": 3.26}}, []string{"de"}, "de", "Langsames Laden: durchschnittlich 3,3 kW"},
+		{"missing param keeps message", Alert{Message: "raw", Code: "OVERSPEED", Params: map[string]interface{}{"speed": 150.0}}, []string{"de"}, "", "raw"},
+		{"unknown code keeps message", Alert{Message: "raw", Code: "NOPE"}, []string{"de"}, "", "raw"},
+		{"no code", Alert{Message: "Low fuel: 9.5%"}, []string{"de"}, "", "Low fuel: 9.5%"},
+	}
+	for _, tc := range cases {
+		got := c.Localize(tc.a, tc.prefs)
+		if got.Message != tc.want || got.Locale != tc.locale {
+			t.Errorf("%s: got %q in %q, want %q in %q", tc.name, got.Message, got.Locale, tc.want, tc.locale)
+		}
+	}
+
+	// overrides replace single templates and can add locales
+	if err := c.Merge([]byte(`{"de":{"messages":{"OVERSPEED":"Zu schnell: {speed:1} km/h"}},"pt-BR":{"decimal":",","messages":{"OVERSPEED":"Excesso de velocidade: {speed:1} km/h"}}}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Localize(overspeed, []string{"de"}).Message; got != "Zu schnell: 145,6 km/h" {
+		t.Errorf("overridden de = %q", got)
+	}
+	if got := c.Localize(overspeed, []string{"pt-br"}); got.Message != "Excesso de velocidade: 145,6 km/h" || got.Locale != "pt-br" {
+		t.Errorf("added pt-BR = %q in %q", got.Message, got.Locale)
+	}
+	if got := c.Localize(Alert{Code: "CHARGING_SLOW", Params: map[string]interface{}{"power_kw": 3.0}}, []string{"de"}).Message; got != "Langsames Laden: durchschnittlich 3,0 kW" {
+		t.Errorf("merge lost the built-in de templates: %q", got)
+	}
+	for _, bad := range []string{`{"de":{"messages":{"X":"{speed"}}}`, `{"de":{"messages":{"X":"{speed:x}"}}}`, `{"de":{"messages":{"X":"{}"}}}`} {
+		if err := c.Merge([]byte(bad)); err == nil {
+			t.Errorf("Merge(%s) accepted", bad)
+		}
+	}
+}
+
+// TestBuiltinLocalesComplete checks every locale translates every code and
+// uses the same params as English.
+func TestBuiltinLocalesComplete(t *testing.T) {
+	c, err := NewCatalog("en")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := func(tmpl messageTemplate) []string {
+		var out []string
+		for _, p := range tmpl {
+			if p.param != "" {
+				out = append(out, p.param)
+			}
+		}
+		sort.Strings(out)
+		return out
+	}
+	en := c.locales["en"]
+	for _, tag := range c.Locales() {
+		l := c.locales[tag]
+		for code, tmpl := range en.messages {
+			other, ok := l.messages[code]
+			if !ok {
+				t.Errorf("%s: no template for %s", tag, code)
+				continue
+			}
+			if !reflect.DeepEqual(params(tmpl), params(other)) {
+				t.Errorf("%s %s uses %v, en uses %v", tag, code, params(other), params(tmpl))
+			}
+		}
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	got := ParseAcceptLanguage("en;q=0.5, de-DE, hi;q=0.8, fr;q=0, *;q=0.1")
+	want := []string{"de-DE", "hi", "en", "*"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ParseAcceptLanguage = %v, want %v", got, want)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/ws?locale=hi", nil)
+	req.Header.Set("Accept-Language", "de")
+	if got := localePrefs(req); !reflect.DeepEqual(got, []string{"hi", "de"}) {
+		t.Fatalf("localePrefs = %v", got)
+	}
+}
+
+func TestListAlertsRenderedInRequestLocale(t *testing.T) {
+	auth, _ := apikey.New("", "", "t", true)
+	ns, err := NewNotificationService(nil, auth, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns.recent.Add(overspeed)
+
+	req := httptest.NewRequest(http.MethodGet, "/alerts", nil)
+	req.Header.Set("Accept-Language", "de-CH, en;q=0.5")
+	rec := httptest.NewRecorder()
+	ns.handleListAlerts(rec, req)
+	var list []Alert
+	if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Locale != "de" || list[0].Params["speed"] != 145.6 {
+		t.Fatalf("alerts = %+v", list)
+	}
+	if got := ns.recent.ListTenant("t")[0].Message; got != overspeed.Message {
+		t.Fatalf("rendering changed the stored alert: %q", got)
+	}
+}
+
+// captureChannel records what it is asked to send.
+type captureChannel struct{ sent chan Alert }
+
+func (c captureChannel) Name() string { return "capture" }
+
+func (c captureChannel) Send(_ context.Context, _ string, a Alert) error {
+	c.sent <- a
+	return nil
+}
+
+func TestDispatcherRendersInRuleLocale(t *testing.T) {
+	ch := captureChannel{sent: make(chan Alert, 4)}
+	channels := map[string]Channel{"capture": ch}
+	rules, err := ParseRoutingRules([]byte(`[
+		{"name":"drivers","tenant":"t","channel":"capture","to":["+4915550100"],"locale":"de"},
+		{"name":"managers","tenant":"t","channel":"capture","to":["ops@example.com"]}
+	]`), channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalog, _ := NewCatalog("en")
+	d := NewDispatcher(channels, rules, &memDeliveryLog{}, RetryPolicy{MaxAttempts: 1}, 1, catalog, log.New(io.Discard, "", 0))
+	defer d.Close(context.Background())
+	d.Dispatch(overspeed)
+
+	got := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case a := <-ch.sent:
+			got[fmt.Sprintf("%s|%s", a.Locale, a.Message)] = true
+		case <-time.After(2 * time.Second):
+			t.Fatal("delivery missing")
+		}
+	}
+	for _, want := range []string{
+		"de|Geschwindigkeitsüberschreitung: 146 km/h (Grenze 140 km/h)",
+		"en|Overspeed: 146 km/h (limit 140 km/h)",
+	} {
+		if !got[want] {
+			t.Errorf("missing delivery %q in %v", want, got)
+		}
+	}
+}
+
+func TestEscalationAlertEmbedsLocalizedMessage(t *testing.T) {
+	catalog, _ := NewCatalog("en")
+	t0 := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	inc := &Incident{ID: "inc-7"}
+	inc.observe(Alert{TenantID: "t", VehicleID: "v1", Level: "CRITICAL", Message: overspeed.Message, Code: overspeed.Code, Params: overspeed.Params}, t0)
+
+	a := escalationAlert(inc, t0.Add(15*time.Minute), catalog, "de")
+	got := catalog.Localize(a, []string{"de"}).Message
+	want := "Seit 15 Min. unbestätigt (Vorfall inc-7, 1 Alarme): Geschwindigkeitsüberschreitung: 146 km/h (Grenze 140 km/h)"
+	if got != want {
+		t.Fatalf("escalation = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,39 @@
+package notification
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"smartfleet/common/tracing"
+)
+
+var tracer = otel.Tracer("smartfleet/notification-service")
+
+// startAlertSpan starts the consumer span name of handling a. It continues
+// the trace of the analytics publish span whose context a carries, so the
+// Redis hop shows between raising an alert and delivering it. The alert
+// is returned without that context, which is not for clients.
+func startAlertSpan(a Alert, name string) (Alert, trace.Span) {
+	_, span := tracer.Start(tracing.Extract(context.Background(), a.TraceContext), name,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String("redis"),
+			semconv.MessagingOperationTypeDeliver,
+			attribute.String("smartfleet.request_id", a.RequestID),
+			attribute.String("smartfleet.tenant", a.TenantID),
+			attribute.String("smartfleet.vehicle_id", a.VehicleID),
+			attribute.String("smartfleet.alert.code", a.Code),
+		))
+	return withoutTrace(a), span
+}
+
+// withoutTrace returns a without its trace context, for alerts read back
+// from the stream for clients.
+func withoutTrace(a Alert) Alert {
+	a.TraceContext = nil
+	return a
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"smartfleet/common/apikey"
+)
+
+// resource describes CRUD wiring for one level of the fleet hierarchy.
+type resource struct {
+	prefix      string // e.g. "/depots/"
+	parentCol   string // column used for ?<parentParam>= filtering
+	parentParam string
+	newItem     func() tenantOwned
+	newList     func() interface{}
+	setID       func(v interface{}, id uint)
+	validate    func(ctx context.Context, s *Store, v interface{}) error
+	remove      func(s *Store, ctx context.Context, id uint) error
+}
+
+// API serves the registry over HTTP, scoping every request to its tenant.
+type API struct {
+	store *Store
+	auth  *apikey.Auth
+}
+
+// NewAPI constructs an API.
+func NewAPI(store *Store, auth *apikey.Auth) *API {
+	return &API{store: store, auth: auth}
+}
+
+// tenantStore authenticates the request and returns a store scoped to its tenant.
+func (a *API) tenantStore(w http.ResponseWriter, r *http.Request) (*Store, bool) {
+	tenant, err := a.auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return nil, false
+	}
+	return a.store.ForTenant(tenant), true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeStoreError maps store errors to HTTP status codes.
+func writeStoreError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, ErrHasChildren):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+// collection handles GET (list) and POST (create) on /<resource>.
+func (a *API) collection(res resource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := a.tenantStore(w, r)
+		if !ok {
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			var parentID uint64
+			if p := r.URL.Query().Get(res.parentParam); p != "" {
+				n, err := strconv.ParseUint(p, 10, 64)
+				if err != nil {
+					http.Error(w, "invalid "+res.parentParam, http.StatusBadRequest)
+					return
+				}
+				parentID = n
+			}
+			list := res.newList()
+			if err := s.List(r.Context(), list, res.parentCol, uint(parentID)); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, list)
+		case http.MethodPost:
+			item := res.newItem()
+			if err := decodeBody(r, item); err != nil {
+				http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			res.setID(item, 0)
+			if err := res.validate(r.Context(), s, item); err != nil {
+				http.Error(w, "validation error: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.Create(r.Context(), item); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusCreated, item)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// item handles GET, PUT and DELETE on /<resource>/{id}.
+func (a *API) item(res resource) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, ok := a.tenantStore(w, r)
+		if !ok {
+			return
+		}
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, res.prefix), 10, 64)
+		if err != nil || id == 0 {
+			http.Error(w, "invalid id", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			item := res.newItem()
+			if err := s.Get(r.Context(), item, id); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, item)
+		case http.MethodPut:
+			existing := res.newItem()
+			if err := s.Get(r.Context(), existing, id); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			item := res.newItem()
+			if err := decodeBody(r, item); err != nil {
+				http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			res.setID(item, uint(id))
+			if err := res.validate(r.Context(), s, item); err != nil {
+				http.Error(w, "validation error: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.Save(r.Context(), item); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			writeJSON(w, http.StatusOK, item)
+		case http.MethodDelete:
+			if err := res.remove(s, r.Context(), uint(id)); err != nil {
+				writeStoreError(w, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// handleVehicles handles GET (list, ?group_id=) and POST (register) on /vehicles.
+func (a *API) handleVehicles(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.tenantStore(w, r)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		var groupID uint64
+		if p := r.URL.Query().Get("group_id"); p != "" {
+			n, err := strconv.ParseUint(p, 10, 64)
+			if err != nil {
+				http.Error(w, "invalid group_id", http.StatusBadRequest)
+				return
+			}
+			groupID = n
+		}
+		list, err := s.ListVehicles(r.Context(), uint(groupID))
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, list)
+	case http.MethodPost:
+		var v Vehicle
+		if err := decodeBody(r, &v); err != nil {
+			http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.validateVehicle(r.Context(), &v); err != nil {
+			http.Error(w, "validation error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := s.GetVehicle(r.Context(), v.VIN); err == nil {
+			http.Error(w, "vehicle already registered", http.StatusConflict)
+			return
+		}
+		if err := s.Create(r.Context(), &v); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, v)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleVehicle handles GET (lookup with hierarchy), PUT and DELETE on /vehicles/{vin}.
+func (a *API) handleVehicle(w http.ResponseWriter, r *http.Request) {
+	s, ok := a.tenantStore(w, r)
+	if !ok {
+		return
+	}
+	vin := NormalizeVIN(strings.TrimPrefix(r.URL.Path, "/vehicles/"))
+	if vin == "" {
+		http.Error(w, "vin required", http.StatusBadRequest)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		view, err := s.LookupVehicle(r.Context(), vin)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, view)
+	case http.MethodPut:
+		existing, err := s.GetVehicle(r.Context(), vin)
+		if err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		var v Vehicle
+		if err := decodeBody(r, &v); err != nil {
+			http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		v.VIN = vin
+		v.CreatedAt = existing.CreatedAt
+		if err := s.validateVehicle(r.Context(), &v); err != nil {
+			http.Error(w, "validation error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Save(r.Context(), &v); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, v)
+	case http.MethodDelete:
+		if err := s.DeleteVehicle(r.Context(), vin); err != nil {
+			writeStoreError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Store) validateVehicle(ctx context.Context, v *Vehicle) error {
+	if err := v.Validate(); err != nil {
+		return err
+	}
+	if v.GroupID != nil {
+		if err := s.Get(ctx, &VehicleGroup{}, *v.GroupID); err != nil {
+			return errors.New("unknown group_id")
+		}
+	}
+	return nil
+}
+
+// Routes registers all registry endpoints on mux.
+func (a *API) Routes(mux *http.ServeMux) {
+	orgs := resource{
+		prefix:  "/organizations/",
+		newItem: func() tenantOwned { return &Organization{} },
+		newList: func() interface{} { return &[]Organization{} },
+		setID:   func(v interface{}, id uint) { v.(*Organization).ID = id },
+		validate: func(_ context.Context, _ *Store, v interface{}) error {
+			if strings.TrimSpace(v.(*Organization).Name) == "" {
+				return errors.New("name required")
+			}
+			return nil
+		},
+		remove: (*Store).DeleteOrganization,
+	}
+	depots := resource{
+		prefix:      "/depots/",
+		parentCol:   "organization_id",
+		parentParam: "organization_id",
+		newItem:     func() tenantOwned { return &Depot{} },
+		newList:     func() interface{} { return &[]Depot{} },
+		setID:       func(v interface{}, id uint) { v.(*Depot).ID = id },
+		validate: func(ctx context.Context, s *Store, v interface{}) error {
+			d := v.(*Depot)
+			if strings.TrimSpace(d.Name) == "" {
+				return errors.New("name required")
+			}
+			if err := s.Get(ctx, &Organization{}, d.OrganizationID); err != nil {
+				return errors.New("unknown organization_id")
+			}
+			return nil
+		},
+		remove: (*Store).DeleteDepot,
+	}
+	groups := resource{
+		prefix:      "/groups/",
+		parentCol:   "depot_id",
+		parentParam: "depot_id",
+		newItem:     func() tenantOwned { return &VehicleGroup{} },
+		newList:     func() interface{} { return &[]VehicleGroup{} },
+		setID:       func(v interface{}, id uint) { v.(*VehicleGroup).ID = id },
+		validate: func(ctx context.Context, s *Store, v interface{}) error {
+			g := v.(*VehicleGroup)
+			if strings.TrimSpace(g.Name) == "" {
+				return errors.New("name required")
+			}
+			if err := s.Get(ctx, &Depot{}, g.DepotID); err != nil {
+				return errors.New("unknown depot_id")
+			}
+			return nil
+		},
+		remove: (*Store).DeleteGroup,
+	}
+	for _, res := range []resource{orgs, depots, groups} {
+		mux.HandleFunc(strings.TrimSuffix(res.prefix, "/"), a.collection(res))
+		mux.HandleFunc(res.prefix, a.item(res))
+	}
+	mux.HandleFunc("/vehicles", a.handleVehicles)
+	mux.HandleFunc("/vehicles/", a.handleVehicle)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"smartfleet/common/apikey"
+)
+
+// testServer serves the registry with API keys key-a and key-b for
+// tenant-a and tenant-b, and the service token svc.
+func testServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	auth, err := apikey.New("key-a=tenant-a,key-b=tenant-b", "svc", "default", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	NewAPI(testStore(t), auth).Routes(mux)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// call sends body to url with the given request headers (name, value
+// pairs) and returns the status and response body.
+func call(t *testing.T, method, url, body string, header ...string) (int, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(b)
+}
+
+func TestAPIIsolatesTenants(t *testing.T) {
+	srv := testServer(t)
+	const vin = "1HGCM82633A004352"
+	keyA, keyB := []string{"X-API-Key", "key-a"}, []string{"X-API-Key", "key-b"}
+
+	status, body := call(t, "POST", srv.URL+"/organizations", `{"name":"Acme","tenant_id":"tenant-b"}`, keyA...)
+	if status != http.StatusCreated {
+		t.Fatalf("create organization: %d %s", status, body)
+	}
+	var org Organization
+	if err := json.Unmarshal([]byte(body), &org); err != nil {
+		t.Fatal(err)
+	}
+	if org.TenantID != "tenant-a" {
+		t.Fatalf("organization created for %q, want the key's tenant", org.TenantID)
+	}
+	status, body = call(t, "POST", srv.URL+"/vehicles", `{"vin":"`+vin+`","fuel_type":"EV","battery_capacity_kwh":75}`, keyA...)
+	if status != http.StatusCreated {
+		t.Fatalf("register vehicle: %d %s", status, body)
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		want               int
+	}{
+		{"GET", "/vehicles/" + vin, "", http.StatusNotFound},
+		{"PUT", "/vehicles/" + vin, `{"fuel_type":"ICE","tank_capacity_l":50}`, http.StatusNotFound},
+		{"DELETE", "/vehicles/" + vin, "", http.StatusNotFound},
+		{"GET", "/organizations/1", "", http.StatusNotFound},
+		{"PUT", "/organizations/1", `{"name":"Mine"}`, http.StatusNotFound},
+		{"DELETE", "/organizations/1", "", http.StatusNotFound},
+		// a depot cannot hang off another tenant's organization
+		{"POST", "/depots", `{"organization_id":1,"name":"North"}`, http.StatusBadRequest},
+	} {
+		if status, body := call(t, tc.method, srv.URL+tc.path, tc.body, keyB...); status != tc.want {
+			t.Errorf("tenant-b %s %s: %d %s, want %d", tc.method, tc.path, status, body, tc.want)
+		}
+	}
+	for _, path := range []string{"/vehicles", "/organizations"} {
+		if status, body := call(t, "GET", srv.URL+path, "", keyB...); status != http.StatusOK || strings.TrimSpace(body) != "[]" {
+			t.Errorf("tenant-b GET %s: %d %s, want an empty list", path, status, body)
+		}
+	}
+
+	// X-Tenant-ID does not widen an API key's tenant
+	if status, _ := call(t, "GET", srv.URL+"/vehicles/"+vin, "", "X-API-Key", "key-b", "X-Tenant-ID", "tenant-a"); status != http.StatusNotFound {
+		t.Errorf("tenant-b key with X-Tenant-ID tenant-a: %d, want 404", status)
+	}
+	// the service token acts for the tenant it names
+	status, body = call(t, "GET", srv.URL+"/vehicles/"+vin, "", "Authorization", "Bearer svc", "X-Tenant-ID", "tenant-a")
+	if status != http.StatusOK || !strings.Contains(body, `"tenant_id":"tenant-a"`) {
+		t.Errorf("service token for tenant-a: %d %s", status, body)
+	}
+	if status, _ := call(t, "GET", srv.URL+"/vehicles/"+vin, "", "Authorization", "Bearer svc", "X-Tenant-ID", "tenant-b"); status != http.StatusNotFound {
+		t.Errorf("service token for tenant-b: %d, want 404", status)
+	}
+	// and tenant-a still sees its vehicle
+	if status, body := call(t, "GET", srv.URL+"/vehicles/"+vin, "", keyA...); status != http.StatusOK {
+		t.Errorf("tenant-a GET its vehicle: %d %s", status, body)
+	}
+}
+
+func TestAPIRequiresCredentials(t *testing.T) {
+	srv := testServer(t)
+	for _, header := range [][]string{
+		nil,
+		{"X-API-Key", "nope"},
+		{"X-Tenant-ID", "tenant-a"},
+		{"Authorization", "Bearer svc"}, // service token without a tenant
+	} {
+		if status, _ := call(t, "GET", srv.URL+"/vehicles", "", header...); status != http.StatusUnauthorized {
+			t.Errorf("GET /vehicles with %v: %d, want 401", header, status)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"smartfleet/common/apikey"
+	"smartfleet/common/config"
+	"smartfleet/common/logging"
+	commonpostgres "smartfleet/common/postgres"
+)
+
+// Config is the service configuration, from the environment, an optional
+// YAML file (-config) and flags; -print-config shows it.
+type Config struct {
+	HTTPAddr string          `yaml:"http_addr" env:"HTTP_ADDR" default:":8085"`
+	Log      config.Log      `yaml:"log"`
+	Postgres config.Postgres `yaml:"postgres"`
+
+	// tenant authentication: "key1=tenantA,key2=tenantB" plus a service token for internal callers
+	APIKeys       string `yaml:"api_keys" env:"REGISTRY_API_KEYS" secret:"true"`
+	ServiceToken  string `yaml:"service_token" env:"REGISTRY_SERVICE_TOKEN" secret:"true"`
+	DefaultTenant string `yaml:"default_tenant" env:"DEFAULT_TENANT" default:"default"`
+	AuthDevMode   bool   `yaml:"auth_dev_mode" env:"AUTH_DEV_MODE" help:"without API keys, trust X-Tenant-ID; never in production"`
+}
+
+func main() {
+	var cfg Config
+	config.MustLoad("registry-service", &cfg)
+	logs, err := logging.New("registry-service", cfg.Log, nil)
+	if err != nil {
+		log.Fatalf("[registry] %v", err)
+	}
+	defer logs.Sync()
+	logger := logs.Std("main")
+
+	// wait for postgres until it answers or the process is signalled
+	startCtx, started := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	db, err := commonpostgres.NewPostgres(startCtx, cfg.Postgres, logs.Std("postgres"))
+	started()
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	if err := MigrateSchemas(db); err != nil {
+		logger.Fatalf("migrate schemas: %v", err)
+	}
+
+	store := NewStore(db, logs.Std("store"))
+	auth, err := apikey.New(cfg.APIKeys, cfg.ServiceToken, cfg.DefaultTenant, cfg.AuthDevMode)
+	if err != nil {
+		logger.Fatalf("REGISTRY_API_KEYS: %v", err)
+	}
+	switch {
+	case auth.DevMode():
+		logger.Println("AUTH_DEV_MODE: X-Tenant-ID is trusted as-is")
+	case !auth.Enabled():
+		logger.Println("no REGISTRY_API_KEYS or REGISTRY_SERVICE_TOKEN set: every request is rejected")
+	}
+
+	mux := http.NewServeMux()
+	NewAPI(store, auth).Routes(mux)
+	mux.Handle("/admin/log-levels", logs.Handler())
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+		defer cancel()
+		s := map[string]interface{}{"status": "ok", "postgres": false}
+		if err := commonpostgres.Ping(ctx, db); err == nil {
+			s["postgres"] = true
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s)
+	})
+
+	server := &http.Server{Addr: cfg.HTTPAddr, Handler: mux}
+
+	idleConnsClosed := make(chan struct{})
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		<-sigCh
+		logger.Println("shutdown signal received: shutting down HTTP server...")
+		ctxShut, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+		defer cancel()
+		if err := server.Shutdown(ctxShut); err != nil {
+			logger.Printf("HTTP server Shutdown: %v", err)
+		}
+		if err := commonpostgres.Close(db); err != nil {
+			logger.Printf("postgres close: %v", err)
+		}
+		close(idleConnsClosed)
+	}()
+
+	logger.Printf("starting HTTP server on %s\n", cfg.HTTPAddr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Fatalf("ListenAndServe(): %v", err)
+	}
+	<-idleConnsClosed
+	logger.Println("service stopped")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Fuel types supported by the registry.
+const (
+	FuelICE    = "ICE"
+	FuelEV     = "EV"
+	FuelHybrid = "HYBRID"
+)
+
+// Organization is the top of the fleet hierarchy (a fleet customer).
+type Organization struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TenantID  string    `gorm:"size:64;not null;uniqueIndex:idx_org_tenant_name,priority:1" json:"tenant_id"`
+	Name      string    `gorm:"not null;uniqueIndex:idx_org_tenant_name,priority:2" json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Depot is a physical site belonging to an organization.
+type Depot struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	TenantID       string    `gorm:"size:64;not null;index" json:"tenant_id"`
+	OrganizationID uint      `gorm:"index;not null" json:"organization_id"`
+	Name           string    `gorm:"not null" json:"name"`
+	Latitude       float64   `json:"latitude"`
+	Longitude      float64   `json:"longitude"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// VehicleGroup is an operational grouping of vehicles inside a depot.
+type VehicleGroup struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TenantID  string    `gorm:"size:64;not null;index" json:"tenant_id"`
+	DepotID   uint      `gorm:"index;not null" json:"depot_id"`
+	Name      string    `gorm:"not null" json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Vehicle is a registered vehicle keyed by (tenant, VIN).
+type Vehicle struct {
+	TenantID           string    `gorm:"primaryKey;size:64" json:"tenant_id"`
+	VIN                string    `gorm:"primaryKey;size:17" json:"vin"`
+	Model              string    `json:"model"`
+	Year               int       `json:"year"`
+	FuelType           string    `gorm:"size:8;not null" json:"fuel_type"`
+	TankCapacityL      float64   `json:"tank_capacity_l,omitempty"`
+	BatteryCapacityKWh float64   `json:"battery_capacity_kwh,omitempty"`
+	GroupID            *uint     `gorm:"index" json:"group_id,omitempty"`
+	CreatedAt          time.Time `json:"created_at"`
+	UpdatedAt          time.Time `json:"updated_at"`
+}
+
+// VehicleView is a vehicle with its resolved hierarchy, served to lookups.
+type VehicleView struct {
+	Vehicle
+	DepotID        *uint `json:"depot_id,omitempty"`
+	OrganizationID *uint `json:"organization_id,omitempty"`
+}
+
+// tenantOwned is implemented by every registry model.
+type tenantOwned interface {
+	setTenant(tenant string)
+}
+
+func (o *Organization) setTenant(t string) { o.TenantID = t }
+func (d *Depot) setTenant(t string)        { d.TenantID = t }
+func (g *VehicleGroup) setTenant(t string) { g.TenantID = t }
+func (v *Vehicle) setTenant(t string)      { v.TenantID = t }
+
+// Validate checks vehicle fields before persisting.
+func (v *Vehicle) Validate() error {
+	v.VIN = NormalizeVIN(v.VIN)
+	if err := ValidateVIN(v.VIN); err != nil {
+		return err
+	}
+	if v.Year != 0 && (v.Year < 1981 || v.Year > time.Now().Year()+1) {
+		return fmt.Errorf("year out of range: %d", v.Year)
+	}
+	switch v.FuelType {
+	case FuelICE:
+		if v.TankCapacityL <= 0 {
+			return errors.New("tank_capacity_l required for ICE vehicles")
+		}
+	case FuelEV:
+		if v.BatteryCapacityKWh <= 0 {
+			return errors.New("battery_capacity_kwh required for EV vehicles")
+		}
+	case FuelHybrid:
+		if v.TankCapacityL <= 0 || v.BatteryCapacityKWh <= 0 {
+			return errors.New("tank_capacity_l and battery_capacity_kwh required for HYBRID vehicles")
+		}
+	default:
+		return fmt.Errorf("fuel_type must be one of %s, %s, %s", FuelICE, FuelEV, FuelHybrid)
+	}
+	return nil
+}
+
+// MigrateSchemas runs AutoMigrate
+func MigrateSchemas(db *gorm.DB) error {
+	return db.AutoMigrate(&Organization{}, &Depot{}, &VehicleGroup{}, &Vehicle{})
+}
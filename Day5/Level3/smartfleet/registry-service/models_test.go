@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVehicleValidate(t *testing.T) {
+	const vin = "1HGCM82633A004352"
+	for _, tc := range []struct {
+		name string
+		v    Vehicle
+		err  string // substring; empty when valid
+	}{
+		{"ICE", Vehicle{VIN: vin, FuelType: FuelICE, TankCapacityL: 60}, ""},
+		{"ICE without tank", Vehicle{VIN: vin, FuelType: FuelICE, BatteryCapacityKWh: 60}, "tank_capacity_l required"},
+		{"EV", Vehicle{VIN: vin, FuelType: FuelEV, BatteryCapacityKWh: 75}, ""},
+		{"EV without battery", Vehicle{VIN: vin, FuelType: FuelEV, TankCapacityL: 60}, "battery_capacity_kwh required"},
+		{"hybrid", Vehicle{VIN: vin, FuelType: FuelHybrid, TankCapacityL: 40, BatteryCapacityKWh: 10}, ""},
+		{"hybrid without battery", Vehicle{VIN: vin, FuelType: FuelHybrid, TankCapacityL: 40}, "HYBRID"},
+		{"hybrid without tank", Vehicle{VIN: vin, FuelType: FuelHybrid, BatteryCapacityKWh: 10}, "HYBRID"},
+		{"unknown fuel", Vehicle{VIN: vin, FuelType: "DIESEL", TankCapacityL: 60}, "fuel_type must be one of"},
+		{"no fuel", Vehicle{VIN: vin, TankCapacityL: 60}, "fuel_type must be one of"},
+		{"negative tank", Vehicle{VIN: vin, FuelType: FuelICE, TankCapacityL: -1}, "tank_capacity_l required"},
+		{"normalized VIN", Vehicle{VIN: " 1hgcm82633a004352 ", FuelType: FuelICE, TankCapacityL: 60}, ""},
+		{"bad VIN", Vehicle{VIN: "1HGCM82643A004352", FuelType: FuelICE, TankCapacityL: 60}, "check digit"},
+		{"year too old", Vehicle{VIN: vin, Year: 1980, FuelType: FuelICE, TankCapacityL: 60}, "year out of range"},
+		{"next model year", Vehicle{VIN: vin, Year: time.Now().Year() + 1, FuelType: FuelICE, TankCapacityL: 60}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.v.Validate()
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("Validate() = %v", err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("Validate() = %v, want %q", err, tc.err)
+			}
+			if tc.err == "" && tc.v.VIN != vin {
+				t.Errorf("VIN = %q, want %q", tc.v.VIN, vin)
+			}
+		})
+	}
+}
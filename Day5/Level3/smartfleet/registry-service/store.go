@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"gorm.io/gorm"
+)
+
+// ErrNotFound is returned when a registry record does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrHasChildren is returned when deleting a node that still owns records.
+var ErrHasChildren = errors.New("record still has children")
+
+// ErrNoTenant is returned when an unscoped Store is used for data access.
+var ErrNoTenant = errors.New("store not scoped to a tenant")
+
+// Store is the DB wrapper. Data access requires a tenant-scoped copy from ForTenant.
+type Store struct {
+	db     *gorm.DB
+	logger *log.Logger
+	tenant string
+}
+
+// NewStore constructs a Store.
+func NewStore(db *gorm.DB, logger *log.Logger) *Store {
+	return &Store{db: db, logger: logger}
+}
+
+// ForTenant returns a Store whose queries only see the given tenant's rows.
+func (s *Store) ForTenant(tenant string) *Store {
+	return &Store{db: s.db, logger: s.logger, tenant: tenant}
+}
+
+// scoped returns a query builder filtered to the store's tenant.
+func (s *Store) scoped(ctx context.Context) (*gorm.DB, error) {
+	if s.tenant == "" {
+		return nil, ErrNoTenant
+	}
+	return s.db.WithContext(ctx).Where("tenant_id = ?", s.tenant), nil
+}
+
+// Create inserts any registry model owned by the store's tenant.
+func (s *Store) Create(ctx context.Context, v tenantOwned) error {
+	if s.tenant == "" {
+		return ErrNoTenant
+	}
+	v.setTenant(s.tenant)
+	return s.db.WithContext(ctx).Create(v).Error
+}
+
+// Save updates (or inserts) any registry model by primary key, keeping created_at.
+// Callers must have loaded the existing row through this store first.
+func (s *Store) Save(ctx context.Context, v tenantOwned) error {
+	if s.tenant == "" {
+		return ErrNoTenant
+	}
+	v.setTenant(s.tenant)
+	return s.db.WithContext(ctx).Omit("created_at").Save(v).Error
+}
+
+// Get loads a registry model by primary key into out.
+func (s *Store) Get(ctx context.Context, out interface{}, id interface{}) error {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return err
+	}
+	err = q.First(out, "id = ?", id).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// List loads registry models into out, optionally filtered by a parent column.
+func (s *Store) List(ctx context.Context, out interface{}, parentCol string, parentID uint) error {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return err
+	}
+	q = q.Order("id")
+	if parentCol != "" && parentID != 0 {
+		q = q.Where(parentCol+" = ?", parentID)
+	}
+	return q.Find(out).Error
+}
+
+// DeleteOrganization removes an organization without depots.
+func (s *Store) DeleteOrganization(ctx context.Context, id uint) error {
+	return s.deleteNode(ctx, &Organization{}, id, &Depot{}, "organization_id")
+}
+
+// DeleteDepot removes a depot without groups.
+func (s *Store) DeleteDepot(ctx context.Context, id uint) error {
+	return s.deleteNode(ctx, &Depot{}, id, &VehicleGroup{}, "depot_id")
+}
+
+// DeleteGroup removes a group without vehicles.
+func (s *Store) DeleteGroup(ctx context.Context, id uint) error {
+	return s.deleteNode(ctx, &VehicleGroup{}, id, &Vehicle{}, "group_id")
+}
+
+func (s *Store) deleteNode(ctx context.Context, model interface{}, id uint, child interface{}, childCol string) error {
+	if s.tenant == "" {
+		return ErrNoTenant
+	}
+	return s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var n int64
+		if err := tx.Model(child).Where("tenant_id = ? AND "+childCol+" = ?", s.tenant, id).Count(&n).Error; err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrHasChildren
+		}
+		res := tx.Where("tenant_id = ?", s.tenant).Delete(model, id)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return nil
+	})
+}
+
+// GetVehicle loads a vehicle by VIN.
+func (s *Store) GetVehicle(ctx context.Context, vin string) (*Vehicle, error) {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var v Vehicle
+	err = q.First(&v, "vin = ?", vin).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// ListVehicles returns vehicles, optionally restricted to one group.
+func (s *Store) ListVehicles(ctx context.Context, groupID uint) ([]Vehicle, error) {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []Vehicle
+	q = q.Order("vin")
+	if groupID != 0 {
+		q = q.Where("group_id = ?", groupID)
+	}
+	if err := q.Find(&out).Error; err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteVehicle removes a vehicle by VIN.
+func (s *Store) DeleteVehicle(ctx context.Context, vin string) error {
+	q, err := s.scoped(ctx)
+	if err != nil {
+		return err
+	}
+	res := q.Delete(&Vehicle{}, "vin = ?", vin)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// LookupVehicle returns a vehicle with depot and organization resolved.
+func (s *Store) LookupVehicle(ctx context.Context, vin string) (*VehicleView, error) {
+	v, err := s.GetVehicle(ctx, vin)
+	if err != nil {
+		return nil, err
+	}
+	view := &VehicleView{Vehicle: *v}
+	if v.GroupID == nil {
+		return view, nil
+	}
+	var g VehicleGroup
+	if err := s.Get(ctx, &g, *v.GroupID); err != nil {
+		return nil, err
+	}
+	var d Depot
+	if err := s.Get(ctx, &d, g.DepotID); err != nil {
+		return nil, err
+	}
+	view.DepotID = &d.ID
+	view.OrganizationID = &d.OrganizationID
+	return view, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// testStore returns an unscoped Store on a fresh in-memory database.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB.SetMaxOpenConns(1) // each connection would get its own database
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := MigrateSchemas(db); err != nil {
+		t.Fatal(err)
+	}
+	return NewStore(db, log.New(io.Discard, "", 0))
+}
+
+// seedHierarchy creates an organization, depot, group and vehicle for s's
+// tenant and returns them.
+func seedHierarchy(t *testing.T, s *Store, vin string) (*Organization, *Depot, *VehicleGroup, *Vehicle) {
+	t.Helper()
+	ctx := context.Background()
+	org := &Organization{Name: "Acme"}
+	if err := s.Create(ctx, org); err != nil {
+		t.Fatal(err)
+	}
+	depot := &Depot{OrganizationID: org.ID, Name: "North"}
+	if err := s.Create(ctx, depot); err != nil {
+		t.Fatal(err)
+	}
+	group := &VehicleGroup{DepotID: depot.ID, Name: "Vans"}
+	if err := s.Create(ctx, group); err != nil {
+		t.Fatal(err)
+	}
+	v := &Vehicle{VIN: vin, FuelType: FuelICE, TankCapacityL: 60, GroupID: &group.ID}
+	if err := s.Create(ctx, v); err != nil {
+		t.Fatal(err)
+	}
+	return org, depot, group, v
+}
+
+func TestStoreIsolatesTenants(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	a, b := store.ForTenant("tenant-a"), store.ForTenant("tenant-b")
+	const vin = "1HGCM82633A004352"
+	org, depot, group, _ := seedHierarchy(t, a, vin)
+
+	if _, err := b.GetVehicle(ctx, vin); !errors.Is(err, ErrNotFound) {
+		t.Errorf("GetVehicle of another tenant: err = %v, want ErrNotFound", err)
+	}
+	if _, err := b.LookupVehicle(ctx, vin); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LookupVehicle of another tenant: err = %v, want ErrNotFound", err)
+	}
+	if err := b.Get(ctx, &Organization{}, org.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get organization of another tenant: err = %v, want ErrNotFound", err)
+	}
+	if list, err := b.ListVehicles(ctx, 0); err != nil || len(list) != 0 {
+		t.Errorf("ListVehicles of tenant-b = %v, %v; want none", list, err)
+	}
+	var depots []Depot
+	if err := b.List(ctx, &depots, "organization_id", org.ID); err != nil || len(depots) != 0 {
+		t.Errorf("List depots of tenant-b = %v, %v; want none", depots, err)
+	}
+
+	// deletes through another tenant find nothing, even for childless nodes
+	if err := b.DeleteVehicle(ctx, vin); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteVehicle of another tenant: err = %v, want ErrNotFound", err)
+	}
+	if err := a.DeleteVehicle(ctx, vin); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.DeleteGroup(ctx, group.ID); !errors.Is(err, ErrNotFound) {
+		t.Errorf("DeleteGroup of another tenant: err = %v, want ErrNotFound", err)
+	}
+	if err := a.Get(ctx, &VehicleGroup{}, group.ID); err != nil {
+		t.Errorf("group gone after another tenant's delete: %v", err)
+	}
+	if err := a.DeleteDepot(ctx, depot.ID); !errors.Is(err, ErrHasChildren) {
+		t.Errorf("DeleteDepot with a group: err = %v, want ErrHasChildren", err)
+	}
+}
+
+func TestStoreSameVINInTwoTenants(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	a, b := store.ForTenant("tenant-a"), store.ForTenant("tenant-b")
+	const vin = "1HGCM82633A004352"
+	seedHierarchy(t, a, vin)
+	_, _, groupB, _ := seedHierarchy(t, b, vin)
+
+	view, err := b.LookupVehicle(ctx, vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if view.TenantID != "tenant-b" || view.GroupID == nil || *view.GroupID != groupB.ID {
+		t.Fatalf("tenant-b lookup = %+v, want its own vehicle in group %d", view, groupB.ID)
+	}
+
+	// a write stamped with another tenant is saved as the store's tenant
+	v := &Vehicle{TenantID: "tenant-a", VIN: vin, FuelType: FuelEV, BatteryCapacityKWh: 80}
+	if err := b.Save(ctx, v); err != nil {
+		t.Fatal(err)
+	}
+	got, err := a.GetVehicle(ctx, vin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FuelType != FuelICE {
+		t.Fatalf("tenant-b's save changed tenant-a's vehicle: %+v", got)
+	}
+}
+
+func TestStoreRequiresTenant(t *testing.T) {
+	store := testStore(t)
+	ctx := context.Background()
+	if _, err := store.GetVehicle(ctx, "1HGCM82633A004352"); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("unscoped read: err = %v, want ErrNoTenant", err)
+	}
+	if err := store.Create(ctx, &Organization{Name: "Acme"}); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("unscoped write: err = %v, want ErrNoTenant", err)
+	}
+	if err := store.DeleteOrganization(ctx, 1); !errors.Is(err, ErrNoTenant) {
+		t.Errorf("unscoped delete: err = %v, want ErrNoTenant", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// VIN validation follows ISO 3779 / 49 CFR 565: 17 characters, no I/O/Q,
+// and a check digit in position 9 computed from weighted transliterated values.
+
+var vinWeights = [17]int{8, 7, 6, 5, 4, 3, 2, 10, 0, 9, 8, 7, 6, 5, 4, 3, 2}
+
+// vinValue transliterates one VIN character to its numeric value.
+func vinValue(c byte) (int, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return int(c - '0'), true
+	case c >= 'A' && c <= 'H':
+		return int(c-'A') + 1, true
+	case c >= 'J' && c <= 'N':
+		return int(c-'J') + 1, true
+	case c == 'P':
+		return 7, true
+	case c == 'R':
+		return 9, true
+	case c >= 'S' && c <= 'Z':
+		return int(c-'S') + 2, true
+	}
+	return 0, false
+}
+
+// NormalizeVIN upper-cases and trims a VIN.
+func NormalizeVIN(vin string) string {
+	return strings.ToUpper(strings.TrimSpace(vin))
+}
+
+// VINCheckDigit computes the expected check digit ('0'-'9' or 'X').
+func VINCheckDigit(vin string) (byte, error) {
+	if len(vin) != 17 {
+		return 0, fmt.Errorf("vin must be 17 characters, got %d", len(vin))
+	}
+	sum := 0
+	for i := 0; i < 17; i++ {
+		v, ok := vinValue(vin[i])
+		if !ok {
+			return 0, fmt.Errorf("invalid vin character %q at position %d", vin[i], i+1)
+		}
+		sum += v * vinWeights[i]
+	}
+	r := sum % 11
+	if r == 10 {
+		return 'X', nil
+	}
+	return byte('0' + r), nil
+}
+
+// ValidateVIN checks length, alphabet and check digit of a normalized VIN.
+func ValidateVIN(vin string) error {
+	if vin == "" {
+		return errors.New("vin required")
+	}
+	want, err := VINCheckDigit(vin)
+	if err != nil {
+		return err
+	}
+	if vin[8] != want {
+		return fmt.Errorf("vin check digit mismatch: got %q want %q", vin[8], want)
+	}
+	return nil
+}
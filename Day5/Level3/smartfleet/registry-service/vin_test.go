@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVINCheckDigit(t *testing.T) {
+	for _, tc := range []struct {
+		vin  string
+		want byte
+	}{
+		{"1HGCM82633A004352", '3'},
+		{"1M8GDM9AXKP042788", 'X'},
+		{"11111111111111111", '1'},
+	} {
+		got, err := VINCheckDigit(tc.vin)
+		if err != nil {
+			t.Errorf("%s: %v", tc.vin, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s: check digit %q, want %q", tc.vin, got, tc.want)
+		}
+	}
+}
+
+func TestValidateVIN(t *testing.T) {
+	for _, tc := range []struct {
+		name, vin string
+		err       string // substring; empty when valid
+	}{
+		{"valid", "1HGCM82633A004352", ""},
+		{"X check digit", "1M8GDM9AXKP042788", ""},
+		{"empty", "", "required"},
+		{"short", "1HGCM82633A00435", "17 characters"},
+		{"long", "1HGCM82633A0043521", "17 characters"},
+		{"letter I", "1HGCM82633I004352", "invalid vin character 'I'"},
+		{"letter O", "1HGCM82633O004352", "invalid vin character 'O'"},
+		{"letter Q", "1HGCM82633Q004352", "invalid vin character 'Q'"},
+		{"lower case", "1hgcm82633a004352", "invalid vin character"},
+		{"wrong check digit", "1HGCM82643A004352", "check digit mismatch"},
+		{"digit where X is due", "1M8GDM9A0KP042788", "check digit mismatch"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := ValidateVIN(tc.vin)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatalf("ValidateVIN(%q) = %v", tc.vin, err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("ValidateVIN(%q) = %v, want %q", tc.vin, err, tc.err)
+			}
+		})
+	}
+}
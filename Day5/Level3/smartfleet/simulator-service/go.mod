@@ -0,0 +1,19 @@
+module smartfleet/simulator-service
+
+go 1.25.0
+
+require (
+	github.com/google/uuid v1.6.0
+	github.com/segmentio/kafka-go v0.4.51
+	go.uber.org/zap v1.27.0
+	gopkg.in/yaml.v3 v3.0.1
+	smartfleet/common v0.0.0
+)
+
+require (
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+)
+
+replace smartfleet/common => ../common
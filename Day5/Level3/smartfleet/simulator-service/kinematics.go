@@ -0,0 +1,308 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Vehicles move with limited acceleration along the legs their Planner
+// hands out, brake for the stops ahead, burn fuel in proportion to the
+// distance driven, pull in to refuel when the tank runs low and have an
+// engine that warms up while running and cools down when switched off.
+// All randomness comes from the vehicle's own source, so a seed reproduces
+// a run exactly.
+
+const defaultSpeedLimitKmph = 50
+
+// physicsStep is the integration step; Advance splits longer intervals.
+const physicsStep = 250 * time.Millisecond
+
+// Physics are the parameters shared by all vehicles.
+type Physics struct {
+	MaxAccel          float64       // m/s²
+	MaxDecel          float64       // m/s², comfortable braking
+	StopProbability   float64       // chance of stopping at an intersection
+	StopMin, StopMax  time.Duration // time stopped at an intersection
+	TankLitres        float64
+	LitresPer100Km    float64 // at steady speed; accelerating burns more
+	IdleLitresPerHour float64
+	RefuelBelowPct    float64       // head for a refuel stop below this
+	RefuelMin         time.Duration // time spent at the pump
+	RefuelMax         time.Duration
+	AmbientC          float64
+	OperatingC        float64       // coolant temperature of a warm engine
+	WarmUp, CoolDown  time.Duration // time constants of the engine temperature
+}
+
+// DefaultPhysics is a mid-size car in city traffic.
+func DefaultPhysics() Physics {
+	return Physics{
+		MaxAccel:          2.5,
+		MaxDecel:          3.0,
+		StopProbability:   0.4,
+		StopMin:           5 * time.Second,
+		StopMax:           45 * time.Second,
+		TankLitres:        45,
+		LitresPer100Km:    7.5,
+		IdleLitresPerHour: 0.8,
+		RefuelBelowPct:    15,
+		RefuelMin:         3 * time.Minute,
+		RefuelMax:         6 * time.Minute,
+		AmbientC:          28,
+		OperatingC:        90,
+		WarmUp:            3 * time.Minute,
+		CoolDown:          15 * time.Minute,
+	}
+}
+
+type vehicleState int
+
+const (
+	driving   vehicleState = iota
+	stopped                // at an intersection, engine idling
+	refueling              // engine off
+)
+
+// Vehicle is one simulated vehicle.
+type Vehicle struct {
+	ID string
+
+	rng     *rand.Rand
+	planner Planner
+	phys    Physics
+
+	leg, next *Leg
+	s         float64 // metres along leg
+	speed     float64 // m/s
+	accel     float64 // m/s², last step
+	stopAtEnd bool    // at the end of leg
+	nextStop  bool    // at the end of next
+	refuelDue bool    // the next stop is at a pump
+	state     vehicleState
+	wait      float64 // seconds until moving on
+	driver    float64 // fraction of the speed limit this driver keeps to
+
+	fuelPct  float64
+	engineC  float64
+	odometer float64 // metres
+
+	// scripted faults, see scenario.go
+	override  float64 // m/s; drive at this speed regardless of limits and stops
+	after     *Leg    // leg to resume with once a diversion is over
+	afterStop bool
+	dwell     float64 // seconds to wait at the end of a diversion
+}
+
+// NewVehicle places a vehicle at the start of its planner's first leg.
+func NewVehicle(seed int64, planner Planner, phys Physics) *Vehicle {
+	rng := rand.New(rand.NewSource(seed))
+	id, _ := uuid.NewRandomFromReader(rng)
+	v := &Vehicle{
+		ID:      id.String(),
+		rng:     rng,
+		planner: planner,
+		phys:    phys,
+		driver:  0.85 + 0.2*rng.Float64(),
+		fuelPct: 40 + 60*rng.Float64(),
+		engineC: phys.AmbientC + 5*rng.Float64(),
+	}
+	v.leg = planner.Start(rng)
+	v.stopAtEnd = v.planStop()
+	v.next = planner.Next(v.leg, rng)
+	v.nextStop = v.planStop()
+	return v
+}
+
+// planStop decides whether the vehicle stops at the end of a leg. Stops
+// are planned a leg ahead so there is room to brake for them.
+func (v *Vehicle) planStop() bool {
+	return v.refuelDue || v.rng.Float64() < v.phys.StopProbability
+}
+
+// Advance moves the simulation on by d.
+func (v *Vehicle) Advance(d time.Duration) {
+	for d > 0 {
+		h := physicsStep
+		if d < h {
+			h = d
+		}
+		v.step(h.Seconds())
+		d -= h
+	}
+}
+
+func (v *Vehicle) step(h float64) {
+	switch v.state {
+	case stopped:
+		v.accel = 0
+		v.burn(0, h)
+		v.wait -= h
+		if v.wait <= 0 {
+			v.nextLeg(0)
+		}
+	case refueling:
+		v.accel = 0
+		target := 100.0
+		if v.wait > h {
+			v.fuelPct += (target - v.fuelPct) * h / v.wait
+		} else {
+			v.fuelPct = target
+			v.refuelDue = false
+			v.nextLeg(0)
+		}
+		v.wait -= h
+	default:
+		v.drive(h)
+	}
+	v.heat(h)
+}
+
+func (v *Vehicle) drive(h float64) {
+	remaining := v.leg.Length() - v.s
+	if !v.refuelDue && v.fuelPct < v.phys.RefuelBelowPct {
+		// pull in at the end of this leg if there is room to brake
+		v.refuelDue = true
+		if v.speed*v.speed <= 2*v.phys.MaxDecel*remaining {
+			v.stopAtEnd = true
+		} else {
+			v.nextStop = true
+		}
+	}
+	// fastest speed from which the end of the leg can be reached at the
+	// speed wanted there: zero for a stop, else the next leg's cruising
+	// speed, or less if the next leg is too short to brake for its stop
+	// Braking is planned one step ahead with some in reserve.
+	brake := 0.8 * v.phys.MaxDecel
+	cruise := v.leg.limitMS * v.driver
+	if v.override > 0 && v.dwell == 0 {
+		cruise, v.stopAtEnd, v.nextStop = v.override, false, false
+	}
+	vEnd := 0.0
+	if !v.stopAtEnd {
+		vEnd = v.next.limitMS * v.driver
+		if v.override > 0 {
+			vEnd = v.override
+		}
+		if v.nextStop {
+			vEnd = math.Min(vEnd, math.Sqrt(2*brake*v.next.Length()))
+		}
+	}
+	target := math.Min(cruise, math.Sqrt(vEnd*vEnd+2*brake*math.Max(0, remaining-v.speed*h)))
+	a := (target - v.speed) / h
+	a = math.Max(-v.phys.MaxDecel, math.Min(v.phys.MaxAccel, a))
+	v.speed = math.Max(0, v.speed+a*h)
+	v.accel = a
+	ds := v.speed * h
+	if v.stopAtEnd && (ds >= remaining || (remaining < 1 && v.speed < 0.5)) {
+		ds = remaining // arrived
+	}
+	v.s += ds
+	v.odometer += ds
+	v.burn(ds, h)
+	if v.s < v.leg.Length() {
+		return
+	}
+	if !v.stopAtEnd {
+		v.nextLeg(v.s - v.leg.Length())
+		return
+	}
+	v.s, v.speed, v.accel = v.leg.Length(), 0, 0
+	switch {
+	case v.dwell > 0:
+		v.state, v.wait, v.dwell = stopped, v.dwell, 0
+	case v.refuelDue:
+		v.state = refueling
+		v.wait = v.between(v.phys.RefuelMin, v.phys.RefuelMax)
+	default:
+		v.state = stopped
+		v.wait = v.between(v.phys.StopMin, v.phys.StopMax)
+	}
+}
+
+// nextLeg moves on to the next leg, s metres in.
+func (v *Vehicle) nextLeg(s float64) {
+	v.leg, v.stopAtEnd = v.next, v.nextStop
+	if v.after != nil {
+		v.next, v.nextStop, v.after = v.after, v.afterStop, nil
+	} else {
+		v.next = v.planner.Next(v.leg, v.rng)
+		v.nextStop = v.planStop()
+	}
+	v.s = math.Min(s, v.leg.Length())
+	v.state = driving
+}
+
+func (v *Vehicle) between(lo, hi time.Duration) float64 {
+	return (lo + time.Duration(v.rng.Int63n(int64(hi-lo)+1))).Seconds()
+}
+
+// burn uses fuel for ds metres driven in h seconds. Accelerating costs up
+// to half as much again; standing still with the engine on costs the idle
+// rate.
+func (v *Vehicle) burn(ds, h float64) {
+	litres := v.phys.IdleLitresPerHour * h / 3600
+	if ds > 0 {
+		litres = ds / 1000 * v.phys.LitresPer100Km / 100 * (1 + 0.5*math.Max(0, v.accel)/v.phys.MaxAccel)
+	}
+	v.fuelPct = math.Max(0, v.fuelPct-litres/v.phys.TankLitres*100)
+}
+
+// heat moves the engine temperature towards its target: the operating
+// temperature plus up to 15 °C under load while running, ambient when off.
+func (v *Vehicle) heat(h float64) {
+	target, tau := v.phys.AmbientC, v.phys.CoolDown.Seconds()
+	if v.state != refueling {
+		load := 0.6*math.Min(1, v.speed/33) + 0.4*math.Max(0, math.Min(1, v.accel/v.phys.MaxAccel))
+		target, tau = v.phys.OperatingC+15*load, v.phys.WarmUp.Seconds()
+	}
+	v.engineC += (target - v.engineC) * (1 - math.Exp(-h/tau))
+}
+
+// Overspeed makes the driver ignore speed limits and stops and keep to
+// kmph instead; zero ends it.
+func (v *Vehicle) Overspeed(kmph float64) {
+	v.override = kmph / 3.6
+	if kmph > 0 && v.state == stopped {
+		v.wait = 0
+	}
+}
+
+// Divert interrupts the current leg: the vehicle drives straight to, waits
+// there for dwell and comes back to where it left its route.
+func (v *Vehicle) Divert(to LatLon, dwell time.Duration) {
+	here, limit := v.Position(), v.leg.limitMS*3.6
+	if v.after == nil {
+		v.after, v.afterStop = v.next, v.nextStop
+	}
+	back := newLeg(append([]LatLon{to}, v.leg.rest(v.s)...), limit)
+	back.node = v.leg.node
+	v.next, v.nextStop = back, v.stopAtEnd
+	v.leg, v.s, v.stopAtEnd = newLeg([]LatLon{here, to}, limit), 0, true
+	v.dwell = math.Max(dwell.Seconds(), 1)
+	v.state = driving
+}
+
+// Drain takes pct of a full tank out without driving.
+func (v *Vehicle) Drain(pct float64) {
+	v.fuelPct = math.Max(0, v.fuelPct-pct)
+}
+
+// Position is where the vehicle is now.
+func (v *Vehicle) Position() LatLon { return v.leg.At(v.s) }
+
+// Telemetry reports the vehicle's current state.
+func (v *Vehicle) Telemetry(now time.Time) VehicleTelemetry {
+	p, temp := v.Position(), v.engineC
+	return VehicleTelemetry{
+		VehicleID:   v.ID,
+		SpeedKmph:   v.speed * 3.6,
+		FuelPercent: v.fuelPct,
+		Latitude:    p.Lat,
+		Longitude:   p.Lon,
+		EngineTemp:  &temp,
+		Timestamp:   now.UnixMilli(),
+	}
+}
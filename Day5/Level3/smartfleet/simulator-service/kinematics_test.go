@@ -0,0 +1,96 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestVehicleReproducible(t *testing.T) {
+	run := func() []VehicleTelemetry {
+		v := NewVehicle(42, defaultRoutes[0].planner(), DefaultPhysics())
+		var out []VehicleTelemetry
+		for i := 0; i < 500; i++ {
+			v.Advance(2 * time.Second)
+			out = append(out, v.Telemetry(time.Unix(0, 0)))
+		}
+		return out
+	}
+	a, b := run(), run()
+	for i := range a {
+		if !sameSample(a[i], b[i]) {
+			t.Fatalf("runs with the same seed differ at step %d: %+v vs %+v", i, a[i], b[i])
+		}
+	}
+	if other := NewVehicle(43, defaultRoutes[0].planner(), DefaultPhysics()); other.ID == a[0].VehicleID {
+		t.Error("different seeds gave the same vehicle ID")
+	}
+}
+
+func TestVehiclePhysics(t *testing.T) {
+	phys := DefaultPhysics()
+	phys.RefuelBelowPct = 90 // refuel early to see it happen
+	v := NewVehicle(7, defaultRoutes[1].planner(), phys)
+	v.fuelPct = 95
+
+	const dt = time.Second
+	var stops, refuels int
+	prevState, prevSpeed, prevPos, prevFuel := v.state, v.speed, v.Position(), v.fuelPct
+	for i := 0; i < 3*3600; i++ {
+		v.Advance(dt)
+		if a := (v.speed - prevSpeed) / dt.Seconds(); a > phys.MaxAccel+1e-9 || a < -phys.MaxDecel-1e-9 {
+			t.Fatalf("step %d: acceleration %.2f m/s²", i, a)
+		}
+		if v.speed*3.6 > defaultRoutes[1].SpeedKmph*1.05+1e-9 {
+			t.Fatalf("step %d: %.1f km/h over the limit", i, v.speed*3.6)
+		}
+		if d := distanceM(prevPos, v.Position()); d > math.Max(v.speed, prevSpeed)*dt.Seconds()+1 {
+			t.Fatalf("step %d: moved %.1f m at %.1f m/s", i, d, v.speed)
+		}
+		if v.fuelPct > prevFuel && v.state != refueling && prevState != refueling {
+			t.Fatalf("step %d: fuel went up from %.3f to %.3f", i, prevFuel, v.fuelPct)
+		}
+		if v.engineC < phys.AmbientC-1e-9 || v.engineC > phys.OperatingC+15 {
+			t.Fatalf("step %d: engine at %.1f °C", i, v.engineC)
+		}
+		if v.state != prevState {
+			switch v.state {
+			case stopped:
+				stops++
+			case refueling:
+				refuels++
+			}
+		}
+		prevState, prevSpeed, prevPos, prevFuel = v.state, v.speed, v.Position(), v.fuelPct
+	}
+	if stops == 0 || refuels == 0 {
+		t.Errorf("stops=%d refuels=%d, want both", stops, refuels)
+	}
+	if v.odometer < 10000 {
+		t.Errorf("only drove %.0f m in three hours", v.odometer)
+	}
+}
+
+func TestEngineWarmsAndCools(t *testing.T) {
+	phys := DefaultPhysics()
+	v := NewVehicle(1, defaultRoutes[2].planner(), phys)
+	v.Advance(20 * time.Minute)
+	if v.state != refueling && v.engineC < phys.OperatingC-5 {
+		t.Errorf("engine only at %.1f °C after 20 minutes", v.engineC)
+	}
+	warm := v.engineC
+	v.state, v.wait, v.speed = refueling, 3600, 0
+	v.Advance(10 * time.Minute)
+	if v.engineC >= warm-10 {
+		t.Errorf("engine off for 10 minutes cooled from %.1f only to %.1f °C", warm, v.engineC)
+	}
+}
+
+// sameSample compares samples by value, engine temperature included.
+func sameSample(a, b VehicleTelemetry) bool {
+	if (a.EngineTemp == nil) != (b.EngineTemp == nil) || a.EngineTemp != nil && *a.EngineTemp != *b.EngineTemp {
+		return false
+	}
+	a.EngineTemp, b.EngineTemp = nil, nil
+	return a == b
+}
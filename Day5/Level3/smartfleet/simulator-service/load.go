@@ -0,0 +1,522 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load mode drives telemetry-service as hard as asked: a large pool of
+// vehicles shares one connection pool and requests are issued either at a
+// target arrival rate (open model: requests start on schedule, however
+// slow the server is) or by a number of workers that each send as soon as
+// their previous request finished (closed model). Stages ramp the rate or
+// the worker count linearly.
+
+// Stage is one ramp: the target goes from From to To over Duration.
+type Stage struct {
+	Duration time.Duration
+	From, To float64
+}
+
+// ParseStages reads "30s:1000,5m:1000,30s:0": each stage ramps from the
+// previous target (0 at the start) to its own.
+func ParseStages(spec string) ([]Stage, error) {
+	var stages []Stage
+	prev := 0.0
+	for _, part := range strings.Split(spec, ",") {
+		d, t, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("stage %q: want duration:target", part)
+		}
+		dur, err := time.ParseDuration(d)
+		if err != nil || dur <= 0 {
+			return nil, fmt.Errorf("stage %q: bad duration", part)
+		}
+		to, err := strconv.ParseFloat(t, 64)
+		if err != nil || to < 0 {
+			return nil, fmt.Errorf("stage %q: bad target", part)
+		}
+		stages = append(stages, Stage{Duration: dur, From: prev, To: to})
+		prev = to
+	}
+	return stages, nil
+}
+
+// stageAt returns the stage running at elapsed and its target then; -1
+// once all stages are over.
+func stageAt(stages []Stage, elapsed time.Duration) (int, float64) {
+	for i, s := range stages {
+		if elapsed < s.Duration {
+			return i, s.From + (s.To-s.From)*float64(elapsed)/float64(s.Duration)
+		}
+		elapsed -= s.Duration
+	}
+	return -1, 0
+}
+
+// LoadConfig configures a load run.
+type LoadConfig struct {
+	Vehicles    int     // distinct vehicles the samples come from
+	Rate        bool    // open model: stage targets are requests per second
+	Concurrency int     // closed model: ignored; open model: cap on requests in flight
+	Stages      []Stage // closed model: targets are concurrent workers
+	Seed        int64
+}
+
+// LoadTarget sends one request carrying samples and reports the HTTP status.
+type LoadTarget interface {
+	Name() string
+	BatchSize() int
+	Send(ctx context.Context, samples []VehicleTelemetry) (int, error)
+}
+
+// singleTarget posts one sample per request, like the live simulator.
+type singleTarget struct{ *httpSender }
+
+func (singleTarget) Name() string   { return "single" }
+func (singleTarget) BatchSize() int { return 1 }
+
+func (t singleTarget) Send(ctx context.Context, samples []VehicleTelemetry) (int, error) {
+	return t.httpSender.Send(ctx, samples[0])
+}
+
+// batchTarget posts a JSON array of samples per request.
+type batchTarget struct {
+	*httpSender
+	size int
+}
+
+func (batchTarget) Name() string     { return "batch" }
+func (t batchTarget) BatchSize() int { return t.size }
+
+func (t batchTarget) Send(ctx context.Context, samples []VehicleTelemetry) (int, error) {
+	batch := make([]interface{}, len(samples))
+	for i, s := range samples {
+		batch[i] = t.format.Encode(s)
+	}
+	payload, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+	return t.post(ctx, payload)
+}
+
+// sharedClient is an http.Client whose pool allows conns connections per
+// host, for all workers to share.
+func sharedClient(conns int, timeout time.Duration) *http.Client {
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.MaxIdleConns = conns
+	tr.MaxIdleConnsPerHost = conns
+	tr.MaxConnsPerHost = conns
+	return &http.Client{Transport: tr, Timeout: timeout}
+}
+
+// LoadSummary is the result of a load run.
+type LoadSummary struct {
+	Model       string         `json:"model"` // open or closed
+	Target      string         `json:"target"`
+	Vehicles    int            `json:"vehicles"`
+	BatchSize   int            `json:"batch_size"`
+	Started     time.Time      `json:"started"`
+	DurationS   float64        `json:"duration_s"`
+	Requests    uint64         `json:"requests"`
+	Samples     uint64         `json:"samples"`
+	RPS         float64        `json:"rps"`
+	SamplesPerS float64        `json:"samples_per_s"`
+	Dropped     uint64         `json:"dropped"` // open model: arrivals with no room under the concurrency cap
+	Status      map[string]int `json:"status"`  // HTTP status (or "error") -> requests
+	LatencyMs   Latency        `json:"latency_ms"`
+	Stages      []StageSummary `json:"stages"`
+	Interrupted bool           `json:"interrupted,omitempty"`
+	FirstErrors []string       `json:"first_errors,omitempty"`
+}
+
+// StageSummary is the part of a run that fell in one stage.
+type StageSummary struct {
+	Duration  string         `json:"duration"`
+	From      float64        `json:"from"`
+	To        float64        `json:"to"`
+	Requests  uint64         `json:"requests"`
+	RPS       float64        `json:"rps"`
+	Status    map[string]int `json:"status"`
+	LatencyMs Latency        `json:"latency_ms"`
+}
+
+// Latency are latency statistics in milliseconds.
+type Latency struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p99_9"`
+	Max  float64 `json:"max"`
+}
+
+// histogram counts latencies in logarithmic buckets 1% wide, from 1µs to
+// well over a minute, without locking.
+type histogram struct {
+	buckets [histBuckets]atomic.Uint64
+	count   atomic.Uint64
+	sumUs   atomic.Uint64
+	minUs   atomic.Uint64 // stored +1 so zero means unset
+	maxUs   atomic.Uint64
+	status  [600]atomic.Uint64
+	errs    atomic.Uint64
+}
+
+const (
+	histBuckets = 2000
+	histGrowth  = 1.01
+)
+
+func bucketOf(us float64) int {
+	if us < 1 {
+		return 0
+	}
+	i := int(math.Log(us)/math.Log(histGrowth)) + 1
+	if i >= histBuckets {
+		i = histBuckets - 1
+	}
+	return i
+}
+
+// bucketValue is the middle of bucket i in µs.
+func bucketValue(i int) float64 {
+	if i == 0 {
+		return 0.5
+	}
+	return math.Pow(histGrowth, float64(i-1)+0.5)
+}
+
+func (h *histogram) record(d time.Duration, status int, err error) {
+	if err != nil || status <= 0 || status >= len(h.status) {
+		h.errs.Add(1)
+	} else {
+		h.status[status].Add(1)
+	}
+	if err != nil {
+		return // a failed request has no meaningful latency
+	}
+	us := uint64(d.Microseconds())
+	h.buckets[bucketOf(float64(us))].Add(1)
+	h.count.Add(1)
+	h.sumUs.Add(us)
+	for {
+		cur := h.minUs.Load()
+		if cur != 0 && cur-1 <= us || h.minUs.CompareAndSwap(cur, us+1) {
+			break
+		}
+	}
+	for {
+		cur := h.maxUs.Load()
+		if cur >= us || h.maxUs.CompareAndSwap(cur, us) {
+			break
+		}
+	}
+}
+
+func (h *histogram) requests() uint64 {
+	n := h.errs.Load()
+	for i := range h.status {
+		n += h.status[i].Load()
+	}
+	return n
+}
+
+func (h *histogram) statusCounts() map[string]int {
+	m := make(map[string]int)
+	for i := range h.status {
+		if n := h.status[i].Load(); n > 0 {
+			m[strconv.Itoa(i)] = int(n)
+		}
+	}
+	if n := h.errs.Load(); n > 0 {
+		m["error"] = int(n)
+	}
+	return m
+}
+
+func (h *histogram) quantile(q float64) float64 {
+	n := h.count.Load()
+	if n == 0 {
+		return 0
+	}
+	rank := uint64(math.Ceil(q * float64(n)))
+	var seen uint64
+	for i := range h.buckets {
+		seen += h.buckets[i].Load()
+		if seen >= rank {
+			return bucketValue(i)
+		}
+	}
+	return float64(h.maxUs.Load())
+}
+
+func (h *histogram) latency() Latency {
+	n := h.count.Load()
+	if n == 0 {
+		return Latency{}
+	}
+	ms := func(us float64) float64 { return math.Round(us) / 1000 }
+	minUs, maxUs := float64(h.minUs.Load()-1), float64(h.maxUs.Load())
+	clamp := func(us float64) float64 { return ms(math.Max(minUs, math.Min(maxUs, us))) }
+	return Latency{
+		Min:  ms(minUs),
+		Mean: ms(float64(h.sumUs.Load()) / float64(n)),
+		P50:  clamp(h.quantile(0.50)),
+		P90:  clamp(h.quantile(0.90)),
+		P95:  clamp(h.quantile(0.95)),
+		P99:  clamp(h.quantile(0.99)),
+		P999: clamp(h.quantile(0.999)),
+		Max:  ms(maxUs),
+	}
+}
+
+// loadVehicle is a pool vehicle; samples move it on by the time since its
+// previous one.
+type loadVehicle struct {
+	mu   sync.Mutex
+	v    *Vehicle
+	last time.Time
+}
+
+func (lv *loadVehicle) sample(now time.Time) VehicleTelemetry {
+	lv.mu.Lock()
+	defer lv.mu.Unlock()
+	if !lv.last.IsZero() {
+		if d := now.Sub(lv.last); d > 0 {
+			lv.v.Advance(minDuration(d, time.Minute))
+		}
+	}
+	lv.last = now
+	return lv.v.Telemetry(now)
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// LoadRun is a load test in progress.
+type LoadRun struct {
+	cfg    LoadConfig
+	target LoadTarget
+	pool   []*loadVehicle
+	next   atomic.Uint64
+	total  histogram
+	stages []*histogram
+	start  time.Time
+
+	dropped  atomic.Uint64
+	inFlight atomic.Int64
+
+	errMu  sync.Mutex
+	errors []string
+}
+
+// NewLoadRun builds the vehicle pool. Vehicles are spread over the routes
+// given by planners, as in the live simulator.
+func NewLoadRun(cfg LoadConfig, target LoadTarget, planners func(i int) Planner) (*LoadRun, error) {
+	if cfg.Vehicles <= 0 || len(cfg.Stages) == 0 {
+		return nil, errors.New("load: vehicles and stages required")
+	}
+	if cfg.Rate && cfg.Concurrency <= 0 {
+		return nil, errors.New("load: open model needs a concurrency cap")
+	}
+	r := &LoadRun{cfg: cfg, target: target}
+	phys := DefaultPhysics()
+	for i := 0; i < cfg.Vehicles; i++ {
+		r.pool = append(r.pool, &loadVehicle{v: NewVehicle(cfg.Seed+int64(i), planners(i), phys)})
+	}
+	for range cfg.Stages {
+		r.stages = append(r.stages, &histogram{})
+	}
+	return r, nil
+}
+
+// fire sends one request and records it.
+func (r *LoadRun) fire(ctx context.Context) {
+	r.inFlight.Add(1)
+	defer r.inFlight.Add(-1)
+	samples := make([]VehicleTelemetry, r.target.BatchSize())
+	now := time.Now()
+	for i := range samples {
+		samples[i] = r.pool[(r.next.Add(1)-1)%uint64(len(r.pool))].sample(now)
+	}
+	stage, _ := stageAt(r.cfg.Stages, now.Sub(r.start))
+	status, err := r.target.Send(ctx, samples)
+	if ctx.Err() != nil {
+		return // cut short by the end of the run: not the server's doing
+	}
+	d := time.Since(now)
+	r.total.record(d, status, err)
+	if stage >= 0 {
+		r.stages[stage].record(d, status, err)
+	}
+	if err != nil {
+		r.errMu.Lock()
+		if len(r.errors) < 10 {
+			r.errors = append(r.errors, err.Error())
+		}
+		r.errMu.Unlock()
+	}
+}
+
+// Execute runs all stages, or until ctx is done, and summarizes.
+func (r *LoadRun) Execute(ctx context.Context) *LoadSummary {
+	var total time.Duration
+	for _, s := range r.cfg.Stages {
+		total += s.Duration
+	}
+	r.start = time.Now()
+	runCtx, cancel := context.WithDeadline(ctx, r.start.Add(total))
+	defer cancel()
+
+	done := make(chan struct{})
+	go r.progress(runCtx, done)
+	if r.cfg.Rate {
+		r.open(runCtx)
+	} else {
+		r.closed(runCtx)
+	}
+	<-done
+	return r.summary(ctx.Err() != nil)
+}
+
+// open issues requests at the stage's rate. Arrivals are scheduled every
+// few milliseconds; if the concurrency cap is reached they are dropped, not
+// queued, so a slow server cannot slow the arrival rate down.
+func (r *LoadRun) open(ctx context.Context) {
+	sem := make(chan struct{}, r.cfg.Concurrency)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ticker := time.NewTicker(5 * time.Millisecond)
+	defer ticker.Stop()
+	last, owed := r.start, 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			_, rate := stageAt(r.cfg.Stages, now.Sub(r.start))
+			owed += rate * now.Sub(last).Seconds()
+			last = now
+			for ; owed >= 1; owed-- {
+				select {
+				case sem <- struct{}{}:
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						r.fire(ctx)
+						<-sem
+					}()
+				default:
+					r.dropped.Add(1)
+				}
+			}
+		}
+	}
+}
+
+// closed runs as many workers as the largest stage target; worker i only
+// sends while the current target is above i.
+func (r *LoadRun) closed(ctx context.Context) {
+	workers := 0.0
+	for _, s := range r.cfg.Stages {
+		workers = math.Max(workers, math.Max(s.From, s.To))
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < int(math.Ceil(workers)); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				if _, n := stageAt(r.cfg.Stages, time.Since(r.start)); float64(i) >= math.Round(n) {
+					select {
+					case <-ctx.Done():
+					case <-time.After(20 * time.Millisecond):
+					}
+					continue
+				}
+				r.fire(ctx)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// progress logs throughput and latency every 5 seconds.
+func (r *LoadRun) progress(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	var prev uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			n := r.total.requests()
+			_, target := stageAt(r.cfg.Stages, now.Sub(r.start))
+			lat := r.total.latency()
+			log.Printf("[load] t=%s target=%.0f rps=%.0f in-flight=%d p50=%.1fms p99=%.1fms dropped=%d status=%v",
+				now.Sub(r.start).Truncate(time.Second), target, float64(n-prev)/5, r.inFlight.Load(),
+				lat.P50, lat.P99, r.dropped.Load(), r.total.statusCounts())
+			prev = n
+		}
+	}
+}
+
+func (r *LoadRun) summary(interrupted bool) *LoadSummary {
+	elapsed := time.Since(r.start).Seconds()
+	model := "closed"
+	if r.cfg.Rate {
+		model = "open"
+	}
+	reqs := r.total.requests()
+	s := &LoadSummary{
+		Model:       model,
+		Target:      r.target.Name(),
+		Vehicles:    len(r.pool),
+		BatchSize:   r.target.BatchSize(),
+		Started:     r.start,
+		DurationS:   math.Round(elapsed*1000) / 1000,
+		Requests:    reqs,
+		Samples:     reqs * uint64(r.target.BatchSize()),
+		RPS:         math.Round(float64(reqs)/elapsed*10) / 10,
+		Dropped:     r.dropped.Load(),
+		Status:      r.total.statusCounts(),
+		LatencyMs:   r.total.latency(),
+		Interrupted: interrupted,
+		FirstErrors: r.errors,
+	}
+	s.SamplesPerS = math.Round(float64(s.Samples)/elapsed*10) / 10
+	for i, st := range r.cfg.Stages {
+		h := r.stages[i]
+		n := h.requests()
+		s.Stages = append(s.Stages, StageSummary{
+			Duration:  st.Duration.String(),
+			From:      st.From,
+			To:        st.To,
+			Requests:  n,
+			RPS:       math.Round(float64(n)/st.Duration.Seconds()*10) / 10,
+			Status:    h.statusCounts(),
+			LatencyMs: h.latency(),
+		})
+	}
+	return s
+}
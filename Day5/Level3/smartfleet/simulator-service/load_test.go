@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestParseStages(t *testing.T) {
+	stages, err := ParseStages("10s:100, 1m:100,5s:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stages) != 3 || stages[0].From != 0 || stages[1].From != 100 || stages[2].To != 0 {
+		t.Fatalf("stages = %+v", stages)
+	}
+	for _, tc := range []struct {
+		at    time.Duration
+		stage int
+		level float64
+	}{{0, 0, 0}, {5 * time.Second, 0, 50}, {30 * time.Second, 1, 100}, {72500 * time.Millisecond, 2, 50}, {80 * time.Second, -1, 0}} {
+		if i, l := stageAt(stages, tc.at); i != tc.stage || math.Abs(l-tc.level) > 1e-9 {
+			t.Errorf("at %s: stage %d level %v, want %d %v", tc.at, i, l, tc.stage, tc.level)
+		}
+	}
+	for _, bad := range []string{"", "10s", "x:1", "10s:-1", "0s:5"} {
+		if _, err := ParseStages(bad); err == nil {
+			t.Errorf("ParseStages(%q) accepted", bad)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 10000; i++ {
+		h.record(time.Duration(i)*time.Microsecond*10, http.StatusAccepted, nil)
+	}
+	h.record(time.Second, 503, nil)
+	h.record(0, 0, context.DeadlineExceeded)
+	lat := h.latency()
+	for _, c := range []struct{ got, want float64 }{{lat.P50, 50}, {lat.P90, 90}, {lat.P99, 99}, {lat.Min, 0.01}, {lat.Max, 1000}} {
+		if math.Abs(c.got-c.want)/c.want > 0.01 {
+			t.Errorf("got %v ms, want %v within 1%%", c.got, c.want)
+		}
+	}
+	if st := h.statusCounts(); st["202"] != 10000 || st["503"] != 1 || st["error"] != 1 || h.requests() != 10002 {
+		t.Errorf("status = %v", st)
+	}
+}
+
+func loadServer(t *testing.T, delay time.Duration, batch *atomic.Int64) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if batch != nil {
+			var samples []VehicleTelemetry
+			if err := json.NewDecoder(r.Body).Decode(&samples); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			batch.Add(int64(len(samples)))
+		}
+		time.Sleep(delay)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestLoadOpenModel(t *testing.T) {
+	srv := loadServer(t, 0, nil)
+	sender := &httpSender{client: sharedClient(20, time.Second), url: srv.URL, format: smartfleetV1{}}
+	planners, _ := newPlannerFactory("", "")
+	run, err := NewLoadRun(LoadConfig{
+		Vehicles: 50, Rate: true, Concurrency: 20,
+		Stages: []Stage{{Duration: time.Second, From: 200, To: 200}},
+	}, singleTarget{sender}, planners)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := run.Execute(context.Background())
+	if s.Model != "open" || s.Requests < 150 || s.Requests > 210 || s.Status["202"] != int(s.Requests) {
+		t.Errorf("summary = %+v", s)
+	}
+	if s.LatencyMs.P50 <= 0 || s.LatencyMs.P99 < s.LatencyMs.P50 || len(s.Stages) != 1 || s.Stages[0].Requests != s.Requests {
+		t.Errorf("latency %+v, stages %+v", s.LatencyMs, s.Stages)
+	}
+}
+
+func TestLoadOpenModelDropsOverCap(t *testing.T) {
+	srv := loadServer(t, 200*time.Millisecond, nil)
+	sender := &httpSender{client: sharedClient(2, time.Second), url: srv.URL, format: smartfleetV1{}}
+	planners, _ := newPlannerFactory("", "")
+	run, _ := NewLoadRun(LoadConfig{
+		Vehicles: 5, Rate: true, Concurrency: 2,
+		Stages: []Stage{{Duration: 500 * time.Millisecond, From: 100, To: 100}},
+	}, singleTarget{sender}, planners)
+	s := run.Execute(context.Background())
+	if s.Dropped < 30 || s.Requests > 6 {
+		t.Errorf("requests %d dropped %d with a slow server", s.Requests, s.Dropped)
+	}
+}
+
+func TestLoadClosedModelBatch(t *testing.T) {
+	var received atomic.Int64
+	srv := loadServer(t, 10*time.Millisecond, &received)
+	sender := &httpSender{client: sharedClient(4, time.Second), url: srv.URL, format: smartfleetV1{}}
+	planners, _ := newPlannerFactory("", "")
+	run, _ := NewLoadRun(LoadConfig{
+		Vehicles: 30,
+		Stages:   []Stage{{Duration: 300 * time.Millisecond, From: 4, To: 4}},
+	}, batchTarget{sender, 25}, planners)
+	s := run.Execute(context.Background())
+	// 4 workers, ~10ms per request: roughly 120 requests
+	if s.Model != "closed" || s.Requests < 40 || s.Requests > 130 {
+		t.Errorf("requests = %d", s.Requests)
+	}
+	if s.Samples != s.Requests*25 || received.Load() < int64(s.Samples) {
+		t.Errorf("samples = %d, server got %d", s.Samples, received.Load())
+	}
+}
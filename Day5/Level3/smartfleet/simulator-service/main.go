@@ -1,126 +1,496 @@
-
 package main
 
 import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
 	"sync"
 	"syscall"
 	"time"
 
-	"github.com/google/uuid"
+	"go.uber.org/zap"
+
+	"smartfleet/common/config"
+	"smartfleet/common/logging"
 )
 
-// VehicleTelemetry represents one vehicle's telemetry data
+// VehicleTelemetry represents one vehicle's telemetry data. It is the
+// simulator's own record; output.go encodes it for the wire.
 type VehicleTelemetry struct {
-	VehicleID   string  `json:"vehicle_id"`
-	SpeedKmph   float64 `json:"speed_kmph"`
-	FuelPercent float64 `json:"fuel_percent"`
-	Latitude    float64 `json:"latitude"`
-	Longitude   float64 `json:"longitude"`
-	EngineTemp  float64 `json:"engine_temp"`
-	Timestamp   int64   `json:"timestamp"`
+	VehicleID   string   `json:"vehicle_id"`
+	SpeedKmph   float64  `json:"speed_kmph"`
+	FuelPercent float64  `json:"fuel_percent"` // -1 when not reported
+	Latitude    float64  `json:"latitude"`
+	Longitude   float64  `json:"longitude"`
+	EngineTemp  *float64 `json:"engine_temp,omitempty"` // celsius; nil when not reported
+	Timestamp   int64    `json:"ts"`                    // unix millis
 }
 
-// Configurable parameters
-var (
-	telemetryURL  = getenv("TELEMETRY_URL", "http://localhost:8081/telemetry")
-	vehicleCount  = getenvInt("VEHICLE_COUNT", 5)
-	sendInterval  = time.Duration(getenvInt("SEND_INTERVAL_MS", 2000)) * time.Millisecond
-	speedMin      = 0.0
-	speedMax      = 180.0
-	fuelMin       = 5.0
-	fuelMax       = 100.0
-	latMin        = 12.90
-	latMax        = 13.10
-	lngMin        = 77.55
-	lngMax        = 77.70
-	engineMinTemp = 70.0
-	engineMaxTemp = 120.0
-)
+// Config is the simulator configuration, from the environment, an optional
+// YAML file (-config) and flags; -print-config shows it. The run, load and
+// replay commands take their own flags and use it for defaults.
+type Config struct {
+	TelemetryURL string        `yaml:"telemetry_url" env:"TELEMETRY_URL" default:"http://localhost:8081/telemetry"`
+	TelemetryKey string        `yaml:"telemetry_api_key" env:"TELEMETRY_API_KEY" secret:"true" help:"ingest credential (identifies the tenant)"`
+	VehicleCount int           `yaml:"vehicle_count" env:"VEHICLE_COUNT" default:"5"`
+	SendInterval time.Duration `yaml:"send_interval" env:"SEND_INTERVAL_MS" default:"2s" unit:"ms"`
+	RoutesFile   string        `yaml:"routes_file" env:"SIM_ROUTES_FILE" help:"JSON waypoint routes"`
+	RoadGraph    string        `yaml:"road_graph" env:"SIM_ROAD_GRAPH" help:"GeoJSON road network, preferred over routes"`
+	HTTPAddr     string        `yaml:"http_addr" env:"SIM_HTTP_ADDR" default:":8084"`
+	Seed         int64         `yaml:"seed" env:"SIM_SEED" help:"random seed; 0 picks one"`
 
-// helper functions
-func getenv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
+	// output: smartfleet-v1 or volkswagen-fleet over http, or smartfleet-v1
+	// straight to Kafka
+	Format    string       `yaml:"format" env:"SIM_FORMAT" default:"smartfleet-v1"`
+	Transport string       `yaml:"transport" env:"SIM_TRANSPORT" default:"http" oneof:"http kafka"`
+	Kafka     config.Kafka `yaml:"kafka"`
+	Tenant    string       `yaml:"tenant" env:"SIM_TENANT" default:"default"`
+
+	// the service's log; the run, load and replay commands print plain text
+	Log config.Log `yaml:"log"`
+
+	// driving behaviour; the defaults are DefaultPhysics'
+	StopProbability float64 `yaml:"stop_probability" env:"SIM_STOP_PROBABILITY" default:"0.4"`
+	RefuelBelowPct  float64 `yaml:"refuel_below_percent" env:"SIM_REFUEL_BELOW_PERCENT" default:"15"`
+}
+
+// Validate checks the payload format exists.
+func (c *Config) Validate() error {
+	_, err := formatByName(c.Format)
+	return err
+}
+
+// conf is loaded by main; until then it holds the defaults.
+var conf = config.Default[Config]()
+
+// envOutput is the configured Output, in format.
+func envOutput(url, key, format string) Output {
+	return Output{
+		Transport: conf.Transport,
+		Format:    format,
+		URL:       url,
+		APIKey:    key,
+		Brokers:   conf.Kafka.Brokers,
+		Topic:     conf.Kafka.Topic,
+		Tenant:    conf.Tenant,
 	}
-	return def
 }
 
-func getenvInt(key string, def int) int {
-	if v := os.Getenv(key); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			return n
-		}
+// httpSender posts samples to telemetry-service.
+type httpSender struct {
+	client *http.Client
+	url    string
+	key    string
+	format Format
+}
+
+func newHTTPSender(url, key string, format Format) *httpSender {
+	return &httpSender{client: &http.Client{Timeout: 2 * time.Second}, url: url, key: key, format: format}
+}
+
+func (h *httpSender) Send(ctx context.Context, data VehicleTelemetry) (int, error) {
+	payload, err := json.Marshal(h.format.Encode(data))
+	if err != nil {
+		return 0, err
 	}
-	return def
+	return h.post(ctx, payload)
 }
 
-// generate random float between min and max
-func randomFloat(min, max float64) float64 {
-	return min + rand.Float64()*(max-min)
+func (h *httpSender) post(ctx context.Context, payload []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.key != "" {
+		req.Header.Set("Authorization", "Bearer "+h.key)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, nil
 }
 
 // simulate one vehicle's telemetry
-func simulateVehicle(ctx context.Context, vehicleID string, wg *sync.WaitGroup) {
+func simulateVehicle(ctx context.Context, v *Vehicle, sender Sender, stats *DeliveryStats, wg *sync.WaitGroup) {
 	defer wg.Done()
-	ticker := time.NewTicker(sendInterval)
+	ticker := time.NewTicker(conf.SendInterval)
 	defer ticker.Stop()
 
-	client := &http.Client{Timeout: 2 * time.Second}
+	vehicleID := v.ID
 
 	for {
 		select {
 		case <-ctx.Done():
 			log.Printf("[sim] vehicle %s stopped", vehicleID)
 			return
-		case <-ticker.C:
-			data := VehicleTelemetry{
-				VehicleID:   vehicleID,
-				SpeedKmph:   randomFloat(speedMin, speedMax),
-				FuelPercent: randomFloat(fuelMin, fuelMax),
-				Latitude:    randomFloat(latMin, latMax),
-				Longitude:   randomFloat(lngMin, lngMax),
-				EngineTemp:  randomFloat(engineMinTemp, engineMaxTemp),
-				Timestamp:   time.Now().Unix(),
-			}
-			payload, _ := json.Marshal(data)
-			req, err := http.NewRequestWithContext(ctx, http.MethodPost, telemetryURL, bytes.NewReader(payload))
-			if err != nil {
-				log.Printf("[sim] vehicle %s error creating request: %v", vehicleID, err)
+		case now := <-ticker.C:
+			v.Advance(conf.SendInterval)
+			data := v.Telemetry(now)
+			status, err := sender.Send(ctx, data)
+			if ctx.Err() != nil {
 				continue
 			}
-			req.Header.Set("Content-Type", "application/json")
-			resp, err := client.Do(req)
+			stats.Record(vehicleID, status, err)
 			if err != nil {
 				log.Printf("[sim] vehicle %s error sending telemetry: %v", vehicleID, err)
 				continue
 			}
-			resp.Body.Close()
+			if status >= 300 {
+				log.Printf("[sim] vehicle %s telemetry rejected: status %d", vehicleID, status)
+				continue
+			}
 			log.Printf("[sim] vehicle %s sent telemetry: speed=%.1f kmph fuel=%.1f%% lat=%.5f lng=%.5f temp=%.1f°C",
-				vehicleID, data.SpeedKmph, data.FuelPercent, data.Latitude, data.Longitude, data.EngineTemp)
+				vehicleID, data.SpeedKmph, data.FuelPercent, data.Latitude, data.Longitude, v.engineC)
+		}
+	}
+}
+
+// runScenario implements "run [-report file] [-sent file] scenario.yaml".
+func runScenario(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	reportFile := fs.String("report", "", "write the JSON report here instead of stdout")
+	sentFile := fs.String("sent", "", "log every sample sent to this file as NDJSON")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: simulate run [-report file] [-sent file] scenario.yaml")
+		return 2
+	}
+	sc, err := LoadScenario(fs.Arg(0))
+	if err != nil {
+		log.Printf("[scenario] %v", err)
+		return 2
+	}
+	sender, err := envOutput(sc.Telemetry.URL, sc.Telemetry.APIKey, sc.Telemetry.Format).Sender()
+	if err != nil {
+		log.Printf("[scenario] %v", err)
+		return 2
+	}
+	if c, ok := sender.(io.Closer); ok {
+		defer c.Close()
+	}
+	run := &Run{Scenario: sc, Sender: sender}
+	if *sentFile != "" {
+		f, err := os.Create(*sentFile)
+		if err != nil {
+			log.Printf("[scenario] %v", err)
+			return 2
+		}
+		defer f.Close()
+		run.Sent = f
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	log.Printf("[scenario] %s: %s of simulated time at %gx, seed %d", sc.Name, sc.Duration, sc.Speedup, sc.Seed)
+	rep, err := run.Execute(ctx)
+	if err != nil {
+		log.Printf("[scenario] %s: %v", sc.Name, err)
+		if rep == nil {
+			return 1
+		}
+	}
+	log.Printf("[scenario] %s: sent %d samples %v", sc.Name, rep.Samples, rep.Status)
+	for _, e := range rep.Expectations {
+		log.Printf("[scenario] %s: %s (found %d)", e.Status, e.Expectation, e.Found)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *reportFile != "" {
+		f, err := os.Create(*reportFile)
+		if err != nil {
+			log.Printf("[scenario] %v", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(rep)
+	if err != nil || !rep.Passed {
+		return 1
+	}
+	return 0
+}
+
+// runLoad implements "load [flags]"; see load.go.
+func runLoad(args []string) int {
+	fs := flag.NewFlagSet("load", flag.ExitOnError)
+	url := fs.String("url", conf.TelemetryURL, "endpoint to load")
+	key := fs.String("key", conf.TelemetryKey, "ingest API key")
+	format := fs.String("format", conf.Format, "payload format: smartfleet-v1 or volkswagen-fleet")
+	target := fs.String("target", "single", "single: one sample per POST; batch: a JSON array of -batch-size samples")
+	batchSize := fs.Int("batch-size", 100, "samples per batch request")
+	vehicles := fs.Int("vehicles", 1000, "distinct vehicles in the pool")
+	model := fs.String("model", "", "open (arrival rate) or closed (concurrent workers); default open with -rate")
+	rate := fs.Float64("rate", 0, "open model: requests per second, without -stages")
+	concurrency := fs.Int("concurrency", 50, "closed model: workers, without -stages; open model: cap on requests in flight")
+	stagesSpec := fs.String("stages", "", "ramp stages, e.g. 30s:1000,5m:1000,30s:0 (targets are rates or workers)")
+	duration := fs.Duration("duration", time.Minute, "run length without -stages")
+	conns := fs.Int("conns", 0, "connection pool size; default -concurrency")
+	timeout := fs.Duration("timeout", 5*time.Second, "request timeout")
+	seed := fs.Int64("seed", 1, "random seed of the vehicle pool")
+	summaryFile := fs.String("summary", "", "write the JSON summary here instead of stdout")
+	_ = fs.Parse(args)
+
+	cfg := LoadConfig{Vehicles: *vehicles, Concurrency: *concurrency, Seed: *seed}
+	switch *model {
+	case "open":
+		cfg.Rate = true
+	case "":
+		cfg.Rate = *rate > 0
+	case "closed":
+	default:
+		log.Printf("[load] -model %q: want open or closed", *model)
+		return 2
+	}
+	if *stagesSpec != "" {
+		stages, err := ParseStages(*stagesSpec)
+		if err != nil {
+			log.Printf("[load] -stages: %v", err)
+			return 2
 		}
+		cfg.Stages = stages
+	} else {
+		level := float64(*concurrency)
+		if cfg.Rate {
+			level = *rate
+		}
+		cfg.Stages = []Stage{{Duration: *duration, From: level, To: level}}
+	}
+	if *conns <= 0 {
+		*conns = *concurrency
+	}
+	f, err := formatByName(*format)
+	if err != nil {
+		log.Printf("[load] -format: %v", err)
+		return 2
+	}
+	sender := &httpSender{client: sharedClient(*conns, *timeout), url: *url, key: *key, format: f}
+	var t LoadTarget
+	switch *target {
+	case "single":
+		t = singleTarget{sender}
+	case "batch":
+		if *batchSize <= 0 {
+			log.Printf("[load] -batch-size must be positive")
+			return 2
+		}
+		t = batchTarget{sender, *batchSize}
+	default:
+		log.Printf("[load] -target %q: want single or batch", *target)
+		return 2
+	}
+
+	planners, err := newPlannerFactory(conf.RoadGraph, conf.RoutesFile)
+	if err != nil {
+		log.Printf("[load] loading roads: %v", err)
+		return 2
+	}
+	run, err := NewLoadRun(cfg, t, planners)
+	if err != nil {
+		log.Printf("[load] %v", err)
+		return 2
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	log.Printf("[load] %s target %s, %d vehicles, open model %v, stages %v", t.Name(), *url, cfg.Vehicles, cfg.Rate, cfg.Stages)
+	summary := run.Execute(ctx)
+
+	out := io.Writer(os.Stdout)
+	if *summaryFile != "" {
+		f, err := os.Create(*summaryFile)
+		if err != nil {
+			log.Printf("[load] %v", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
+	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		log.Printf("[load] writing summary: %v", err)
+		return 1
+	}
+	return 0
+}
+
+// runReplay implements "replay [flags] trace...", sending recorded traces
+// (see trace.go) through the configured output.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	url := fs.String("url", conf.TelemetryURL, "telemetry endpoint")
+	key := fs.String("key", conf.TelemetryKey, "ingest API key")
+	format := fs.String("format", conf.Format, "payload format: smartfleet-v1 or volkswagen-fleet")
+	kind := fs.String("in", "", "trace kind: csv, ndjson or gpx; default by file extension")
+	speedSpec := fs.String("speed", "1", "replay speed: 1 (real time), N or Nx, or max")
+	rebase := fs.Bool("rebase", false, "move timestamps so the trace starts now")
+	remapSpec := fs.String("remap", "", "rename vehicles: from=to,from=to")
+	anonymize := fs.Bool("anonymize", false, "give vehicles not in -remap random IDs")
+	seed := fs.Int64("seed", 1, "random seed of -anonymize")
+	summaryFile := fs.String("summary", "", "write the JSON summary here instead of stdout")
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: simulate replay [flags] trace...")
+		return 2
+	}
+	speed, err := ParseSpeed(*speedSpec)
+	if err != nil {
+		log.Printf("[replay] -speed %q: %v", *speedSpec, err)
+		return 2
+	}
+	remap, err := ParseRemap(*remapSpec)
+	if err != nil {
+		log.Printf("[replay] -remap: %v", err)
+		return 2
+	}
+	trace, err := LoadTrace(fs.Args(), *kind)
+	if err != nil {
+		log.Printf("[replay] %v", err)
+		return 2
+	}
+	if *anonymize {
+		remap = AnonymousIDs(trace, remap, *seed)
+	}
+	sender, err := envOutput(*url, *key, *format).Sender()
+	if err != nil {
+		log.Printf("[replay] %v", err)
+		return 2
+	}
+	if c, ok := sender.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	log.Printf("[replay] %d vehicles, %s recorded from %s, speed %s, rebase %v",
+		len(trace.Vehicles), trace.End.Sub(trace.Start), trace.Start.Format(time.RFC3339), *speedSpec, *rebase)
+	replay := &Replay{Trace: trace, Sender: sender, Speed: speed, Rebase: *rebase, Remap: remap}
+	summary := replay.Execute(ctx)
+	log.Printf("[replay] sent %d of %d events in %s: %d accepted, %d rejected, %d failed",
+		summary.Total.Sent, summary.Events, summary.Elapsed, summary.Total.Accepted, summary.Total.Rejected, summary.Total.Failed)
+
+	out := io.Writer(os.Stdout)
+	if *summaryFile != "" {
+		f, err := os.Create(*summaryFile)
+		if err != nil {
+			log.Printf("[replay] %v", err)
+			return 1
+		}
+		defer f.Close()
+		out = f
 	}
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		log.Printf("[replay] writing summary: %v", err)
+		return 1
+	}
+	if summary.Cancelled || summary.Total.Accepted < summary.Total.Sent {
+		return 1
+	}
+	return 0
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		var command func([]string) int
+		switch os.Args[1] {
+		case "run":
+			command = runScenario
+		case "load":
+			command = runLoad
+		case "replay":
+			command = runReplay
+		}
+		if command != nil {
+			// commands parse their own flags; the environment and
+			// CONFIG_FILE still apply
+			if err := config.Load("simulator", &conf, config.Sources{}); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(2)
+			}
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+	config.MustLoad("simulator", &conf)
+	logs, err := logging.New("simulator-service", conf.Log, nil)
+	if err != nil {
+		log.Fatalf("[sim] %v", err)
+	}
+	defer logs.Sync()
+	defer zap.RedirectStdLog(logs.Logger("sim"))()
 	log.Println("[sim] Simulator Service starting...")
-	rand.Seed(time.Now().UnixNano())
+	seed := conf.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	log.Printf("[sim] seed %d (set SIM_SEED to replay this run)", seed)
+	planner, err := newPlannerFactory(conf.RoadGraph, conf.RoutesFile)
+	if err != nil {
+		log.Fatalf("[sim] loading roads: %v", err)
+	}
+	phys := DefaultPhysics()
+	phys.StopProbability = conf.StopProbability
+	phys.RefuelBelowPct = conf.RefuelBelowPct
+
+	sender, err := envOutput(conf.TelemetryURL, conf.TelemetryKey, conf.Format).Sender()
+	if err != nil {
+		log.Fatalf("[sim] output: %v", err)
+	}
+	log.Printf("[sim] sending %s over %s", conf.Format, conf.Transport)
+
 	ctx, cancel := context.WithCancel(context.Background())
 	wg := &sync.WaitGroup{}
+	stats := NewDeliveryStats()
 
-	// start multiple vehicle goroutines
-	for i := 0; i < vehicleCount; i++ {
-		vehicleID := uuid.New().String()
+	// per-vehicle delivery counts
+	mux := http.NewServeMux()
+	mux.Handle("/stats", stats)
+	mux.Handle("/admin/log-levels", logs.Handler())
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("ok"))
+	})
+	srv := &http.Server{Addr: conf.HTTPAddr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Printf("[sim] http server: %v", err)
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				t, _ := stats.Snapshot()
+				log.Printf("[sim] deliveries: sent=%d accepted=%d rejected=%d failed=%d status=%v",
+					t.Sent, t.Accepted, t.Rejected, t.Failed, t.Status)
+			}
+		}
+	}()
+
+	// start multiple vehicle goroutines; each has its own random source
+	// derived from the seed, so a vehicle's run does not depend on the others
+	for i := 0; i < conf.VehicleCount; i++ {
+		v := NewVehicle(seed+int64(i), planner(i), phys)
 		wg.Add(1)
-		go simulateVehicle(ctx, vehicleID, wg)
+		go simulateVehicle(ctx, v, sender, stats, wg)
 	}
 
 	// graceful shutdown on signals
@@ -130,7 +500,11 @@ func main() {
 	log.Println("[sim] shutdown signal received...")
 	cancel()
 	wg.Wait()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	_ = srv.Shutdown(shutdownCtx)
+	if c, ok := sender.(io.Closer); ok {
+		_ = c.Close()
+	}
 	log.Println("[sim] Simulator Service stopped")
 }
-
-
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+
+	"smartfleet/common/logging"
+)
+
+// Format encodes samples the way a telemetry endpoint expects them.
+type Format interface {
+	Name() string
+	Encode(t VehicleTelemetry) interface{}
+}
+
+// Formats by name (SIM_FORMAT).
+var formats = map[string]Format{
+	"smartfleet-v1":    smartfleetV1{},
+	"volkswagen-fleet": volkswagenFleet{},
+}
+
+// formatByName returns the named format.
+func formatByName(name string) (Format, error) {
+	if f, ok := formats[name]; ok {
+		return f, nil
+	}
+	names := make([]string, 0, len(formats))
+	for n := range formats {
+		names = append(names, n)
+	}
+	return nil, fmt.Errorf("unknown format %q (have %s)", name, strings.Join(names, ", "))
+}
+
+// smartfleetV1 is telemetry-service's TelemetryPayload: km/h, percent and
+// a millisecond timestamp. It rejects unknown fields, so only those are set.
+type smartfleetV1 struct{}
+
+type smartfleetV1Payload struct {
+	VehicleID  string   `json:"vehicle_id"`
+	Speed      float64  `json:"speed"`
+	Fuel       float64  `json:"fuel_level"`
+	Lat        float64  `json:"latitude"`
+	Lon        float64  `json:"longitude"`
+	Ts         int64    `json:"ts"`
+	EngineTemp *float64 `json:"engine_temp,omitempty"`
+}
+
+func (smartfleetV1) Name() string { return "smartfleet-v1" }
+
+func (smartfleetV1) Encode(t VehicleTelemetry) interface{} {
+	return smartfleetV1Payload{
+		VehicleID:  t.VehicleID,
+		Speed:      t.SpeedKmph,
+		Fuel:       t.FuelPercent,
+		Lat:        t.Latitude,
+		Lon:        t.Longitude,
+		Ts:         t.Timestamp,
+		EngineTemp: t.EngineTemp,
+	}
+}
+
+// volkswagenFleet is the volkswagen-fleet telemetry-service's Telemetry.
+type volkswagenFleet struct{}
+
+type volkswagenFleetPayload struct {
+	VehicleID   string    `json:"vehicle_id"`
+	Speed       float64   `json:"speed"`
+	Temperature float64   `json:"temperature"`
+	FuelLevel   float64   `json:"fuel_level"`
+	Timestamp   time.Time `json:"timestamp"`
+}
+
+func (volkswagenFleet) Name() string { return "volkswagen-fleet" }
+
+func (volkswagenFleet) Encode(t VehicleTelemetry) interface{} {
+	p := volkswagenFleetPayload{
+		VehicleID: t.VehicleID,
+		Speed:     t.SpeedKmph,
+		FuelLevel: t.FuelPercent,
+		Timestamp: time.UnixMilli(t.Timestamp).UTC(),
+	}
+	if t.EngineTemp != nil {
+		p.Temperature = *t.EngineTemp
+	}
+	return p
+}
+
+// Output says where samples go: POSTed to an HTTP endpoint, or written
+// straight to telemetry-service's Kafka topic, bypassing it.
+type Output struct {
+	Transport string // http or kafka
+	Format    string
+
+	URL    string // http
+	APIKey string // http
+
+	Brokers []string // kafka
+	Topic   string   // kafka
+	Tenant  string   // kafka: tenant_id header, normally set by telemetry-service
+}
+
+// Sender builds the Sender for o.
+func (o Output) Sender() (Sender, error) {
+	f, err := formatByName(o.Format)
+	if err != nil {
+		return nil, err
+	}
+	switch o.Transport {
+	case "", "http":
+		return newHTTPSender(o.URL, o.APIKey, f), nil
+	case "kafka":
+		if f.Name() != "smartfleet-v1" {
+			return nil, errors.New("kafka carries smartfleet-v1 payloads only")
+		}
+		if len(o.Brokers) == 0 || o.Topic == "" {
+			return nil, errors.New("kafka needs brokers and a topic")
+		}
+		return &kafkaSender{
+			w: &kafka.Writer{
+				Addr:         kafka.TCP(o.Brokers...),
+				Topic:        o.Topic,
+				Balancer:     &kafka.Hash{}, // keyed by vehicle, as telemetry-service does
+				BatchTimeout: 10 * time.Millisecond,
+			},
+			format: f,
+			tenant: o.Tenant,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown transport %q (want http or kafka)", o.Transport)
+}
+
+// kafkaSender writes samples to the telemetry topic with the headers
+// telemetry-service would add. A successful write counts as 202 Accepted.
+type kafkaSender struct {
+	w      *kafka.Writer
+	format Format
+	tenant string
+}
+
+func (k *kafkaSender) Send(ctx context.Context, t VehicleTelemetry) (int, error) {
+	value, err := json.Marshal(k.format.Encode(t))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	err = k.w.WriteMessages(ctx, kafka.Message{
+		Key:   []byte(t.VehicleID),
+		Value: value,
+		Time:  time.UnixMilli(t.Timestamp),
+		Headers: []kafka.Header{
+			{Key: "tenant_id", Value: []byte(k.tenant)},
+			{Key: "received_at", Value: []byte(strconv.FormatInt(now.UnixMilli(), 10))},
+			{Key: logging.RequestIDKafkaHeader, Value: []byte(logging.NewRequestID())},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	return http.StatusAccepted, nil
+}
+
+func (k *kafkaSender) Close() error { return k.w.Close() }
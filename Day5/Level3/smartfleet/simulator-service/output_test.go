@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSample = VehicleTelemetry{
+	VehicleID: "v1", SpeedKmph: 62.5, FuelPercent: 41, Latitude: 12.97, Longitude: 77.6,
+	EngineTemp: func() *float64 { t := 91.0; return &t }(), Timestamp: 1700000000000,
+}
+
+func TestSmartfleetV1(t *testing.T) {
+	data, _ := json.Marshal(smartfleetV1{}.Encode(testSample))
+	// telemetry-service decodes with DisallowUnknownFields
+	var got struct {
+		VehicleID  string   `json:"vehicle_id"`
+		Speed      float64  `json:"speed"`
+		Fuel       float64  `json:"fuel_level"`
+		Lat        float64  `json:"latitude"`
+		Lon        float64  `json:"longitude"`
+		Ts         int64    `json:"ts"`
+		BatteryPct *float64 `json:"battery_pct,omitempty"`
+		Charging   *bool    `json:"charging,omitempty"`
+		EngineTemp *float64 `json:"engine_temp,omitempty"`
+	}
+	dec := json.NewDecoder(strings.NewReader(string(data)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&got); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	if got.Speed != 62.5 || got.Fuel != 41 || got.Ts != 1700000000000 || got.EngineTemp == nil || *got.EngineTemp != 91 {
+		t.Errorf("decoded %+v", got)
+	}
+}
+
+func TestVolkswagenFleet(t *testing.T) {
+	data, _ := json.Marshal(volkswagenFleet{}.Encode(testSample))
+	var got map[string]interface{}
+	_ = json.Unmarshal(data, &got)
+	want := map[string]interface{}{
+		"vehicle_id": "v1", "speed": 62.5, "temperature": 91.0, "fuel_level": 41.0,
+		"timestamp": time.UnixMilli(1700000000000).UTC().Format(time.RFC3339),
+	}
+	if len(got) != len(want) {
+		t.Fatalf("fields %v", got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestOutputSender(t *testing.T) {
+	var body, auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		body, auth = string(b), r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}))
+	defer srv.Close()
+
+	s, err := Output{Format: "volkswagen-fleet", URL: srv.URL, APIKey: "k"}.Sender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := s.Send(context.Background(), testSample)
+	if err != nil || status != http.StatusUnprocessableEntity {
+		t.Fatalf("status %d, err %v", status, err)
+	}
+	if auth != "Bearer k" || !strings.Contains(body, `"temperature":91`) {
+		t.Errorf("auth %q body %s", auth, body)
+	}
+
+	for _, o := range []Output{
+		{Format: "csv"},
+		{Format: "smartfleet-v1", Transport: "carrier-pigeon"},
+		{Format: "volkswagen-fleet", Transport: "kafka", Brokers: []string{"k:9092"}, Topic: "t"},
+		{Format: "smartfleet-v1", Transport: "kafka"},
+	} {
+		if _, err := o.Sender(); err == nil {
+			t.Errorf("%+v accepted", o)
+		}
+	}
+	if _, err := (Output{Format: "smartfleet-v1", Transport: "kafka", Brokers: []string{"k:9092"}, Topic: "t"}).Sender(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDeliveryStats(t *testing.T) {
+	s := NewDeliveryStats()
+	s.Record("b", 202, nil)
+	s.Record("b", 400, nil)
+	s.Record("a", 202, nil)
+	s.Record("a", 0, errors.New("connection refused"))
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var got struct {
+		Total    Deliveries   `json:"total"`
+		Vehicles []Deliveries `json:"vehicles"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Total.Sent != 4 || got.Total.Accepted != 2 || got.Total.Rejected != 1 || got.Total.Failed != 1 || got.Total.Status["202"] != 2 {
+		t.Errorf("total %+v", got.Total)
+	}
+	if len(got.Vehicles) != 2 || got.Vehicles[0].VehicleID != "a" || got.Vehicles[0].LastError != "connection refused" || got.Vehicles[1].Status["400"] != 1 {
+		t.Errorf("vehicles %+v", got.Vehicles)
+	}
+}
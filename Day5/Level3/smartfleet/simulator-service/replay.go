@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Replay sends a recorded Trace again. Every vehicle replays on its own,
+// keeping the gaps between its events (divided by Speed), so vehicles that
+// reported at different rates still do.
+type Replay struct {
+	Trace  *Trace
+	Sender Sender
+	Stats  *DeliveryStats // optional
+
+	// Speed is recorded seconds per second: 1 replays in real time, 10 ten
+	// times faster, and 0 as fast as the sender takes them.
+	Speed float64
+
+	// Rebase moves the trace to start now. Timestamps keep their recorded
+	// gaps whatever the speed, so analytics sees the trips as driven.
+	Rebase bool
+
+	// Remap renames vehicles; those not in it keep their recorded IDs.
+	Remap map[string]string
+}
+
+// ReplaySummary is the outcome of a Replay.
+type ReplaySummary struct {
+	Started   time.Time    `json:"started"`
+	Elapsed   string       `json:"elapsed"`
+	Recorded  string       `json:"recorded"` // trace length
+	Speed     float64      `json:"speed"`    // 0: as fast as possible
+	Rebased   bool         `json:"rebased"`
+	Events    int          `json:"events"`
+	Total     Deliveries   `json:"total"`
+	Vehicles  []Deliveries `json:"vehicles"`
+	Cancelled bool         `json:"cancelled,omitempty"`
+}
+
+// Execute replays the trace to its end, or until ctx is done.
+func (r *Replay) Execute(ctx context.Context) *ReplaySummary {
+	stats := r.Stats
+	if stats == nil {
+		stats = NewDeliveryStats()
+	}
+	start := time.Now()
+	shift := time.Duration(0)
+	if r.Rebase {
+		shift = start.Sub(r.Trace.Start)
+	}
+	var (
+		wg     sync.WaitGroup
+		events int
+	)
+	for id, trace := range r.Trace.Vehicles {
+		events += len(trace)
+		to := id
+		if m, ok := r.Remap[id]; ok {
+			to = m
+		}
+		wg.Add(1)
+		go func(id string, trace []TraceEvent) {
+			defer wg.Done()
+			r.replayVehicle(ctx, id, trace, start, shift, stats)
+		}(to, trace)
+	}
+	wg.Wait()
+
+	total, list := stats.Snapshot()
+	return &ReplaySummary{
+		Started:   start,
+		Elapsed:   time.Since(start).Round(time.Millisecond).String(),
+		Recorded:  r.Trace.End.Sub(r.Trace.Start).String(),
+		Speed:     r.Speed,
+		Rebased:   r.Rebase,
+		Events:    events,
+		Total:     total,
+		Vehicles:  list,
+		Cancelled: ctx.Err() != nil,
+	}
+}
+
+func (r *Replay) replayVehicle(ctx context.Context, id string, trace []TraceEvent, start time.Time, shift time.Duration, stats *DeliveryStats) {
+	for _, ev := range trace {
+		if r.Speed > 0 {
+			due := start.Add(time.Duration(float64(ev.At.Sub(r.Trace.Start)) / r.Speed))
+			if !sleepUntil(ctx, due) {
+				return
+			}
+		} else if ctx.Err() != nil {
+			return
+		}
+		s := ev.Sample
+		s.VehicleID = id
+		s.Timestamp = ev.At.Add(shift).UnixMilli()
+		status, err := r.Sender.Send(ctx, s)
+		if ctx.Err() != nil {
+			return
+		}
+		stats.Record(id, status, err)
+		switch {
+		case err != nil:
+			log.Printf("[replay] vehicle %s error sending telemetry: %v", id, err)
+		case status >= 300:
+			log.Printf("[replay] vehicle %s telemetry rejected: status %d", id, status)
+		}
+	}
+}
+
+// sleepUntil waits for t, reporting false if ctx is done first.
+func sleepUntil(ctx context.Context, t time.Time) bool {
+	timer := time.NewTimer(time.Until(t))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// ParseRemap parses vehicle renames: "from=to,from=to".
+func ParseRemap(spec string) (map[string]string, error) {
+	m := make(map[string]string)
+	for _, pair := range strings.Split(spec, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("remap %q: want from=to", pair)
+		}
+		if _, dup := m[from]; dup {
+			return nil, fmt.Errorf("remap %q: %s renamed twice", pair, from)
+		}
+		m[from] = to
+	}
+	return m, nil
+}
+
+// AnonymousIDs gives every vehicle of the trace not already in remap a
+// random UUID, the same for the same seed, so recorded vehicles do not
+// collide with registered ones.
+func AnonymousIDs(t *Trace, remap map[string]string, seed int64) map[string]string {
+	if remap == nil {
+		remap = make(map[string]string)
+	}
+	ids := make([]string, 0, len(t.Vehicles))
+	for id := range t.Vehicles {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	rng := rand.New(rand.NewSource(seed))
+	for _, id := range ids {
+		if _, ok := remap[id]; ok {
+			continue
+		}
+		u, _ := uuid.NewRandomFromReader(rng)
+		remap[id] = u.String()
+	}
+	return remap
+}
+
+// ParseSpeed parses a replay speed: 1, 10, 10x or max.
+func ParseSpeed(v string) (float64, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if v == "max" {
+		return 0, nil
+	}
+	f, err := strconv.ParseFloat(strings.TrimSuffix(v, "x"), 64)
+	if err != nil || f <= 0 {
+		return 0, errors.New("want a positive factor or max")
+	}
+	return f, nil
+}
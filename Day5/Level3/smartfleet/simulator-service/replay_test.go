@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSender keeps what it is sent, and when.
+type recordingSender struct {
+	mu   sync.Mutex
+	sent []VehicleTelemetry
+	at   []time.Time
+}
+
+func (s *recordingSender) Send(ctx context.Context, t VehicleTelemetry) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, t)
+	s.at = append(s.at, time.Now())
+	return 202, nil
+}
+
+func testTrace(t *testing.T) *Trace {
+	t.Helper()
+	start := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	ev := func(id string, at time.Duration) TraceEvent {
+		ts := start.Add(at)
+		return TraceEvent{At: ts, Sample: VehicleTelemetry{VehicleID: id, FuelPercent: -1, Timestamp: ts.UnixMilli()}}
+	}
+	return &Trace{
+		Vehicles: map[string][]TraceEvent{
+			"a": {ev("a", 0), ev("a", 2*time.Second), ev("a", 4*time.Second)},
+			"b": {ev("b", time.Second), ev("b", 3*time.Second)},
+		},
+		Start: start,
+		End:   start.Add(4 * time.Second),
+	}
+}
+
+func TestReplayAsFastAsPossible(t *testing.T) {
+	tr := testTrace(t)
+	sender := &recordingSender{}
+	r := &Replay{Trace: tr, Sender: sender, Remap: map[string]string{"a": "truck-1"}}
+	sum := r.Execute(context.Background())
+	if sum.Events != 5 || sum.Total.Sent != 5 || sum.Total.Accepted != 5 {
+		t.Fatalf("summary = %+v", sum)
+	}
+	last := map[string]int64{}
+	for _, s := range sender.sent {
+		if s.VehicleID == "a" {
+			t.Fatalf("a was not remapped")
+		}
+		if s.Timestamp <= last[s.VehicleID] {
+			t.Errorf("%s out of order: %d after %d", s.VehicleID, s.Timestamp, last[s.VehicleID])
+		}
+		last[s.VehicleID] = s.Timestamp
+	}
+	if last["truck-1"] != tr.End.UnixMilli() {
+		t.Errorf("without rebase the recorded timestamps are kept, got %d", last["truck-1"])
+	}
+}
+
+func TestReplayTiming(t *testing.T) {
+	sender := &recordingSender{}
+	r := &Replay{Trace: testTrace(t), Sender: sender, Speed: 20, Rebase: true}
+	start := time.Now()
+	r.Execute(context.Background())
+
+	// 4s recorded at 20x is 200ms; the gaps of each vehicle scale alike.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("replay took %s, want about 200ms", elapsed)
+	}
+	firstTs := map[string]int64{}
+	for _, s := range sender.sent {
+		if _, ok := firstTs[s.VehicleID]; !ok {
+			firstTs[s.VehicleID] = s.Timestamp
+		}
+	}
+	for i, s := range sender.sent {
+		recorded := time.Duration(s.Timestamp-firstTs["a"]) * time.Millisecond
+		if got := sender.at[i].Sub(start); got < recorded/20 {
+			t.Errorf("%s sent %s into the replay, recorded %s into the trace", s.VehicleID, got, recorded)
+		}
+	}
+	// rebased to now, with the recorded gaps
+	if ts := time.UnixMilli(firstTs["a"]); ts.Before(start.Add(-time.Second)) || ts.After(time.Now()) {
+		t.Errorf("rebased start %s, want about %s", ts, start)
+	}
+	if d := firstTs["b"] - firstTs["a"]; d != 1000 {
+		t.Errorf("b starts %dms after a, want 1000", d)
+	}
+}
+
+func TestReplayCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sender := &recordingSender{}
+	r := &Replay{Trace: testTrace(t), Sender: sender, Speed: 1}
+	time.AfterFunc(100*time.Millisecond, cancel)
+	sum := r.Execute(ctx)
+	if !sum.Cancelled || sum.Total.Sent != 1 {
+		t.Errorf("cancelled after the first event: %+v", sum)
+	}
+}
+
+func TestParseRemapAndSpeed(t *testing.T) {
+	m, err := ParseRemap("a=truck-1, b = truck-2,")
+	if err != nil || len(m) != 2 || m["b"] != "truck-2" {
+		t.Fatalf("remap = %v, %v", m, err)
+	}
+	for _, bad := range []string{"a", "a=", "=b", "a=x,a=y"} {
+		if _, err := ParseRemap(bad); err == nil {
+			t.Errorf("ParseRemap(%q) accepted", bad)
+		}
+	}
+	ids := AnonymousIDs(testTrace(t), map[string]string{"a": "kept"}, 7)
+	again := AnonymousIDs(testTrace(t), nil, 7)
+	if ids["a"] != "kept" || len(ids["b"]) != 36 || again["b"] == "" {
+		t.Errorf("anonymous ids = %v", ids)
+	}
+	for spec, want := range map[string]float64{"1": 1, "10x": 10, "0.5": 0.5, "max": 0} {
+		if got, err := ParseSpeed(spec); err != nil || got != want {
+			t.Errorf("ParseSpeed(%q) = %v, %v", spec, got, err)
+		}
+	}
+	for _, bad := range []string{"0", "-2", "fast", "10y"} {
+		if _, err := ParseSpeed(bad); err == nil {
+			t.Errorf("ParseSpeed(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+)
+
+// Vehicles drive legs: polylines from one intersection to the next with a
+// speed limit. A Planner hands out the next leg whenever a vehicle reaches
+// the end of its current one, either by following a fixed waypoint route or
+// by wandering a road graph loaded from GeoJSON.
+
+// LatLon is a WGS84 position in degrees.
+type LatLon struct {
+	Lat, Lon float64
+}
+
+const earthRadiusM = 6371000.0
+
+// distanceM is the haversine distance between a and b in metres.
+func distanceM(a, b LatLon) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Lat - a.Lat) * rad
+	dLon := (b.Lon - a.Lon) * rad
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(a.Lat*rad)*math.Cos(b.Lat*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusM * math.Asin(math.Sqrt(h))
+}
+
+// Leg is a stretch of road between two intersections.
+type Leg struct {
+	points  []LatLon
+	cum     []float64 // distance from points[0] to points[i], metres
+	limitMS float64   // speed limit, m/s
+	node    int       // graph node at the end, -1 for waypoint routes
+}
+
+func newLeg(points []LatLon, limitKmph float64) *Leg {
+	l := &Leg{points: points, cum: make([]float64, len(points)), limitMS: limitKmph / 3.6, node: -1}
+	for i := 1; i < len(points); i++ {
+		l.cum[i] = l.cum[i-1] + distanceM(points[i-1], points[i])
+	}
+	return l
+}
+
+// Length is the leg's length in metres.
+func (l *Leg) Length() float64 { return l.cum[len(l.cum)-1] }
+
+// At returns the position s metres along the leg.
+func (l *Leg) At(s float64) LatLon {
+	if s <= 0 {
+		return l.points[0]
+	}
+	for i := 1; i < len(l.points); i++ {
+		if s <= l.cum[i] {
+			seg := l.cum[i] - l.cum[i-1]
+			if seg == 0 {
+				return l.points[i]
+			}
+			f := (s - l.cum[i-1]) / seg
+			a, b := l.points[i-1], l.points[i]
+			return LatLon{a.Lat + f*(b.Lat-a.Lat), a.Lon + f*(b.Lon-a.Lon)}
+		}
+	}
+	return l.points[len(l.points)-1]
+}
+
+// rest is the part of the leg from s metres on.
+func (l *Leg) rest(s float64) []LatLon {
+	out := []LatLon{l.At(s)}
+	for i, c := range l.cum {
+		if c > s {
+			out = append(out, l.points[i])
+		}
+	}
+	return out
+}
+
+// Planner chooses the legs a vehicle drives. Each vehicle has its own
+// Planner so the choices only depend on the vehicle's random source.
+type Planner interface {
+	// Start returns the first leg.
+	Start(rng *rand.Rand) *Leg
+	// Next returns the leg that follows prev.
+	Next(prev *Leg, rng *rand.Rand) *Leg
+}
+
+// Route is a fixed list of waypoints; every waypoint is an intersection.
+// Loop routes continue from the last waypoint to the first, others turn
+// back at the end.
+type Route struct {
+	Name      string       `json:"name" yaml:"name"`
+	Points    [][2]float64 `json:"points" yaml:"points"` // [lat, lon]
+	SpeedKmph float64      `json:"speed_kmph,omitempty" yaml:"speed_kmph"`
+	Loop      bool         `json:"loop,omitempty" yaml:"loop"`
+}
+
+// routePlanner drives a Route leg by leg.
+type routePlanner struct {
+	legs []*Leg // forward legs, then the way back for routes that do not loop
+	i    int
+}
+
+func (r *Route) planner() *routePlanner {
+	pts := make([]LatLon, len(r.Points))
+	for i, p := range r.Points {
+		pts[i] = LatLon{p[0], p[1]}
+	}
+	order := make([]LatLon, 0, 2*len(pts))
+	order = append(order, pts...)
+	if r.Loop {
+		order = append(order, pts[0])
+	} else {
+		for i := len(pts) - 2; i >= 0; i-- {
+			order = append(order, pts[i])
+		}
+	}
+	p := &routePlanner{}
+	for i := 1; i < len(order); i++ {
+		p.legs = append(p.legs, newLeg([]LatLon{order[i-1], order[i]}, r.SpeedKmph))
+	}
+	return p
+}
+
+func (p *routePlanner) Start(rng *rand.Rand) *Leg {
+	p.i = rng.Intn(len(p.legs))
+	return p.legs[p.i]
+}
+
+func (p *routePlanner) Next(_ *Leg, _ *rand.Rand) *Leg {
+	p.i = (p.i + 1) % len(p.legs)
+	return p.legs[p.i]
+}
+
+// LoadRoutes reads a JSON array of routes.
+func LoadRoutes(data []byte) ([]Route, error) {
+	var routes []Route
+	if err := json.Unmarshal(data, &routes); err != nil {
+		return nil, err
+	}
+	if err := checkRoutes(routes); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// checkRoutes validates routes and fills in default speeds.
+func checkRoutes(routes []Route) error {
+	if len(routes) == 0 {
+		return errors.New("no routes")
+	}
+	for i := range routes {
+		r := &routes[i]
+		if len(r.Points) < 2 {
+			return fmt.Errorf("route %q: want at least 2 points", r.Name)
+		}
+		if r.SpeedKmph <= 0 {
+			r.SpeedKmph = defaultSpeedLimitKmph
+		}
+	}
+	return nil
+}
+
+// RoadGraph is a road network; vehicles wander it, choosing a random road at
+// every intersection and turning back only at dead ends.
+type RoadGraph struct {
+	nodes []LatLon
+	adj   [][]roadEdge
+}
+
+type roadEdge struct {
+	to        int
+	limitKmph float64
+}
+
+// geoJSON is the subset of a GeoJSON FeatureCollection the loader reads.
+type geoJSON struct {
+	Features []struct {
+		Geometry struct {
+			Type        string          `json:"type"`
+			Coordinates json.RawMessage `json:"coordinates"`
+		} `json:"geometry"`
+		Properties map[string]interface{} `json:"properties"`
+	} `json:"features"`
+}
+
+// LoadRoadGraph builds a graph from the LineString and MultiLineString
+// features of a GeoJSON FeatureCollection. Lines that share a coordinate are
+// connected there. A numeric or "50"-style maxspeed property sets the speed
+// limit in km/h; oneway=yes makes a line one-directional.
+func LoadRoadGraph(data []byte) (*RoadGraph, error) {
+	var fc geoJSON
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return nil, err
+	}
+	g := &RoadGraph{}
+	index := make(map[[2]int64]int)
+	node := func(c []float64) int {
+		key := [2]int64{int64(math.Round(c[1] * 1e6)), int64(math.Round(c[0] * 1e6))}
+		if id, ok := index[key]; ok {
+			return id
+		}
+		id := len(g.nodes)
+		index[key] = id
+		g.nodes = append(g.nodes, LatLon{c[1], c[0]}) // GeoJSON is [lon, lat]
+		g.adj = append(g.adj, nil)
+		return id
+	}
+	for _, f := range fc.Features {
+		var lines [][][]float64
+		switch f.Geometry.Type {
+		case "LineString":
+			var line [][]float64
+			if err := json.Unmarshal(f.Geometry.Coordinates, &line); err != nil {
+				return nil, err
+			}
+			lines = [][][]float64{line}
+		case "MultiLineString":
+			if err := json.Unmarshal(f.Geometry.Coordinates, &lines); err != nil {
+				return nil, err
+			}
+		default:
+			continue
+		}
+		limit := propertySpeed(f.Properties["maxspeed"])
+		oneway := fmt.Sprint(f.Properties["oneway"]) == "yes" || f.Properties["oneway"] == true
+		for _, line := range lines {
+			prev := -1
+			for _, c := range line {
+				if len(c) < 2 {
+					return nil, errors.New("coordinate with fewer than 2 values")
+				}
+				id := node(c)
+				if prev >= 0 && prev != id {
+					g.adj[prev] = append(g.adj[prev], roadEdge{id, limit})
+					if !oneway {
+						g.adj[id] = append(g.adj[id], roadEdge{prev, limit})
+					}
+				}
+				prev = id
+			}
+		}
+	}
+	if len(g.nodes) == 0 {
+		return nil, errors.New("no LineString features")
+	}
+	return g, nil
+}
+
+func propertySpeed(v interface{}) float64 {
+	switch x := v.(type) {
+	case float64:
+		if x > 0 {
+			return x
+		}
+	case string:
+		if f, err := strconv.ParseFloat(x, 64); err == nil && f > 0 {
+			return f
+		}
+	}
+	return defaultSpeedLimitKmph
+}
+
+// intersection reports whether vehicles choose their way at node n: where
+// roads meet, split or end.
+func (g *RoadGraph) intersection(n int) bool { return len(g.adj[n]) != 2 }
+
+// graphPlanner wanders a RoadGraph.
+type graphPlanner struct {
+	g    *RoadGraph
+	from int // node before the end of the current leg, to avoid U-turns
+}
+
+func (g *RoadGraph) planner() *graphPlanner { return &graphPlanner{g: g} }
+
+func (p *graphPlanner) Start(rng *rand.Rand) *Leg {
+	for tries := 0; tries < 100; tries++ {
+		n := rng.Intn(len(p.g.nodes))
+		if len(p.g.adj[n]) > 0 {
+			return p.walk(n, -1, rng)
+		}
+	}
+	for n := range p.g.nodes {
+		if len(p.g.adj[n]) > 0 {
+			return p.walk(n, -1, rng)
+		}
+	}
+	panic("road graph has no edges")
+}
+
+func (p *graphPlanner) Next(prev *Leg, rng *rand.Rand) *Leg {
+	return p.walk(prev.node, p.from, rng)
+}
+
+// walk starts at node n, avoiding the road back to came unless it is the
+// only one, and follows the road until the next intersection.
+func (p *graphPlanner) walk(n, came int, rng *rand.Rand) *Leg {
+	g := p.g
+	if len(g.adj[n]) == 0 {
+		if came < 0 {
+			return p.Start(rng)
+		}
+		// one-way street into a dead end: turn round anyway
+		leg := newLeg([]LatLon{g.nodes[n], g.nodes[came]}, defaultSpeedLimitKmph)
+		leg.node, p.from = came, n
+		return leg
+	}
+	e := p.choose(n, came, rng)
+	pts := []LatLon{g.nodes[n]}
+	limit := e.limitKmph
+	prev, cur := n, e.to
+	for steps := 0; ; steps++ {
+		pts = append(pts, g.nodes[cur])
+		if g.intersection(cur) || cur == n || steps > len(g.nodes) {
+			break
+		}
+		next := p.choose(cur, prev, rng)
+		limit = math.Min(limit, next.limitKmph)
+		prev, cur = cur, next.to
+	}
+	leg := newLeg(pts, limit)
+	leg.node = cur
+	p.from = prev
+	return leg
+}
+
+func (p *graphPlanner) choose(n, came int, rng *rand.Rand) roadEdge {
+	out := p.g.adj[n]
+	options := make([]roadEdge, 0, len(out))
+	for _, e := range out {
+		if e.to != came {
+			options = append(options, e)
+		}
+	}
+	if len(options) == 0 {
+		return out[rng.Intn(len(out))]
+	}
+	return options[rng.Intn(len(options))]
+}
+
+// defaultRoutes are loops around Bangalore used without SIM_ROUTES_FILE or
+// SIM_ROAD_GRAPH.
+var defaultRoutes = []Route{
+	{Name: "mg-road-indiranagar", SpeedKmph: 50, Loop: true, Points: [][2]float64{
+		{12.9757, 77.6057}, {12.9736, 77.6205}, {12.9784, 77.6408}, {12.9719, 77.6412},
+		{12.9609, 77.6387}, {12.9592, 77.6200}, {12.9660, 77.6050},
+	}},
+	{Name: "koramangala-hsr", SpeedKmph: 40, Loop: true, Points: [][2]float64{
+		{12.9352, 77.6245}, {12.9279, 77.6271}, {12.9116, 77.6389}, {12.9081, 77.6476},
+		{12.9204, 77.6503}, {12.9344, 77.6402},
+	}},
+	{Name: "outer-ring-north", SpeedKmph: 60, Loop: true, Points: [][2]float64{
+		{13.0358, 77.5970}, {13.0285, 77.5560}, {13.0093, 77.5550}, {12.9980, 77.5710},
+		{13.0050, 77.5900}, {13.0200, 77.5970},
+	}},
+}
+
+// newPlannerFactory returns a function making one Planner per vehicle:
+// from SIM_ROAD_GRAPH, from SIM_ROUTES_FILE, or the built-in routes.
+// Vehicles are spread over the routes round-robin.
+func newPlannerFactory(graphFile, routesFile string) (func(i int) Planner, error) {
+	if graphFile != "" {
+		data, err := os.ReadFile(graphFile)
+		if err != nil {
+			return nil, err
+		}
+		g, err := LoadRoadGraph(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", graphFile, err)
+		}
+		return func(int) Planner { return g.planner() }, nil
+	}
+	routes := defaultRoutes
+	if routesFile != "" {
+		data, err := os.ReadFile(routesFile)
+		if err != nil {
+			return nil, err
+		}
+		if routes, err = LoadRoutes(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", routesFile, err)
+		}
+	}
+	return func(i int) Planner { return routes[i%len(routes)].planner() }, nil
+}
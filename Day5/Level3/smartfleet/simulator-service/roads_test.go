@@ -0,0 +1,63 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// a crossroads with one arm that continues through a bend, and a one-way
+// street out of the centre
+const testGraph = `{"type": "FeatureCollection", "features": [
+  {"type": "Feature", "properties": {"maxspeed": "30"},
+   "geometry": {"type": "LineString", "coordinates": [[77.600, 12.970], [77.601, 12.970], [77.602, 12.970]]}},
+  {"type": "Feature", "properties": {},
+   "geometry": {"type": "LineString", "coordinates": [[77.601, 12.969], [77.601, 12.970], [77.601, 12.971], [77.602, 12.972]]}},
+  {"type": "Feature", "properties": {"oneway": "yes", "maxspeed": 20},
+   "geometry": {"type": "LineString", "coordinates": [[77.601, 12.970], [77.600, 12.971]]}}
+]}`
+
+func TestRoadGraph(t *testing.T) {
+	g, err := LoadRoadGraph([]byte(testGraph))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(g.nodes) != 7 {
+		t.Fatalf("nodes = %d, want 7", len(g.nodes))
+	}
+	p := g.planner()
+	rng := rand.New(rand.NewSource(1))
+	leg := p.Start(rng)
+	for i := 0; i < 200; i++ {
+		next := p.Next(leg, rng)
+		if end, start := leg.At(leg.Length()), next.At(0); distanceM(end, start) > 0.01 {
+			t.Fatalf("leg %d ends at %v but the next starts at %v", i, end, start)
+		}
+		if next.limitMS <= 0 || next.Length() <= 0 {
+			t.Fatalf("leg %d: limit %.1f m/s, length %.1f m", i, next.limitMS, next.Length())
+		}
+		leg = next
+	}
+
+	for _, bad := range []string{`{}`, `{"type": "FeatureCollection", "features": []}`, `not json`} {
+		if _, err := LoadRoadGraph([]byte(bad)); err == nil {
+			t.Errorf("LoadRoadGraph(%s) accepted", bad)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	routes, err := LoadRoutes([]byte(`[{"name": "a", "points": [[12.97, 77.60], [12.98, 77.60], [12.98, 77.61]]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := routes[0].planner()
+	if len(p.legs) != 4 {
+		t.Fatalf("out and back has %d legs, want 4", len(p.legs))
+	}
+	if routes[0].SpeedKmph != defaultSpeedLimitKmph {
+		t.Errorf("speed = %v, want the default", routes[0].SpeedKmph)
+	}
+	if _, err := LoadRoutes([]byte(`[{"name": "short", "points": [[12.97, 77.60]]}]`)); err == nil {
+		t.Error("route with one point accepted")
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sender delivers one sample and reports the HTTP status it got.
+type Sender interface {
+	Send(ctx context.Context, t VehicleTelemetry) (int, error)
+}
+
+// Report says what a scenario run sent and whether the expected alerts
+// were raised.
+type Report struct {
+	Scenario string          `json:"scenario"`
+	Seed     int64           `json:"seed"`
+	Started  time.Time       `json:"started"` // simulated time 0
+	Duration string          `json:"duration"`
+	Samples  int             `json:"samples"`
+	Status   map[string]int  `json:"status"` // HTTP status (or "error") -> samples
+	Vehicles []VehicleReport `json:"vehicles"`
+	Faults   []FaultReport   `json:"faults"`
+
+	Expectations []ExpectationResult `json:"expectations,omitempty"`
+	Passed       bool                `json:"passed"` // no checked expectation was missed
+}
+
+// VehicleReport sums up one vehicle's samples.
+type VehicleReport struct {
+	ID             string  `json:"id"`
+	Cohort         string  `json:"cohort"`
+	Index          int     `json:"index"`
+	Sent           int     `json:"sent"`
+	Accepted       int     `json:"accepted"` // 2xx
+	Rejected       int     `json:"rejected"` // other statuses
+	Failed         int     `json:"failed"`   // not delivered
+	DistanceKm     float64 `json:"distance_km"`
+	MaxSpeedKmph   float64 `json:"max_speed_kmph"`
+	MinFuelPercent float64 `json:"min_fuel_percent"`
+	MaxEngineTemp  float64 `json:"max_engine_temp"`
+}
+
+// FaultReport is a fault as it was injected.
+type FaultReport struct {
+	Type     string    `json:"type"`
+	From     time.Time `json:"from"`
+	Until    time.Time `json:"until"`
+	Vehicles []string  `json:"vehicles"`
+	Samples  int       `json:"samples"` // sent while the fault was on
+}
+
+// ExpectationResult is the outcome of one expectation: "met", "missed" or,
+// without a check URL, "unchecked".
+type ExpectationResult struct {
+	Expectation string   `json:"expectation"`
+	Status      string   `json:"status"`
+	Found       int      `json:"found"`
+	Vehicles    []string `json:"vehicles"`
+}
+
+// sentSample is a line of the -sent log.
+type sentSample struct {
+	At     string           `json:"at"` // simulated time since the start
+	Sample VehicleTelemetry `json:"sample"`
+	Status int              `json:"status,omitempty"`
+	Error  string           `json:"error,omitempty"`
+	Faults []string         `json:"faults,omitempty"`
+}
+
+// scenarioVehicle is a Vehicle in a run.
+type scenarioVehicle struct {
+	*Vehicle
+	report *VehicleReport
+	frozen map[string]float64 // sensor -> value held by sensor_freeze
+	last   VehicleTelemetry
+}
+
+// Run executes a Scenario.
+type Run struct {
+	Scenario *Scenario
+	Sender   Sender
+	Sent     io.Writer    // optional: every sample sent, as NDJSON
+	Client   *http.Client // for the alert check
+
+	// pace waits until the simulated time d has come; tests replace it to
+	// run at full speed
+	pace func(ctx context.Context, start time.Time, d time.Duration) error
+}
+
+// Execute runs the scenario to the end (or until ctx is done) and checks
+// the expectations.
+func (r *Run) Execute(ctx context.Context) (*Report, error) {
+	sc := r.Scenario
+	vehicles, err := sc.vehicles()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now().Truncate(time.Second)
+	rep := &Report{
+		Scenario: sc.Name,
+		Seed:     sc.Seed,
+		Started:  start,
+		Duration: sc.Duration.String(),
+		Status:   make(map[string]int),
+		Passed:   true,
+	}
+	for _, v := range vehicles {
+		rep.Vehicles = append(rep.Vehicles, *v.report)
+	}
+	for i := range vehicles {
+		vehicles[i].report = &rep.Vehicles[i]
+	}
+	targets := make([][]*scenarioVehicle, len(sc.Faults))
+	for i, f := range sc.Faults {
+		targets[i] = sc.selectVehicles(vehicles, f.Target)
+		fr := FaultReport{Type: f.Type, From: start.Add(f.At), Until: start.Add(f.Until())}
+		for _, v := range targets[i] {
+			fr.Vehicles = append(fr.Vehicles, v.ID)
+		}
+		rep.Faults = append(rep.Faults, fr)
+	}
+	pace := r.pace
+	if pace == nil {
+		pace = func(ctx context.Context, start time.Time, d time.Duration) error {
+			t := time.NewTimer(time.Until(start.Add(time.Duration(float64(d) / sc.Speedup))))
+			defer t.Stop()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-t.C:
+				return nil
+			}
+		}
+	}
+
+	var mu sync.Mutex // guards rep and r.Sent
+	for t := time.Duration(0); t < sc.Duration; {
+		// faults starting now act on the vehicles before they move
+		for i, f := range sc.Faults {
+			for _, v := range targets[i] {
+				r.inject(v, f, t)
+			}
+		}
+		t += sc.Interval
+		at := start.Add(t)
+		var wg sync.WaitGroup
+		for _, v := range vehicles {
+			v.Advance(sc.Interval)
+			sample := v.Telemetry(at)
+			var on []string
+			for i, f := range sc.Faults {
+				if f.At < t && t <= f.Until() && contains(targets[i], v) {
+					sample = v.falsify(sample, f)
+					rep.Faults[i].Samples++
+					on = append(on, f.Type)
+				}
+			}
+			v.last = sample
+			v.observe(sample)
+			wg.Add(1)
+			go func(v *scenarioVehicle, sample VehicleTelemetry) {
+				defer wg.Done()
+				status, err := r.Sender.Send(ctx, sample)
+				mu.Lock()
+				defer mu.Unlock()
+				rep.Samples++
+				v.report.Sent++
+				line := sentSample{At: t.String(), Sample: sample, Status: status, Faults: on}
+				switch {
+				case err != nil:
+					v.report.Failed++
+					rep.Status["error"]++
+					line.Error = err.Error()
+				case status >= 200 && status < 300:
+					v.report.Accepted++
+					rep.Status[strconv.Itoa(status)]++
+				default:
+					v.report.Rejected++
+					rep.Status[strconv.Itoa(status)]++
+				}
+				if r.Sent != nil {
+					_ = json.NewEncoder(r.Sent).Encode(line)
+				}
+			}(v, sample)
+		}
+		wg.Wait()
+		if err := pace(ctx, start, t); err != nil {
+			return rep, err
+		}
+	}
+	for _, v := range vehicles {
+		v.report.DistanceKm = v.odometer / 1000
+	}
+
+	rep.Expectations = r.check(ctx, vehicles, start)
+	for _, e := range rep.Expectations {
+		if e.Status == "missed" {
+			rep.Passed = false
+		}
+	}
+	return rep, nil
+}
+
+// inject applies what fault f does to the vehicle at simulated time t.
+func (r *Run) inject(v *scenarioVehicle, f Fault, t time.Duration) {
+	step := r.Scenario.Interval
+	switch f.Type {
+	case FaultOverspeed:
+		if t == f.At.Truncate(step) {
+			v.Overspeed(f.SpeedKmph)
+		} else if t == f.Until().Truncate(step) {
+			v.Overspeed(0)
+		}
+	case FaultGeofenceExit:
+		if t == f.At.Truncate(step) {
+			v.Divert(LatLon{f.Lat, f.Lon}, f.For)
+		}
+	case FaultFuelTheft:
+		if f.At <= t && t < f.Until() {
+			v.Drain(f.DropPercent * math.Min(1, float64(step)/float64(f.For)))
+		}
+	case FaultSensorFreeze:
+		if t == f.At.Truncate(step) {
+			v.frozen[f.Sensor] = sensorValue(v.last, f.Sensor)
+			if v.last.VehicleID == "" {
+				v.frozen[f.Sensor] = sensorValue(v.Telemetry(time.Time{}), f.Sensor)
+			}
+		}
+	}
+}
+
+// falsify changes a sample the way a reporting fault does.
+func (v *scenarioVehicle) falsify(s VehicleTelemetry, f Fault) VehicleTelemetry {
+	switch f.Type {
+	case FaultGPSDropout:
+		s.Latitude, s.Longitude = 0, 0
+	case FaultSensorFreeze:
+		val := v.frozen[f.Sensor]
+		switch f.Sensor {
+		case "speed_kmph":
+			s.SpeedKmph = val
+		case "fuel_percent":
+			s.FuelPercent = val
+		case "engine_temp":
+			s.EngineTemp = &val
+		}
+	}
+	return s
+}
+
+func sensorValue(s VehicleTelemetry, sensor string) float64 {
+	switch sensor {
+	case "speed_kmph":
+		return s.SpeedKmph
+	case "fuel_percent":
+		return s.FuelPercent
+	}
+	if s.EngineTemp != nil {
+		return *s.EngineTemp
+	}
+	return 0
+}
+
+func (v *scenarioVehicle) observe(s VehicleTelemetry) {
+	r := v.report
+	r.MaxSpeedKmph = math.Max(r.MaxSpeedKmph, s.SpeedKmph)
+	if s.EngineTemp != nil {
+		r.MaxEngineTemp = math.Max(r.MaxEngineTemp, *s.EngineTemp)
+	}
+	if r.Sent == 0 || s.FuelPercent < r.MinFuelPercent {
+		r.MinFuelPercent = s.FuelPercent
+	}
+}
+
+func contains(list []*scenarioVehicle, v *scenarioVehicle) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+// vehicles builds the scenario's vehicles in cohort order. Each gets its
+// own seed, so adding a cohort at the end does not change the others.
+func (sc *Scenario) vehicles() ([]*scenarioVehicle, error) {
+	var graph *RoadGraph
+	if sc.RoadGraph != "" {
+		data, err := os.ReadFile(sc.RoadGraph)
+		if err != nil {
+			return nil, err
+		}
+		if graph, err = LoadRoadGraph(data); err != nil {
+			return nil, fmt.Errorf("%s: %w", sc.RoadGraph, err)
+		}
+	}
+	routes := sc.routes()
+	spread := defaultRoutes
+	if len(sc.Routes) > 0 {
+		spread = sc.Routes
+	}
+	var out []*scenarioVehicle
+	for _, c := range sc.Cohorts {
+		phys := DefaultPhysics()
+		if c.StopProbability != nil {
+			phys.StopProbability = *c.StopProbability
+		}
+		for i := 0; i < c.Count; i++ {
+			n := len(out)
+			var p Planner
+			switch {
+			case c.Route == "graph", c.Route == "" && graph != nil:
+				p = graph.planner()
+			case c.Route != "":
+				p = routes[c.Route].planner()
+			default:
+				p = spread[n%len(spread)].planner()
+			}
+			v := NewVehicle(sc.Seed+int64(n), p, phys)
+			if i < len(c.IDs) {
+				v.ID = c.IDs[i]
+			}
+			if c.FuelPercent > 0 {
+				v.fuelPct = c.FuelPercent
+			}
+			out = append(out, &scenarioVehicle{
+				Vehicle: v,
+				report:  &VehicleReport{ID: v.ID, Cohort: c.Name, Index: i},
+				frozen:  make(map[string]float64),
+			})
+		}
+	}
+	return out, nil
+}
+
+// selectVehicles returns the vehicles t refers to.
+func (sc *Scenario) selectVehicles(all []*scenarioVehicle, t Target) []*scenarioVehicle {
+	var out []*scenarioVehicle
+	for _, v := range all {
+		if t.Cohort != "" && v.report.Cohort != t.Cohort {
+			continue
+		}
+		if len(t.Vehicles) == 0 {
+			out = append(out, v)
+			continue
+		}
+		for _, i := range t.Vehicles {
+			if v.report.Index == i {
+				out = append(out, v)
+			}
+		}
+	}
+	return out
+}
+
+// raisedAlert is the part of a notification-service alert the check reads.
+type raisedAlert struct {
+	VehicleID string    `json:"vehicle_id"`
+	Code      string    `json:"code"`
+	Rule      string    `json:"rule"`
+	Ts        time.Time `json:"ts"`
+}
+
+// check evaluates the expectations, polling the alert list until they are
+// all met or Check.Wait has passed.
+func (r *Run) check(ctx context.Context, vehicles []*scenarioVehicle, start time.Time) []ExpectationResult {
+	sc := r.Scenario
+	if len(sc.Expect) == 0 {
+		return nil
+	}
+	results := make([]ExpectationResult, len(sc.Expect))
+	ids := make([]map[string]bool, len(sc.Expect))
+	for i, e := range sc.Expect {
+		results[i] = ExpectationResult{Expectation: e.String(), Status: "unchecked"}
+		ids[i] = make(map[string]bool)
+		for _, v := range sc.selectVehicles(vehicles, e.Target) {
+			ids[i][v.ID] = true
+			results[i].Vehicles = append(results[i].Vehicles, v.ID)
+		}
+	}
+	if sc.Check.URL == "" {
+		return results
+	}
+	client := r.Client
+	if client == nil {
+		client = &http.Client{Timeout: 5 * time.Second}
+	}
+	deadline := time.Now().Add(sc.Check.Wait)
+	for {
+		alerts, err := fetchAlerts(ctx, client, sc.Check.URL, sc.Check.Token)
+		done := err == nil
+		for i, e := range sc.Expect {
+			if err != nil {
+				results[i].Status = "missed"
+				continue
+			}
+			found := 0
+			for _, a := range alerts {
+				if ids[i][a.VehicleID] && (e.Code == "" || a.Code == e.Code) && (e.Rule == "" || a.Rule == e.Rule) &&
+					!a.Ts.Before(start.Add(e.After)) && (e.Within == 0 || a.Ts.Before(start.Add(e.After+e.Within))) {
+					found++
+				}
+			}
+			results[i].Found = found
+			results[i].Status = "met"
+			if found < e.Min || (e.Max != nil && found > *e.Max) {
+				results[i].Status = "missed"
+			}
+			// an upper bound can only be confirmed once the wait is over
+			if results[i].Status == "missed" || e.Max != nil {
+				done = false
+			}
+		}
+		if done || !time.Now().Before(deadline) {
+			return results
+		}
+		select {
+		case <-ctx.Done():
+			return results
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+func fetchAlerts(ctx context.Context, client *http.Client, url, token string) ([]raisedAlert, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("alerts: status %d", resp.StatusCode)
+	}
+	var alerts []raisedAlert
+	if err := json.NewDecoder(resp.Body).Decode(&alerts); err != nil {
+		return nil, err
+	}
+	return alerts, nil
+}
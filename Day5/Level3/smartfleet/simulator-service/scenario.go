@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is a scripted run: cohorts of vehicles on given routes, faults
+// injected at given times and the alerts the run is expected to raise.
+//
+//	name: overspeed-and-theft
+//	seed: 42
+//	duration: 10m
+//	telemetry: {url: http://localhost:8081/telemetry, api_key: "${TELEMETRY_API_KEY}"}
+//	cohorts:
+//	  - {name: vans, count: 3, route: koramangala-hsr}
+//	faults:
+//	  - {type: overspeed, at: 1m, for: 40s, cohort: vans, vehicles: [0], speed_kmph: 130}
+//	expect:
+//	  - {code: OVERSPEED, cohort: vans, vehicles: [0], after: 1m, within: 3m}
+//
+// ${NAME} is replaced by the environment variable NAME before parsing.
+type Scenario struct {
+	Name     string        `yaml:"name"`
+	Seed     int64         `yaml:"seed"`     // default 1, so runs repeat
+	Duration time.Duration `yaml:"duration"` // simulated time
+	Interval time.Duration `yaml:"interval"` // between a vehicle's samples; default 1s
+	Speedup  float64       `yaml:"speedup"`  // simulated seconds per second; default 1
+
+	Telemetry struct {
+		URL    string `yaml:"url"`     // default TELEMETRY_URL
+		APIKey string `yaml:"api_key"` // default TELEMETRY_API_KEY
+		Format string `yaml:"format"`  // default SIM_FORMAT
+	} `yaml:"telemetry"`
+
+	RoadGraph string   `yaml:"road_graph"` // GeoJSON, relative to the scenario file
+	Routes    []Route  `yaml:"routes"`     // in addition to the built-in ones
+	Cohorts   []Cohort `yaml:"cohorts"`
+
+	Faults []Fault       `yaml:"faults"`
+	Expect []Expectation `yaml:"expect"`
+	Check  AlertCheck    `yaml:"check"`
+}
+
+// Cohort is a group of vehicles driving alike.
+type Cohort struct {
+	Name            string   `yaml:"name"`
+	Count           int      `yaml:"count"`            // default len(ids)
+	IDs             []string `yaml:"ids"`              // e.g. registered vehicles; the rest get random IDs
+	Route           string   `yaml:"route"`            // route name, or "graph" for road_graph
+	FuelPercent     float64  `yaml:"fuel_percent"`     // at the start; default random
+	StopProbability *float64 `yaml:"stop_probability"` // at intersections
+}
+
+// Fault types.
+const (
+	FaultOverspeed    = "overspeed"     // drive at speed_kmph, ignoring limits and stops
+	FaultGeofenceExit = "geofence_exit" // drive to lat, lon, wait there for `for`, come back
+	FaultFuelTheft    = "fuel_theft"    // lose drop_percent of a tank over `for`
+	FaultGPSDropout   = "gps_dropout"   // report position 0, 0
+	FaultSensorFreeze = "sensor_freeze" // sensor keeps reporting its value at `at`
+)
+
+// Sensors a sensor_freeze fault can freeze.
+var freezableSensors = []string{"speed_kmph", "fuel_percent", "engine_temp"}
+
+// Target selects vehicles: some or all of one cohort, or every vehicle.
+type Target struct {
+	Cohort   string `yaml:"cohort"`
+	Vehicles []int  `yaml:"vehicles"` // indexes in the cohort
+}
+
+// Fault is a scripted fault. It lasts from At for For, or to the end of
+// the run.
+type Fault struct {
+	Type   string        `yaml:"type"`
+	At     time.Duration `yaml:"at"`
+	For    time.Duration `yaml:"for"`
+	Target `yaml:",inline"`
+
+	SpeedKmph   float64 `yaml:"speed_kmph"`   // overspeed
+	Lat         float64 `yaml:"lat"`          // geofence_exit
+	Lon         float64 `yaml:"lon"`          // geofence_exit
+	DropPercent float64 `yaml:"drop_percent"` // fuel_theft
+	Sensor      string  `yaml:"sensor"`       // sensor_freeze; default engine_temp
+}
+
+// Until is when the fault is over.
+func (f *Fault) Until() time.Duration { return f.At + f.For }
+
+// Expectation is an alert the run should (or, with max: 0, should not)
+// raise for the targeted vehicles, with its event time in the window.
+type Expectation struct {
+	Code   string `yaml:"code"` // e.g. OVERSPEED
+	Rule   string `yaml:"rule"` // or the analytics rule, e.g. sensor_freeze_engine_temp
+	Target `yaml:",inline"`
+
+	After  time.Duration `yaml:"after"`  // window start, from the start of the run
+	Within time.Duration `yaml:"within"` // window length; default to the end of the run
+	Min    int           `yaml:"min"`    // default 1, or 0 with max
+	Max    *int          `yaml:"max"`
+}
+
+func (e *Expectation) String() string {
+	what := e.Code
+	if e.Rule != "" {
+		what = e.Rule
+	}
+	who := "all vehicles"
+	if e.Cohort != "" {
+		who = e.Cohort
+		if len(e.Vehicles) > 0 {
+			who = fmt.Sprintf("%s%v", e.Cohort, e.Vehicles)
+		}
+	}
+	window := fmt.Sprintf("after %s", e.After)
+	if e.Within > 0 {
+		window = fmt.Sprintf("%s..%s", e.After, e.After+e.Within)
+	}
+	if e.Max != nil {
+		return fmt.Sprintf("%d..%d %s for %s %s", e.Min, *e.Max, what, who, window)
+	}
+	return fmt.Sprintf("at least %d %s for %s %s", e.Min, what, who, window)
+}
+
+// AlertCheck says where to look for the expected alerts. Without a URL the
+// expectations are reported but not checked.
+type AlertCheck struct {
+	URL   string        `yaml:"url"`   // notification-service /alerts
+	Token string        `yaml:"token"` // its API key
+	Wait  time.Duration `yaml:"wait"`  // for alerts after the run; default 30s
+}
+
+// LoadScenario reads a scenario file.
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	sc, err := ParseScenario(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if sc.RoadGraph != "" && !filepath.IsAbs(sc.RoadGraph) {
+		sc.RoadGraph = filepath.Join(filepath.Dir(path), sc.RoadGraph)
+	}
+	return sc, nil
+}
+
+// ParseScenario parses and checks a scenario, filling in defaults.
+func ParseScenario(data []byte) (*Scenario, error) {
+	dec := yaml.NewDecoder(bytes.NewReader([]byte(os.ExpandEnv(string(data)))))
+	dec.KnownFields(true)
+	var sc Scenario
+	if err := dec.Decode(&sc); err != nil {
+		return nil, err
+	}
+	if err := sc.validate(); err != nil {
+		return nil, err
+	}
+	return &sc, nil
+}
+
+func (sc *Scenario) validate() error {
+	if sc.Duration <= 0 {
+		return errors.New("duration required")
+	}
+	if sc.Seed == 0 {
+		sc.Seed = 1
+	}
+	if sc.Interval == 0 {
+		sc.Interval = time.Second
+	}
+	if sc.Interval < 0 || sc.Speedup < 0 {
+		return errors.New("interval and speedup must be positive")
+	}
+	if sc.Speedup == 0 {
+		sc.Speedup = 1
+	}
+	if sc.Telemetry.URL == "" {
+		sc.Telemetry.URL = conf.TelemetryURL
+	}
+	if sc.Telemetry.APIKey == "" {
+		sc.Telemetry.APIKey = conf.TelemetryKey
+	}
+	if sc.Telemetry.Format == "" {
+		sc.Telemetry.Format = conf.Format
+	}
+	if _, err := formatByName(sc.Telemetry.Format); err != nil {
+		return err
+	}
+	if sc.Check.Wait == 0 {
+		sc.Check.Wait = 30 * time.Second
+	}
+	if len(sc.Routes) > 0 {
+		if err := checkRoutes(sc.Routes); err != nil {
+			return fmt.Errorf("routes: %w", err)
+		}
+	}
+	routes := sc.routes()
+
+	if len(sc.Cohorts) == 0 {
+		return errors.New("no cohorts")
+	}
+	cohorts := make(map[string]*Cohort)
+	for i := range sc.Cohorts {
+		c := &sc.Cohorts[i]
+		if c.Name == "" || cohorts[c.Name] != nil {
+			return fmt.Errorf("cohort %d: missing or duplicate name %q", i, c.Name)
+		}
+		cohorts[c.Name] = c
+		if c.Count == 0 {
+			c.Count = len(c.IDs)
+		}
+		if c.Count <= 0 || len(c.IDs) > c.Count {
+			return fmt.Errorf("cohort %s: count %d with %d ids", c.Name, c.Count, len(c.IDs))
+		}
+		switch {
+		case c.Route == "graph" && sc.RoadGraph == "":
+			return fmt.Errorf("cohort %s: route graph without road_graph", c.Name)
+		case c.Route != "" && c.Route != "graph" && routes[c.Route] == nil:
+			return fmt.Errorf("cohort %s: unknown route %q", c.Name, c.Route)
+		}
+		if c.FuelPercent < 0 || c.FuelPercent > 100 {
+			return fmt.Errorf("cohort %s: fuel_percent %v", c.Name, c.FuelPercent)
+		}
+	}
+	target := func(t Target) error {
+		if t.Cohort == "" {
+			if len(t.Vehicles) > 0 {
+				return errors.New("vehicles without cohort")
+			}
+			return nil
+		}
+		c := cohorts[t.Cohort]
+		if c == nil {
+			return fmt.Errorf("unknown cohort %q", t.Cohort)
+		}
+		for _, i := range t.Vehicles {
+			if i < 0 || i >= c.Count {
+				return fmt.Errorf("cohort %s has no vehicle %d", t.Cohort, i)
+			}
+		}
+		return nil
+	}
+
+	for i := range sc.Faults {
+		f := &sc.Faults[i]
+		if err := sc.validateFault(f); err != nil {
+			return fmt.Errorf("fault %d (%s): %w", i, f.Type, err)
+		}
+		if err := target(f.Target); err != nil {
+			return fmt.Errorf("fault %d (%s): %w", i, f.Type, err)
+		}
+	}
+	for i := range sc.Expect {
+		e := &sc.Expect[i]
+		if (e.Code == "") == (e.Rule == "") {
+			return fmt.Errorf("expectation %d: want one of code and rule", i)
+		}
+		if err := target(e.Target); err != nil {
+			return fmt.Errorf("expectation %d: %w", i, err)
+		}
+		if e.Min == 0 && e.Max == nil {
+			e.Min = 1
+		}
+		if e.After < 0 || e.Within < 0 || e.Min < 0 || (e.Max != nil && *e.Max < e.Min) {
+			return fmt.Errorf("expectation %d: bad window or bounds", i)
+		}
+	}
+	return nil
+}
+
+func (sc *Scenario) validateFault(f *Fault) error {
+	if f.At < 0 || f.At >= sc.Duration || f.For < 0 {
+		return fmt.Errorf("at %s for %s is outside the run", f.At, f.For)
+	}
+	if f.For == 0 {
+		switch f.Type {
+		case FaultGeofenceExit, FaultFuelTheft:
+			f.For = time.Minute
+		default:
+			f.For = sc.Duration - f.At
+		}
+	}
+	switch f.Type {
+	case FaultOverspeed:
+		if f.SpeedKmph <= 0 {
+			return errors.New("speed_kmph required")
+		}
+	case FaultGeofenceExit:
+		if f.Lat == 0 && f.Lon == 0 || f.Lat < -90 || f.Lat > 90 || f.Lon < -180 || f.Lon > 180 {
+			return errors.New("lat and lon required")
+		}
+	case FaultFuelTheft:
+		if f.DropPercent <= 0 || f.DropPercent > 100 {
+			return errors.New("drop_percent must be in (0, 100]")
+		}
+	case FaultGPSDropout:
+	case FaultSensorFreeze:
+		if f.Sensor == "" {
+			f.Sensor = "engine_temp"
+		}
+		for _, s := range freezableSensors {
+			if f.Sensor == s {
+				return nil
+			}
+		}
+		return fmt.Errorf("sensor %q, want one of %v", f.Sensor, freezableSensors)
+	default:
+		return errors.New("unknown fault type")
+	}
+	return nil
+}
+
+// routes are the built-in routes and the scenario's, by name.
+func (sc *Scenario) routes() map[string]*Route {
+	m := make(map[string]*Route)
+	for _, list := range [][]Route{defaultRoutes, sc.Routes} {
+		for i := range list {
+			m[list[i].Name] = &list[i]
+		}
+	}
+	return m
+}
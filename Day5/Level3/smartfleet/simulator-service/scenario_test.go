@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadScenarioExample(t *testing.T) {
+	t.Setenv("TELEMETRY_API_KEY", "k1")
+	sc, err := LoadScenario("scenarios/alerts-e2e.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sc.Telemetry.APIKey != "k1" || sc.Seed != 42 || sc.Speedup != 1 {
+		t.Errorf("scenario = %+v", sc)
+	}
+	if f := sc.Faults[4]; f.For != sc.Duration-f.At {
+		t.Errorf("open-ended fault lasts %s", f.For)
+	}
+	if e := sc.Expect[0]; e.Min != 1 || e.Max != nil {
+		t.Errorf("default bounds %d %v", e.Min, e.Max)
+	}
+}
+
+func TestParseScenarioErrors(t *testing.T) {
+	base := "duration: 1m\ncohorts: [{name: a, count: 2}]\n"
+	for _, tc := range []struct{ yaml, want string }{
+		{"cohorts: [{name: a, count: 1}]", "duration"},
+		{"duration: 1m", "no cohorts"},
+		{"duration: 1m\ncohorts: [{name: a, count: 1}, {name: a, count: 1}]", "duplicate"},
+		{"duration: 1m\ncohorts: [{name: a, ids: [x, y], count: 1}]", "count"},
+		{"duration: 1m\ncohorts: [{name: a, count: 1, route: nowhere}]", "unknown route"},
+		{"duration: 1m\ncohorts: [{name: a, count: 1, route: graph}]", "road_graph"},
+		{"duration: 1m\ncohorts: [{name: a, count: 1}]\nspeed: 3", "not found"},
+		{base + "faults: [{type: overspeed, at: 10s}]", "speed_kmph"},
+		{base + "faults: [{type: overspeed, at: 2m, speed_kmph: 100}]", "outside"},
+		{base + "faults: [{type: teleport, at: 1s}]", "unknown fault"},
+		{base + "faults: [{type: gps_dropout, at: 1s, cohort: b}]", "unknown cohort"},
+		{base + "faults: [{type: gps_dropout, at: 1s, cohort: a, vehicles: [2]}]", "no vehicle 2"},
+		{base + "faults: [{type: sensor_freeze, at: 1s, sensor: tyre}]", "sensor"},
+		{base + "faults: [{type: geofence_exit, at: 1s}]", "lat and lon"},
+		{base + "faults: [{type: fuel_theft, at: 1s, drop_percent: 120}]", "drop_percent"},
+		{base + "expect: [{cohort: a}]", "code and rule"},
+		{base + "expect: [{code: X, min: 2, max: 1}]", "bounds"},
+	} {
+		_, err := ParseScenario([]byte(tc.yaml))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%q: err = %v, want %q", tc.yaml, err, tc.want)
+		}
+	}
+}
+
+type captureSender struct {
+	mu      sync.Mutex
+	samples map[string][]VehicleTelemetry
+}
+
+func (c *captureSender) Send(_ context.Context, t VehicleTelemetry) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.samples[t.VehicleID] = append(c.samples[t.VehicleID], t)
+	if t.Latitude == 0 {
+		return http.StatusBadRequest, nil
+	}
+	return http.StatusAccepted, nil
+}
+
+const testScenario = `
+name: faults
+seed: 3
+duration: 5m
+cohorts:
+  - {name: vans, count: 5, ids: [van-0], route: mg-road-indiranagar, fuel_percent: 60}
+faults:
+  - {type: overspeed, at: 1m, for: 40s, cohort: vans, vehicles: [0], speed_kmph: 120}
+  - {type: geofence_exit, at: 30s, for: 1m, cohort: vans, vehicles: [1], lat: 12.99, lon: 77.62}
+  - {type: fuel_theft, at: 1m, for: 30s, cohort: vans, vehicles: [2], drop_percent: 30}
+  - {type: gps_dropout, at: 2m, for: 20s, cohort: vans, vehicles: [3]}
+  - {type: sensor_freeze, at: 2m, cohort: vans, vehicles: [4], sensor: engine_temp}
+expect:
+  - {code: OVERSPEED, cohort: vans, vehicles: [0], after: 1m, within: 1m}
+  - {code: GPS_JUMP, cohort: vans, vehicles: [3]}
+  - {code: OVERSPEED, cohort: vans, vehicles: [4], max: 0}
+check:
+  wait: 1s
+`
+
+func TestScenarioRun(t *testing.T) {
+	sc, err := ParseScenario([]byte(testScenario))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start time.Time
+	alerts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			http.Error(w, "no", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode([]raisedAlert{
+			{VehicleID: "van-0", Code: "OVERSPEED", Ts: start.Add(70 * time.Second)},
+			{VehicleID: "van-0", Code: "OVERSPEED", Ts: start.Add(3 * time.Minute)}, // outside the window
+		})
+	}))
+	defer alerts.Close()
+	sc.Check.URL, sc.Check.Token = alerts.URL, "tok"
+
+	sender := &captureSender{samples: make(map[string][]VehicleTelemetry)}
+	var sent strings.Builder
+	run := &Run{Scenario: sc, Sender: sender, Sent: &sent,
+		pace: func(context.Context, time.Time, time.Duration) error { return nil }}
+	start = time.Now().Truncate(time.Second)
+	rep, err := run.Execute(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rep.Samples != 5*300 || len(rep.Vehicles) != 5 || strings.Count(sent.String(), "\n") != rep.Samples {
+		t.Fatalf("samples = %d, vehicles = %d", rep.Samples, len(rep.Vehicles))
+	}
+	if rep.Status["400"] != 20 || rep.Status["202"] != rep.Samples-20 {
+		t.Errorf("status = %v", rep.Status)
+	}
+	if rep.Faults[3].Samples != 20 {
+		t.Errorf("gps dropout covered %d samples", rep.Faults[3].Samples)
+	}
+	ids := make([]string, 5)
+	for i, v := range rep.Vehicles {
+		ids[i] = v.ID
+	}
+	if ids[0] != "van-0" || ids[1] == ids[2] {
+		t.Fatalf("ids = %v", ids)
+	}
+	at := func(id string, d time.Duration) VehicleTelemetry {
+		return sender.samples[id][int(d/time.Second)-1]
+	}
+
+	// overspeed: well over the limit while it lasts, back under afterwards
+	if s := at(ids[0], 100*time.Second); s.SpeedKmph < 110 {
+		t.Errorf("speed during overspeed %.1f", s.SpeedKmph)
+	}
+	if rep.Vehicles[0].MaxSpeedKmph > 121 {
+		t.Errorf("max speed %.1f", rep.Vehicles[0].MaxSpeedKmph)
+	}
+	if s := at(ids[0], 4*time.Minute); s.SpeedKmph > 60 {
+		t.Errorf("speed after overspeed %.1f", s.SpeedKmph)
+	}
+	// geofence exit: reaches the point and comes back
+	target := LatLon{12.99, 77.62}
+	closest := 1e9
+	for _, s := range sender.samples[ids[1]] {
+		if d := distanceM(LatLon{s.Latitude, s.Longitude}, target); d < closest {
+			closest = d
+		}
+	}
+	if closest > 1 {
+		t.Errorf("diverted vehicle got within %.0f m of the target", closest)
+	}
+	// fuel theft: 30% gone in 30s
+	if before, after := at(ids[2], time.Minute), at(ids[2], 90*time.Second); before.FuelPercent-after.FuelPercent < 29 {
+		t.Errorf("fuel went from %.1f to %.1f", before.FuelPercent, after.FuelPercent)
+	}
+	// sensor freeze: the same engine temperature from 2m on
+	frozen := *at(ids[4], 2*time.Minute+time.Second).EngineTemp
+	for _, d := range []time.Duration{150 * time.Second, 5 * time.Minute} {
+		if got := *at(ids[4], d).EngineTemp; got != frozen {
+			t.Errorf("engine temp at %s = %v, want frozen %v", d, got, frozen)
+		}
+	}
+	if *at(ids[4], 2*time.Minute).EngineTemp == *at(ids[4], time.Minute).EngineTemp {
+		t.Error("engine temp frozen before the fault")
+	}
+
+	want := []struct {
+		status string
+		found  int
+	}{{"met", 1}, {"missed", 0}, {"met", 0}}
+	for i, w := range want {
+		if e := rep.Expectations[i]; e.Status != w.status || e.Found != w.found {
+			t.Errorf("expectation %d = %+v, want %s with %d", i, e, w.status, w.found)
+		}
+	}
+	if rep.Passed {
+		t.Error("run passed with a missed expectation")
+	}
+
+	// same seed, same samples
+	again := &captureSender{samples: make(map[string][]VehicleTelemetry)}
+	sc.Expect = nil
+	run = &Run{Scenario: sc, Sender: again, pace: run.pace}
+	if _, err := run.Execute(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for id, list := range sender.samples {
+		for i, s := range list {
+			s.Timestamp = 0
+			o := again.samples[id][i]
+			o.Timestamp = 0
+			if !sameSample(s, o) {
+				t.Fatalf("%s sample %d differs: %+v vs %+v", id, i, s, o)
+			}
+		}
+	}
+}
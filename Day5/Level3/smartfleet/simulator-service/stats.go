@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Deliveries counts one vehicle's samples by outcome.
+type Deliveries struct {
+	VehicleID string            `json:"vehicle_id,omitempty"`
+	Sent      uint64            `json:"sent"`
+	Accepted  uint64            `json:"accepted"` // 2xx
+	Rejected  uint64            `json:"rejected"` // other statuses
+	Failed    uint64            `json:"failed"`   // not delivered
+	Status    map[string]uint64 `json:"status"`   // HTTP status (or "error") -> samples
+	LastError string            `json:"last_error,omitempty"`
+}
+
+func (d *Deliveries) add(status int, err error) {
+	d.Sent++
+	key := strconv.Itoa(status)
+	switch {
+	case err != nil:
+		d.Failed++
+		d.LastError = err.Error()
+		key = "error"
+	case status >= 200 && status < 300:
+		d.Accepted++
+	default:
+		d.Rejected++
+	}
+	if d.Status == nil {
+		d.Status = make(map[string]uint64)
+	}
+	d.Status[key]++
+}
+
+// DeliveryStats keeps Deliveries for every simulated vehicle.
+type DeliveryStats struct {
+	mu       sync.Mutex
+	vehicles map[string]*Deliveries
+}
+
+func NewDeliveryStats() *DeliveryStats {
+	return &DeliveryStats{vehicles: make(map[string]*Deliveries)}
+}
+
+// Record counts a sample of vehicleID that got status, or err.
+func (s *DeliveryStats) Record(vehicleID string, status int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d := s.vehicles[vehicleID]
+	if d == nil {
+		d = &Deliveries{VehicleID: vehicleID}
+		s.vehicles[vehicleID] = d
+	}
+	d.add(status, err)
+}
+
+// Snapshot returns the totals and a copy of every vehicle's counts, by ID.
+func (s *DeliveryStats) Snapshot() (Deliveries, []Deliveries) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := Deliveries{Status: make(map[string]uint64)}
+	list := make([]Deliveries, 0, len(s.vehicles))
+	for _, d := range s.vehicles {
+		c := *d
+		c.Status = make(map[string]uint64, len(d.Status))
+		for k, n := range d.Status {
+			c.Status[k] = n
+			total.Status[k] += n
+		}
+		list = append(list, c)
+		total.Sent += d.Sent
+		total.Accepted += d.Accepted
+		total.Rejected += d.Rejected
+		total.Failed += d.Failed
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].VehicleID < list[j].VehicleID })
+	return total, list
+}
+
+// ServeHTTP serves GET /stats.
+func (s *DeliveryStats) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	total, list := s.Snapshot()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"format":    conf.Format,
+		"transport": conf.Transport,
+		"total":     total,
+		"vehicles":  list,
+	})
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A trace is recorded telemetry to replay. Three kinds are read:
+//
+//   - csv: a header row naming the columns, then one sample per row
+//   - ndjson: one JSON object per line
+//   - gpx: position-only tracks; speed is derived from the points
+//
+// CSV and NDJSON accept the field names of the simulator, smartfleet v1 and
+// volkswagen-fleet (see traceFields). Times are RFC 3339, unix seconds or
+// unix milliseconds.
+
+// TraceEvent is one recorded sample.
+type TraceEvent struct {
+	At     time.Time
+	Sample VehicleTelemetry
+}
+
+// Trace is recorded telemetry by vehicle, each in time order.
+type Trace struct {
+	Vehicles map[string][]TraceEvent
+	Start    time.Time // earliest event
+	End      time.Time // latest event
+}
+
+// traceFields maps each sample field to the names it is recorded under.
+var traceFields = map[string][]string{
+	"vehicle": {"vehicle_id", "vehicle", "id"},
+	"time":    {"ts", "timestamp", "time"},
+	"speed":   {"speed_kmph", "speed"},
+	"fuel":    {"fuel_percent", "fuel_level", "fuel"},
+	"lat":     {"latitude", "lat"},
+	"lon":     {"longitude", "lon", "lng"},
+	"temp":    {"engine_temp", "temperature"},
+}
+
+// LoadTrace reads trace files, of the given kind or, if kind is empty, the
+// kind their extension says. GPX tracks without a vehicle name are named
+// after their file.
+func LoadTrace(paths []string, kind string) (*Trace, error) {
+	t := &Trace{Vehicles: make(map[string][]TraceEvent)}
+	for _, path := range paths {
+		k := kind
+		if k == "" {
+			k = traceKind(path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+		events, err := ReadTrace(f, k, name)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for _, ev := range events {
+			t.Vehicles[ev.Sample.VehicleID] = append(t.Vehicles[ev.Sample.VehicleID], ev)
+		}
+	}
+	if len(t.Vehicles) == 0 {
+		return nil, errors.New("trace has no events")
+	}
+	for id, events := range t.Vehicles {
+		sort.SliceStable(events, func(i, j int) bool { return events[i].At.Before(events[j].At) })
+		if first := events[0].At; t.Start.IsZero() || first.Before(t.Start) {
+			t.Start = first
+		}
+		if last := events[len(events)-1].At; last.After(t.End) {
+			t.End = last
+		}
+		t.Vehicles[id] = events
+	}
+	return t, nil
+}
+
+func traceKind(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".gpx":
+		return "gpx"
+	case ".ndjson", ".jsonl", ".json":
+		return "ndjson"
+	}
+	return "csv"
+}
+
+// ReadTrace reads events of one kind: csv, ndjson or gpx. vehicle names
+// GPX tracks that have no name of their own.
+func ReadTrace(r io.Reader, kind, vehicle string) ([]TraceEvent, error) {
+	switch kind {
+	case "csv":
+		return readCSVTrace(r)
+	case "ndjson":
+		return readNDJSONTrace(r)
+	case "gpx":
+		return readGPXTrace(r, vehicle)
+	}
+	return nil, fmt.Errorf("unknown trace kind %q (want csv, ndjson or gpx)", kind)
+}
+
+func readCSVTrace(r io.Reader) ([]TraceEvent, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("header: %w", err)
+	}
+	var events []TraceEvent
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		fields := make(map[string]string, len(row))
+		for i, v := range row {
+			fields[strings.ToLower(strings.TrimSpace(header[i]))] = v
+		}
+		ev, err := traceEvent(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		events = append(events, ev)
+	}
+}
+
+func readNDJSONTrace(r io.Reader) ([]TraceEvent, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	var events []TraceEvent
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(text))
+		dec.UseNumber()
+		var obj map[string]interface{}
+		if err := dec.Decode(&obj); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		fields := make(map[string]string, len(obj))
+		for k, v := range obj {
+			if v != nil {
+				fields[strings.ToLower(k)] = fmt.Sprint(v)
+			}
+		}
+		ev, err := traceEvent(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		events = append(events, ev)
+	}
+	return events, sc.Err()
+}
+
+// traceEvent builds an event from named fields. Vehicle and time are
+// required; a missing fuel level is -1 and a missing engine temperature
+// is left out, as telemetry-service expects of sensors a vehicle lacks.
+func traceEvent(fields map[string]string) (TraceEvent, error) {
+	get := func(field string) (string, bool) {
+		for _, name := range traceFields[field] {
+			if v, ok := fields[name]; ok && strings.TrimSpace(v) != "" {
+				return strings.TrimSpace(v), true
+			}
+		}
+		return "", false
+	}
+	var ev TraceEvent
+	id, ok := get("vehicle")
+	if !ok {
+		return ev, errors.New("no vehicle_id")
+	}
+	ts, ok := get("time")
+	if !ok {
+		return ev, errors.New("no timestamp")
+	}
+	at, err := parseTraceTime(ts)
+	if err != nil {
+		return ev, err
+	}
+	num := func(field string, def float64) (float64, error) {
+		v, ok := get(field)
+		if !ok {
+			return def, nil
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", field, err)
+		}
+		return f, nil
+	}
+	s := VehicleTelemetry{VehicleID: id, Timestamp: at.UnixMilli()}
+	if s.SpeedKmph, err = num("speed", 0); err != nil {
+		return ev, err
+	}
+	if s.FuelPercent, err = num("fuel", -1); err != nil {
+		return ev, err
+	}
+	if s.Latitude, err = num("lat", 0); err != nil {
+		return ev, err
+	}
+	if s.Longitude, err = num("lon", 0); err != nil {
+		return ev, err
+	}
+	if _, ok := get("temp"); ok {
+		temp, err := num("temp", 0)
+		if err != nil {
+			return ev, err
+		}
+		s.EngineTemp = &temp
+	}
+	return TraceEvent{At: at, Sample: s}, nil
+}
+
+// parseTraceTime reads RFC 3339, or a unix time in seconds (possibly
+// fractional) or milliseconds.
+func parseTraceTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("bad time %q", v)
+	}
+	if f > 1e11 { // milliseconds: 1e11 seconds is the year 5138
+		return time.UnixMilli(int64(f)), nil
+	}
+	return time.UnixMilli(int64(f * 1000)), nil
+}
+
+type gpxFile struct {
+	Tracks []struct {
+		Name     string `xml:"name"`
+		Segments []struct {
+			Points []struct {
+				Lat  float64 `xml:"lat,attr"`
+				Lon  float64 `xml:"lon,attr"`
+				Time string  `xml:"time"`
+			} `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+}
+
+// readGPXTrace reads the tracks of a GPX file, one vehicle per track. GPX
+// records positions only: speed comes from the distance between points and
+// fuel and engine temperature are not reported.
+func readGPXTrace(r io.Reader, vehicle string) ([]TraceEvent, error) {
+	var g gpxFile
+	if err := xml.NewDecoder(r).Decode(&g); err != nil {
+		return nil, err
+	}
+	var events []TraceEvent
+	for i, trk := range g.Tracks {
+		id := strings.TrimSpace(trk.Name)
+		if id == "" {
+			id = vehicle
+			if len(g.Tracks) > 1 {
+				id = fmt.Sprintf("%s-%d", vehicle, i+1)
+			}
+		}
+		for _, seg := range trk.Segments {
+			var prev *TraceEvent
+			for _, p := range seg.Points {
+				if p.Time == "" {
+					return nil, fmt.Errorf("track %q: point without time", id)
+				}
+				at, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(p.Time))
+				if err != nil {
+					return nil, fmt.Errorf("track %q: %w", id, err)
+				}
+				ev := TraceEvent{At: at, Sample: VehicleTelemetry{
+					VehicleID:   id,
+					FuelPercent: -1,
+					Latitude:    p.Lat,
+					Longitude:   p.Lon,
+					Timestamp:   at.UnixMilli(),
+				}}
+				if prev != nil {
+					if dt := at.Sub(prev.At).Hours(); dt > 0 {
+						km := distanceM(LatLon{prev.Sample.Latitude, prev.Sample.Longitude}, LatLon{p.Lat, p.Lon}) / 1000
+						ev.Sample.SpeedKmph = km / dt
+					}
+				}
+				events = append(events, ev)
+				prev = &events[len(events)-1]
+			}
+		}
+	}
+	if len(events) == 0 {
+		return nil, errors.New("no track points")
+	}
+	return events, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCSVTrace(t *testing.T) {
+	in := `vehicle_id,timestamp,speed,fuel_level,lat,lon,temperature
+v1,2024-05-01T10:00:00Z,42.5,80,12.97,77.59,91
+v1,1714557601,43,79.9,12.971,77.591,
+v2,1714557600500,0,,12.9,77.6,
+`
+	events, err := ReadTrace(strings.NewReader(in), "csv", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("%d events, want 3", len(events))
+	}
+	first := events[0].Sample
+	if first.VehicleID != "v1" || first.SpeedKmph != 42.5 || first.FuelPercent != 80 ||
+		first.Latitude != 12.97 || first.EngineTemp == nil || *first.EngineTemp != 91 {
+		t.Errorf("first = %+v", first)
+	}
+	if got := events[1].At.Sub(events[0].At); got != time.Second {
+		t.Errorf("unix seconds: gap %s, want 1s", got)
+	}
+	if got := events[2].At.Sub(events[0].At); got != 500*time.Millisecond {
+		t.Errorf("unix millis: gap %s, want 500ms", got)
+	}
+	if s := events[2].Sample; s.FuelPercent != -1 || s.EngineTemp != nil || s.Timestamp != 1714557600500 {
+		t.Errorf("missing sensors: %+v", s)
+	}
+	for _, bad := range []string{
+		"speed,ts\n1,1714557600\n",               // no vehicle
+		"vehicle_id,speed\nv1,1\n",               // no time
+		"vehicle_id,ts,speed\nv1,1714557600,x\n", // bad number
+		"vehicle_id,ts\nv1,yesterday\n",          // bad time
+	} {
+		if _, err := ReadTrace(strings.NewReader(bad), "csv", ""); err == nil {
+			t.Errorf("accepted %q", bad)
+		}
+	}
+}
+
+func TestReadNDJSONTrace(t *testing.T) {
+	// smartfleet v1 and the simulator's own record, as captured or logged
+	in := `{"vehicle_id":"v1","speed":50,"fuel_level":-1,"latitude":12.9,"longitude":77.6,"ts":1714557600000,"engine_temp":88.5}
+
+{"vehicle_id":"v1","speed_kmph":51,"fuel_percent":70,"latitude":12.91,"longitude":77.61,"ts":1714557602000}
+`
+	events, err := ReadTrace(strings.NewReader(in), "ndjson", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("%d events, want 2", len(events))
+	}
+	if s := events[0].Sample; s.FuelPercent != -1 || s.EngineTemp == nil || *s.EngineTemp != 88.5 || s.Longitude != 77.6 {
+		t.Errorf("first = %+v", s)
+	}
+	if s := events[1].Sample; s.SpeedKmph != 51 || s.FuelPercent != 70 || s.EngineTemp != nil {
+		t.Errorf("second = %+v", s)
+	}
+	if _, err := ReadTrace(strings.NewReader("{not json}\n"), "ndjson", ""); err == nil {
+		t.Error("accepted bad JSON")
+	}
+}
+
+func TestReadGPXTrace(t *testing.T) {
+	in := `<?xml version="1.0"?>
+<gpx version="1.1" xmlns="http://www.topografix.com/GPX/1/1">
+  <trk><trkseg>
+    <trkpt lat="12.9716" lon="77.5946"><time>2024-05-01T10:00:00Z</time></trkpt>
+    <trkpt lat="12.9716" lon="77.5956"><time>2024-05-01T10:00:10Z</time></trkpt>
+  </trkseg></trk>
+</gpx>`
+	events, err := ReadTrace(strings.NewReader(in), "gpx", "van-7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("%d events, want 2", len(events))
+	}
+	s := events[1].Sample
+	if s.VehicleID != "van-7" || s.FuelPercent != -1 || s.EngineTemp != nil {
+		t.Errorf("sample = %+v", s)
+	}
+	// 0.001° of longitude at this latitude is about 108 m, in 10 s
+	want := distanceM(LatLon{12.9716, 77.5946}, LatLon{12.9716, 77.5956}) / 10 * 3.6
+	if events[0].Sample.SpeedKmph != 0 || math.Abs(s.SpeedKmph-want) > 1e-9 || s.SpeedKmph < 35 || s.SpeedKmph > 45 {
+		t.Errorf("speed = %v, want %v", s.SpeedKmph, want)
+	}
+}
+
+func TestLoadTrace(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	csvPath := write("day.csv", "vehicle_id,ts,speed\nv1,1714557610,1\nv1,1714557600,2\n")
+	jsonPath := write("night.jsonl", `{"vehicle_id":"v2","ts":1714557605,"speed":3}`+"\n")
+	trace, err := LoadTrace([]string{csvPath, jsonPath}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Vehicles) != 2 || trace.End.Sub(trace.Start) != 10*time.Second {
+		t.Fatalf("trace: %d vehicles from %s to %s", len(trace.Vehicles), trace.Start, trace.End)
+	}
+	if v1 := trace.Vehicles["v1"]; v1[0].Sample.SpeedKmph != 2 {
+		t.Errorf("v1 not in time order: %+v", v1)
+	}
+	if _, err := LoadTrace([]string{write("empty.csv", "vehicle_id,ts\n")}, ""); err == nil {
+		t.Error("accepted an empty trace")
+	}
+}
@@ -0,0 +1,10 @@
+// Command telemetry-service receives vehicle telemetry over HTTP and queues
+// it on Kafka. The service lives in package telemetry, where the pipeline
+// harness wires it up in process.
+package main
+
+import telemetry "smartfleet/telemetry-service"
+
+func main() {
+	telemetry.Main()
+}
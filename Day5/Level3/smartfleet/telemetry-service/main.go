@@ -1,22 +1,25 @@
-
-package main
+package telemetry
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
-	"sync/atomic"
+	"strings"
 	"syscall"
 	"time"
 
-	kafka "github.com/segmentio/kafka-go"
-	"github.com/redis/go-redis/v9"
+	"smartfleet/common/apikey"
+	"smartfleet/common/config"
+	commonkafka "smartfleet/common/kafka"
+	"smartfleet/common/lifecycle"
+	"smartfleet/common/logging"
+	commonredis "smartfleet/common/redis"
+	"smartfleet/common/registry"
+	"smartfleet/common/tracing"
 )
 
 // TelemetryPayload is the JSON schema accepted by this service.
@@ -27,40 +30,38 @@ type TelemetryPayload struct {
 	Lat       float64 `json:"latitude"`
 	Lon       float64 `json:"longitude"`
 	Ts        int64   `json:"ts"` // unix millis (optional - server will set if empty)
-}
 
-// configuration via env (12-factor)
-var (
-	httpAddr   = getenv("HTTP_ADDR", ":8081")
-	kafkaAddr  = getenv("KAFKA_BROKER", "kafka:9092")
-	kafkaTopic = getenv("KAFKA_TOPIC", "telemetry.events")
-	redisAddr  = getenv("REDIS_ADDR", "redis:6379")
-	redisTTL   = getenvInt("REDIS_TTL_SECONDS", 3600) // seconds
-)
-
-func getenv(key, def string) string {
-	if v := os.Getenv(key); v != "" {
-		return v
-	}
-	return def
+	// EV fields (optional; omitted by ICE vehicles)
+	BatteryPct *float64 `json:"battery_pct,omitempty"` // state of charge 0-100
+	Charging   *bool    `json:"charging,omitempty"`    // charger connected, if the vehicle reports it
+	EngineTemp *float64 `json:"engine_temp,omitempty"` // celsius
 }
 
-func getenvInt(key string, def int) int {
-	if s := os.Getenv(key); s != "" {
-		if n, err := strconv.Atoi(s); err == nil {
-			return n
-		}
-	}
-	return def
+// Config is the service configuration, from the environment, an optional
+// YAML file (-config) and flags; -print-config shows it.
+type Config struct {
+	HTTPAddr string         `yaml:"http_addr" env:"HTTP_ADDR" default:":8081"`
+	Log      config.Log     `yaml:"log"`
+	Tracing  config.Tracing `yaml:"tracing"`
+	Kafka    config.Kafka   `yaml:"kafka"`
+	Redis    config.Redis   `yaml:"redis"`
+	// how long the latest state of a vehicle is kept
+	LatestTTL time.Duration `yaml:"latest_ttl" env:"REDIS_TTL_SECONDS" default:"1h" unit:"s"`
+
+	// vehicle registry lookup (disabled when REGISTRY_URL is empty)
+	Registry            config.Registry `yaml:"registry"`
+	RegistryCacheTTL    time.Duration   `yaml:"registry_cache_ttl" env:"REGISTRY_CACHE_TTL_SECONDS" default:"5m" unit:"s"`
+	RegistryNegCacheTTL time.Duration   `yaml:"registry_negative_cache_ttl" env:"REGISTRY_NEGATIVE_CACHE_TTL_SECONDS" default:"30s" unit:"s"`
+	UnregisteredPolicy  string          `yaml:"unregistered_policy" env:"UNREGISTERED_POLICY" default:"quarantine" oneof:"reject quarantine"`
+	QuarantineTopic     string          `yaml:"quarantine_topic" env:"KAFKA_QUARANTINE_TOPIC" default:"telemetry.quarantine"`
+
+	// tenant authentication: "key1=tenantA,key2=tenantB"; empty rejects every
+	// request unless AuthDevMode puts them in X-Tenant-ID or the default tenant
+	APIKeys       string `yaml:"api_keys" env:"INGEST_API_KEYS" secret:"true"`
+	DefaultTenant string `yaml:"default_tenant" env:"DEFAULT_TENANT" default:"default"`
+	AuthDevMode   bool   `yaml:"auth_dev_mode" env:"AUTH_DEV_MODE" help:"without API keys, trust X-Tenant-ID; never in production"`
 }
 
-// global counters (atomic)
-var (
-	recvCounter uint64
-	okCounter   uint64
-	errCounter  uint64
-)
-
 // validate basic payload fields
 func (t *TelemetryPayload) Validate() error {
 	if t.VehicleID == "" {
@@ -77,135 +78,88 @@ func (t *TelemetryPayload) Validate() error {
 	if t.Lat < -90 || t.Lat > 90 || t.Lon < -180 || t.Lon > 180 {
 		return fmt.Errorf("invalid lat/lon")
 	}
+	if t.BatteryPct != nil && (*t.BatteryPct < 0 || *t.BatteryPct > 100) {
+		return fmt.Errorf("battery_pct out of range: %.2f", *t.BatteryPct)
+	}
+	if t.EngineTemp != nil && (*t.EngineTemp < -50 || *t.EngineTemp > 250) {
+		return fmt.Errorf("engine_temp out of range: %.2f", *t.EngineTemp)
+	}
 	return nil
 }
 
-func main() {
-	logger := log.New(os.Stdout, "[telemetry] ", log.LstdFlags|log.Lmsgprefix)
-
-	// Kafka writer (producer)
-	kWriter := kafka.NewWriter(kafka.WriterConfig{
-		Brokers:  []string{kafkaAddr},
-		Topic:    kafkaTopic,
-		Balancer: &kafka.Hash{}, // Keyed by vehicle id for ordering
-		Async:    false,
-	})
-	defer func() {
-		_ = kWriter.Close()
-	}()
-
-	// Redis client
-	rdb := redis.NewClient(&redis.Options{
-		Addr: redisAddr,
-	})
-	defer func() {
-		_ = rdb.Close()
-	}()
-
-	// Verify connectivity
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	if err := kWriter.Close(); err != nil {
-		// we created writer then closed immediately to verify; recreate real writer
-		// re-create writer for normal operation
-		kWriter = kafka.NewWriter(kafka.WriterConfig{
-			Brokers:  []string{kafkaAddr},
-			Topic:    kafkaTopic,
-			Balancer: &kafka.Hash{},
-		})
+// Main runs telemetry-service until it is signalled to stop.
+func Main() {
+	var cfg Config
+	config.MustLoad("telemetry-service", &cfg)
+	logs, err := logging.New("telemetry-service", cfg.Log, nil)
+	if err != nil {
+		log.Fatalf("[telemetry] %v", err)
 	}
-	// Ping Redis
-	if err := rdb.Ping(ctx).Err(); err != nil {
-		logger.Fatalf("redis ping failed: %v", err)
+	defer logs.Sync()
+	logger := logs.Std("main")
+
+	// dependencies come up in any order under compose: wait for them
+	// until they answer or the process is signalled
+	startCtx, started := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	var clients lifecycle.Closer
+	stopTracing, err := tracing.Setup(startCtx, "telemetry-service", cfg.Tracing)
+	if err != nil {
+		logger.Fatalf("%v", err)
 	}
+	clients.Add("tracing", stopTracing) // closed last: flushes the spans of the others
+	rdb, err := commonredis.NewClient(startCtx, cfg.Redis, logs.Std("redis"))
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	clients.Add("redis", rdb.Close)
+	kWriter, err := commonkafka.NewProducer(startCtx, cfg.Kafka, cfg.Kafka.Topic, logs.Std("kafka"))
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	clients.Add("kafka writer", kWriter.Close) // closing flushes
 
-	// HTTP handlers
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/telemetry", func(w http.ResponseWriter, r *http.Request) {
-		atomic.AddUint64(&recvCounter, 1)
-		if r.Method != http.MethodPost {
-			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
-			atomic.AddUint64(&errCounter, 1)
-			return
-		}
-		var tp TelemetryPayload
-		dec := json.NewDecoder(r.Body)
-		dec.DisallowUnknownFields()
-		if err := dec.Decode(&tp); err != nil {
-			http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
-			atomic.AddUint64(&errCounter, 1)
-			return
-		}
-		// set timestamp server-side if missing or unreasonable
-		if tp.Ts <= 0 {
-			tp.Ts = time.Now().UnixMilli()
-		}
-		if err := tp.Validate(); err != nil {
-			http.Error(w, "validation error: "+err.Error(), http.StatusBadRequest)
-			atomic.AddUint64(&errCounter, 1)
-			return
-		}
-
-		// marshal payload for kafka and redis
-		value, err := json.Marshal(tp)
-		if err != nil {
-			http.Error(w, "internal error", http.StatusInternalServerError)
-			atomic.AddUint64(&errCounter, 1)
-			return
-		}
-
-		// Write to Kafka with short timeout
-		kctx, kcancel := context.WithTimeout(r.Context(), 3*time.Second)
-		defer kcancel()
-		msg := kafka.Message{
-			Key:   []byte(tp.VehicleID),
-			Value: value,
-			Time:  time.UnixMilli(tp.Ts),
-		}
-		if err := kWriter.WriteMessages(kctx, msg); err != nil {
-			logger.Printf("kafka write failed: %v", err)
-			http.Error(w, "enqueue failed", http.StatusInternalServerError)
-			atomic.AddUint64(&errCounter, 1)
-			return
-		}
+	auth, err := apikey.New(cfg.APIKeys, "", cfg.DefaultTenant, cfg.AuthDevMode)
+	if err != nil {
+		logger.Fatalf("INGEST_API_KEYS: %v", err)
+	}
+	switch {
+	case auth.DevMode():
+		logger.Printf("AUTH_DEV_MODE: telemetry is attributed to X-Tenant-ID, or else tenant %q", cfg.DefaultTenant)
+	case !auth.Enabled():
+		logger.Printf("INGEST_API_KEYS not set: all telemetry is rejected")
+	}
+	srv := &Server{
+		Auth:      auth,
+		Publisher: kWriter,
+		Cache:     NewRedisCache(rdb),
+		CacheTTL:  cfg.LatestTTL,
+		Topic:     cfg.Kafka.Topic,
+		Logger:    logs.Logger("ingest"),
+		Probes: map[string]lifecycle.Probe{
+			"kafka": func(ctx context.Context) error { return commonkafka.Ping(ctx, cfg.Kafka) },
+		},
+	}
 
-		// Update Redis latest state (non-blocking but wait for the SET result)
-		redisKey := "vehicle:latest:" + tp.VehicleID
-		rctx, rcancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
-		defer rcancel()
-		if err := rdb.Set(rctx, redisKey, value, time.Duration(redisTTL)*time.Second).Err(); err != nil {
-			// log but do not fail the request (best-effort cache)
-			logger.Printf("redis set failed for %s: %v", tp.VehicleID, err)
+	// Vehicle registry (optional) and quarantine producer for unregistered vehicles
+	if cfg.Registry.URL != "" {
+		srv.Registry = registry.NewClient(cfg.Registry.URL, cfg.RegistryCacheTTL, cfg.RegistryNegCacheTTL, cfg.Registry.Token)
+		if cfg.UnregisteredPolicy == "quarantine" {
+			quarantine, err := commonkafka.NewProducer(startCtx, cfg.Kafka, cfg.QuarantineTopic, logs.Std("kafka"))
+			if err != nil {
+				logger.Fatalf("%v", err)
+			}
+			clients.Add("kafka quarantine writer", quarantine.Close)
+			srv.Quarantine, srv.QuarantineTopic = quarantine, cfg.QuarantineTopic
 		}
+	}
 
-		w.WriteHeader(http.StatusAccepted)
-		atomic.AddUint64(&okCounter, 1)
-	})
-
-	// health & metrics endpoint
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		// simple health: redis ok, kafka writer exists
-		// attempt quick redis ping
-		ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
-		defer cancel()
-		health := map[string]interface{}{
-			"status":          "ok",
-			"received_total":  atomic.LoadUint64(&recvCounter),
-			"accepted_total":  atomic.LoadUint64(&okCounter),
-			"errors_total":    atomic.LoadUint64(&errCounter),
-			"redis_connected": false,
-			"kafka_topic":     kafkaTopic,
-		}
-		if err := rdb.Ping(ctx).Err(); err == nil {
-			health["redis_connected"] = true
-		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(health)
-	})
+	started()
 
+	mux := http.NewServeMux()
+	mux.Handle("/", srv.Handler())
+	mux.Handle("/admin/log-levels", logs.Handler())
 	server := &http.Server{
-		Addr:    httpAddr,
+		Addr:    cfg.HTTPAddr,
 		Handler: mux,
 	}
 
@@ -225,20 +179,16 @@ func main() {
 			logger.Printf("HTTP server Shutdown: %v", err)
 		}
 
-		// flush kafka writer (close will flush)
-		logger.Println("closing kafka writer...")
-		if err := kWriter.Close(); err != nil {
-			logger.Printf("kafka writer close err: %v", err)
-		}
-		// close redis client
-		if err := rdb.Close(); err != nil {
-			logger.Printf("redis close err: %v", err)
+		// flush the kafka writers, then close redis
+		logger.Println("closing clients...")
+		if err := clients.Close(ctxShut); err != nil {
+			logger.Printf("%v", err)
 		}
 
 		close(idleConnsClosed)
 	}()
 
-	logger.Printf("starting HTTP server on %s (kafka=%s redis=%s)\n", httpAddr, kafkaAddr, redisAddr)
+	logger.Printf("starting HTTP server on %s (kafka=%s redis=%s)\n", cfg.HTTPAddr, strings.Join(cfg.Kafka.Brokers, ","), cfg.Redis.Addr)
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		// fatal error
 		logger.Fatalf("ListenAndServe(): %v", err)
@@ -247,5 +197,3 @@ func main() {
 	<-idleConnsClosed
 	logger.Println("service stopped")
 }
-
-
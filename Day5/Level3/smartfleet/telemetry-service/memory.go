@@ -0,0 +1,91 @@
+package telemetry
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// MemoryPublisher is a Publisher that keeps what it is given, for tests.
+type MemoryPublisher struct {
+	mu     sync.Mutex
+	msgs   []kafka.Message
+	closed bool
+}
+
+func (p *MemoryPublisher) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return io.ErrClosedPipe // as kafka.Writer does
+	}
+	p.msgs = append(p.msgs, msgs...)
+	return nil
+}
+
+func (p *MemoryPublisher) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	return nil
+}
+
+// Messages returns the messages written so far.
+func (p *MemoryPublisher) Messages() []kafka.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]kafka.Message(nil), p.msgs...)
+}
+
+// MemoryCache is a LatestStateCache in a map. Expired entries are not
+// returned; Now, when set, is its clock.
+type MemoryCache struct {
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	state   []byte
+	expires time.Time // zero: never
+}
+
+// NewMemoryCache constructs an empty MemoryCache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{entries: make(map[string]memoryEntry)}
+}
+
+func (c *MemoryCache) now() time.Time {
+	if c.Now != nil {
+		return c.Now()
+	}
+	return time.Now()
+}
+
+func (c *MemoryCache) SetLatest(ctx context.Context, tenant, vehicleID string, state []byte, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := memoryEntry{state: append([]byte(nil), state...)}
+	if ttl > 0 {
+		e.expires = c.now().Add(ttl)
+	}
+	c.entries[latestKey(tenant, vehicleID)] = e
+	return nil
+}
+
+func (c *MemoryCache) Ping(ctx context.Context) error { return nil }
+
+// Latest returns a vehicle's latest state, if it has one that has not expired.
+func (c *MemoryCache) Latest(tenant, vehicleID string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[latestKey(tenant, vehicleID)]
+	if !ok || (!e.expires.IsZero() && !c.now().Before(e.expires)) {
+		return nil, false
+	}
+	return e.state, true
+}
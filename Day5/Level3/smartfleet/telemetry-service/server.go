@@ -0,0 +1,202 @@
+package telemetry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+
+	"smartfleet/common/apikey"
+	commonkafka "smartfleet/common/kafka"
+	"smartfleet/common/lifecycle"
+	"smartfleet/common/logging"
+	"smartfleet/common/registry"
+	"smartfleet/common/tracing"
+)
+
+// Server is the ingest API: it authenticates, validates and queues
+// telemetry, and keeps the latest state of every vehicle.
+type Server struct {
+	Auth            *apikey.Auth
+	Publisher       Publisher        // accepted telemetry
+	Quarantine      Publisher        // unregistered vehicles, with Registry; nil rejects them
+	Cache           LatestStateCache // latest state
+	CacheTTL        time.Duration
+	Registry        *registry.Client           // nil accepts every vehicle
+	Topic           string                     // reported by /health, and names the produce span
+	QuarantineTopic string                     // names the produce span of quarantined telemetry
+	Probes          map[string]lifecycle.Probe // further dependencies, reported by /health as <name>_connected
+	Logger          *zap.Logger                // nil discards
+
+	// counters (atomic)
+	recvCounter uint64
+	okCounter   uint64
+	errCounter  uint64
+
+	unregisteredCounter uint64
+	quarantineCounter   uint64
+	registryErrCounter  uint64
+}
+
+// Handler returns the routes: POST /telemetry and GET /health. Telemetry
+// requests are traced, and the trace continues in the Kafka message.
+func (s *Server) Handler() http.Handler {
+	if s.Logger == nil {
+		s.Logger = zap.NewNop()
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/telemetry", s.handleTelemetry)
+	mux.HandleFunc("/health", s.handleHealth)
+	return tracing.Handler(mux, "telemetry")
+}
+
+func (s *Server) handleTelemetry(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&s.recvCounter, 1)
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		atomic.AddUint64(&s.errCounter, 1)
+		return
+	}
+	receivedAt := time.Now()
+	// the ID follows the event into analytics and its alerts; callers may
+	// bring their own
+	requestID := logging.FromRequest(r)
+	w.Header().Set(logging.RequestIDHeader, requestID)
+	log := s.Logger.With(zap.String("request_id", requestID))
+	span := trace.SpanFromContext(r.Context())
+	span.SetAttributes(attribute.String("smartfleet.request_id", requestID))
+	tenant, err := s.Auth.TenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		atomic.AddUint64(&s.errCounter, 1)
+		return
+	}
+	var tp TelemetryPayload
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&tp); err != nil {
+		http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		atomic.AddUint64(&s.errCounter, 1)
+		return
+	}
+	// set timestamp server-side if missing or unreasonable
+	if tp.Ts <= 0 {
+		tp.Ts = time.Now().UnixMilli()
+	}
+	if err := tp.Validate(); err != nil {
+		http.Error(w, "validation error: "+err.Error(), http.StatusBadRequest)
+		atomic.AddUint64(&s.errCounter, 1)
+		return
+	}
+	span.SetAttributes(attribute.String("smartfleet.tenant", tenant), attribute.String("smartfleet.vehicle_id", tp.VehicleID))
+
+	// marshal payload for kafka and redis
+	value, err := json.Marshal(tp)
+	if err != nil {
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		atomic.AddUint64(&s.errCounter, 1)
+		return
+	}
+
+	// registry check: unknown vehicles are rejected or quarantined.
+	// Registry outages fail open so ingestion keeps flowing.
+	if s.Registry != nil {
+		rv, err := s.Registry.Lookup(r.Context(), tenant, tp.VehicleID)
+		if err != nil {
+			atomic.AddUint64(&s.registryErrCounter, 1)
+			log.Warn("registry lookup failed", zap.String("vehicle_id", tp.VehicleID), zap.Error(err))
+		} else if rv == nil {
+			atomic.AddUint64(&s.unregisteredCounter, 1)
+			if s.Quarantine == nil {
+				http.Error(w, "unregistered vehicle", http.StatusUnprocessableEntity)
+				atomic.AddUint64(&s.errCounter, 1)
+				return
+			}
+			qctx, qcancel := context.WithTimeout(r.Context(), 3*time.Second)
+			defer qcancel()
+			qmsg := kafka.Message{
+				Key:     []byte(tp.VehicleID),
+				Value:   value,
+				Time:    time.UnixMilli(tp.Ts),
+				Headers: ingestHeaders(tenant, receivedAt, requestID),
+			}
+			qctx, produce := commonkafka.StartProduce(qctx, s.QuarantineTopic, &qmsg)
+			err := s.Quarantine.WriteMessages(qctx, qmsg)
+			tracing.End(produce, err)
+			if err != nil {
+				log.Error("kafka quarantine write failed", zap.Error(err))
+				http.Error(w, "enqueue failed", http.StatusInternalServerError)
+				atomic.AddUint64(&s.errCounter, 1)
+				return
+			}
+			atomic.AddUint64(&s.quarantineCounter, 1)
+			log.Info("unregistered vehicle quarantined", zap.String("tenant", tenant), zap.String("vehicle_id", tp.VehicleID))
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+	}
+
+	// Write to Kafka with short timeout
+	kctx, kcancel := context.WithTimeout(r.Context(), 3*time.Second)
+	defer kcancel()
+	msg := kafka.Message{
+		Key:     []byte(tp.VehicleID),
+		Value:   value,
+		Time:    time.UnixMilli(tp.Ts),
+		Headers: ingestHeaders(tenant, receivedAt, requestID),
+	}
+	kctx, produce := commonkafka.StartProduce(kctx, s.Topic, &msg)
+	err = s.Publisher.WriteMessages(kctx, msg)
+	tracing.End(produce, err)
+	if err != nil {
+		log.Error("kafka write failed", zap.String("vehicle_id", tp.VehicleID), zap.Error(err))
+		http.Error(w, "enqueue failed", http.StatusInternalServerError)
+		atomic.AddUint64(&s.errCounter, 1)
+		return
+	}
+
+	// Update the latest state (wait for the result, but do not fail on it)
+	rctx, rcancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer rcancel()
+	if err := s.Cache.SetLatest(rctx, tenant, tp.VehicleID, value, s.CacheTTL); err != nil {
+		// log but do not fail the request (best-effort cache)
+		log.Warn("redis set failed", zap.String("vehicle_id", tp.VehicleID), zap.Error(err))
+	}
+	log.Debug("telemetry accepted", zap.String("tenant", tenant), zap.String("vehicle_id", tp.VehicleID), zap.Int64("ts", tp.Ts))
+
+	w.WriteHeader(http.StatusAccepted)
+	atomic.AddUint64(&s.okCounter, 1)
+}
+
+// health & metrics endpoint
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	// simple health: cache reachable, counters
+	ctx, cancel := context.WithTimeout(r.Context(), 200*time.Millisecond)
+	defer cancel()
+	health := map[string]interface{}{
+		"status":          "ok",
+		"received_total":  atomic.LoadUint64(&s.recvCounter),
+		"accepted_total":  atomic.LoadUint64(&s.okCounter),
+		"errors_total":    atomic.LoadUint64(&s.errCounter),
+		"redis_connected": false,
+		"kafka_topic":     s.Topic,
+
+		"unregistered_total":    atomic.LoadUint64(&s.unregisteredCounter),
+		"quarantined_total":     atomic.LoadUint64(&s.quarantineCounter),
+		"registry_errors_total": atomic.LoadUint64(&s.registryErrCounter),
+	}
+	if err := s.Cache.Ping(ctx); err == nil {
+		health["redis_connected"] = true
+	}
+	for name, ok := range lifecycle.Check(ctx, 200*time.Millisecond, s.Probes) {
+		health[name+"_connected"] = ok
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(health)
+}
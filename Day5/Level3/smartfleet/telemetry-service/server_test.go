@@ -0,0 +1,141 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"smartfleet/common/apikey"
+	"smartfleet/common/logging"
+	"smartfleet/common/registry"
+	"smartfleet/common/tracing"
+)
+
+func testServer(t *testing.T) (*Server, *MemoryPublisher, *MemoryCache) {
+	t.Helper()
+	auth, err := apikey.New("key-a=tenant-a", "", "default", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, cache := &MemoryPublisher{}, NewMemoryCache()
+	return &Server{Auth: auth, Publisher: pub, Cache: cache, Logger: zap.NewNop()}, pub, cache
+}
+
+func TestIngest(t *testing.T) {
+	cases := []struct {
+		name   string
+		key    string
+		body   string
+		status int
+	}{
+		{"accepted", "key-a", `{"vehicle_id":"v1","speed":50,"fuel_level":40,"latitude":12.9,"longitude":77.6,"ts":1700000000000}`, http.StatusAccepted},
+		{"no key", "", `{"vehicle_id":"v1"}`, http.StatusUnauthorized},
+		{"unknown field", "key-a", `{"vehicle_id":"v1","speed_kmph":50}`, http.StatusBadRequest},
+		{"out of range", "key-a", `{"vehicle_id":"v1","speed":500}`, http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			srv, pub, cache := testServer(t)
+			req := httptest.NewRequest(http.MethodPost, "/telemetry", strings.NewReader(tc.body))
+			if tc.key != "" {
+				req.Header.Set("Authorization", "Bearer "+tc.key)
+			}
+			rec := httptest.NewRecorder()
+			srv.Handler().ServeHTTP(rec, req)
+			if rec.Code != tc.status {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tc.status, rec.Body)
+			}
+			msgs := pub.Messages()
+			_, cached := cache.Latest("tenant-a", "v1")
+			if tc.status != http.StatusAccepted {
+				if len(msgs) != 0 || cached {
+					t.Fatalf("rejected payload published (%d) or cached (%v)", len(msgs), cached)
+				}
+				return
+			}
+			if len(msgs) != 1 || string(msgs[0].Key) != "v1" || !cached {
+				t.Fatalf("published %d, cached %v", len(msgs), cached)
+			}
+			var tenant, requestID string
+			for _, h := range msgs[0].Headers {
+				switch h.Key {
+				case tenantHeader:
+					tenant = string(h.Value)
+				case logging.RequestIDKafkaHeader:
+					requestID = string(h.Value)
+				}
+			}
+			if tenant != "tenant-a" {
+				t.Errorf("tenant header = %q", tenant)
+			}
+			if requestID == "" || requestID != rec.Header().Get(logging.RequestIDHeader) {
+				t.Errorf("request_id header = %q, response X-Request-ID = %q", requestID, rec.Header().Get(logging.RequestIDHeader))
+			}
+		})
+	}
+}
+
+func TestQuarantineCarriesTraceContext(t *testing.T) {
+	spans := tracing.InMemory("telemetry")
+	reg := httptest.NewServer(http.NotFoundHandler()) // no vehicle is registered
+	defer reg.Close()
+	srv, pub, _ := testServer(t)
+	quarantine := &MemoryPublisher{}
+	srv.Registry = registry.NewClient(reg.URL, time.Minute, time.Minute, "")
+	srv.Quarantine, srv.QuarantineTopic = quarantine, "telemetry.quarantine"
+
+	req := httptest.NewRequest(http.MethodPost, "/telemetry", strings.NewReader(`{"vehicle_id":"v9","speed":50,"ts":1700000000000}`))
+	req.Header.Set("Authorization", "Bearer key-a")
+	rec := httptest.NewRecorder()
+	srv.Handler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted || len(pub.Messages()) != 0 {
+		t.Fatalf("status %d, %d messages published; want 202 and none", rec.Code, len(pub.Messages()))
+	}
+	msgs := quarantine.Messages()
+	if len(msgs) != 1 {
+		t.Fatalf("quarantined %d messages, want 1", len(msgs))
+	}
+	headers := map[string]string{}
+	for _, h := range msgs[0].Headers {
+		headers[h.Key] = string(h.Value)
+	}
+	if headers[tenantHeader] != "tenant-a" || headers[logging.RequestIDKafkaHeader] != rec.Header().Get(logging.RequestIDHeader) {
+		t.Errorf("headers = %v", headers)
+	}
+	var produce bool
+	for _, s := range spans.GetSpans() {
+		if s.Name == "telemetry.quarantine publish" {
+			produce = true
+			if want := s.SpanContext.TraceID().String(); !strings.Contains(headers["traceparent"], want) {
+				t.Errorf("traceparent = %q, want trace %s", headers["traceparent"], want)
+			}
+		}
+	}
+	if !produce {
+		t.Errorf("no quarantine produce span in %v", spans.GetSpans().Snapshots())
+	}
+}
+
+func TestHealthCounts(t *testing.T) {
+	srv, _, _ := testServer(t)
+	h := srv.Handler()
+	for _, key := range []string{"key-a", "nope"} {
+		req := httptest.NewRequest(http.MethodPost, "/telemetry", strings.NewReader(`{"vehicle_id":"v1","speed":1}`))
+		req.Header.Set("X-API-Key", key)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var health map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if health["received_total"] != 2.0 || health["accepted_total"] != 1.0 || health["errors_total"] != 1.0 || health["redis_connected"] != true {
+		t.Errorf("health = %v", health)
+	}
+}
@@ -0,0 +1,41 @@
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+// Publisher queues accepted telemetry for analytics-service. *kafka.Writer
+// is one; MemoryPublisher and the pipeline harness provide others.
+type Publisher interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// LatestStateCache keeps each vehicle's latest accepted payload for
+// dashboards. Writes are best effort: ingestion does not fail on them.
+type LatestStateCache interface {
+	SetLatest(ctx context.Context, tenant, vehicleID string, state []byte, ttl time.Duration) error
+	Ping(ctx context.Context) error
+}
+
+// RedisCache is the LatestStateCache in Redis, under latestKey.
+type RedisCache struct {
+	rdb *redis.Client
+}
+
+// NewRedisCache constructs a RedisCache.
+func NewRedisCache(rdb *redis.Client) *RedisCache {
+	return &RedisCache{rdb: rdb}
+}
+
+func (c *RedisCache) SetLatest(ctx context.Context, tenant, vehicleID string, state []byte, ttl time.Duration) error {
+	return c.rdb.Set(ctx, latestKey(tenant, vehicleID), state, ttl).Err()
+}
+
+func (c *RedisCache) Ping(ctx context.Context) error {
+	return c.rdb.Ping(ctx).Err()
+}
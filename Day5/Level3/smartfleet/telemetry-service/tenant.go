@@ -0,0 +1,30 @@
+package telemetry
+
+import (
+	"strconv"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+
+	"smartfleet/common/logging"
+)
+
+// Kafka headers added at ingest, with logging.RequestIDKafkaHeader.
+const (
+	tenantHeader     = "tenant_id"   // authenticated tenant
+	receivedAtHeader = "received_at" // ingest time, unix millis
+)
+
+// ingestHeaders builds the Kafka headers attached to every accepted event.
+func ingestHeaders(tenant string, receivedAt time.Time, requestID string) []kafka.Header {
+	return []kafka.Header{
+		{Key: tenantHeader, Value: []byte(tenant)},
+		{Key: receivedAtHeader, Value: []byte(strconv.FormatInt(receivedAt.UnixMilli(), 10))},
+		{Key: logging.RequestIDKafkaHeader, Value: []byte(requestID)},
+	}
+}
+
+// latestKey is the Redis key holding a vehicle's latest state, scoped by tenant.
+func latestKey(tenant, vehicleID string) string {
+	return "tenant:" + tenant + ":vehicle:latest:" + vehicleID
+}
@@ -0,0 +1,13 @@
+package telemetry
+
+import "testing"
+
+func TestLatestKeyIsTenantScoped(t *testing.T) {
+	a, b := latestKey("tenant-a", "v1"), latestKey("tenant-b", "v1")
+	if a == b {
+		t.Fatalf("same vehicle in two tenants shares redis key %q", a)
+	}
+	if a != "tenant:tenant-a:vehicle:latest:v1" {
+		t.Fatalf("latestKey = %q", a)
+	}
+}